@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// ---------- bench ----------
+
+// bench runs the capture to text pipeline on its own, at a few sizes and
+// in each mode, so people can see what their machine keeps up with and
+// we can see when a change makes it slower.
+
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	device := fs.Int("device", -1, "Camera to capture from (default: a built-in test pattern)")
+	sizes := fs.String("sizes", "80x24,160x48,240x72", "Comma-separated frame sizes in cells")
+	modes := fs.String("modes", strings.Join(rendererNames(), ","), "Comma-separated renderers")
+	colors := fs.String("colors", "truecolor,256", "Comma-separated color depths")
+	each := fs.Duration("time", time.Second, "How long to run each case")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: asciichat-client bench [-device n] [-sizes 80x24,...] [-modes ascii,...] [-colors truecolor,...] [-time 1s]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var dims [][2]int
+	for _, s := range strings.Split(*sizes, ",") {
+		var w, h int
+		if _, err := fmt.Sscanf(s, "%dx%d", &w, &h); err != nil || w < 1 || h < 1 {
+			fmt.Fprintf(os.Stderr, "Error: bad size %q, want e.g. 80x24\n", s)
+			os.Exit(1)
+		}
+		dims = append(dims, [2]int{w, h})
+	}
+	var ms []int
+	for _, m := range strings.Split(*modes, ",") {
+		i := rendererIndex(m)
+		if i < 0 {
+			fmt.Fprintf(os.Stderr, "Error: unknown mode %q\n", m)
+			os.Exit(1)
+		}
+		ms = append(ms, i)
+	}
+	var ds []depth
+	for _, c := range strings.Split(*colors, ",") {
+		d, ok := parseDepth(c)
+		if !ok || d == depthAuto {
+			fmt.Fprintf(os.Stderr, "Error: unknown color depth %q\n", c)
+			os.Exit(1)
+		}
+		ds = append(ds, d)
+	}
+
+	img := benchCapture(*device)
+	defer img.Close()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "size\tmode\tcolors\tfps\tscale\trender\tencode\tKB/frame\t")
+	for _, dim := range dims {
+		for _, m := range ms {
+			for _, d := range ds {
+				o := options{Mode: m, Depth: d, Charset: defaultCharset, Mirror: true, Quantizer: quantizerIndex("perceptual")}
+				r := benchCase(img, dim[0], dim[1], o, *each)
+				fmt.Fprintf(tw, "%dx%d\t%s\t%s\t%.0f\t%s\t%s\t%s\t%.1f\t\n",
+					dim[0], dim[1], renderers[m].name, d, r.fps(), r.per(r.scale), r.per(r.render), r.per(r.encode), float64(r.bytes)/float64(r.frames)/1024)
+				tw.Flush()
+			}
+		}
+	}
+}
+
+// benchCapture gets the frame everything is rendered from, timing the
+// camera if there is one
+func benchCapture(device int) gocv.Mat {
+	if device < 0 {
+		return testPattern(640, 480)
+	}
+
+	webcam, err := openCamera(device)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	defer webcam.Close()
+
+	img := gocv.NewMat()
+	webcam.Read(&img) // the first frame is often slow, or empty
+	n, start := 0, time.Now()
+	for time.Since(start) < 2*time.Second {
+		if webcam.Read(&img) && !img.Empty() {
+			n++
+		}
+	}
+	if n == 0 {
+		fmt.Fprintf(os.Stderr, "Error: camera %d sent no picture\n", device)
+		os.Exit(1)
+	}
+	took := time.Since(start)
+	fmt.Printf("capture: %dx%d, %.1f fps, %s a frame\n\n", img.Cols(), img.Rows(), float64(n)/took.Seconds(), (took / time.Duration(n)).Round(time.Microsecond))
+	return img
+}
+
+// benchResult is the time spent in each stage over some frames
+type benchResult struct {
+	frames                int
+	scale, render, encode time.Duration
+	bytes                 int
+}
+
+func (r benchResult) fps() float64 {
+	return float64(r.frames) / (r.scale + r.render + r.encode).Seconds()
+}
+
+// per is a stage's time for one frame
+func (r benchResult) per(d time.Duration) string {
+	return (d / time.Duration(r.frames)).Round(time.Microsecond).String()
+}
+
+// benchCase renders img over and over for about d, timing each stage of
+// processFrame
+func benchCase(img gocv.Mat, width, height int, o options, d time.Duration) benchResult {
+	var r benchResult
+	start := time.Now()
+	for r.frames == 0 || time.Since(start) < d {
+		t0 := time.Now()
+		p := scaleFrame(img, width, height, o)
+		t1 := time.Now()
+		g := drawGrid(p, width, height, o)
+		t2 := time.Now()
+		out := g.ansi(o)
+		t3 := time.Now()
+
+		r.scale += t1.Sub(t0)
+		r.render += t2.Sub(t1)
+		r.encode += t3.Sub(t2)
+		r.bytes += len(out)
+		r.frames++
+	}
+	return r
+}
+
+func rendererNames() []string {
+	names := make([]string, len(renderers))
+	for i, r := range renderers {
+		names[i] = r.name
+	}
+	return names
+}
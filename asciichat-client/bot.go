@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+)
+
+// ---------- echo bot ----------
+
+// bot joins a room and sends everyone their own video back, so one
+// person can check their camera, terminal and connection end to end,
+// and tests can run a call without a second human:
+//
+//	asciichat-client bot -room test &
+//	asciichat-client -room test
+//
+// It asks each peer for frames the size of the tile they show it in,
+// so what comes back fits, and can hold them back, drop some or strip
+// their colors to see how the call copes.
+
+func runBot(args []string) {
+	fs := flag.NewFlagSet("bot", flag.ExitOnError)
+	server := fs.String("server", defaultServer, "WebSocket server URL")
+	room := fs.String("room", "", "Room to wait in")
+	name := fs.String("name", "echo bot", "Name to show peers")
+	e2e := fs.Bool("e2e", true, "Take part in end-to-end encryption, like the peers expect")
+	delay := fs.Duration("delay", 0, "Hold each frame this long before sending it back")
+	drop := fs.Float64("drop", 0, "Fraction of frames to drop, 0 to 1")
+	mono := fs.Bool("mono", false, "Strip the colors from frames before sending them back")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: asciichat-client bot [-room name] [-delay 500ms] [-drop 0.2] [-mono]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *drop < 0 || *drop > 1 {
+		fmt.Fprintln(os.Stderr, "Error: -drop must be between 0 and 1")
+		os.Exit(1)
+	}
+
+	ep := endpoint{server: *server, query: url.Values{}, header: http.Header{}}
+	if *room != "" {
+		ep.query.Set("room", *room)
+	}
+	ws, _, err := connectWS(ep, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn := &link{ws: ws}
+	defer conn.close()
+
+	sess := newSession()
+	peers := newPeerSet(sess)
+	out := make(chan Message, 64)
+	go func() {
+		defer guard()
+		for msg := range out {
+			for _, m := range peers.wire(msg, *e2e) {
+				b, _ := json.Marshal(m)
+				if err := conn.write(b); err != nil {
+					log.Println("write error:", err)
+				}
+			}
+		}
+	}()
+
+	// the size each peer asked us for, which we ask them for back
+	asked := make(map[uint64]Message)
+	sizeFor := func(p *peer) Message {
+		m := Message{Type: MsgTypeSize, To: p.id, Width: 80, Height: 24, Name: *name}
+		if a, ok := asked[p.id]; ok && a.Width > 0 {
+			m.Width, m.Height, m.Colors, m.Light = a.Width, a.Height, a.Colors, a.Light
+			m.Renderers, m.Aspect, m.CellW, m.CellH = a.Renderers, a.Aspect, a.CellW, a.CellH
+		}
+		return m
+	}
+	greet := func() {
+		out <- Message{Type: MsgTypeSize, Width: 80, Height: 24, Name: *name}
+		if *e2e {
+			out <- sess.hello()
+		}
+	}
+
+	log.Printf("echo bot waiting in %q", *room)
+	greet()
+	stop := conn.watch()
+	for {
+		_, data, err := conn.read()
+		if err != nil {
+			log.Println("read error:", err)
+			close(stop)
+			peers.clear()
+			conn.redial(ep, func(int) {})
+			stop = conn.watch()
+			greet()
+			continue
+		}
+		var msg Message
+		if json.Unmarshal(data, &msg) != nil {
+			continue
+		}
+
+		var p *peer
+		if forPeer(msg.Type) || msg.Type == MsgTypeHello || msg.Type == MsgTypeSealed {
+			p, _ = peers.ensure(msg.From)
+		}
+		if msg.Type == MsgTypeHello && *e2e {
+			fresh, err := p.sess.establish(msg.Key)
+			if err != nil {
+				log.Println("key exchange error:", err)
+				continue
+			}
+			if fresh {
+				hello := sess.hello()
+				hello.To = p.id
+				out <- hello
+				out <- sizeFor(p)
+			}
+			continue
+		}
+		if p != nil {
+			if msg, err = p.sess.open(msg, *e2e); err != nil {
+				log.Println("sealed message error:", err)
+				continue
+			}
+		}
+		if err := checkMessage(msg); err != nil {
+			log.Printf("dropping %s from %d: %v", msg.Type, msg.From, err)
+			continue
+		}
+
+		switch msg.Type {
+		case MsgTypeSize:
+			if a, ok := asked[p.id]; !ok || a.Width != msg.Width || a.Height != msg.Height || a.CellW != msg.CellW {
+				asked[p.id] = msg
+				out <- sizeFor(p)
+			}
+		case MsgTypeFrame:
+			if rand.Float64() < *drop {
+				continue
+			}
+			echo := echoFrame(msg, *mono)
+			echo.To = p.id
+			if *delay > 0 {
+				time.AfterFunc(*delay, func() { out <- echo })
+			} else {
+				out <- echo
+			}
+		case MsgTypePing:
+			out <- Message{Type: MsgTypePong, To: msg.From, Time: msg.Time}
+		case MsgTypeJoined:
+			log.Printf("peer %d joined", msg.ID)
+			p, _ := peers.ensure(msg.ID)
+			if *e2e {
+				hello := sess.hello()
+				hello.To = p.id
+				out <- hello
+			}
+			out <- sizeFor(p)
+		case MsgTypeLeft:
+			log.Printf("peer %d left", msg.ID)
+			peers.remove(msg.ID)
+			delete(asked, msg.ID)
+		}
+	}
+}
+
+var sgrSeq = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// echoFrame is a peer's frame as we send it back: the picture, as text
+// or pixels, and what was stamped on it
+func echoFrame(msg Message, mono bool) Message {
+	m := Message{Type: MsgTypeFrame, Frame: msg.Frame, Pixels: msg.Pixels, PixW: msg.PixW, PixH: msg.PixH,
+		Caption: msg.Caption, Clock: msg.Clock, Scale: msg.Scale}
+	if mono {
+		m.Frame = sgrSeq.ReplaceAllString(m.Frame, "")
+		if p, err := unpackPixels(m.Pixels, m.PixW, m.PixH); err == nil {
+			m.Pixels = packPixels(p, true)
+		}
+	}
+	return m
+}
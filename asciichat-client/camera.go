@@ -0,0 +1,510 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// ---------- cameras ----------
+
+// -camera adds more video sources to switch between with x mid-call,
+// after the one from -device or -input: another device number, anything
+// else OpenCV opens (a /dev/video path, a file, a stream URL), or
+// "screen" to share the screen, grabbed by ffmpeg. Each is opened the
+// first time it's picked and kept open after, so switching back is
+// instant; the call never notices.
+
+// openSource opens one -camera
+func openSource(spec string) (source, error) {
+	if spec == "screen" {
+		return openScreen()
+	}
+	cam, err := gocv.OpenVideoCapture(spec)
+	if err != nil || !cam.IsOpened() {
+		return nil, fmt.Errorf("couldn't open camera %s", spec)
+	}
+	return newSteadyCamera(cam, spec), nil
+}
+
+// ---------- when the camera won't open ----------
+
+// OpenCV only says a camera didn't open, not why, and the why is nearly
+// always one of three: the OS won't let us have it (macOS and Windows
+// ask per app, Linux by group), another app has it, or there's no camera
+// by that number. We work out which as best the platform lets us, say
+// what to do about it, and list the cameras that do open.
+
+// cameraError is a camera that won't open, and what to do about it
+type cameraError struct {
+	device    int
+	why, fix  string
+	available []string // the cameras that do open, e.g. "0 (1280x720)"
+}
+
+func (e *cameraError) Error() string {
+	msg := fmt.Sprintf("can't open camera %d: %s\n  %s", e.device, e.why, e.fix)
+	if len(e.available) == 0 {
+		return msg + "\n  no camera opens at all; you can still watch with -no-send"
+	}
+	return msg + "\n  cameras that open: " + strings.Join(e.available, ", ") + " (pick one with -device)"
+}
+
+// openCamera opens -device, or explains why it won't open
+func openCamera(device int) (*gocv.VideoCapture, error) {
+	if cam, err := gocv.OpenVideoCapture(device); err == nil && cam.IsOpened() {
+		return cam, nil
+	} else if cam != nil {
+		cam.Close()
+	}
+	var available []string
+	for _, n := range openableCameras(device) {
+		available = append(available, n.String())
+	}
+	why, fix := diagnoseCamera(device, len(available) > 0)
+	return nil, &cameraError{device: device, why: why, fix: fix, available: available}
+}
+
+// cameraSize is a camera that opens, and what it captures by default
+type cameraSize struct{ n, w, h int }
+
+func (c cameraSize) String() string {
+	if c.w == 0 {
+		return strconv.Itoa(c.n)
+	}
+	return fmt.Sprintf("%d (%dx%d)", c.n, c.w, c.h)
+}
+
+// openableCameras tries device numbers up to maxCameras, apart from
+// skip
+func openableCameras(skip int) []cameraSize {
+	var found []cameraSize
+	for n := range maxCameras {
+		if n == skip {
+			continue
+		}
+		if cam, err := gocv.OpenVideoCapture(n); err == nil && cam.IsOpened() {
+			found = append(found, cameraSize{n, int(cam.Get(gocv.VideoCaptureFrameWidth)), int(cam.Get(gocv.VideoCaptureFrameHeight))})
+			cam.Close()
+		} else if cam != nil {
+			cam.Close()
+		}
+	}
+	return found
+}
+
+// diagnoseCamera says why device won't open, and what to try; others is
+// whether any other camera opens
+func diagnoseCamera(device int, others bool) (why, fix string) {
+	switch runtime.GOOS {
+	case "linux":
+		path := fmt.Sprintf("/dev/video%d", device)
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			return "there's no " + path, "check it's plugged in (v4l2-ctl --list-devices lists cameras), or pick another -device"
+		case errors.Is(err, fs.ErrPermission):
+			return "you're not allowed to use " + path,
+				"add yourself to its group (ls -l " + path + " shows it; usually sudo usermod -aG video $USER), then log out and back in"
+		case errors.Is(err, syscall.EBUSY):
+			return "another app is using it", "close whatever else has the camera (fuser " + path + " shows it)"
+		case err == nil:
+			f.Close()
+			return path + " opens, but not as a camera",
+				"another app may be streaming from it (fuser " + path + " shows it), or it's a camera's metadata node: try the number next to it"
+		}
+		return err.Error(), "check it's plugged in, and that no other app is using it"
+	case "darwin":
+		if others {
+			return "there's no camera " + strconv.Itoa(device), "pick another -device, or quit any app using it (FaceTime, Zoom, Photo Booth)"
+		}
+		return "macOS didn't let us have a camera, or another app has it",
+			"allow your terminal under System Settings > Privacy & Security > Camera and restart the terminal; quit any other app using the camera"
+	case "windows":
+		if others {
+			return "there's no camera " + strconv.Itoa(device) + ", or another app has it",
+				"pick another -device; Windows lets only one app use a camera at a time, so close Teams, Zoom or the Camera app"
+		}
+		return "Windows didn't let us have a camera, or another app has it",
+			"turn on Settings > Privacy & security > Camera > Let desktop apps access your camera; Windows lets only one app use a camera at a time"
+	}
+	return "it didn't open", "check it's plugged in, that no other app is using it, and that you're allowed to use it"
+}
+
+// ---------- capture size ----------
+
+// Left alone, a camera hands over whatever it likes best, often 1080p,
+// which is a lot of USB bandwidth and scaling just to end up 80 cells
+// wide. -capture-size and -capture-fps ask it for less. Cameras only do
+// certain sizes and rates and quietly pick the nearest they have, so we
+// log what we got.
+//
+// -mjpeg (on by default) asks for MJPEG, which UVC cameras send far
+// more of over USB than raw YUYV, and takes the JPEGs undecoded so they
+// can be decoded at a half, a quarter or an eighth of their size when
+// that's still all we need (see steadyCamera.Read): most of the work of
+// decoding is skipped, along with converting and shrinking a full-size
+// picture, which is what a Raspberry Pi spends its time on otherwise.
+// Cameras and backends that won't do either just give us pictures as
+// before.
+
+// captureMode is what to ask cameras for; zero leaves it to the camera
+type captureMode struct {
+	w, h, fps int
+	mjpeg     bool
+}
+
+// capture applies to every camera we open
+var capture captureMode
+
+func parseCaptureSize(s string) (w, h int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	if _, err := fmt.Sscanf(s, "%dx%d", &w, &h); err != nil || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("bad -capture-size %q, want e.g. 640x480", s)
+	}
+	return w, h, nil
+}
+
+// apply asks cam for m, and returns the size it captures at. The format
+// goes first: V4L2 only offers some sizes in some formats.
+func (m captureMode) apply(cam *gocv.VideoCapture, name string) (w, h int) {
+	mjpg := cam.ToCodec("MJPG")
+	if m.mjpeg {
+		cam.Set(gocv.VideoCaptureFOURCC, mjpg)
+	}
+	if m.w > 0 {
+		cam.Set(gocv.VideoCaptureFrameWidth, float64(m.w))
+		cam.Set(gocv.VideoCaptureFrameHeight, float64(m.h))
+	}
+	if m.fps > 0 {
+		cam.Set(gocv.VideoCaptureFPS, float64(m.fps))
+	}
+	format := ""
+	if m.mjpeg && cam.Get(gocv.VideoCaptureFOURCC) == mjpg {
+		cam.Set(gocv.VideoCaptureConvertRGB, 0) // the JPEGs themselves, see reduced
+		format = " (MJPEG)"
+	}
+	w, h = int(cam.Get(gocv.VideoCaptureFrameWidth)), int(cam.Get(gocv.VideoCaptureFrameHeight))
+	if m.w > 0 || m.fps > 0 || m.mjpeg {
+		log.Printf("camera %s captures %dx%d at %.0f fps%s", name, w, h, cam.Get(gocv.VideoCaptureFPS), format)
+	}
+	return w, h
+}
+
+// reduced is how much smaller than w x h a JPEG can be decoded and still
+// be at least needW x needH
+func reduced(w, h, needW, needH int) gocv.IMReadFlag {
+	for _, r := range []struct {
+		by   int
+		flag gocv.IMReadFlag
+	}{{8, gocv.IMReadReducedColor8}, {4, gocv.IMReadReducedColor4}, {2, gocv.IMReadReducedColor2}} {
+		if needW > 0 && w/r.by >= needW && h/r.by >= needH {
+			return r.flag
+		}
+	}
+	return gocv.IMReadColor
+}
+
+// neededPixels is the most of the picture any frame we render this time
+// will use: our own view, or the biggest a peer asked for
+func neededPixels(peers []*peer, width, height int, o options) (int, int) {
+	r := renderers[o.Mode]
+	w, h := width*r.cellW, height*r.cellH
+	for _, p := range peers {
+		pw, ph := p.width, p.height
+		if pw == 0 {
+			pw, ph = width, height
+		}
+		pw, ph = capSize(pw, ph, o)
+		cw, ch := p.cellW, p.cellH
+		if cw == 0 {
+			pr := renderers[drawableMode(o.Mode, p.renderers)]
+			cw, ch = pr.cellW, pr.cellH
+		}
+		w, h = max(w, pw*cw), max(h, ph*ch)
+	}
+	return w, h
+}
+
+// screenSource is the screen, as y4m from ffmpeg
+type screenSource struct {
+	*stdinSource
+	cmd *exec.Cmd
+}
+
+// screenGrab is ffmpeg's input for the whole screen on each platform
+func screenGrab() []string {
+	switch runtime.GOOS {
+	case "darwin":
+		return []string{"-f", "avfoundation", "-capture_cursor", "1", "-i", "Capture screen 0"}
+	case "windows":
+		return []string{"-f", "gdigrab", "-i", "desktop"}
+	}
+	display := os.Getenv("DISPLAY")
+	if display == "" {
+		display = ":0"
+	}
+	return []string{"-f", "x11grab", "-i", display} // not Wayland: pipe something in with -input instead
+}
+
+func openScreen() (source, error) {
+	args := append([]string{"-loglevel", "error", "-framerate", "15"}, screenGrab()...)
+	args = append(args, "-vf", "scale=640:-2", "-pix_fmt", "yuv420p", "-f", "yuv4mpegpipe", "-")
+	cmd := exec.Command("ffmpeg", args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("sharing the screen takes ffmpeg: %w", err)
+	}
+	in, err := newStdinSource(out, "y4m", 0, 0)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("couldn't grab the screen: %s", msg)
+		}
+		return nil, fmt.Errorf("couldn't grab the screen: %w", err)
+	}
+	return &screenSource{stdinSource: in, cmd: cmd}, nil
+}
+
+func (s *screenSource) Close() error {
+	s.cmd.Process.Kill()
+	return s.cmd.Wait()
+}
+
+// switcher is a source that's one of several, the active one changed
+// with next
+type switcher struct {
+	mu     sync.Mutex
+	names  []string
+	specs  []string // what to open, "" for the first, which is open already
+	open   []source
+	active int
+}
+
+func newSwitcher(first source, firstName string, cameras []string) *switcher {
+	s := &switcher{names: []string{firstName}, specs: []string{""}, open: []source{first}}
+	for _, c := range cameras {
+		name := "camera " + c
+		if c == "screen" {
+			name = "screen share"
+		}
+		s.names = append(s.names, name)
+		s.specs = append(s.specs, c)
+		s.open = append(s.open, nil)
+	}
+	return s
+}
+
+func (s *switcher) Read(img *gocv.Mat) bool {
+	return s.current().Read(img)
+}
+
+// current is the active source
+func (s *switcher) current() source {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.open[s.active]
+}
+
+// next moves on to the next source that opens and says which it is;
+// any that won't open are skipped, and the first failure reported. Only
+// the key handler calls it, so only Read needs the lock.
+func (s *switcher) next() (string, error) {
+	var failed error
+	n := len(s.specs)
+	for i := (s.active + 1) % n; i != s.active; i = (i + 1) % n {
+		src := s.open[i]
+		if src == nil {
+			var err error
+			if src, err = openSource(s.specs[i]); err != nil {
+				failed = cmp.Or(failed, err)
+				continue
+			}
+		}
+		s.mu.Lock()
+		s.open[i], s.active = src, i
+		s.mu.Unlock()
+		return s.names[i], nil
+	}
+	return s.names[s.active], failed
+}
+
+// Close closes what we opened; the first source is the caller's
+func (s *switcher) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, src := range s.open[1:] {
+		if src != nil {
+			src.Close()
+		}
+	}
+	return nil
+}
+
+// ---------- losing the camera ----------
+
+// A camera that's unplugged, or taken by another app, stops giving
+// frames and never starts again by itself. After lostAfter failed reads
+// in a row we give it up, close it, and try opening it again every
+// reopenEvery; meanwhile the call gets a placeholder picture with
+// "camera lost" on it instead of a frozen one, and it picks up again as
+// soon as the camera's back.
+
+const (
+	lostAfter   = 15
+	reopenEvery = 2 * time.Second
+)
+
+// steadyCamera is a camera that goes away and comes back
+type steadyCamera struct {
+	spec string
+
+	mu           sync.Mutex
+	cam          *gocv.VideoCapture // nil while it's lost
+	fails        int
+	retry        time.Time
+	w, h         int // what it captures at
+	needW, needH int // the most we'll use, 0 until we know
+}
+
+// newSteadyCamera asks cam for -capture-size and the rest, and keeps it
+func newSteadyCamera(cam *gocv.VideoCapture, spec string) *steadyCamera {
+	s := &steadyCamera{cam: cam, spec: spec}
+	s.w, s.h = capture.apply(cam, spec)
+	return s
+}
+
+func (s *steadyCamera) Read(img *gocv.Mat) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cam == nil {
+		if time.Now().Before(s.retry) {
+			time.Sleep(100 * time.Millisecond) // don't spin while it's gone
+			return false
+		}
+		cam, err := gocv.OpenVideoCapture(s.spec)
+		if err != nil || !cam.IsOpened() {
+			if cam != nil {
+				cam.Close()
+			}
+			s.retry = time.Now().Add(reopenEvery)
+			return false
+		}
+		log.Printf("camera %s is back", s.spec)
+		s.w, s.h = capture.apply(cam, s.spec)
+		s.cam, s.fails = cam, 0
+	}
+
+	if s.cam.Read(img) && !img.Empty() && s.decode(img) {
+		s.fails = 0
+		return true
+	}
+	if s.fails++; s.fails >= lostAfter {
+		log.Printf("camera %s stopped giving frames; trying to reopen it every %s", s.spec, reopenEvery)
+		s.cam.Close()
+		s.cam, s.retry = nil, time.Now().Add(reopenEvery)
+	}
+	time.Sleep(20 * time.Millisecond)
+	return false
+}
+
+// decode turns a JPEG straight from the camera, a single row of bytes,
+// into a picture no bigger than we need; anything else is a picture
+// already
+func (s *steadyCamera) decode(img *gocv.Mat) bool {
+	if img.Rows() != 1 {
+		return true
+	}
+	pic, err := gocv.IMDecode(img.ToBytes(), reduced(s.w, s.h, s.needW, s.needH))
+	if err != nil || pic.Empty() {
+		return false // a torn frame; the next will do
+	}
+	defer pic.Close()
+	return pic.CopyTo(img) == nil
+}
+
+// want says how much of the picture we'll use from now on
+func (s *steadyCamera) want(w, h int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.needW, s.needH = w, h
+}
+
+// lost reports whether the camera's gone and we're waiting for it
+func (s *steadyCamera) lost() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cam == nil
+}
+
+func (s *steadyCamera) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cam == nil {
+		return nil
+	}
+	return s.cam.Close()
+}
+
+// sourceLost reports whether src is a camera that's gone
+func sourceLost(src source) bool {
+	switch s := src.(type) {
+	case *steadyCamera:
+		return s.lost()
+	case *switcher:
+		return sourceLost(s.current())
+	}
+	return false
+}
+
+// wantPixels tells src, if it's a camera, how much of the picture we'll use
+func wantPixels(src source, w, h int) {
+	switch s := src.(type) {
+	case *steadyCamera:
+		s.want(w, h)
+	case *switcher:
+		wantPixels(s.current(), w, h)
+	}
+}
+
+const lostCaption = "camera lost, trying to get it back..."
+
+// placeholder is the picture we send while the camera's lost: dark gray
+// with faint diagonal stripes, so it reads as "no picture", not a frozen
+// one
+func placeholder() gocv.Mat {
+	const w, h = 320, 240
+	buf := make([]byte, 0, 3*w*h)
+	for y := range h {
+		for x := range w {
+			v := byte(40)
+			if (x+y)/12%2 == 0 {
+				v = 56
+			}
+			buf = append(buf, v, v, v)
+		}
+	}
+	m, _ := gocv.NewMatFromBytes(h, w, gocv.MatTypeCV8UC3, buf)
+	return m
+}
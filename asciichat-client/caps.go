@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------- terminal capabilities ----------
+
+// detectDepth works out how many colors our terminal can show, from
+// NO_COLOR, the multiplexer we're in, COLORTERM, TERM and finally
+// terminfo
+func detectDepth() depth {
+	// https://no-color.org: present and not empty
+	if os.Getenv("NO_COLOR") != "" {
+		return depthMono
+	}
+
+	// inside tmux or screen, COLORTERM describes the terminal outside,
+	// which isn't who we're talking to
+	switch multiplexer() {
+	case "tmux":
+		return tmuxDepth()
+	case "screen":
+		if strings.Contains(os.Getenv("TERM"), "256color") {
+			return depth256 // screen 4 mangles truecolor
+		}
+		return depth16
+	}
+
+	switch strings.ToLower(os.Getenv("COLORTERM")) {
+	case "truecolor", "24bit":
+		return depthTrue
+	}
+
+	t := os.Getenv("TERM")
+	switch {
+	case t == "" || t == "dumb":
+		return depthMono
+	case strings.Contains(t, "direct") || strings.Contains(t, "truecolor"):
+		return depthTrue
+	case strings.Contains(t, "256color"):
+		return depth256
+	}
+
+	if out, err := exec.Command("tput", "colors").Output(); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(out))); err == nil {
+			switch {
+			case n >= 1<<24:
+				return depthTrue
+			case n >= 256:
+				return depth256
+			case n >= 8:
+				return depth16
+			default:
+				return depthMono
+			}
+		}
+	}
+	return depth16
+}
+
+// ---------- multiplexers ----------
+
+// multiplexer is "tmux", "screen" or "" for neither
+func multiplexer() string {
+	switch {
+	case os.Getenv("TMUX") != "":
+		return "tmux"
+	case os.Getenv("STY") != "":
+		return "screen"
+	}
+	t := os.Getenv("TERM")
+	switch {
+	case strings.HasPrefix(t, "tmux"):
+		return "tmux"
+	case strings.HasPrefix(t, "screen"):
+		return "screen" // or tmux over ssh; either way, the safe choice
+	}
+	return ""
+}
+
+// tmuxDepth asks tmux whether the terminal it's attached to takes
+// truecolor (the RGB feature, tmux 3.2+, or Tc before that). Otherwise
+// tmux squashes 24-bit colors down itself, badly, so we do it instead.
+func tmuxDepth() depth {
+	if out, err := exec.Command("tmux", "display-message", "-p", "#{client_termfeatures}").Output(); err == nil {
+		if strings.Contains(string(out), "RGB") {
+			return depthTrue
+		}
+	} else if out, err := exec.Command("tmux", "info").Output(); err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.Contains(line, "Tc: (flag) true") || strings.Contains(line, "RGB: (flag) true") {
+				return depthTrue
+			}
+		}
+	}
+	if strings.Contains(os.Getenv("TERM"), "256color") {
+		return depth256
+	}
+	return depth16
+}
+
+// passthrough wraps an escape sequence so the multiplexer hands it to
+// the real terminal instead of eating it. tmux needs allow-passthrough
+// on (3.3+); without it the sequence is dropped, which is no worse.
+func passthrough(seq string) string {
+	switch multiplexer() {
+	case "tmux":
+		return "\033Ptmux;" + strings.ReplaceAll(seq, "\033", "\033\033") + "\033\\"
+	case "screen":
+		return "\033P" + seq + "\033\\"
+	}
+	return seq
+}
+
+// ---------- background color ----------
+
+// the queries we ask at startup, all in one round trip: the background
+// color (OSC 11) and the cell size in pixels (CSI 16 t)
+const (
+	backgroundQuery = "\033]11;?\033\\"
+	cellQuery       = "\033[16t"
+)
+
+// lightBackground reads the background color out of the terminal's
+// replies
+func lightBackground(reply []byte) bool {
+	c, ok := parseOSC11(reply)
+	return ok && c.lum() > 128
+}
+
+// ask sends the terminal queries, then asks for its device attributes,
+// which every terminal answers, so we know when to stop waiting; a
+// terminal that answers nothing gets a second. Stdin must be in raw
+// mode, and nothing else reading it yet.
+func ask(query string) []byte {
+	os.Stdout.WriteString(query + "\033[c")
+
+	reply := make(chan []byte, 1)
+	go func() {
+		defer guard()
+		var b []byte
+		buf := make([]byte, 64)
+		for len(b) < 256 {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				break
+			}
+			b = append(b, buf[:n]...)
+			if i := bytes.LastIndex(b, []byte("\033[?")); i >= 0 && bytes.IndexByte(b[i:], 'c') >= 0 {
+				break // the attributes came back, so that's everything
+			}
+		}
+		reply <- b
+	}()
+
+	select {
+	case b := <-reply:
+		return b
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+// parseOSC11 reads the color out of a "\033]11;rgb:rrrr/gggg/bbbb" reply;
+// each channel is 1 to 4 hex digits
+func parseOSC11(b []byte) (rgb, bool) {
+	i := bytes.Index(b, []byte("]11;rgb:"))
+	if i < 0 {
+		return rgb{}, false
+	}
+	rest := string(b[i+len("]11;rgb:"):])
+	if j := strings.IndexAny(rest, "\a\033"); j >= 0 {
+		rest = rest[:j]
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) != 3 {
+		return rgb{}, false
+	}
+	var c [3]uint8
+	for k, p := range parts {
+		v, err := strconv.ParseUint(p, 16, 16)
+		if err != nil || len(p) == 0 || len(p) > 4 {
+			return rgb{}, false
+		}
+		c[k] = uint8(v * 255 / (1<<(4*len(p)) - 1))
+	}
+	return rgb{c[0], c[1], c[2]}, true
+}
+
+// ---------- what the terminal can draw ----------
+
+// drawable lists the renderers our terminal can show: anything but
+// ascii and bg needs block characters, so a UTF-8 locale (we assume one
+// if nothing says), and the Linux console's font stops at half blocks
+func drawable() []string {
+	for _, v := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		if s := strings.ToLower(os.Getenv(v)); s != "" {
+			if !strings.Contains(s, "utf-8") && !strings.Contains(s, "utf8") {
+				return []string{"ascii", "bg"}
+			}
+			break
+		}
+	}
+	if os.Getenv("TERM") == "linux" {
+		return []string{"ascii", "bg", "halfblock"}
+	}
+	return rendererNames()
+}
+
+// cellAspect reads the cell size out of the terminal's replies, as its
+// height over its width, or 0 if it didn't say
+func cellAspect(b []byte) float64 {
+	i := bytes.Index(b, []byte("\033[6;"))
+	if i < 0 {
+		return 0
+	}
+	var h, w int
+	if _, err := fmt.Sscanf(string(b[i:]), "\033[6;%d;%dt", &h, &w); err != nil || h <= 0 || w <= 0 {
+		return 0
+	}
+	return float64(h) / float64(w)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// ---------- caption ----------
+
+// A caption ("BRB", "demo starts at 3pm") is burned into the bottom of
+// our outgoing video, so everyone sees it, recordings and viewers too.
+// c opens a prompt to set it.
+
+const maxCaption = 60
+
+// stamp writes text into the grid from x, y in white on black, over
+// whatever the camera put there; anything off the edge is dropped
+func (g *grid) stamp(text string, x, y int) {
+	if y < 0 || y >= g.h {
+		return
+	}
+	for _, r := range text {
+		if x >= 0 && x < g.w {
+			cl := g.at(x, y)
+			cl.ch = r
+			cl.fg, cl.hasFg = rgb{255, 255, 255}, true
+			cl.bg, cl.hasBg = rgb{0, 0, 0}, true
+		}
+		x++
+	}
+}
+
+// stampCaption centers the caption on the bottom row
+func (g *grid) stampCaption(caption string) {
+	text := " " + caption + " "
+	g.stamp(text, (g.w-utf8.RuneCountInString(text))/2, g.h-1)
+}
+
+// captionRune reports whether r can go in a caption: printable and one
+// cell wide, since each grid cell holds a single rune
+func captionRune(r rune) bool {
+	return unicode.IsPrint(r) && runewidth.RuneWidth(r) == 1
+}
+
+// cleanCaption keeps what a caption can show, up to maxCaption runes
+func cleanCaption(s string) string {
+	var out []rune
+	for _, r := range s {
+		if captionRune(r) && len(out) < maxCaption {
+			out = append(out, r)
+		}
+	}
+	return string(out)
+}
+
+// prompt is the c overlay for typing a caption
+type prompt struct {
+	scr  *screen
+	set  *settings
+	open bool
+	text []rune
+}
+
+func (p *prompt) draw() string {
+	return box("caption", []string{string(p.text) + "▏", "", "enter: set (empty clears)  esc: cancel"})
+}
+
+func (p *prompt) handle(k string) bool {
+	if !p.open {
+		if k != "c" {
+			return false
+		}
+		p.open = true
+		p.text = []rune(p.set.get().Caption)
+		p.scr.setLayer("caption", p.draw)
+		return true
+	}
+
+	switch k {
+	case keyEnter:
+		caption := string(p.text)
+		p.set.update(func(o *options) { o.Caption = caption })
+		p.close()
+		if caption == "" {
+			p.scr.toast("caption cleared")
+		} else {
+			p.scr.toast("caption set")
+		}
+	case keyEsc:
+		p.close()
+	case keyBackspace:
+		if len(p.text) > 0 {
+			p.text = p.text[:len(p.text)-1]
+		}
+		p.scr.setLayer("caption", p.draw)
+	default:
+		if r, size := utf8.DecodeRuneInString(k); size == len(k) && captionRune(r) && len(p.text) < maxCaption {
+			p.text = append(p.text, r)
+			p.scr.setLayer("caption", p.draw)
+		}
+	}
+	return true // swallow everything while typing
+}
+
+func (p *prompt) close() {
+	p.open = false
+	p.scr.setLayer("caption", nil)
+}
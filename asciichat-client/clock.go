@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// ---------- clock ----------
+
+// -clock burns the local time, how long the call has gone on, or both
+// into the top right of our outgoing video, so recordings and
+// broadcasts say when they happened.
+
+var clockNames = []string{"off", "time", "elapsed", "both"}
+
+const (
+	clockOff = iota
+	clockTime
+	clockElapsed
+	clockBoth
+)
+
+func clockIndex(name string) int {
+	for i, n := range clockNames {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// clockText is what to burn in right now; since is when the call
+// started, zero while we're waiting
+func clockText(mode int, since time.Time) string {
+	now := time.Now().Format("15:04:05")
+	elapsed := "--:--"
+	if !since.IsZero() {
+		elapsed = formatElapsed(time.Since(since))
+	}
+	switch mode {
+	case clockTime:
+		return now
+	case clockElapsed:
+		return elapsed
+	case clockBoth:
+		return now + " | " + elapsed
+	}
+	return ""
+}
+
+// formatElapsed is mm:ss, or h:mm:ss past the hour
+func formatElapsed(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d >= time.Hour {
+		return fmt.Sprintf("%d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+	}
+	return fmt.Sprintf("%02d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
+
+// stampClock puts the clock in the top right corner
+func (g *grid) stampClock(text string) {
+	text = " " + text + " "
+	g.stamp(text, g.w-utf8.RuneCountInString(text), 0)
+}
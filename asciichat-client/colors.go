@@ -0,0 +1,213 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+)
+
+// ---------- color depth ----------
+
+type depth int
+
+const (
+	depthMono depth = iota
+	depth16
+	depth256
+	depthTrue
+
+	// whatever the receiving terminal says it supports; sorts last so
+	// min(choice, receiver) always does the right thing
+	depthAuto
+)
+
+var depthNames = []string{"mono", "16", "256", "truecolor", "auto"}
+
+func parseDepth(s string) (depth, bool) {
+	for i, n := range depthNames {
+		if n == s {
+			return depth(i), true
+		}
+	}
+	return depthMono, false
+}
+
+func (d depth) String() string { return depthNames[d] }
+
+// ---------- quantizers ----------
+
+// quantizer picks a palette index for a color when we can't send 24-bit:
+// the nearest palette entry in some color space
+type quantizer struct {
+	name  string
+	space func(c rgb) [3]float64
+	snap  func(c rgb) rgb // applied before the search, if set
+}
+
+var quantizers = []quantizer{
+	{name: "nearest", space: rgbSpace},
+	{name: "perceptual", space: toLab},
+	{name: "websafe", space: rgbSpace, snap: webSafe},
+}
+
+func quantizerIndex(name string) int {
+	for i, q := range quantizers {
+		if q.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func rgbSpace(c rgb) [3]float64 {
+	return [3]float64{float64(c.r), float64(c.g), float64(c.b)}
+}
+
+// toLab converts to CIELAB, where euclidean distance (CIE76) tracks how
+// different colors look far better than RGB does, skin tones especially
+func toLab(c rgb) [3]float64 {
+	lin := func(v uint8) float64 {
+		f := float64(v) / 255
+		if f <= 0.04045 {
+			return f / 12.92
+		}
+		return math.Pow((f+0.055)/1.055, 2.4)
+	}
+	r, g, b := lin(c.r), lin(c.g), lin(c.b)
+
+	// sRGB -> XYZ (D65), normalized by the white point
+	x := (0.4124*r + 0.3576*g + 0.1805*b) / 0.95047
+	y := 0.2126*r + 0.7152*g + 0.0722*b
+	z := (0.0193*r + 0.1192*g + 0.9505*b) / 1.08883
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+// webSafe rounds each channel to the 6 web-safe levels (0, 51, ... 255)
+func webSafe(c rgb) rgb {
+	s := func(v uint8) uint8 { return uint8((int(v) + 25) / 51 * 51) }
+	return rgb{s(c.r), s(c.g), s(c.b)}
+}
+
+// paletteFor returns the first index and the colors a depth can use. 256
+// skips the 16 system colors since every terminal theme redefines them.
+func paletteFor(d depth) (int, []rgb) {
+	first, n := 0, 16
+	if d == depth256 {
+		first, n = 16, 256
+	}
+	var colors []rgb
+	for i := first; i < n; i++ {
+		c := xterm256(i)
+		colors = append(colors, rgb{c.R, c.G, c.B})
+	}
+	return first, colors
+}
+
+// lookup tables from 15-bit color to palette index, built on first use
+var (
+	quantMu     sync.Mutex
+	quantTables = map[[2]int][]uint8{}
+)
+
+func quantTable(d depth, qi int) []uint8 {
+	quantMu.Lock()
+	defer quantMu.Unlock()
+
+	key := [2]int{int(d), qi}
+	if t, ok := quantTables[key]; ok {
+		return t
+	}
+
+	q := quantizers[qi]
+	first, colors := paletteFor(d)
+	pal := make([][3]float64, len(colors))
+	for i, c := range colors {
+		pal[i] = q.space(c)
+	}
+
+	t := make([]uint8, 1<<15)
+	for k := range t {
+		// middle of the 5-bit bucket
+		c := rgb{uint8(k>>10<<3 | 4), uint8(k>>5&31<<3 | 4), uint8(k&31<<3 | 4)}
+		if q.snap != nil {
+			c = q.snap(c)
+		}
+		v := q.space(c)
+		best, bestD := 0, math.MaxFloat64
+		for i, p := range pal {
+			d0, d1, d2 := v[0]-p[0], v[1]-p[1], v[2]-p[2]
+			if dd := d0*d0 + d1*d1 + d2*d2; dd < bestD {
+				best, bestD = i, dd
+			}
+		}
+		t[k] = uint8(first + best)
+	}
+	quantTables[key] = t
+	return t
+}
+
+// colorEncoder writes SGR colors at a given depth
+type colorEncoder struct {
+	depth depth
+	lut   []uint8
+	step  float64 // rough distance between palette colors, for dithering
+}
+
+func newColorEncoder(o options) colorEncoder {
+	e := colorEncoder{depth: o.Depth}
+	if o.Depth == depth16 || o.Depth == depth256 {
+		e.lut = quantTable(o.Depth, o.Quantizer)
+		if o.Dither == ditherOrdered {
+			e.step = 40 // the 256 cube's levels are ~40 apart
+			if o.Depth == depth16 {
+				e.step = 128
+			}
+		}
+	}
+	return e
+}
+
+func (e colorEncoder) index(c rgb) int {
+	return int(e.lut[int(c.r>>3)<<10|int(c.g>>3)<<5|int(c.b>>3)])
+}
+
+// sgr is the escape that sets c as the foreground (or background) of
+// the cell at x, y
+func (e colorEncoder) sgr(c rgb, bg bool, x, y int) string {
+	if e.step > 0 {
+		c = ditherRGB(c, x, y, e.step)
+	}
+	switch e.depth {
+	case depthTrue:
+		code := "\033[38;2;"
+		if bg {
+			code = "\033[48;2;"
+		}
+		return code + strconv.Itoa(int(c.r)) + ";" + strconv.Itoa(int(c.g)) + ";" + strconv.Itoa(int(c.b)) + "m"
+	case depth256:
+		code := "\033[38;5;"
+		if bg {
+			code = "\033[48;5;"
+		}
+		return code + strconv.Itoa(e.index(c)) + "m"
+	case depth16:
+		i := e.index(c)
+		base := 30
+		if bg {
+			base = 40
+		}
+		if i >= 8 {
+			base += 90 - 30 - 8 // bright colors are 90-97 / 100-107
+		}
+		return "\033[" + strconv.Itoa(base+i) + "m"
+	}
+	return ""
+}
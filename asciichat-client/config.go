@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ---------- config file ----------
+
+// config.json holds defaults for flags, by flag name, as first run setup
+// saves them: {"device": 0, "colors": "256"}. Anything on the command
+// line, or set by a -quality preset, wins.
+
+func configPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.json"), nil
+}
+
+// loadConfig reads the config; a missing file is an error that
+// satisfies os.IsNotExist
+func loadConfig() (map[string]any, error) {
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg map[string]any
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+func saveConfig(cfg map[string]any) (string, error) {
+	path, err := configPath()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", err
+	}
+	b, _ := json.MarshalIndent(cfg, "", "  ")
+	return path, os.WriteFile(path, append(b, '\n'), 0o600)
+}
+
+// applyConfig sets every flag in the config that hasn't been set
+// already
+func applyConfig(cfg map[string]any) {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if given["color"] {
+		given["colors"] = true
+	}
+
+	for name, v := range cfg {
+		if given[name] {
+			continue
+		}
+		if flag.Lookup(name) == nil {
+			fmt.Fprintf(os.Stderr, "config: ignoring unknown setting %q\n", name)
+			continue
+		}
+		value := fmt.Sprint(v)
+		switch v.(type) {
+		case []any, map[string]any:
+			b, _ := json.Marshal(v) // flags that take lists, like filters, take them as JSON
+			value = string(b)
+		}
+		if err := flag.Set(name, value); err != nil {
+			fmt.Fprintf(os.Stderr, "config: %s: %v\n", name, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// ---------- congestion control ----------
+
+// With -adapt (the default) we don't send 30 frames a second into a
+// link that can't carry them. Two things say the link is full: pings
+// coming back slower than the best we've seen, as queues fill up along
+// the way, and our own writes backing up, as the socket stops taking
+// data. Every second the controller looks at both and steps down a
+// rung if either is bad, or back up after a few calm seconds. Lower
+// rungs send fewer frames, fewer colors, compressed, then smaller ones
+// the receiver enlarges back to size.
+
+const adaptEvery = time.Second
+
+// rung is one step of the ladder, the first leaving everything alone
+type rung struct {
+	fps     int
+	depth   depth
+	deflate bool
+	scale   int // render at 1/scale the size asked for
+}
+
+var rungs = []rung{
+	{0, depthAuto, false, 1},
+	{20, depthAuto, false, 1},
+	{15, depth256, false, 1},
+	{15, depth256, true, 1},
+	{10, depth16, true, 1},
+	{10, depth16, true, 2},
+	{5, depthMono, true, 2},
+}
+
+type congestion struct {
+	mu    sync.Mutex
+	rung  int
+	queue int // room in the write queue
+
+	minRTT  time.Duration // the link empty, as near as we can tell
+	rtt     time.Duration // the latest round trip this interval, 0 for none
+	blocked time.Duration // spent in writes this interval
+	backlog int           // frames waiting to be written, at worst
+	calm    int           // good intervals in a row
+}
+
+// ack takes a ping's round trip
+func (c *congestion) ack(rtt time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.minRTT == 0 || rtt < c.minRTT {
+		c.minRTT = rtt
+	}
+	c.rtt = max(c.rtt, rtt)
+}
+
+// wrote takes how long a frame took to write and how many messages were
+// queued behind it
+func (c *congestion) wrote(took time.Duration, backlog int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blocked += took
+	c.backlog = max(c.backlog, backlog)
+}
+
+// run is the control loop
+func (c *congestion) run() {
+	defer guard()
+	for range time.Tick(adaptEvery) {
+		c.step()
+	}
+}
+
+func (c *congestion) step() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// half the time spent writing, or the queue half full, or pings
+	// taking twice as long as they can plus some jitter
+	full := c.blocked > adaptEvery/2 || c.backlog > c.queue/2 ||
+		c.rtt > 0 && c.rtt > 2*c.minRTT+50*time.Millisecond
+
+	was := c.rung
+	if full {
+		c.rung = min(c.rung+1, len(rungs)-1)
+		c.calm = 0
+	} else if c.calm++; c.calm >= 5 && c.rung > 0 {
+		c.rung--
+		c.calm = 0
+	}
+	if c.rung != was {
+		log.Printf("adapt: rung %d (rtt %s, best %s, writing %s, backlog %d)", c.rung, c.rtt, c.minRTT, c.blocked, c.backlog)
+	}
+	c.rtt, c.blocked, c.backlog = 0, 0, 0
+}
+
+func (c *congestion) current() rung {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return rungs[c.rung]
+}
+
+// apply caps the options at the current rung
+func (c *congestion) apply(o options) options {
+	r := c.current()
+	if r.fps > 0 {
+		o.FPS = min(o.FPS, r.fps)
+	}
+	o.Depth = min(o.Depth, r.depth)
+	o.Scale = r.scale
+	return o
+}
+
+// deflate is whether to compress what we write right now
+func (c *congestion) deflate() bool {
+	return c.current().deflate
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/term"
+)
+
+// ---------- connection ----------
+
+// A relay that stops answering doesn't close the socket, it just goes
+// quiet, so we ping it and give up on the connection when nothing at all
+// has come back for a while. Then we redial and pick up where we left
+// off, as far as the people on the other end can tell.
+
+const (
+	pingEvery  = 10 * time.Second
+	stallAfter = 30 * time.Second // silence before we call the connection dead
+	writeWait  = 10 * time.Second
+)
+
+// link is the current connection to the relay; the reader swaps in a new
+// one when it dies, and the writer writes to whatever's there
+type link struct {
+	mu sync.Mutex
+	ws wire // a *websocket.Conn unless we're on webtransport
+
+	deflate func() bool // whether to compress each write, nil to leave it to the connection
+}
+
+func (l *link) get() wire {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ws
+}
+
+func (l *link) close() {
+	if ws := l.get(); ws != nil {
+		ws.Close()
+	}
+}
+
+// read waits for the next message, failing after stallAfter of silence
+func (l *link) read() (int, []byte, error) {
+	ws := l.get()
+	ws.SetReadDeadline(time.Now().Add(stallAfter))
+	return ws.ReadMessage()
+}
+
+var errOffline = errors.New("not connected")
+
+func (l *link) write(b []byte) error {
+	ws := l.get()
+	if ws == nil {
+		return errOffline
+	}
+	if c, ok := ws.(*websocket.Conn); ok && l.deflate != nil {
+		c.EnableWriteCompression(l.deflate())
+	}
+	ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return ws.WriteMessage(websocket.TextMessage, b)
+}
+
+// watch pings the relay until stop is closed; every pong pushes the read
+// deadline back. Over webtransport QUIC does this for us.
+func (l *link) watch() chan struct{} {
+	stop := make(chan struct{})
+	ws, ok := l.get().(*websocket.Conn)
+	if !ok {
+		return stop
+	}
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(stallAfter))
+	})
+
+	go func() {
+		defer guard()
+		t := time.NewTicker(pingEvery)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+			}
+		}
+	}()
+	return stop
+}
+
+// redial replaces a dead connection, backing off between attempts until
+// one works, and telling tried about each attempt. A server that's been
+// swapped for an incompatible one is fatal.
+func (l *link) redial(ep endpoint, tried func(attempt int)) {
+	l.close()
+
+	wait := time.Second
+	for n := 1; ; n++ {
+		tried(n)
+		ws, _, err := dial(ep)
+		if err == nil {
+			l.mu.Lock()
+			l.ws = ws
+			l.mu.Unlock()
+			log.Println("reconnected")
+			return
+		}
+		if hopeless(err) {
+			fatalf("%v", err)
+		}
+		log.Printf("%v; retrying in %s", err, wait)
+		time.Sleep(wait)
+		wait = backoff(wait)
+	}
+}
+
+// selfTile is where our own camera goes, see offerMirror; mixTile is
+// the server's composite of everyone else, with -mix
+const (
+	selfTile = ^uint64(0)
+	mixTile  = 0
+)
+
+// offerMirror asks, when the server can't be reached at launch, whether
+// to carry on with just our own camera on screen while we keep trying
+func offerMirror(err error) bool {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "%v\ncontinue offline with your own camera, and call once the server's back? [Y/n] ", err)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "" || answer == "y" || answer == "yes"
+}
+
+// backoff doubles the wait between attempts, up to half a minute
+func backoff(wait time.Duration) time.Duration {
+	return min(2*wait, 30*time.Second)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ---------- accounts and contacts ----------
+
+// On a server with accounts, -user alice signs in as alice with the
+// -identity key (the first key to sign in as a name owns it), and then
+// anyone can call alice by name: "asciichat-client call alice", or
+// -call alice, puts us in a fresh room and the server invites alice's
+// client, wherever it's connected, to join us. Contacts are our own
+// short list of names to call, kept in the config directory, one
+// "name account" a line.
+//
+// Signed in, we tell the server how available we are (-status, and a
+// cycles it): available, busy, where calls ring without the bell (see
+// ring.go), or dnd, where the server doesn't pass invites on at all and
+// tells the caller so. "contacts"
+// asks the server how each contact is doing before you call them.
+
+const (
+	statusAvailable = "available"
+	statusBusy      = "busy"
+	statusDND       = "dnd"
+)
+
+var statuses = []string{statusAvailable, statusBusy, statusDND}
+
+var statusNames = map[string]string{
+	statusAvailable: "available",
+	statusBusy:      "busy",
+	statusDND:       "do not disturb",
+	"offline":       "offline",
+}
+
+// account signs us in, afresh for every connection since a login only
+// holds for a couple of minutes
+type account struct {
+	name   string
+	signer ssh.Signer
+}
+
+// signIn adds the login to a connection's query
+func (a *account) signIn(q url.Values) error {
+	t := time.Now().Unix()
+	sig, err := a.signer.Sign(nil, []byte("faceterm-login\n"+a.name+"\n"+strconv.FormatInt(t, 10)))
+	if err != nil {
+		return fmt.Errorf("failed to sign in as %s: %w", a.name, err)
+	}
+	q.Set("user", a.name)
+	q.Set("key", base64.StdEncoding.EncodeToString(a.signer.PublicKey().Marshal()))
+	q.Set("t", strconv.FormatInt(t, 10))
+	q.Set("sig", base64.StdEncoding.EncodeToString(ssh.Marshal(sig)))
+	return nil
+}
+
+func contactsPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "contacts"), nil
+}
+
+// contact is a name we call someone by and their account
+type contact struct{ name, account string }
+
+func loadContacts() []contact {
+	path, err := contactsPath()
+	if err != nil {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var list []contact
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		c := contact{fields[0], fields[0]}
+		if len(fields) > 1 {
+			c.account = fields[1]
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+func saveContacts(list []contact) error {
+	path, err := contactsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, c := range list {
+		fmt.Fprintf(&b, "%s %s\n", c.name, c.account)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o600)
+}
+
+// accountFor is who calling name reaches: a contact's account, or the
+// name itself
+func accountFor(name string) string {
+	for _, c := range loadContacts() {
+		if c.name == name {
+			return c.account
+		}
+	}
+	return name
+}
+
+// presence asks the server how available each account is
+func presence(server string, accounts []string) (map[string]string, error) {
+	u, err := altURL(server, "/api/presence", false)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = url.Values{"user": accounts}.Encode()
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to ask who's around: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to ask who's around: %s (the server may have no accounts)", resp.Status)
+	}
+	var status map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to ask who's around: %w", err)
+	}
+	return status, nil
+}
+
+// runContacts lists, adds or removes contacts
+func runContacts(args []string) {
+	fs := flag.NewFlagSet("contacts", flag.ExitOnError)
+	server := fs.String("server", defaultServer, "Relay to ask how available each contact is")
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "usage: asciichat-client contacts [-server url] [add name [account] | remove name]")
+		os.Exit(2)
+	}
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: asciichat-client contacts [-server url] [add name [account] | remove name]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	args = fs.Args()
+
+	list := loadContacts()
+	if len(args) == 0 {
+		if len(list) == 0 {
+			fmt.Println("no contacts yet; add one with: asciichat-client contacts add alice")
+			return
+		}
+		var accounts []string
+		for _, c := range list {
+			accounts = append(accounts, c.account)
+		}
+		status, err := presence(*server, accounts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, c := range list {
+			who := c.name
+			if c.account != c.name {
+				who += " (" + c.account + ")"
+			}
+			fmt.Fprintf(tw, "%s\t%s\n", who, statusNames[status[c.account]])
+		}
+		tw.Flush()
+		return
+	}
+
+	switch {
+	case args[0] == "add" && (len(args) == 2 || len(args) == 3):
+		c := contact{args[1], args[1]}
+		if len(args) == 3 {
+			c.account = args[2]
+		}
+		kept := list[:0]
+		for _, o := range list {
+			if o.name != c.name {
+				kept = append(kept, o)
+			}
+		}
+		list = append(kept, c)
+	case args[0] == "remove" && len(args) == 2:
+		kept := list[:0]
+		for _, o := range list {
+			if o.name != args[1] {
+				kept = append(kept, o)
+			}
+		}
+		list = kept
+	default:
+		usage()
+	}
+	if err := saveContacts(list); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+// ---------- ordered dithering ----------
+
+// Bayer dithering adds a fixed, position-dependent threshold before
+// quantizing. Unlike error diffusion it's cheap and the pattern doesn't
+// change between frames, so video doesn't crawl.
+
+var ditherNames = []string{"none", "ordered"}
+
+const (
+	ditherNone = iota
+	ditherOrdered
+)
+
+func ditherIndex(name string) int {
+	for i, n := range ditherNames {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+var bayer4 = [4][4]float64{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+// bayer returns the threshold for a position, in (0, 1)
+func bayer(x, y int) float64 {
+	return (bayer4[y&3][x&3] + 0.5) / 16
+}
+
+// ditherRGB nudges a color by up to half a palette step either way
+func ditherRGB(c rgb, x, y int, step float64) rgb {
+	off := (bayer(x, y) - 0.5) * step
+	ch := func(v uint8) uint8 {
+		return uint8(min(255, max(0, float64(v)+off)))
+	}
+	return rgb{ch(c.r), ch(c.g), ch(c.b)}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gocv.io/x/gocv"
+	"golang.org/x/term"
+)
+
+// ---------- doctor ----------
+
+// Most "it doesn't work" reports come down to the camera, the terminal
+// or the network. doctor checks each and says what to do about it.
+
+// doctor collects check results as they're printed
+type doctor struct{ failed bool }
+
+// pass, warn and fail print one result line; fix is what to try
+func (d *doctor) pass(what string, args ...any) {
+	fmt.Printf("[ ok ] %s\n", fmt.Sprintf(what, args...))
+}
+
+func (d *doctor) warn(what, fix string) {
+	fmt.Printf("[warn] %s\n       %s\n", what, fix)
+}
+
+func (d *doctor) fail(what, fix string) {
+	d.failed = true
+	fmt.Printf("[FAIL] %s\n       %s\n", what, fix)
+}
+
+func runDoctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	device := fs.Int("device", 0, "Camera to check")
+	server := fs.String("server", defaultServer, "Relay to check")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: asciichat-client doctor [-device n] [-server url]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	log.SetOutput(io.Discard) // dialWS chatters
+
+	d := &doctor{}
+	img := d.camera(*device)
+	defer img.Close()
+	width, height := d.terminal()
+	d.network(*server)
+	d.conversion(img, width, height)
+
+	if d.failed {
+		os.Exit(1)
+	}
+}
+
+// camera opens the device and grabs a frame, which it returns for the
+// speed test (empty if it couldn't get one)
+func (d *doctor) camera(device int) gocv.Mat {
+	img := gocv.NewMat()
+	webcam, err := openCamera(device)
+	if err != nil {
+		e := err.(*cameraError)
+		fix := e.fix
+		if len(e.available) > 0 {
+			fix += "; cameras that open: " + strings.Join(e.available, ", ")
+		}
+		d.fail(fmt.Sprintf("camera %d won't open: %s", device, e.why), fix)
+		return img
+	}
+	defer webcam.Close()
+
+	// the first few frames can be empty while the camera wakes up
+	for range 10 {
+		if webcam.Read(&img) && !img.Empty() {
+			d.pass("camera %d: %dx%d", device, img.Cols(), img.Rows())
+			return img
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	d.fail(fmt.Sprintf("camera %d opened but sent no picture", device),
+		"try another -device number (ffmpeg -f avfoundation -list_devices true -i \"\" or v4l2-ctl --list-devices lists them)")
+	return img
+}
+
+// terminal checks what we'd be drawing on, and returns the video area
+func (d *doctor) terminal() (int, int) {
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		d.fail("stdout isn't a terminal", "run asciichat in a terminal, not through a pipe or IDE output pane")
+		return 80, 24
+	}
+
+	w, h, err := term.GetSize(int(os.Stdout.Fd()))
+	switch {
+	case err != nil:
+		d.fail("can't read the terminal size: "+err.Error(), "try a different terminal emulator")
+		w, h = 80, 24
+	case tooSmall(w-1, h-1):
+		d.fail(fmt.Sprintf("terminal is %dx%d", w, h), fmt.Sprintf("make the window at least %dx%d, or the font smaller", minWidth+1, minHeight+1))
+	default:
+		d.pass("terminal size: %dx%d", w, h)
+	}
+
+	switch dep := detectDepth(); dep {
+	case depthTrue:
+		d.pass("colors: truecolor")
+	case depthMono:
+		d.warn("colors: none", "NO_COLOR is set or TERM is dumb; unset NO_COLOR or set TERM=xterm-256color for color video")
+	default:
+		fix := "set COLORTERM=truecolor if your terminal supports it"
+		if multiplexer() == "tmux" {
+			fix = "add set -as terminal-features ',*:RGB' to ~/.tmux.conf if the terminal outside tmux supports truecolor"
+		}
+		d.warn("colors: "+dep.String(), fix)
+	}
+
+	// the alt screen, and the cursor movement everything is drawn with
+	if t := os.Getenv("TERM"); t == "" || t == "dumb" {
+		d.fail(fmt.Sprintf("TERM is %q, so no cursor movement or alternate screen", t), "set TERM=xterm-256color")
+	} else {
+		d.pass("TERM=%s", t)
+	}
+	return w - 1, h - 1
+}
+
+// network makes one connection to the relay, the way a call would
+func (d *doctor) network(server string) {
+	start := time.Now()
+	ws, _, err := dialWS(endpoint{server: server, query: url.Values{}, header: http.Header{}})
+	switch {
+	case errors.Is(err, errIncompatible):
+		d.fail(err.Error(), "update the client, or ask whoever runs the server to")
+	case errors.Is(err, errLogin):
+		d.pass("server %s reachable, and wants a login (asciichat-client login)", server)
+	case err != nil:
+		d.fail(err.Error(), "check the -server URL, that you're online, and that a firewall or proxy isn't blocking websockets")
+	default:
+		ws.Close()
+		d.pass("server %s reachable in %s", server, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// conversion times turning frames into text at the terminal's size
+func (d *doctor) conversion(img gocv.Mat, width, height int) {
+	if img.Empty() {
+		pattern := testPattern(640, 480)
+		defer pattern.Close()
+		img = pattern
+	}
+	o := options{Depth: detectDepth(), Charset: defaultCharset, Mirror: true, Quantizer: quantizerIndex("perceptual")}
+
+	n, start := 0, time.Now()
+	for time.Since(start) < 2*time.Second {
+		processFrame(img, width, height, o)
+		n++
+	}
+	fps := float64(n) / time.Since(start).Seconds()
+	what := fmt.Sprintf("conversion: %.0f fps at %dx%d", fps, width, height)
+	switch {
+	case fps >= 30:
+		d.pass("%s", what)
+	case fps >= 15:
+		d.warn(what, "fine for a call; -quality medium or a smaller window leaves more headroom")
+	default:
+		d.fail(what, "try -quality low, -max-cols 80, or a smaller window")
+	}
+}
+
+// testPattern is a color gradient to render when there's no camera
+func testPattern(w, h int) gocv.Mat {
+	data := make([]byte, 0, w*h*3)
+	for y := range h {
+		for x := range w {
+			data = append(data, byte(255*x/w), byte(255*y/h), byte(255*(x+y)/(w+h))) // BGR
+		}
+	}
+	img, err := gocv.NewMatFromBytes(h, w, gocv.MatTypeCV8UC3, data)
+	if err != nil {
+		return gocv.NewMat()
+	}
+	return img
+}
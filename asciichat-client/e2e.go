@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ---------- end-to-end encryption ----------
+
+// Each client makes an X25519 key at startup and sends the public half
+// in a hello. Once both sides have the other's, everything meant for the
+// peer travels sealed with AES-GCM, so the relay only sees ciphertext.
+// Each sealed message carries a sequence number that doubles as its
+// nonce; anything that doesn't move the number forward is a replay or
+// a reorder by the relay and gets dropped. Gaps are fine: the relay is
+// allowed to drop frames for slow receivers.
+// The relay could still swap the keys in transit, which is what the
+// short authentication string is for: both ends derive it from the
+// session, and if the two people read out the same emoji, nobody's in
+// the middle.
+
+// sealed carries an encrypted message
+const MsgTypeSealed MessageType = "sealed"
+
+type session struct {
+	mu      sync.Mutex
+	priv    *ecdh.PrivateKey
+	peerKey []byte
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	sas     []byte
+
+	sendSeq uint64 // last sequence number we sealed
+	recvSeq uint64 // highest one we've opened
+
+	// the peer's ssh key, once they've proven they hold it
+	peerIdentity ssh.PublicKey
+}
+
+func newSession() *session {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err) // only if the system has no randomness
+	}
+	return &session{priv: priv}
+}
+
+// fork starts a session with another peer in the room. It shares our
+// key, so a single hello covers everyone, but each pair of clients gets
+// its own session keys and sequence numbers.
+func (s *session) fork() *session {
+	return &session{priv: s.priv}
+}
+
+// hello announces our public key
+func (s *session) hello() Message {
+	return Message{Type: MsgTypeHello, Key: s.priv.PublicKey().Bytes()}
+}
+
+// errRekey is a second key from a peer we've already agreed one with.
+// A real peer that starts over comes back through a left and a joined,
+// with a session of its own, so this is the relay trying to take over a
+// call after the peer has proven who they are.
+var errRekey = errors.New("the peer's key changed mid-call; ignoring it")
+
+// establish derives session keys from the peer's hello. It reports
+// whether the key was new to us, in which case the peer may not have
+// ours yet either.
+func (s *session) establish(peerKey []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if bytes.Equal(peerKey, s.peerKey) {
+		return false, nil
+	}
+	if s.peerKey != nil {
+		return false, errRekey
+	}
+	pub, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return false, err
+	}
+	shared, err := s.priv.ECDH(pub)
+	if err != nil {
+		return false, err
+	}
+
+	// both ends need the same salt and the same idea of who's who
+	mine := s.priv.PublicKey().Bytes()
+	lo, hi := mine, peerKey
+	if bytes.Compare(lo, hi) > 0 {
+		lo, hi = hi, lo
+	}
+	okm, err := hkdf.Key(sha256.New, shared, append(append([]byte{}, lo...), hi...), "faceterm e2e v1", 32+32+6)
+	if err != nil {
+		return false, err
+	}
+	loToHi, hiToLo := okm[:32], okm[32:64]
+	sendKey, recvKey := loToHi, hiToLo
+	if !bytes.Equal(mine, lo) {
+		sendKey, recvKey = hiToLo, loToHi
+	}
+
+	if s.send, err = newAEAD(sendKey); err != nil {
+		return false, err
+	}
+	if s.recv, err = newAEAD(recvKey); err != nil {
+		return false, err
+	}
+	s.peerKey = peerKey
+	s.sas = okm[64:]
+	s.sendSeq, s.recvSeq = 0, 0
+	return true, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// identityKey is the peer's verified ssh key, if any
+func (s *session) identityKey() ssh.PublicKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peerIdentity
+}
+
+func (s *session) established() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.send != nil
+}
+
+// forPeer reports whether a message is meant for the other client, as
+// opposed to the server or the key exchange itself
+func forPeer(t MessageType) bool {
+	switch t {
+	case MsgTypeHello, MsgTypeSealed, MsgTypeNext, MsgTypeBlock, MsgTypeReport,
+		MsgTypeJoined, MsgTypeLeft, MsgTypeWaiting, MsgTypeMix, MsgTypeFocus, MsgTypeScheduled,
+		MsgTypeInvite, MsgTypeCalling, MsgTypeUnreachable, MsgTypeRefused, MsgTypeStatus,
+		MsgTypeDecline, MsgTypeDeclined, MsgTypeCancelled:
+		return false
+	}
+	return true
+}
+
+// seal encrypts a message for the peer; before the keys are agreed, or
+// for messages the server has to read, it's passed through as is
+func (s *session) seal(m Message) Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.send == nil || !forPeer(m.Type) {
+		return m
+	}
+	plain, _ := json.Marshal(m)
+	s.sendSeq++
+	nonce := seqNonce(s.sendSeq)
+	// the sequence number goes out in the clear, ahead of the ciphertext,
+	// and so does who it's for, and any trace
+	return Message{Type: MsgTypeSealed, To: m.To, Trace: m.Trace, Data: s.send.Seal(nonce[4:], nonce, plain, nil)}
+}
+
+// wire is what goes out for m. Encrypted (strict is -e2e), nothing for
+// a peer goes in the clear: m goes sealed to the peer it's for, or to
+// each peer we have keys with if it's for everyone, and to nobody
+// without keys, so a relay that drops the hellos gets nothing to read,
+// and neither does the last frame it keeps for viewers. Otherwise it's
+// sealed if it can be.
+func (ps *peerSet) wire(m Message, strict bool) []Message {
+	if !strict || !forPeer(m.Type) {
+		if s := ps.session(m.To); s != nil {
+			m = s.seal(m)
+		}
+		return []Message{m}
+	}
+	if m.To != 0 {
+		if s := ps.session(m.To); s != nil && s.established() {
+			return []Message{s.seal(m)}
+		}
+		return nil
+	}
+	var out []Message
+	for _, p := range ps.list() {
+		if p.sess.established() {
+			one := m
+			one.To = p.id
+			out = append(out, p.sess.seal(one))
+		}
+	}
+	return out
+}
+
+// seqNonce is the GCM nonce for a sequence number: four zero bytes then
+// the number. Each direction has its own key, so no nonce is ever reused.
+func seqNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+var errUnsealed = errors.New("dropping unencrypted message in an encrypted call")
+
+// open decrypts a sealed message. Once the call is encrypted, or from
+// the start if strict (-e2e), anything for us that arrives in the clear
+// must have come from the relay, so it's rejected.
+func (s *session) open(m Message, strict bool) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m.Type != MsgTypeSealed {
+		if (strict || s.recv != nil) && forPeer(m.Type) {
+			return m, errUnsealed
+		}
+		return m, nil
+	}
+	if s.recv == nil {
+		return m, errors.New("sealed message before key exchange")
+	}
+
+	if len(m.Data) < 8 {
+		return m, errors.New("short sealed message")
+	}
+	seq := binary.BigEndian.Uint64(m.Data)
+	if seq <= s.recvSeq {
+		return m, fmt.Errorf("replayed or reordered message (seq %d, already at %d)", seq, s.recvSeq)
+	}
+	plain, err := s.recv.Open(nil, seqNonce(seq), m.Data[8:], nil)
+	if err != nil {
+		return m, err
+	}
+	s.recvSeq = seq // only once it's authentic
+	var inner Message
+	if err := json.Unmarshal(plain, &inner); err != nil {
+		return m, err
+	}
+	if !forPeer(inner.Type) {
+		return m, fmt.Errorf("sealed %q message", inner.Type)
+	}
+	inner.From = m.From // the server's word, not the sender's
+	if m.Trace != "" {
+		inner.Trace = m.Trace // the relay's, if it traced it
+	}
+	return inner, nil
+}
+
+// ---------- fingerprint ----------
+
+// sasEmoji is the 64-symbol table from the Matrix SAS spec, so the
+// pictures are ones people already know how to name
+var sasEmoji = [64]struct{ emoji, name string }{
+	{"🐶", "Dog"}, {"🐱", "Cat"}, {"🦁", "Lion"}, {"🐎", "Horse"},
+	{"🦄", "Unicorn"}, {"🐷", "Pig"}, {"🐘", "Elephant"}, {"🐰", "Rabbit"},
+	{"🐼", "Panda"}, {"🐓", "Rooster"}, {"🐧", "Penguin"}, {"🐢", "Turtle"},
+	{"🐟", "Fish"}, {"🐙", "Octopus"}, {"🦋", "Butterfly"}, {"🌷", "Flower"},
+	{"🌳", "Tree"}, {"🌵", "Cactus"}, {"🍄", "Mushroom"}, {"🌏", "Globe"},
+	{"🌙", "Moon"}, {"☁️", "Cloud"}, {"🔥", "Fire"}, {"🍌", "Banana"},
+	{"🍎", "Apple"}, {"🍓", "Strawberry"}, {"🌽", "Corn"}, {"🍕", "Pizza"},
+	{"🎂", "Cake"}, {"❤️", "Heart"}, {"😀", "Smiley"}, {"🤖", "Robot"},
+	{"🎩", "Hat"}, {"👓", "Glasses"}, {"🔧", "Spanner"}, {"🎅", "Santa"},
+	{"👍", "Thumbs Up"}, {"☂️", "Umbrella"}, {"⌛", "Hourglass"}, {"⏰", "Clock"},
+	{"🎁", "Gift"}, {"💡", "Light Bulb"}, {"📕", "Book"}, {"✏️", "Pencil"},
+	{"📎", "Paperclip"}, {"✂️", "Scissors"}, {"🔒", "Lock"}, {"🔑", "Key"},
+	{"🔨", "Hammer"}, {"☎️", "Telephone"}, {"🏁", "Flag"}, {"🚂", "Train"},
+	{"🚲", "Bicycle"}, {"✈️", "Aeroplane"}, {"🚀", "Rocket"}, {"🏆", "Trophy"},
+	{"⚽", "Ball"}, {"🎸", "Guitar"}, {"🎺", "Trumpet"}, {"🔔", "Bell"},
+	{"⚓", "Anchor"}, {"🎧", "Headphones"}, {"📁", "Folder"}, {"📌", "Pin"},
+}
+
+// fingerprint is the short authentication string as seven emoji (six
+// bits each) and as three four-digit groups, for terminals that can't
+// draw emoji. It's empty until the keys are agreed.
+func (s *session) fingerprint() (emoji []string, digits string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sas == nil {
+		return nil, ""
+	}
+	var b [8]byte
+	copy(b[2:], s.sas)
+	n := binary.BigEndian.Uint64(b[:]) // 48 bits
+	for i := 0; i < 7; i++ {
+		e := sasEmoji[(n>>(42-6*i))&63]
+		emoji = append(emoji, e.emoji+" "+e.name)
+	}
+
+	var groups []string
+	for i := 0; i < 3; i++ {
+		v := binary.BigEndian.Uint16(s.sas[i*2:])
+		groups = append(groups, fmt.Sprintf("%04d", int(v)%10000))
+	}
+	return emoji, strings.Join(groups, " ")
+}
+
+// verify is the v overlay showing the fingerprint, closed by any key
+type verify struct {
+	scr   *screen
+	peers *peerSet
+	open  bool
+}
+
+func (v *verify) draw() string {
+	p := v.peers.primary()
+	if p == nil {
+		return box("verify", []string{"nobody here yet", "", "press any key"})
+	}
+	emoji, digits := p.sess.fingerprint()
+	if emoji == nil {
+		return box("verify", []string{"not encrypted yet: waiting for the peer's key", "", "press any key"})
+	}
+	lines := []string{"read these out to each other; they must match", ""}
+	lines = append(lines, emoji...)
+	lines = append(lines, "", digits)
+	if pub := p.sess.identityKey(); pub != nil {
+		lines = append(lines, "", "peer's ssh key: "+ssh.FingerprintSHA256(pub))
+		if alias := knownPeer(pub); alias != "" {
+			lines = append(lines, "known as "+alias)
+		}
+	}
+	lines = append(lines, "", "press any key")
+	return box("verify", lines)
+}
+
+func (v *verify) handle(k string) bool {
+	if v.open {
+		v.open = false
+		v.scr.setLayer("verify", nil)
+		return true
+	}
+	if k == "v" {
+		v.open = true
+		v.scr.setLayer("verify", v.draw)
+		return true
+	}
+	return false
+}
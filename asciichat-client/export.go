@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"io"
+	"os"
+
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// castEvent is a single output event from a recording
+type castEvent struct {
+	time float64
+	data string
+}
+
+func readCast(path string) (castHeader, []castEvent, error) {
+	var hdr castHeader
+
+	f, err := os.Open(path)
+	if err != nil {
+		return hdr, nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 1<<20), 64<<20) // frames can be big
+
+	if !sc.Scan() {
+		return hdr, nil, fmt.Errorf("%s: empty recording", path)
+	}
+	if err := json.Unmarshal(sc.Bytes(), &hdr); err != nil {
+		return hdr, nil, fmt.Errorf("%s: bad header: %v", path, err)
+	}
+
+	var events []castEvent
+	for sc.Scan() {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(sc.Bytes(), &raw); err != nil || len(raw) != 3 {
+			continue
+		}
+		var ev castEvent
+		var kind string
+		if json.Unmarshal(raw[0], &ev.time) != nil || json.Unmarshal(raw[1], &kind) != nil || kind != "o" {
+			continue
+		}
+		if json.Unmarshal(raw[2], &ev.data) != nil {
+			continue
+		}
+		events = append(events, ev)
+	}
+	return hdr, events, sc.Err()
+}
+
+// readTtyrec reads a ttyrec file; it carries no screen size, so the
+// caller supplies one
+func readTtyrec(path string, width, height int) (castHeader, []castEvent, error) {
+	hdr := castHeader{Version: 2, Width: width, Height: height}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return hdr, nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var events []castEvent
+	var start float64
+	for {
+		var h [12]byte
+		if _, err := io.ReadFull(r, h[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return hdr, nil, fmt.Errorf("%s: truncated chunk header", path)
+		}
+
+		t := float64(binary.LittleEndian.Uint32(h[0:])) + float64(binary.LittleEndian.Uint32(h[4:]))/1e6
+		n := binary.LittleEndian.Uint32(h[8:])
+		if n > maxChunk {
+			return hdr, nil, fmt.Errorf("%s: chunk of %d bytes, more than a recording ever has; is it a ttyrec?", path, n)
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return hdr, nil, fmt.Errorf("%s: truncated chunk", path)
+		}
+
+		if len(events) == 0 {
+			start = t
+			hdr.Timestamp = int64(t)
+		}
+		events = append(events, castEvent{time: t - start, data: string(data)})
+	}
+	return hdr, events, nil
+}
+
+// maxChunk is the biggest ttyrec chunk we'll read. We write a frame a
+// chunk, after -zoom, so one can outgrow a message, but not by this much;
+// past it the file's corrupt or not a ttyrec.
+const maxChunk = 4 * maxMessage
+
+// readRecording sniffs the format: casts start with a JSON header
+func readRecording(path string, width, height int) (castHeader, []castEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return castHeader{}, nil, err
+	}
+	first := make([]byte, 1)
+	n, err := f.Read(first)
+	f.Close()
+	if n == 0 {
+		if err == io.EOF {
+			err = fmt.Errorf("%s is empty", path)
+		}
+		return castHeader{}, nil, err
+	}
+
+	if first[0] == '{' {
+		return readCast(path)
+	}
+	return readTtyrec(path, width, height)
+}
+
+// runExport implements `export`: recording -> animated GIF
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "out.gif", "Output GIF file")
+	fps := fs.Int("fps", 15, "Maximum frames per second in the GIF")
+	cols := fs.Int("cols", 80, "Screen width for ttyrec input")
+	rows := fs.Int("rows", 24, "Screen height for ttyrec input")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: asciichat-client export [-o out.gif] [-fps n] recording.{cast,ttyrec}")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	hdr, events, err := readRecording(fs.Arg(0), *cols, *rows)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	if len(events) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: recording has no frames")
+		os.Exit(1)
+	}
+
+	anim := exportGIF(hdr, events, *fps)
+
+	f, err := os.Create(*out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	if err := gif.EncodeAll(f, anim); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("wrote %d frames to %s\n", len(anim.Image), *out)
+}
+
+func exportGIF(hdr castHeader, events []castEvent, fps int) *gif.GIF {
+	if fps <= 0 {
+		fps = 15
+	}
+	minGap := 1.0 / float64(fps)
+
+	term := newVT(hdr.Width, hdr.Height)
+	anim := &gif.GIF{}
+	indexes := map[color.RGBA]uint8{}
+
+	last := -1.0
+	for i, ev := range events {
+		term.feed(ev.data)
+
+		// skip frames that come too fast, unless it's the last one
+		if i < len(events)-1 && last >= 0 && ev.time-last < minGap {
+			continue
+		}
+		if n := len(anim.Delay); n > 0 {
+			anim.Delay[n-1] = max(2, int((ev.time-last)*100))
+		}
+
+		anim.Image = append(anim.Image, rasterize(term, indexes))
+		anim.Delay = append(anim.Delay, 10)
+		last = ev.time
+	}
+	return anim
+}
+
+// rasterize draws the emulated screen with the 7x13 basic font
+func rasterize(term *vt, indexes map[color.RGBA]uint8) *image.Paletted {
+	face := basicfont.Face7x13
+	cw, ch := face.Advance, face.Height
+
+	img := image.NewPaletted(image.Rect(0, 0, term.width*cw, term.height*ch), palette.Plan9)
+
+	index := func(c color.RGBA) uint8 {
+		i, ok := indexes[c]
+		if !ok {
+			i = uint8(img.Palette.Index(c))
+			indexes[c] = i
+		}
+		return i
+	}
+
+	for y := 0; y < term.height; y++ {
+		for x := 0; x < term.width; x++ {
+			cell := term.at(x, y)
+			rect := image.Rect(x*cw, y*ch, (x+1)*cw, (y+1)*ch)
+
+			bg := index(cell.bg)
+			for py := rect.Min.Y; py < rect.Max.Y; py++ {
+				for px := rect.Min.X; px < rect.Max.X; px++ {
+					img.SetColorIndex(px, py, bg)
+				}
+			}
+			if cell.ch == ' ' {
+				continue
+			}
+
+			dot := fixed.P(rect.Min.X, rect.Min.Y+face.Ascent)
+			dr, mask, mp, _, ok := face.Glyph(dot, cell.ch)
+			if !ok {
+				continue
+			}
+			fg := index(cell.fg)
+			for py := dr.Min.Y; py < dr.Max.Y; py++ {
+				for px := dr.Min.X; px < dr.Max.X; px++ {
+					if _, _, _, a := mask.At(mp.X+px-dr.Min.X, mp.Y+py-dr.Min.Y).RGBA(); a > 0x7fff {
+						img.SetColorIndex(px, py, fg)
+					}
+				}
+			}
+		}
+	}
+	return img
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ---------- filters ----------
+
+// -filters runs built-in filters over our video, in order, before it's
+// drawn or sent (and before -script): the scaled picture goes through
+// each in turn. On the command line it's a list with any settings after
+// each name,
+//
+//	-filters "denoise, autolevel, facecrop zoom=2, sepia amount=0.6"
+//
+// and in config.json it can be that, or a list:
+//
+//	"filters": ["denoise", "autolevel", {"name": "facecrop", "zoom": 2}, {"name": "sepia", "amount": 0.6}]
+//
+// facecrop has no real face detection: it follows the skin-colored
+// pixels, which works for one face in ordinary light.
+//
+// Mid-call, e picks one of them, o turns it off and on again, and [ and
+// ] turn its first setting down and up; the status line lists them, the
+// picked one in brackets and any that are off with a minus.
+
+// filterParam is one setting of a filter, kept between lo and hi, and
+// turned up and down by step
+type filterParam struct {
+	name              string
+	def, lo, hi, step float64
+}
+
+type filterKind struct {
+	name   string
+	params []filterParam
+	apply  func(p pixels, args []float64, st *filterState)
+}
+
+// filterState is what a filter remembers between frames
+type filterState struct {
+	cx, cy float64 // facecrop: where the face is, 0-1 across and down
+	found  bool
+}
+
+var filterKinds = []filterKind{
+	{"denoise", nil, denoise},
+	{"autolevel", []filterParam{{"cut", 1, 0, 20, 1}}, autolevel},
+	{"brightness", []filterParam{{"amount", 0.1, -1, 1, 0.05}}, func(p pixels, a []float64, _ *filterState) {
+		mapChannels(p, func(v float64) float64 { return v + a[0]*255 })
+	}},
+	{"contrast", []filterParam{{"amount", 1.3, 0, 4, 0.1}}, func(p pixels, a []float64, _ *filterState) {
+		mapChannels(p, func(v float64) float64 { return (v-128)*a[0] + 128 })
+	}},
+	{"gray", nil, func(p pixels, _ []float64, _ *filterState) { tone(p, grayTone, 1) }},
+	{"sepia", []filterParam{{"amount", 1, 0, 1, 0.1}}, func(p pixels, a []float64, _ *filterState) { tone(p, sepiaTone, a[0]) }},
+	{"posterize", []filterParam{{"levels", 4, 2, 16, 1}}, func(p pixels, a []float64, _ *filterState) {
+		step := 255 / math.Round(a[0]-1)
+		mapChannels(p, func(v float64) float64 { return math.Round(v/step) * step })
+	}},
+	{"vignette", []filterParam{{"strength", 0.5, 0, 1, 0.1}}, vignette},
+	{"facecrop", []filterParam{{"zoom", 1.6, 1, 4, 0.2}}, facecrop},
+}
+
+func filterKindIndex(name string) int {
+	return slices.IndexFunc(filterKinds, func(k filterKind) bool { return k.name == name })
+}
+
+func filterNames() string {
+	var names []string
+	for _, k := range filterKinds {
+		names = append(names, k.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// filter is one filter in the pipeline, with its settings
+type filter struct {
+	kind *filterKind
+	args []float64 // one per kind.params
+	off  bool      // turned off mid-call
+	st   filterState
+}
+
+// String is the filter and its settings, as -filters takes them
+func (f *filter) String() string {
+	s := f.kind.name
+	for i, p := range f.kind.params {
+		s += fmt.Sprintf(" %s=%g", p.name, f.args[i])
+	}
+	return s
+}
+
+func newFilter(name string, set map[string]float64) (*filter, error) {
+	i := filterKindIndex(name)
+	if i < 0 {
+		return nil, fmt.Errorf("no filter %q; there's %s", name, filterNames())
+	}
+	f := &filter{kind: &filterKinds[i]}
+	for _, p := range f.kind.params {
+		v, ok := set[p.name]
+		if !ok {
+			v = p.def
+		}
+		if v < p.lo || v > p.hi {
+			return nil, fmt.Errorf("%s %s=%g: want %g to %g", name, p.name, v, p.lo, p.hi)
+		}
+		f.args = append(f.args, v)
+		delete(set, p.name)
+	}
+	for k := range set {
+		return nil, fmt.Errorf("filter %s has no setting %q", name, k)
+	}
+	return f, nil
+}
+
+// pipeline is -filters
+type pipeline struct {
+	mu      sync.Mutex
+	filters []*filter
+	picked  int // what o, [ and ] change
+}
+
+// userFilters is -filters, nil if there aren't any
+var userFilters *pipeline
+
+// parsePipeline reads -filters: the command line's list, or the config
+// file's, which arrives as JSON (see applyConfig)
+func parsePipeline(s string) (*pipeline, error) {
+	pl := &pipeline{}
+	if strings.HasPrefix(strings.TrimSpace(s), "[") {
+		var items []any
+		if err := json.Unmarshal([]byte(s), &items); err != nil {
+			return nil, fmt.Errorf("filters: %v", err)
+		}
+		for _, item := range items {
+			var name string
+			set := make(map[string]float64)
+			switch it := item.(type) {
+			case string:
+				name = it
+			case map[string]any:
+				for k, v := range it {
+					if k == "name" {
+						name, _ = v.(string)
+						continue
+					}
+					n, ok := v.(float64)
+					if !ok {
+						return nil, fmt.Errorf("filters: %s: %s should be a number", name, k)
+					}
+					set[k] = n
+				}
+			default:
+				return nil, fmt.Errorf("filters: want a filter name or {\"name\": ...}, not %v", item)
+			}
+			f, err := newFilter(name, set)
+			if err != nil {
+				return nil, fmt.Errorf("filters: %w", err)
+			}
+			pl.filters = append(pl.filters, f)
+		}
+		return pl, nil
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			continue
+		}
+		set := make(map[string]float64)
+		for _, kv := range fields[1:] {
+			k, v, ok := strings.Cut(kv, "=")
+			n, err := strconv.ParseFloat(v, 64)
+			if !ok || err != nil {
+				return nil, fmt.Errorf("filters: want %s setting=number, not %q", fields[0], kv)
+			}
+			set[k] = n
+		}
+		f, err := newFilter(fields[0], set)
+		if err != nil {
+			return nil, fmt.Errorf("filters: %w", err)
+		}
+		pl.filters = append(pl.filters, f)
+	}
+	return pl, nil
+}
+
+// apply runs p through every filter, in place
+func (pl *pipeline) apply(p pixels) pixels {
+	if pl == nil || p.w == 0 || p.h == 0 {
+		return p
+	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	for _, f := range pl.filters {
+		if !f.off {
+			f.kind.apply(p, f.args, &f.st)
+		}
+	}
+	return p
+}
+
+// pick moves on to the next filter and describes it
+func (pl *pipeline) pick() string {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.picked = (pl.picked + 1) % len(pl.filters)
+	return pl.describe()
+}
+
+// toggle turns the picked filter off, or on again
+func (pl *pipeline) toggle() string {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	f := pl.filters[pl.picked]
+	f.off = !f.off
+	return pl.describe()
+}
+
+// adjust turns the picked filter's first setting up or down a step
+func (pl *pipeline) adjust(dir int) string {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	f := pl.filters[pl.picked]
+	if len(f.args) == 0 {
+		return f.kind.name + " has no settings"
+	}
+	p := f.kind.params[0]
+	v := f.args[0] + float64(dir)*p.step
+	f.args[0] = math.Round(max(p.lo, min(p.hi, v))*100) / 100
+	return pl.describe()
+}
+
+func (pl *pipeline) describe() string {
+	f := pl.filters[pl.picked]
+	if f.off {
+		return "filter " + f.String() + " (off)"
+	}
+	return "filter " + f.String()
+}
+
+// status lists the filters for the status line, "" if there are none
+func (pl *pipeline) status() string {
+	if pl == nil {
+		return ""
+	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	var names []string
+	for i, f := range pl.filters {
+		name := f.kind.name
+		if f.off {
+			name = "-" + name
+		}
+		if i == pl.picked && len(pl.filters) > 1 {
+			name = "[" + name + "]"
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, " ")
+}
+
+// applyFilters is everything between the camera and drawing: -filters,
+// -plugin, -script's pixels hook, then -watermark on top
+func applyFilters(p pixels) pixels {
+	return userMark.stampPixels(userScript.filterPixels(userPlugin.apply(userFilters.apply(p))))
+}
+
+func clampByte(v float64) byte {
+	return byte(max(0, min(255, math.Round(v))))
+}
+
+// mapChannels runs fn over every channel of every pixel
+func mapChannels(p pixels, fn func(float64) float64) {
+	var table [256]byte
+	for i := range table {
+		table[i] = clampByte(fn(float64(i)))
+	}
+	for i, v := range p.bgr {
+		p.bgr[i] = table[v]
+	}
+}
+
+// denoise takes the median of each 3x3 neighborhood, channel by channel:
+// it scrubs out the speckle a webcam makes in low light and keeps edges
+func denoise(p pixels, _ []float64, _ *filterState) {
+	src := slices.Clone(p.bgr)
+	var near [9]byte
+	for y := range p.h {
+		for x := range p.w {
+			for ch := range 3 {
+				n := 0
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						nx, ny := min(max(x+dx, 0), p.w-1), min(max(y+dy, 0), p.h-1)
+						near[n] = src[(ny*p.w+nx)*3+ch]
+						n++
+					}
+				}
+				slices.Sort(near[:])
+				p.bgr[(y*p.w+x)*3+ch] = near[4]
+			}
+		}
+	}
+}
+
+// autolevel stretches the picture's brightness to the full range,
+// ignoring the darkest and brightest cut percent
+func autolevel(p pixels, a []float64, _ *filterState) {
+	var hist [256]int
+	n := p.w * p.h
+	for i := range n {
+		hist[int(p.at(i%p.w, i/p.w).lum())]++
+	}
+	cut := int(float64(n) * a[0] / 100)
+	lo, hi := 0, 255
+	for seen := 0; lo < 255 && seen+hist[lo] <= cut; lo++ {
+		seen += hist[lo]
+	}
+	for seen := 0; hi > 0 && seen+hist[hi] <= cut; hi-- {
+		seen += hist[hi]
+	}
+	if hi-lo < 16 {
+		return // flat already; stretching it would only show the noise
+	}
+	scale := 255 / float64(hi-lo)
+	mapChannels(p, func(v float64) float64 { return (v - float64(lo)) * scale })
+}
+
+// the colors each pixel becomes, as rows of r, g and b from r, g and b
+var (
+	grayTone  = [3][3]float64{{0.2126, 0.7152, 0.0722}, {0.2126, 0.7152, 0.0722}, {0.2126, 0.7152, 0.0722}}
+	sepiaTone = [3][3]float64{{0.393, 0.769, 0.189}, {0.349, 0.686, 0.168}, {0.272, 0.534, 0.131}}
+)
+
+// tone blends each pixel toward m of it by amount
+func tone(p pixels, m [3][3]float64, amount float64) {
+	for i := 0; i+2 < len(p.bgr); i += 3 {
+		c := [3]float64{float64(p.bgr[i+2]), float64(p.bgr[i+1]), float64(p.bgr[i])}
+		for ch := range 3 {
+			v := m[ch][0]*c[0] + m[ch][1]*c[1] + m[ch][2]*c[2]
+			p.bgr[i+2-ch] = clampByte(c[ch] + (v-c[ch])*amount)
+		}
+	}
+}
+
+// vignette darkens toward the corners
+func vignette(p pixels, a []float64, _ *filterState) {
+	cx, cy := float64(p.w-1)/2, float64(p.h-1)/2
+	for y := range p.h {
+		for x := range p.w {
+			dx, dy := (float64(x)-cx)/max(cx, 1), (float64(y)-cy)/max(cy, 1)
+			k := 1 - a[0]*min(1, (dx*dx+dy*dy)/2)
+			i := (y*p.w + x) * 3
+			for ch := range 3 {
+				p.bgr[i+ch] = clampByte(float64(p.bgr[i+ch]) * k)
+			}
+		}
+	}
+}
+
+// skin is the usual YCbCr box for skin tones, which holds up across
+// complexions better than anything in RGB
+func skin(c rgb) bool {
+	r, g, b := float64(c.r), float64(c.g), float64(c.b)
+	cb := 128 - 0.168736*r - 0.331264*g + 0.5*b
+	cr := 128 + 0.5*r - 0.418688*g - 0.081312*b
+	return cb >= 77 && cb <= 127 && cr >= 133 && cr <= 173
+}
+
+// facecrop zooms in on the face: the middle of the skin-colored pixels,
+// with the crop easing toward it so it doesn't jitter
+func facecrop(p pixels, a []float64, st *filterState) {
+	var sx, sy, n float64
+	for y := range p.h {
+		for x := range p.w {
+			if skin(p.at(x, y)) {
+				sx, sy, n = sx+float64(x), sy+float64(y), n+1
+			}
+		}
+	}
+	if n > float64(p.w*p.h)/100 { // too few is noise: stay put
+		fx, fy := sx/n/float64(p.w), sy/n/float64(p.h)
+		if !st.found {
+			st.cx, st.cy, st.found = fx, fy, true
+		}
+		st.cx += (fx - st.cx) * 0.2
+		st.cy += (fy - st.cy) * 0.2
+	}
+	if !st.found {
+		return
+	}
+
+	zoom := a[0]
+	cw, ch := float64(p.w)/zoom, float64(p.h)/zoom
+	left := min(max(st.cx*float64(p.w)-cw/2, 0), float64(p.w)-cw)
+	top := min(max(st.cy*float64(p.h)-ch/2, 0), float64(p.h)-ch)
+	src := slices.Clone(p.bgr)
+	for y := range p.h {
+		sy := min(int(top+float64(y)/zoom), p.h-1)
+		for x := range p.w {
+			sx := min(int(left+float64(x)/zoom), p.w-1)
+			copy(p.bgr[(y*p.w+x)*3:][:3], src[(sy*p.w+sx)*3:])
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+)
+
+// rgb is a plain 24-bit color
+type rgb struct{ r, g, b uint8 }
+
+func (c rgb) lum() float64 {
+	return 0.2126*float64(c.r) + 0.7152*float64(c.g) + 0.0722*float64(c.b)
+}
+
+// pixels is a BGR image copied out of a Mat, so renderers are plain Go
+type pixels struct {
+	w, h int
+	bgr  []byte
+}
+
+func (p pixels) at(x, y int) rgb {
+	i := (y*p.w + x) * 3
+	return rgb{p.bgr[i+2], p.bgr[i+1], p.bgr[i]}
+}
+
+// cell is one character of output and its colors
+type cell struct {
+	ch           rune
+	fg, bg       rgb
+	hasFg, hasBg bool
+}
+
+// grid is a rendered frame before it becomes ANSI text
+type grid struct {
+	w, h  int
+	cells []cell
+}
+
+func newGrid(w, h int) *grid {
+	return &grid{w: w, h: h, cells: make([]cell, w*h)}
+}
+
+func (g *grid) at(x, y int) *cell {
+	return &g.cells[y*g.w+x]
+}
+
+// ansi encodes the grid at the options' color depth, only emitting a
+// color when it changes
+func (g *grid) ansi(o options) string {
+	var b strings.Builder
+	b.Grow(g.w * g.h * 4)
+
+	enc := newColorEncoder(o)
+	colored := false
+	for y := 0; y < g.h; y++ {
+		var fg, bg string
+		for x := 0; x < g.w; x++ {
+			c := g.at(x, y)
+			if c.hasFg && o.Depth != depthMono {
+				if s := enc.sgr(c.fg, false, x, y); s != fg {
+					b.WriteString(s)
+					fg, colored = s, true
+				}
+			}
+			if c.hasBg && o.Depth != depthMono {
+				if s := enc.sgr(c.bg, true, x, y); s != bg {
+					b.WriteString(s)
+					bg, colored = s, true
+				}
+			}
+			b.WriteRune(c.ch)
+		}
+		// don't let a background bleed past the end of the line
+		if bg != "" {
+			b.WriteString("\033[0m")
+		}
+		b.WriteByte('\n')
+	}
+
+	if colored {
+		b.WriteString("\033[0m") // reset color
+	}
+	return b.String()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// ---------- call history ----------
+
+// Every call, once it's over, gets a line in history.jsonl in the state
+// directory: who it was with, where, when, how long, and how it went.
+// "asciichat-client history" lists the latest, and "history 3 [flags]"
+// calls the third one again: the same account with -call, or the same
+// room on the same server. Strangers from -match can't be called back.
+
+const (
+	maxHistory  = 1000 // calls kept in the file
+	listHistory = 20   // calls listed
+)
+
+// callRecord is one line of history.jsonl
+type callRecord struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	Peer  string `json:"peer,omitempty"`  // the name they gave
+	Key   string `json:"key,omitempty"`   // their ssh key's fingerprint, if they showed one
+	Alias string `json:"alias,omitempty"` // what we saved that key as
+	User  string `json:"user,omitempty"`  // the account we called, or that called us
+
+	Server string `json:"server"`
+	Room   string `json:"room,omitempty"` // empty for the lobby
+	Match  bool   `json:"match,omitempty"`
+
+	FramesIn  int     `json:"frames_in"`
+	FramesOut int     `json:"frames_out"`
+	RTT       float64 `json:"rtt_ms,omitempty"` // the average round trip
+}
+
+func historyPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "history.jsonl"), nil
+}
+
+// loadHistory never fails: no history is an empty one. Oldest first.
+func loadHistory() []callRecord {
+	path, err := historyPath()
+	if err != nil {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var calls []callRecord
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		var c callRecord
+		if json.Unmarshal(sc.Bytes(), &c) == nil {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+var historyMu sync.Mutex
+
+// recordCall adds a finished call to the history
+func recordCall(c callRecord) error {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	calls := append(loadHistory(), c)
+	if len(calls) > maxHistory {
+		calls = calls[len(calls)-maxHistory:]
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, c := range calls {
+		enc.Encode(c)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// who the call was with, as best we know
+func (c callRecord) who() string {
+	switch {
+	case c.User != "":
+		return c.User
+	case c.Alias != "":
+		return c.Alias
+	case c.Peer != "":
+		return c.Peer
+	}
+	return "someone"
+}
+
+// where the call was
+func (c callRecord) where() string {
+	var w string
+	switch {
+	case c.Match:
+		w = "stranger"
+	case c.Room != "":
+		w = "room " + c.Room
+	default:
+		w = "lobby"
+	}
+	if c.Server != defaultServer {
+		w += " on " + c.Server
+	}
+	return w
+}
+
+// how the call went
+func (c callRecord) how() string {
+	secs := c.End.Sub(c.Start).Seconds()
+	if secs < 1 {
+		return ""
+	}
+	s := fmt.Sprintf("%.0f fps in, %.0f out", float64(c.FramesIn)/secs, float64(c.FramesOut)/secs)
+	if c.RTT > 0 {
+		s += fmt.Sprintf(", %.0f ms", c.RTT)
+	}
+	return s
+}
+
+// again is the flags that call it back, nil if there's no way to
+func (c callRecord) again() []string {
+	switch {
+	case c.Match:
+		return nil
+	case c.User != "":
+		return []string{"-server", c.Server, "-call", c.User}
+	case c.Room != "":
+		return []string{"-server", c.Server, "-room", c.Room}
+	}
+	return []string{"-server", c.Server}
+}
+
+// runHistory lists the latest calls, or with a number, returns the
+// flags to call that one again, followed by any others given
+func runHistory(args []string) []string {
+	calls := loadHistory()
+	if len(args) == 0 {
+		if len(calls) == 0 {
+			fmt.Println("no calls yet")
+			return nil
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for i := 0; i < listHistory && i < len(calls); i++ {
+			c := calls[len(calls)-1-i]
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", i+1, c.Start.Local().Format("Mon Jan 2 15:04"),
+				formatElapsed(c.End.Sub(c.Start)), c.who(), c.where(), c.how())
+		}
+		tw.Flush()
+		fmt.Println("\ncall one again with: asciichat-client history <number>")
+		return nil
+	}
+
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		fmt.Fprintln(os.Stderr, "usage: asciichat-client history [number [flags]]")
+		os.Exit(2)
+	}
+	if n > len(calls) {
+		fmt.Fprintf(os.Stderr, "Error: there are only %d calls in the history\n", len(calls))
+		os.Exit(1)
+	}
+	c := calls[len(calls)-n]
+	again := c.again()
+	if again == nil {
+		fmt.Fprintln(os.Stderr, "Error: that was a stranger from -match; there's no calling them back")
+		os.Exit(1)
+	}
+	return append(again, args[1:]...)
+}
@@ -0,0 +1,39 @@
+package main
+
+// ---------- hold ----------
+
+// h puts the call on hold: we stop sending video, and tell everyone so
+// they stop sending theirs to us and show why the picture's gone,
+// instead of a frozen frame. h again picks up where we left off. Anyone
+// who joins or reconnects while we're on hold hears about it first.
+
+// holdMsg tells to (0 for everyone) whether we've put the call on hold
+func holdMsg(to uint64, held bool) Message {
+	return Message{Type: MsgTypeHold, To: to, Held: held}
+}
+
+// toggleHold puts the call on hold or takes it off, and says which
+func (s *callState) toggleHold() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hold = !s.hold
+	return s.hold
+}
+
+func (s *callState) onHold() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hold
+}
+
+// holding reports whether everyone here has put us on hold
+func (ps *peerSet) holding() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, p := range ps.peers {
+		if !p.held {
+			return false
+		}
+	}
+	return len(ps.peers) > 0
+}
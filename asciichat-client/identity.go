@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ---------- ssh identities ----------
+
+// With -identity, we sign the key exchange with one of the user's ssh
+// keys and send the signature (sealed) to the peer. The peer checks it
+// against the session it negotiated, shows the key's fingerprint, and
+// recognizes repeat callers from known_peers.
+
+// MsgTypeIdentity carries an ssh public key and a signature over the
+// session transcript; it's only ever sent sealed
+const MsgTypeIdentity MessageType = "identity"
+
+// loadIdentity reads a private key, falling back to ssh-agent for keys
+// that have a passphrase
+func loadIdentity(path string) (ssh.Signer, error) {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, rest)
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return signer, err
+	}
+
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, fmt.Errorf("%s needs a passphrase; add it to ssh-agent", path)
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range signers {
+		if missing.PublicKey != nil && bytes.Equal(s.PublicKey().Marshal(), missing.PublicKey.Marshal()) {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("%s isn't loaded in ssh-agent", path)
+}
+
+// transcript is what an identity signs: both exchange keys plus the
+// signer's own, so a signature can't be lifted into another session or
+// reflected back at its owner. Must hold s.mu.
+func (s *session) transcript(signerKey []byte) []byte {
+	mine := s.priv.PublicKey().Bytes()
+	lo, hi := mine, s.peerKey
+	if bytes.Compare(lo, hi) > 0 {
+		lo, hi = hi, lo
+	}
+	t := []byte("faceterm identity v1\x00")
+	t = append(t, lo...)
+	t = append(t, hi...)
+	return append(t, signerKey...)
+}
+
+// identity signs the current session with our ssh key
+func (s *session) identity(signer ssh.Signer) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.peerKey == nil {
+		return Message{}, errors.New("no session to sign")
+	}
+	sig, err := signer.Sign(nil, s.transcript(s.priv.PublicKey().Bytes()))
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MsgTypeIdentity, Key: signer.PublicKey().Marshal(), Sig: ssh.Marshal(sig)}, nil
+}
+
+// verifyIdentity checks the peer's signature over this session and
+// remembers their key
+func (s *session) verifyIdentity(m Message) (ssh.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.peerKey == nil {
+		return nil, errors.New("identity before key exchange")
+	}
+	pub, err := ssh.ParsePublicKey(m.Key)
+	if err != nil {
+		return nil, err
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(m.Sig, &sig); err != nil {
+		return nil, err
+	}
+	if err := pub.Verify(s.transcript(s.peerKey), &sig); err != nil {
+		return nil, err
+	}
+	s.peerIdentity = pub
+	return pub, nil
+}
+
+// ---------- known peers ----------
+
+// known_peers holds one "alias keytype base64" line per peer, like a
+// cut-down known_hosts
+func knownPeersPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "known_peers"), nil
+}
+
+// knownPeer looks a key up, returning the alias we saved it under
+func knownPeer(pub ssh.PublicKey) string {
+	path, err := knownPeersPath()
+	if err != nil {
+		return ""
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		alias, key, ok := strings.Cut(strings.TrimSpace(sc.Text()), " ")
+		if !ok || strings.HasPrefix(alias, "#") {
+			continue
+		}
+		k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err == nil && bytes.Equal(k.Marshal(), pub.Marshal()) {
+			return alias
+		}
+	}
+	return ""
+}
+
+// rememberPeer saves a key under an alias
+func rememberPeer(alias string, pub ssh.PublicKey) error {
+	path, err := knownPeersPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	alias = strings.Join(strings.Fields(alias), "_")
+	if alias == "" {
+		alias = "peer"
+	}
+	_, err = fmt.Fprintf(f, "%s %s", alias, ssh.MarshalAuthorizedKey(pub))
+	return err
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// ---------- video from stdin ----------
+
+// -input - reads frames from stdin instead of a camera, so anything that
+// can write video (ffmpeg, OBS, a screen recorder) can feed a call:
+//
+//	ffmpeg -i talk.mp4 -f yuv4mpegpipe - | asciichat-client -input -
+//	ffmpeg -i talk.mp4 -f rawvideo -pix_fmt bgr24 -s 640x480 - | asciichat-client -input - -input-format bgr24 -input-size 640x480
+//
+// y4m says its own size and color format; raw video needs telling.
+
+// source is where our video comes from: a camera, or stdin
+type source interface {
+	Read(img *gocv.Mat) bool
+	Close() error
+}
+
+// rawFormats are the -input-format values besides y4m; yuv is
+// converted to BGR as it's read
+var rawFormats = []string{"bgr24", "rgb24", "gray", "yuv420p"}
+
+func inputFormatIndex(name string) int {
+	for i, f := range rawFormats {
+		if f == name {
+			return i
+		}
+	}
+	return -1
+}
+
+type stdinSource struct {
+	r      *bufio.Reader
+	y4m    bool
+	format string
+	w, h   int
+	chroma string // y4m's C parameter: 420..., 422, 444 or mono
+	ended  bool
+}
+
+// newStdinSource reads the y4m header now, so a bad stream fails at
+// startup rather than mid-call
+func newStdinSource(in io.Reader, format string, w, h int) (*stdinSource, error) {
+	s := &stdinSource{r: bufio.NewReaderSize(in, 1<<20), format: format, w: w, h: h}
+	if format != "y4m" {
+		if w <= 0 || h <= 0 {
+			return nil, fmt.Errorf("-input-format %s needs -input-size, e.g. 640x480", format)
+		}
+		return s, nil
+	}
+
+	s.y4m, s.chroma = true, "420jpeg"
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading y4m header: %v", err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != "YUV4MPEG2" {
+		return nil, fmt.Errorf("stdin isn't y4m (ffmpeg -f yuv4mpegpipe), or pass -input-format for raw video")
+	}
+	for _, f := range fields[1:] {
+		switch f[0] {
+		case 'W':
+			s.w, _ = strconv.Atoi(f[1:])
+		case 'H':
+			s.h, _ = strconv.Atoi(f[1:])
+		case 'C':
+			s.chroma = f[1:]
+		}
+	}
+	if s.w <= 0 || s.h <= 0 {
+		return nil, fmt.Errorf("y4m header has no size: %q", strings.TrimSpace(line))
+	}
+	switch s.chroma {
+	case "420", "420jpeg", "420mpeg2", "420paldv", "422", "444", "mono":
+	default: // 10 bit and the like
+		return nil, fmt.Errorf("y4m color format C%s isn't supported; use -pix_fmt yuv420p", s.chroma)
+	}
+	return s, nil
+}
+
+// frameSize is the bytes in one frame as it arrives
+func (s *stdinSource) frameSize() int {
+	n := s.w * s.h
+	cw, ch := (s.w+1)/2, (s.h+1)/2
+	switch {
+	case s.y4m && s.chroma == "mono", !s.y4m && s.format == "gray":
+		return n
+	case s.y4m && s.chroma == "444":
+		return 3 * n
+	case s.y4m && s.chroma == "422":
+		return n + 2*cw*s.h
+	case s.y4m, s.format == "yuv420p":
+		return n + 2*cw*ch
+	}
+	return 3 * n // bgr24, rgb24
+}
+
+// Read replaces img with the next frame. At the end of the input it
+// keeps returning false, slowly, so the capture loop doesn't spin.
+func (s *stdinSource) Read(img *gocv.Mat) bool {
+	if s.ended {
+		time.Sleep(100 * time.Millisecond)
+		return false
+	}
+	if s.y4m {
+		// FRAME, maybe with parameters we don't need
+		if _, err := s.r.ReadString('\n'); err != nil {
+			return s.end(err)
+		}
+	}
+	buf := make([]byte, s.frameSize())
+	if _, err := io.ReadFull(s.r, buf); err != nil {
+		return s.end(err)
+	}
+
+	m, err := gocv.NewMatFromBytes(s.h, s.w, gocv.MatTypeCV8UC3, s.bgr(buf))
+	if err != nil {
+		log.Println("input frame:", err)
+		return false
+	}
+	img.Close()
+	*img = m
+	return true
+}
+
+func (s *stdinSource) end(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		log.Println("input ended")
+	} else {
+		log.Println("reading input:", err)
+	}
+	s.ended = true
+	return false
+}
+
+func (s *stdinSource) Close() error { return nil }
+
+// bgr converts a frame as it arrived to the packed BGR that Mats hold
+func (s *stdinSource) bgr(buf []byte) []byte {
+	n := s.w * s.h
+	switch {
+	case !s.y4m && s.format == "bgr24":
+		return buf
+	case !s.y4m && s.format == "rgb24":
+		for i := 0; i+2 < len(buf); i += 3 {
+			buf[i], buf[i+2] = buf[i+2], buf[i]
+		}
+		return buf
+	case !s.y4m && s.format == "gray", s.y4m && s.chroma == "mono":
+		out := make([]byte, 0, 3*n)
+		for _, v := range buf[:n] {
+			out = append(out, v, v, v)
+		}
+		return out
+	}
+
+	// planar YUV: full size luma, then U and V, subsampled per chroma
+	sx, sy := 2, 2
+	switch {
+	case s.y4m && s.chroma == "444":
+		sx, sy = 1, 1
+	case s.y4m && s.chroma == "422":
+		sy = 1
+	}
+	cw, ch := (s.w+sx-1)/sx, (s.h+sy-1)/sy
+	yp, up, vp := buf[:n], buf[n:n+cw*ch], buf[n+cw*ch:n+2*cw*ch]
+
+	out := make([]byte, 3*n)
+	for y := range s.h {
+		for x := range s.w {
+			c := (y/sy)*cw + x/sx
+			r, g, b := yuvToRGB(yp[y*s.w+x], up[c], vp[c])
+			i := 3 * (y*s.w + x)
+			out[i], out[i+1], out[i+2] = b, g, r
+		}
+	}
+	return out
+}
+
+// yuvToRGB is the BT.601 conversion for limited range video, what ffmpeg
+// writes unless told otherwise
+func yuvToRGB(y, u, v byte) (byte, byte, byte) {
+	c := 298 * (int(y) - 16)
+	d, e := int(u)-128, int(v)-128
+	clamp := func(x int) byte { return byte(max(0, min(255, (x+128)>>8))) }
+	return clamp(c + 409*e), clamp(c - 100*d - 208*e), clamp(c + 516*d)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// ---------- intro and outro ----------
+
+// A moment of animation over the video area when a call connects
+// (-intro) and when the last peer leaves (-outro): the faceterm logo
+// wiping in, or out, or frames of your own from a text file, one after
+// another with a line of just --- between them. It's drawn here, over
+// whatever video there is, and never sent: a peer sees their own.
+
+const (
+	animFrame     = 80 * time.Millisecond // how long each frame is up
+	maxAnimFrames = 250                   // 20 seconds
+)
+
+// animation is the frames, each a few lines of art
+type animation [][]string
+
+var logo = []string{
+	"  __                     _",
+	" / _|  __ _   ___   ___ | |_   ___  _ __  _ __ ___",
+	"| |_  / _` | / __| / _ \\| __| / _ \\| '__|| '_ ` _ \\",
+	"|  _|| (_| || (__ |  __/| |_ |  __/| |   | | | | | |",
+	"|_|   \\__,_| \\___| \\___| \\__| \\___||_|   |_| |_| |_|",
+}
+
+// logoAnimation wipes the logo in from the left and holds it, or for
+// an outro holds it and wipes it back out
+func logoAnimation(out bool) animation {
+	const steps, hold = 12, 10
+	w := 0
+	for _, l := range logo {
+		w = max(w, len(l))
+	}
+	var a animation
+	for i := 1; i <= steps; i++ {
+		frame := make([]string, len(logo))
+		for j, l := range logo {
+			frame[j] = l[:min(len(l), w*i/steps)]
+		}
+		a = append(a, frame)
+	}
+	for range hold {
+		a = append(a, logo)
+	}
+	if out {
+		slices.Reverse(a)
+	}
+	return a
+}
+
+// loadAnimation is what -intro or -outro (named by which) asks for:
+// off, logo, or a file of frames
+func loadAnimation(which, v string) (animation, error) {
+	switch v {
+	case "", "off":
+		return nil, nil
+	case "logo":
+		return logoAnimation(which == "outro"), nil
+	}
+	b, err := os.ReadFile(v)
+	if err != nil {
+		return nil, fmt.Errorf("-%s: %v", which, err)
+	}
+	var a animation
+	var frame []string
+	end := func() {
+		if strings.TrimSpace(strings.Join(frame, "")) != "" {
+			a = append(a, frame)
+		}
+		frame = nil
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "---" {
+			end()
+			continue
+		}
+		frame = append(frame, cleanName(line)) // no escapes from a file
+	}
+	end()
+	switch {
+	case len(a) == 0:
+		return nil, fmt.Errorf("-%s: %s has no frames", which, v)
+	case len(a) > maxAnimFrames:
+		return nil, fmt.Errorf("-%s: %s has %d frames, and %d is plenty (they go by at %s each)", which, v, len(a), maxAnimFrames, animFrame)
+	}
+	return a, nil
+}
+
+// size is the width and height that hold every frame
+func (a animation) size() (int, int) {
+	w, h := 0, 0
+	for _, f := range a {
+		h = max(h, len(f))
+		for _, l := range f {
+			w = max(w, runewidth.StringWidth(l))
+		}
+	}
+	return w, h
+}
+
+// animator plays animations on a layer of their own, one at a time
+type animator struct {
+	scr     *screen
+	area    func() rect
+	playing atomic.Int64 // bumped by each play, so an older one knows to stop
+}
+
+// play runs a, in the background, over what area is at the time; one
+// that's still going gives way to it. Frames are drawn at the size of
+// the biggest, in the middle, so each paints over the one before, and
+// nothing's drawn if they don't fit.
+func (an *animator) play(a animation) {
+	if len(a) == 0 {
+		return
+	}
+	n := an.playing.Add(1)
+	go func() {
+		defer guard()
+		w, h := a.size()
+		an.scr.setLayer("intro", nil) // wipes one that was bigger
+		for _, f := range a {
+			if an.playing.Load() != n {
+				return // the next one has the layer
+			}
+			area := an.area()
+			if w > area.w || h > area.h {
+				break
+			}
+			x, y := area.x+(area.w-w)/2, area.y+(area.h-h)/2
+			an.scr.setLayer("intro", func() string {
+				var b strings.Builder
+				b.WriteString("\0337")
+				for i := range h {
+					line := ""
+					if i < len(f) {
+						line = f[i]
+					}
+					fmt.Fprintf(&b, "\033[%d;%dH%s%s", y+i+1, x+1, ui.box, fitWidth(line, w))
+				}
+				b.WriteString("\033[0m\0338")
+				return b.String()
+			})
+			time.Sleep(animFrame)
+		}
+		if an.playing.Load() == n {
+			an.scr.setLayer("intro", nil)
+		}
+	}()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// key names for the non-printable keys we care about; printable keys
+// are just the character itself
+const (
+	keyUp    = "up"
+	keyDown  = "down"
+	keyLeft  = "left"
+	keyRight = "right"
+	keyEnter = "enter"
+	keyEsc   = "esc"
+	keyCtrlC = "ctrl+c"
+
+	keyBackspace = "backspace"
+)
+
+var escKeys = map[string]string{
+	"\033[A": keyUp, "\033OA": keyUp,
+	"\033[B": keyDown, "\033OB": keyDown,
+	"\033[C": keyRight, "\033OC": keyRight,
+	"\033[D": keyLeft, "\033OD": keyLeft,
+}
+
+// readKeys turns raw stdin bytes into key names
+func readKeys(in io.Reader, keys chan<- string) {
+	defer guard()
+	buf := make([]byte, 64)
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			close(keys)
+			return
+		}
+		chunk := string(buf[:n])
+
+		// a lone escape is the key; anything longer is a sequence
+		if chunk == "\033" {
+			keys <- keyEsc
+			continue
+		}
+		if k, ok := escKeys[chunk]; ok {
+			keys <- k
+			continue
+		}
+		if strings.HasPrefix(chunk, "\033[<") {
+			// mouse reports, maybe several at once
+			for _, seq := range strings.Split(chunk, "\033")[1:] {
+				if k := mouseKey("\033" + seq); k != "" {
+					keys <- k
+				}
+			}
+			continue
+		}
+		if chunk[0] == '\033' {
+			continue // some sequence we don't handle
+		}
+
+		for _, r := range chunk {
+			switch r {
+			case '\r', '\n':
+				keys <- keyEnter
+			case 3:
+				keys <- keyCtrlC
+			case 8, 127:
+				keys <- keyBackspace
+			default:
+				keys <- string(r)
+			}
+		}
+	}
+}
+
+// keyHelp lists the bindings shown by the ? overlay
+var keyHelp = []struct{ key, what string }{
+	{"?", "this help"},
+	{"m", "settings menu"},
+	{"+ / -", "denser / sparser characters"},
+	{"p", "pause / resume your video"},
+	{"x", "next camera (with -camera)"},
+	{"e / o", "pick a filter / turn it off and on (with -filters)"},
+	{"[ / ]", "turn the picked filter down / up"},
+	{"h", "hold / resume the call, video both ways"},
+	{"s", "split: off, side, stacked, auto"},
+	{"f", "focus: one person big, the rest small"},
+	{"c", "caption on your video"},
+	{"1-4", "react: heart, laugh, wow, +1"},
+	{"n", "next stranger (with -match)"},
+	{"b / r", "block / report this stranger"},
+	{"v", "verify the encryption fingerprint"},
+	{"k", "remember the peer's ssh key"},
+	{"y / n", "answer / decline an incoming call"},
+	{"a", "status: available, busy, do not disturb (with -user)"},
+	{"q", "quit"},
+}
+
+// help is the ? overlay: bindings plus current settings, closed by any key
+type help struct {
+	scr  *screen
+	set  *settings
+	open bool
+}
+
+func (h *help) draw() string {
+	var lines []string
+	for _, k := range keyHelp {
+		lines = append(lines, fmt.Sprintf("%-8s %s", k.key, k.what))
+	}
+	lines = append(lines, "")
+	o := h.set.get()
+	for _, it := range menuItems {
+		lines = append(lines, fmt.Sprintf("%-10s %s", it.label, it.value(o)))
+	}
+	lines = append(lines, "", "press any key")
+	return box("help", lines)
+}
+
+func (h *help) handle(k string) bool {
+	if h.open {
+		h.open = false
+		h.scr.setLayer("help", nil)
+		return true
+	}
+	if k == "?" {
+		h.open = true
+		h.scr.setLayer("help", h.draw)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import "fmt"
+
+// ---------- message limits ----------
+
+// Everything a peer sends us passes through the relay unread, so it's
+// checked before we act on it: a size of a billion cells would have us
+// render a frame the size of a city, and a frame of a gigabyte would
+// sit in memory while we sanitized it. Anything out of range is logged
+// and dropped whole, and a message too big for the socket's read limit
+// never gets parsed at all.
+
+const (
+	maxMessage = 8 << 20 // bytes on the wire, sealed or not
+	maxFrame   = 4 << 20 // bytes of ANSI in a frame, thumbnail included
+
+	maxWidth, maxHeight = 1000, 500 // the biggest size anyone can ask for
+	maxCellPixels       = 4         // pixels a cell, across or down, see pixels.go
+	maxText             = 256       // bytes in names, captions and the like
+	maxRenderers        = 16        // names in a size; ones we don't know are fine
+)
+
+// checkMessage reports what's wrong with a peer's message, if anything
+func checkMessage(m Message) error {
+	switch {
+	case fromServer(m.Type) && m.From != 0:
+		// the server stamps what it relays with who it's from, and what it
+		// says itself with nobody, so a peer can't pass as it
+		return fmt.Errorf("%s is the server's to send", m.Type)
+	case m.Width < 0 || m.Width > maxWidth || m.Height < 0 || m.Height > maxHeight:
+		return fmt.Errorf("size %dx%d out of range", m.Width, m.Height)
+	case len(m.Frame)+len(m.Thumb) > maxFrame:
+		return fmt.Errorf("frame of %d bytes", len(m.Frame)+len(m.Thumb))
+	case m.ThumbW < 0 || m.ThumbW > maxWidth || m.ThumbH < 0 || m.ThumbH > maxHeight:
+		return fmt.Errorf("thumbnail %dx%d out of range", m.ThumbW, m.ThumbH)
+	case m.Scale < 0 || m.Scale > 4:
+		return fmt.Errorf("scale %d out of range", m.Scale)
+	case m.CellW < 0 || m.CellW > maxCellPixels || m.CellH < 0 || m.CellH > maxCellPixels:
+		return fmt.Errorf("cell of %dx%d pixels out of range", m.CellW, m.CellH)
+	case m.PixW < 0 || m.PixW > maxWidth*maxCellPixels || m.PixH < 0 || m.PixH > maxHeight*maxCellPixels:
+		return fmt.Errorf("pixel grid %dx%d out of range", m.PixW, m.PixH)
+	case m.Aspect != 0 && (m.Aspect < 0.5 || m.Aspect > 4):
+		return fmt.Errorf("cell aspect %g out of range", m.Aspect)
+	case len(m.Renderers) > maxRenderers:
+		return fmt.Errorf("%d renderers", len(m.Renderers))
+	case len(m.Name) > maxText || len(m.Caption) > maxText || len(m.Clock) > maxText || len(m.Reaction) > maxText || len(m.Colors) > maxText || len(m.Trace) > maxText ||
+		len(m.User) > maxText || len(m.Room) > maxText || len(m.Text) > maxText || len(m.Status) > maxText:
+		return fmt.Errorf("text over %d bytes", maxText)
+	}
+	return nil
+}
+
+// fromServer reports whether only the server sends messages of type t
+func fromServer(t MessageType) bool {
+	switch t {
+	case MsgTypeJoined, MsgTypeLeft, MsgTypeWaiting, MsgTypeMix, MsgTypeScheduled, MsgTypeInvite, MsgTypeCalling,
+		MsgTypeUnreachable, MsgTypeRefused, MsgTypeDeclined, MsgTypeCancelled:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ---------- room listing ----------
+
+// "asciichat-client rooms" lists the public rooms on the server, the
+// ones made with -public or through the API with "public": true, and
+// then the rooms we've been in lately. Private rooms never show up: a
+// room's code is all it takes to get in.
+
+// publicRoom is one entry of the server's GET /api/rooms
+type publicRoom struct {
+	Code    string     `json:"code"`
+	Clients int        `json:"clients"`
+	Viewers int        `json:"viewers"`
+	Opens   *time.Time `json:"opens"`
+}
+
+func runRooms(args []string) {
+	fs := flag.NewFlagSet("rooms", flag.ExitOnError)
+	server := fs.String("server", defaultServer, "Relay to list the rooms of")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: asciichat-client rooms [-server url]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	rooms, err := listRooms(*server)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	if len(rooms) == 0 {
+		fmt.Println("no public rooms right now")
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, r := range rooms {
+			fmt.Fprintf(tw, "%s\t%s\n", r.Code, r.describe())
+		}
+		tw.Flush()
+	}
+
+	if recent := loadState().Rooms; len(recent) > 0 {
+		fmt.Println("\nrecent:")
+		for _, r := range recent {
+			fmt.Println(" ", r)
+		}
+	}
+}
+
+// listRooms asks the server for its public rooms
+func listRooms(server string) ([]publicRoom, error) {
+	u, err := altURL(server, "/api/rooms", false)
+	if err != nil {
+		return nil, err
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rooms: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list rooms: %s (the server may be too old to list them)", resp.Status)
+	}
+	var rooms []publicRoom
+	if err := json.NewDecoder(resp.Body).Decode(&rooms); err != nil {
+		return nil, fmt.Errorf("failed to list rooms: %w", err)
+	}
+	return rooms, nil
+}
+
+// describe is who's in a room, or when it opens
+func (r publicRoom) describe() string {
+	if r.Opens != nil && time.Now().Before(*r.Opens) {
+		return "opens " + r.Opens.Local().Format("Mon Jan 2 15:04")
+	}
+	var who []string
+	switch r.Clients {
+	case 0:
+		who = append(who, "empty")
+	case 1:
+		who = append(who, "1 person")
+	default:
+		who = append(who, fmt.Sprintf("%d people", r.Clients))
+	}
+	if r.Viewers > 0 {
+		who = append(who, fmt.Sprintf("%d watching", r.Viewers))
+	}
+	return strings.Join(who, ", ")
+}
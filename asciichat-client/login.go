@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// ---------- login ----------
+
+// A hosted relay can ask people to log in. "asciichat-client login"
+// fetches where from the server (GET /api/auth) and runs the OAuth
+// device flow: it prints a short code and a URL, you approve it in a
+// browser, on any device, and we save the token we get back in
+// logins.json in the config directory. Every connection to that server
+// then sends it as "Authorization: Bearer", refreshing it first when
+// it's run out. -header Authorization wins over a saved login.
+
+// errLogin means the server turned us away for want of a login
+var errLogin = errors.New("login needed")
+
+func loginNeeded() error {
+	return fmt.Errorf("%w: the server wants you to log in; run \"asciichat-client login\"", errLogin)
+}
+
+// authConfig is what the server's GET /api/auth says
+type authConfig struct {
+	ClientID  string   `json:"client_id"`
+	DeviceURL string   `json:"device_url"`
+	TokenURL  string   `json:"token_url"`
+	Scopes    []string `json:"scopes"`
+}
+
+func (a authConfig) oauth() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID: a.ClientID,
+		Scopes:   a.Scopes,
+		Endpoint: oauth2.Endpoint{DeviceAuthURL: a.DeviceURL, TokenURL: a.TokenURL},
+	}
+}
+
+// savedLogin is one server's entry in logins.json
+type savedLogin struct {
+	Auth  authConfig    `json:"auth"`
+	Token *oauth2.Token `json:"token"`
+}
+
+func runLogin(args []string) {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	server := fs.String("server", defaultServer, "Relay to log in to")
+	logout := fs.Bool("logout", false, "Forget the saved login instead")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: asciichat-client login [-server url] [-logout]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	if *logout {
+		if err := saveLogin(*server, nil); err != nil {
+			fail(err)
+		}
+		fmt.Println("logged out of", *server)
+		return
+	}
+
+	auth, err := fetchAuth(*server)
+	if err != nil {
+		fail(err)
+	}
+	cfg := auth.oauth()
+	ctx := context.Background()
+	da, err := cfg.DeviceAuth(ctx)
+	if err != nil {
+		fail(fmt.Errorf("failed to start logging in: %w", err))
+	}
+	if da.VerificationURIComplete != "" {
+		fmt.Printf("To log in, open %s\nand check it shows the code %s\n", da.VerificationURIComplete, da.UserCode)
+	} else {
+		fmt.Printf("To log in, open %s\nand enter the code %s\n", da.VerificationURI, da.UserCode)
+	}
+	fmt.Println("Waiting for you to approve it...")
+	tok, err := cfg.DeviceAccessToken(ctx, da)
+	if err != nil {
+		fail(fmt.Errorf("login didn't go through: %w", err))
+	}
+	if err := saveLogin(*server, &savedLogin{Auth: auth, Token: tok}); err != nil {
+		fail(err)
+	}
+	fmt.Println("Logged in.")
+}
+
+// fetchAuth asks the server how to log in to it
+func fetchAuth(server string) (authConfig, error) {
+	var auth authConfig
+	u, err := altURL(server, "/api/auth", false)
+	if err != nil {
+		return auth, err
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return auth, fmt.Errorf("failed to reach the server: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return auth, fmt.Errorf("%s doesn't have logins", server)
+	case resp.StatusCode != http.StatusOK:
+		return auth, fmt.Errorf("failed to ask the server how to log in: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return auth, fmt.Errorf("failed to ask the server how to log in: %w", err)
+	}
+	return auth, nil
+}
+
+// ---------- saved logins ----------
+
+func loginsPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "logins.json"), nil
+}
+
+// loginKey is the server a login is for, whatever the transport:
+// scheme, host and base path
+func loginKey(server string) string {
+	u, err := altURL(server, "", false)
+	if err != nil {
+		return server
+	}
+	u.RawQuery = ""
+	return u.String()
+}
+
+var loginsMu sync.Mutex
+
+func loadLogins() map[string]savedLogin {
+	logins := make(map[string]savedLogin)
+	if path, err := loginsPath(); err == nil {
+		if b, err := os.ReadFile(path); err == nil {
+			json.Unmarshal(b, &logins)
+		}
+	}
+	return logins
+}
+
+// saveLogin stores server's login, or with nil, forgets it
+func saveLogin(server string, l *savedLogin) error {
+	loginsMu.Lock()
+	defer loginsMu.Unlock()
+
+	logins := loadLogins()
+	if l == nil {
+		delete(logins, loginKey(server))
+	} else {
+		logins[loginKey(server)] = *l
+	}
+	path, err := loginsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	b, _ := json.MarshalIndent(logins, "", "  ")
+	return os.WriteFile(path, append(b, '\n'), 0o600) // tokens: ours alone
+}
+
+// loginFor is the token source for server's saved login, nil if we
+// haven't logged in there. It refreshes the token when it runs out and
+// saves the new one.
+func loginFor(server string) oauth2.TokenSource {
+	l, ok := loadLogins()[loginKey(server)]
+	if !ok || l.Token == nil {
+		return nil
+	}
+	src := l.Auth.oauth().TokenSource(context.Background(), l.Token)
+	return &savingSource{server: server, login: l, src: src}
+}
+
+// savingSource writes the token back whenever it changes
+type savingSource struct {
+	mu     sync.Mutex
+	server string
+	login  savedLogin
+	src    oauth2.TokenSource
+}
+
+func (s *savingSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tok, err := s.src.Token()
+	var refused *oauth2.RetrieveError
+	if errors.As(err, &refused) || err != nil && s.login.Token.RefreshToken == "" {
+		return nil, fmt.Errorf("%w: the saved login has run out (%v); run \"asciichat-client login\" again", errLogin, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh the login: %w", err)
+	}
+	if tok.AccessToken != s.login.Token.AccessToken {
+		s.login.Token = tok
+		saveLogin(s.server, &s.login)
+	}
+	return tok, nil
+}
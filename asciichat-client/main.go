@@ -1,137 +1,927 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"image"
+	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"gocv.io/x/gocv"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/oauth2"
 	"golang.org/x/term"
 )
 
-// connectWS connects to the given ws:// or wss:// URL and returns the connection
-func connectWS(addr string) *websocket.Conn {
-	u := url.URL{Scheme: "wss", Host: addr, Path: "/ws"}
+// endpoint is where and how we connect
+type endpoint struct {
+	server   string
+	query    url.Values
+	header   http.Header // sent with the upgrade, e.g. auth for a proxy in front of the server
+	compress bool        // ask for permessage-deflate
+	adapt    bool        // ask for it anyway, for congestion control to turn on
+
+	transport string // see transport.go; empty for auto
+
+	login oauth2.TokenSource // a saved login's token, see login.go; nil for none
+	user  *account           // who we sign in as, see contacts.go; nil for nobody
+}
+
+// connectWS connects to the server's room and returns the connection,
+// plus the headers the server answered with. A network that isn't up yet
+// or a DNS blip is common at launch, so it keeps trying with a countdown
+// until timeout (0 = forever).
+func connectWS(ep endpoint, timeout time.Duration) (wire, http.Header, error) {
+	start := time.Now()
+	wait := time.Second
+	for {
+		c, hdr, err := dial(ep)
+		if err == nil {
+			return c, hdr, nil
+		}
+		if hopeless(err) {
+			log.Fatal(err)
+		}
+		if timeout > 0 && time.Since(start)+wait > timeout {
+			return nil, nil, fmt.Errorf("%w; gave up after %s", err, time.Since(start).Round(time.Second))
+		}
+		for left := wait; left > 0; left -= time.Second {
+			fmt.Fprintf(os.Stderr, "\r\033[K%v; retrying in %s (Ctrl+C to quit)", err, left)
+			time.Sleep(time.Second)
+		}
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		wait = backoff(wait)
+	}
+}
+
+// errIncompatible means retrying won't help: the server speaks another
+// version of the protocol
+var errIncompatible = errors.New("incompatible server")
+
+// hopeless reports whether an attempt failed in a way another won't fix
+func hopeless(err error) bool {
+	return errors.Is(err, errIncompatible) || errors.Is(err, errLogin)
+}
+
+// dialWS makes one attempt over a websocket
+func dialWS(ep endpoint) (wire, http.Header, error) {
+	u, err := url.Parse(ep.server)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad -server URL: %w", err)
+	}
+	u.RawQuery = ep.query.Encode()
 	log.Printf("connecting to %s", u.String())
 
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{subprotocol}
+	dialer.EnableCompression = ep.compress || ep.adapt
+	c, resp, err := dialer.Dial(u.String(), ep.header)
 	if err != nil {
-		log.Fatalf("failed to connect to websocket: %v", err)
+		if resp != nil && resp.StatusCode == http.StatusUpgradeRequired {
+			return nil, nil, fmt.Errorf("%w: the server speaks a different protocol version than this client (%s); time to update", errIncompatible, subprotocol)
+		}
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return nil, nil, loginNeeded()
+		}
+		return nil, nil, fmt.Errorf("failed to connect to websocket: %w", err)
 	}
-	return c
+	if c.Subprotocol() != subprotocol {
+		c.Close()
+		return nil, nil, fmt.Errorf("%w: server didn't agree to %s, it's probably too old for this client", errIncompatible, subprotocol)
+	}
+	c.SetReadLimit(maxMessage)
+	return c, resp.Header, nil
 }
 
-var asciiChars = []byte(" .:-=+*#%@")
+// subprotocol is the wire protocol version, negotiated during the upgrade
+const subprotocol = "faceterm.v1"
 
 type MessageType string
 
 const (
 	MsgTypeSize  MessageType = "size"
 	MsgTypeFrame MessageType = "frame"
+
+	// echoed by the peer to measure round trip time
+	MsgTypePing MessageType = "ping"
+	MsgTypePong MessageType = "pong"
+
+	// sent by the server
+	MsgTypeJoined MessageType = "joined"
+	MsgTypeLeft   MessageType = "left"
+
+	// matchmaking: we ask for the next stranger, the server says when
+	// we're back in the pool
+	MsgTypeNext    MessageType = "next"
+	MsgTypeWaiting MessageType = "waiting"
+
+	// never match me with this peer again / flag them to the operator
+	MsgTypeBlock  MessageType = "block"
+	MsgTypeReport MessageType = "report"
+
+	// end-to-end key exchange, see e2e.go
+	MsgTypeHello MessageType = "hello"
+
+	// a heart or the like, floated over our video, see reaction.go
+	MsgTypeReaction MessageType = "reaction"
+
+	// everyone else tiled into one frame by the server, with -mix
+	MsgTypeMix MessageType = "mix"
+
+	// who we're watching most closely, so the server can thin out
+	// everyone else's frames; id 0 for nobody
+	MsgTypeFocus MessageType = "focus"
+
+	// the room is booked for later; Time says when it opens, and until
+	// then we wait outside
+	MsgTypeScheduled MessageType = "scheduled"
+
+	// calling someone by name, see contacts.go: the callee's invite to
+	// the caller's room, and the caller's answer that it went out, or
+	// that they're not online; refused says why the server hung up
+	MsgTypeInvite      MessageType = "invite"
+	MsgTypeCalling     MessageType = "calling"
+	MsgTypeUnreachable MessageType = "unreachable"
+	MsgTypeRefused     MessageType = "refused"
+
+	// ringing, see ring.go: the callee turning a call down, the caller
+	// hearing so, and the callee hearing the caller hung up
+	MsgTypeDecline   MessageType = "decline"
+	MsgTypeDeclined  MessageType = "declined"
+	MsgTypeCancelled MessageType = "cancelled"
+
+	// the sender put the call on hold, or with Held false, took it off;
+	// see hold.go
+	MsgTypeHold MessageType = "hold"
+
+	// how available we are for calls, to the server
+	MsgTypeStatus MessageType = "status"
 )
 
-const serverAddress = "asciichat.cadenmilne.com"
+const defaultServer = "wss://asciichat.cadenmilne.com/ws"
 
 type Message struct {
 	Type   MessageType `json:"type"`
 	Width  int         `json:"width,omitempty"`
 	Height int         `json:"height,omitempty"`
 	Frame  string      `json:"frame,omitempty"`
+	Name   string      `json:"name,omitempty"`
+	Time   int64       `json:"time,omitempty"`   // unix nanoseconds, for ping/pong
+	Colors string      `json:"colors,omitempty"` // color depth the sender's terminal can show
+	Peer   string      `json:"peer,omitempty"`   // anonymous id of a matched stranger
+	Key    []byte      `json:"key,omitempty"`    // X25519 public key, in hellos
+	Data   []byte      `json:"data,omitempty"`   // nonce + ciphertext, in sealed messages
+	Sig    []byte      `json:"sig,omitempty"`    // ssh signature, in identities
+
+	// addressing, in rooms of more than two, see peers.go
+	From uint64 `json:"from,omitempty"` // stamped by the server
+	To   uint64 `json:"to,omitempty"`   // 0 for everyone
+	ID   uint64 `json:"id,omitempty"`   // who joined or left
+
+	NoFrames bool `json:"noframes,omitempty"` // in sizes: the sender is broadcast only, don't render for it
+	Light    bool `json:"light,omitempty"`    // in sizes: the sender's terminal has a light background
+
+	Reaction string `json:"reaction,omitempty"` // which one, by name
+
+	// with -simulcast, a smaller rendition of the frame, and its size
+	Thumb  string `json:"thumb,omitempty"`
+	ThumbW int    `json:"thumbw,omitempty"`
+	ThumbH int    `json:"thumbh,omitempty"`
+
+	Scale int `json:"scale,omitempty"` // in frames: rendered this many times too small, to save bandwidth; enlarge it
+
+	// with -pixels, see pixels.go: in sizes, the pixels in each of the
+	// sender's cells; in frames, the picture and what goes on top of it
+	CellW   int    `json:"cellw,omitempty"`
+	CellH   int    `json:"cellh,omitempty"`
+	Pixels  []byte `json:"pixels,omitempty"`
+	PixW    int    `json:"pixw,omitempty"`
+	PixH    int    `json:"pixh,omitempty"`
+	Caption string `json:"caption,omitempty"`
+	Clock   string `json:"clock,omitempty"`
+
+	// in sizes: the renderers the sender's terminal can draw (none for
+	// any), and its cells' height over their width, if it knows
+	Renderers []string `json:"renderers,omitempty"`
+	Aspect    float64  `json:"aspect,omitempty"`
+
+	Trace string `json:"trace,omitempty"` // in frames: W3C traceparent, if traced, see tracing.go
+
+	// in invites and calls: who, and the room; in refusals: why
+	User string `json:"user,omitempty"`
+	Room string `json:"room,omitempty"`
+	Text string `json:"text,omitempty"`
+
+	Status string `json:"status,omitempty"` // in statuses, and calls: available, busy or dnd
+
+	Held bool `json:"held,omitempty"` // in holds: on hold, or off it
 }
 
-func processFrame(img gocv.Mat, width, height int, color bool) string {
-	// Flip horizontally (mirror)
-	flipped := gocv.NewMat()
-	gocv.Flip(img, &flipped, 1)
-	defer flipped.Close()
-
-	// Resize to terminal size (*2 for aspect correction)
-	resized := gocv.NewMat()
-	gocv.Resize(flipped, &resized, image.Point{X: width, Y: height * 2}, 0, 0, gocv.InterpolationArea)
-	defer resized.Close()
-
-	// Convert to ASCII
-	var ascii string
-	if color {
-		ascii = matToASCIIColor(resized)
-	} else {
-		ascii = matToASCII(resized)
-	}
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
 
-	return ascii
+// ringBell beeps and briefly flashes the screen (reverse video); the
+// flash goes straight to the terminal, tmux and screen can't do it
+func ringBell() {
+	fmt.Print("\a" + passthrough("\033[?5h"))
+	time.Sleep(150 * time.Millisecond)
+	fmt.Print(passthrough("\033[?5l"))
 }
 
-func sendTerminalSize(ws *websocket.Conn, width, height int) {
-	msg := Message{
-		Type:   MsgTypeSize,
-		Width:  width,
-		Height: height,
-	}
-	b, _ := json.Marshal(msg)
-	if err := ws.WriteMessage(websocket.TextMessage, b); err != nil {
-		log.Println("write size error:", err)
+// handleKeys dispatches key presses: open overlays get first pick
+func handleKeys(keys <-chan string, scr *screen, set *settings, state *callState, peers *peerSet, msgCh chan<- Message, match bool, buttons func() []button, ring *ringing, cams *switcher, quit chan<- struct{}) {
+	defer guard()
+	h := &help{scr: scr, set: set}
+	m := &menu{scr: scr, set: set}
+	v := &verify{scr: scr, peers: peers}
+	c := &prompt{scr: scr, set: set}
+	for k := range keys {
+		// a click on a status line button is its key
+		if x, y, ok := parseClick(k); ok {
+			w, h, err := term.GetSize(int(os.Stdout.Fd()))
+			if err != nil || y != h || c.open || buttons == nil {
+				continue
+			}
+			if k = buttonAt(buttons(), x, w); k == "" {
+				continue
+			}
+		}
+
+		// a caption being typed takes every key; otherwise c opens it
+		// like any other overlay
+		if ring.handle(k) || c.open && c.handle(k) || h.handle(k) || m.handle(k) || v.handle(k) || c.handle(k) {
+			continue
+		}
+		switch k {
+		case "q", keyCtrlC:
+			close(quit)
+			return
+		case "n":
+			if match {
+				msgCh <- Message{Type: MsgTypeNext}
+				scr.toast("finding someone new...")
+			}
+		case "k":
+			var pub ssh.PublicKey
+			if p := peers.primary(); p != nil {
+				pub = p.sess.identityKey()
+			}
+			if pub == nil {
+				scr.toast("the peer hasn't shown an ssh key")
+				continue
+			}
+			name := state.name()
+			if err := rememberPeer(name, pub); err != nil {
+				scr.toast("couldn't save: " + err.Error())
+				continue
+			}
+			state.setIdentity(ssh.FingerprintSHA256(pub), knownPeer(pub))
+			scr.toast("remembered " + name)
+		case "b", "r": // block or report; either way we never see them again
+			peer := state.peer()
+			if !match || peer == "" {
+				continue
+			}
+			if err := saveBlocked(peer); err != nil {
+				log.Println("saving block list:", err)
+			}
+			if k == "r" {
+				msgCh <- Message{Type: MsgTypeReport, Peer: peer}
+				scr.toast("reported and blocked")
+			} else {
+				msgCh <- Message{Type: MsgTypeBlock, Peer: peer}
+				scr.toast("blocked")
+			}
+		case "a":
+			st := state.cycleStatus()
+			msgCh <- Message{Type: MsgTypeStatus, Status: st}
+			scr.toast("status: " + statusNames[st])
+		case "1", "2", "3", "4":
+			if r, ok := reactionKey(k); ok {
+				msgCh <- Message{Type: MsgTypeReaction, Reaction: r.name}
+				scr.toast("sent " + r.name)
+			}
+		case "p":
+			set.update(func(o *options) { o.Paused = !o.Paused })
+			if set.get().Paused {
+				scr.toast("video paused")
+			} else {
+				scr.toast("video resumed")
+			}
+			scr.redrawLayers() // the button changes
+		case "h":
+			held := state.toggleHold()
+			for _, p := range peers.list() {
+				msgCh <- holdMsg(p.id, held)
+			}
+			scr.clearFrames()
+			if held {
+				scr.toast("call on hold")
+			} else {
+				scr.toast("call resumed")
+			}
+		case "x": // the next camera
+			if cams == nil {
+				scr.toast("no other cameras: add them with -camera")
+				continue
+			}
+			name, err := cams.next()
+			if err != nil {
+				scr.toast(err.Error())
+			} else {
+				scr.toast("sending " + name)
+			}
+		case "e", "o", "[", "]": // the filters, see filters.go
+			if userFilters == nil || len(userFilters.filters) == 0 {
+				scr.toast("no filters: add them with -filters")
+				continue
+			}
+			switch k {
+			case "e":
+				scr.toast(userFilters.pick())
+			case "o":
+				scr.toast(userFilters.toggle())
+			case "[":
+				scr.toast(userFilters.adjust(-1))
+			case "]":
+				scr.toast(userFilters.adjust(1))
+			}
+			scr.redrawLayers() // the status line lists them
+		case "f": // give someone the big tile
+			if len(peers.list()) < 2 {
+				scr.toast("focus needs three or more in the room")
+				continue
+			}
+			id := peers.cycleFocus()
+			msgCh <- Message{Type: MsgTypeFocus, ID: id}
+			if id == 0 {
+				scr.toast("focus off")
+			} else {
+				scr.toast(fmt.Sprintf("focus on #%d", id))
+			}
+		case "s": // pick the split yourself
+			set.update(func(o *options) { o.Split = cycle(o.Split, len(splitNames), 1) })
+			scr.toast("split: " + splitNames[set.get().Split])
+		case "+", "=": // denser ramp
+			set.update(func(o *options) { o.Charset = min(o.Charset+1, len(charsets)-1) })
+			scr.toast("charset: " + charsets[set.get().Charset].name)
+		case "-", "_": // sparser ramp
+			set.update(func(o *options) { o.Charset = max(o.Charset-1, 0) })
+			scr.toast("charset: " + charsets[set.get().Charset].name)
+		}
 	}
 }
 
-var latestRemoteFrame atomic.Value // stores string
-
 func main() {
 
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		runExport(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		runDoctor(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bot" {
+		runBot(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rooms" {
+		runRooms(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "contacts" {
+		runContacts(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		again := runHistory(os.Args[2:])
+		if again == nil {
+			return
+		}
+		os.Args = append([]string{os.Args[0]}, again...)
+	}
+	if len(os.Args) > 2 && os.Args[1] == "call" {
+		// "call alice [flags]" is -call alice
+		os.Args = append(append([]string{os.Args[0]}, os.Args[3:]...), "-call", os.Args[2])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "login" {
+		runLogin(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "setup" {
+		if _, err := runSetup(defaultServer); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Handle cli args
 	device := flag.Int("device", -1, "A device number from ffmpeg's list")
-	color := flag.Bool("color", false, "Use color or not?")
+	color := flag.Bool("color", false, "Use color or not? (same as -colors truecolor)")
+	colors := flag.String("colors", "auto", "Color depth to send: auto (whatever the peer's terminal supports), truecolor, 256, 16 or mono")
+	quant := flag.String("quantizer", "perceptual", "How 256/16 colors are picked: nearest, perceptual (CIELAB) or websafe")
+	dither := flag.String("dither", "none", "Dithering: none or ordered (Bayer)")
+	quality := flag.String("quality", "", "Preset for fps, resolution, colors and compression: low, medium or high (other flags override it)")
+	fps := flag.Int("fps", 30, "Most frames per second to send")
+	captureSize := flag.String("capture-size", "", "Ask the camera for this resolution, e.g. 640x480, instead of its default (often far more than a terminal shows)")
+	captureFPS := flag.Int("capture-fps", 0, "Ask the camera for this frame rate (0 = its default)")
+	themeName := flag.String("theme", "default", "Colors and borders for the status line, banners and boxes: default, ascii, ocean, amber, or a theme file (see theme.go)")
+	filters := flag.String("filters", "", "Built-in filters for your video, in order, with any settings, e.g. \"denoise, autolevel, facecrop zoom=2, sepia amount=0.6\" (see filters.go)")
+	markPath := flag.String("watermark", "", "Image (PNG, JPEG, GIF) or ASCII art file to put in a corner of your video")
+	markCorner := flag.String("watermark-corner", "bottom-right", "Where the -watermark goes: bottom-right, bottom-left, top-right or top-left")
+	markOpacity := flag.Float64("watermark-opacity", 0.8, "How solid the -watermark is, 0 to 1")
+	markSize := flag.Float64("watermark-size", 0.2, "How wide a -watermark image is, as a fraction of your video's width")
+	introAnim := flag.String("intro", "logo", "Animation over the video when a call connects: logo, off, or a text file of frames with a line of --- between them")
+	outroAnim := flag.String("outro", "logo", "Animation when the call ends, like -intro")
+	pluginCmd := flag.String("plugin", "", "Program to pipe your video through, frame by frame, e.g. ./myfilter (see plugin.go for what it reads and writes)")
+	scriptPath := flag.String("script", "", "Starlark file to filter your video with before it's sent: it defines pixels(frame) and/or cells(frame) (see script.go)")
+	mjpeg := flag.Bool("mjpeg", true, "Ask the camera for MJPEG and decode only as much of it as we need: much less CPU than raw video on small machines like a Raspberry Pi")
+	compress := flag.Bool("compress", false, "Compress the connection (permessage-deflate): less bandwidth, more CPU")
+	adapt := flag.Bool("adapt", true, "Cut frame rate, colors and resolution while the connection can't keep up, and bring them back when it can")
+	invert := flag.Bool("invert", false, "Light terminal background: ask for frames with the brightness ramp reversed (detected when not given)")
+	maxCols := flag.Int("max-cols", 0, "Never render or ask for frames wider than this, to save bandwidth and CPU (0 = terminal width)")
+	maxRows := flag.Int("max-rows", 0, "Never render or ask for frames taller than this (0 = terminal height)")
+	zoom := flag.Int("zoom", 1, "Low-vision mode: draw each of the peer's pixels as an n x n block of cells (1 to 4, 1 is off)")
+	pal := flag.String("palette", "none", "Recolor the peer's video for color blindness: none, deuteranopia, protanopia or tritanopia")
+	split := flag.String("split", "off", "Show your own camera next to the call: off, side (left/right), stacked (top/bottom) or auto (by the terminal's shape)")
+	mode := flag.String("mode", "ascii", "Renderer: ascii, quadrant (2x2 blocks), sextant (2x3 blocks, needs a Unicode 13 font), bg (colored cells) or halfblock (two colored pixels per cell)")
+	server := flag.String("server", defaultServer, "Relay websocket URL, including any base path (e.g. wss://example.com/faceterm/ws)")
+	room := flag.String("room", "", "Room code to join (default: the shared lobby)")
+	public := flag.Bool("public", false, "If -room makes a new room, list it for anyone to find with \"asciichat-client rooms\"")
+	var cameras stringList
+	flag.Var(&cameras, "camera", `Another video source to switch to with x: a device number, a path or URL, or "screen" to share the screen through ffmpeg (repeatable)`)
+	var headers stringList
+	flag.Var(&headers, "header", `Extra header for the connection, e.g. "Authorization: Bearer <token>" (repeatable)`)
+	transport := flag.String("transport", transportAuto, "How to reach the relay: websocket, webtransport (HTTP/3 over UDP, if the server runs -webtransport), sse (server-sent events and posts, plain HTTP), or auto to fall back from one to the next when the websocket won't connect")
+	connectTimeout := flag.Duration("connect-timeout", time.Minute, "Keep trying to reach the server at startup for this long (0 = forever)")
+	e2e := flag.Bool("e2e", true, "Encrypt the call end to end (web and ssh viewers can't watch an encrypted call)")
+	identityPath := flag.String("identity", "", "SSH private key to prove who you are to the peer (e.g. ~/.ssh/id_ed25519)")
+	user := flag.String("user", "", "Sign in to a server with accounts under this name, with the -identity key, so people can call you by it")
+	status := flag.String("status", statusAvailable, "With -user, how available you are for calls: available, busy (calls ring without the bell) or dnd (callers are told, and you don't hear of it); a changes it")
+	callee := flag.String("call", "", "Call someone signed in with -user, by name or contact, in a fresh room of our own")
+	match := flag.Bool("match", false, "Get paired with a random stranger instead of joining a room; n skips to the next")
+	name := flag.String("name", os.Getenv("USER"), "Name shown to the peer")
+	bell := flag.Bool("bell", true, "Ring the bell and flash the screen when the peer joins")
+	notify := flag.Bool("notify", false, "Show desktop notifications when the peer joins or leaves")
+	record := flag.String("record", "", "Record the call to a file")
+	clock := flag.String("clock", "off", "Burn a clock into your video: off, time (local), elapsed (call length) or both")
+	caption := flag.String("caption", "", "Caption burned into the bottom of your video (c changes it mid-call)")
+	recordFormat := flag.String("record-format", "auto", "Recording format: cast (asciinema), ttyrec, or auto from the file extension")
+	noSend := flag.Bool("no-send", false, "Watch only: don't open a camera or send video")
+	stdout := flag.Bool("stdout", false, "Write the peer's frames to stdout as plain ANSI, one after another, for pipes and files (no screen handling or keys)")
+	simulcast := flag.Bool("simulcast", false, "In rooms of three or more, send each frame once at full size plus a thumbnail, instead of once per person (needs -e2e=false)")
+	mix := flag.Bool("mix", false, "Ask the server for everyone's video tiled into one stream, for big rooms on slow machines (needs -e2e=false)")
+	teeInPath := flag.String("tee-in", "", "Copy the video we receive, as ANSI, to this file (latest frame) or named pipe (every frame)")
+	teeOutPath := flag.String("tee-out", "", "Copy the video we send, as ANSI, to this file or named pipe")
+	mouse := flag.Bool("mouse", true, "Clickable buttons on the status line (turn off to select text with the mouse)")
+	input := flag.String("input", "", `Video source instead of a camera: "-" for stdin (y4m, or raw with -input-format)`)
+	inputFormat := flag.String("input-format", "y4m", "Format of -input: y4m, or raw bgr24, rgb24, gray or yuv420p")
+	inputSize := flag.String("input-size", "", "Frame size of raw -input, e.g. 640x480")
+	noRecv := flag.Bool("no-recv", false, "Broadcast only: send video but don't ask for or draw the peer's")
+	pixelGrids := flag.Bool("pixels", false, "Ask peers for pixels instead of text and draw them with our own renderer, charset and colors: about half the bandwidth")
+	statsOut := flag.String("stats-out", "", "Write per-second stats (frames, bytes, round trip, drops) to this file as the call goes: CSV, or JSON lines for .json or .jsonl")
+	otelExporter := flag.String("otel", "", "Report OpenTelemetry traces and metrics of where each frame's time goes: otlp (to OTEL_EXPORTER_OTLP_ENDPOINT) or stderr")
+	otelSample := flag.Float64("otel-sample", 0.01, "Fraction of the frames we send to trace with -otel, from 0 to 1")
 	flag.Parse()
 
+	if *quality != "" {
+		i := presetIndex(*quality)
+		if i < 0 {
+			fmt.Fprintf(os.Stderr, "Error: unknown -quality %q\n", *quality)
+			os.Exit(1)
+		}
+		applyPreset(presets[i])
+	}
+
+	// saved defaults, then what we used last time; the first time, ask
+	saved := loadState()
+	cfg, err := loadConfig()
+	firstRun := *device == -1 && saved.Device == nil && !*noSend && !*stdout && *input == "" && term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+	if os.IsNotExist(err) && firstRun {
+		cfg, err = runSetup(*server)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "config:", err)
+	}
+	applyConfig(cfg)
+	applyConfig(saved.defaults())
+	if *fps < 1 {
+		fmt.Fprintln(os.Stderr, "Error: -fps must be at least 1")
+		os.Exit(1)
+	}
+
+	if *noSend && *noRecv {
+		fmt.Fprintln(os.Stderr, "Error: -no-send and -no-recv together leave nothing to do")
+		os.Exit(1)
+	}
+	if *simulcast && *e2e {
+		fmt.Fprintln(os.Stderr, "Error: -simulcast needs -e2e=false; encrypted frames are sealed for one person each")
+		os.Exit(1)
+	}
+	if *mix && *e2e {
+		fmt.Fprintln(os.Stderr, "Error: -mix needs -e2e=false; the server can't tile video it can't read")
+		os.Exit(1)
+	}
+	if *mix && *pixelGrids {
+		fmt.Fprintln(os.Stderr, "Error: -pixels and -mix don't go together; the server tiles text, not pixels")
+		os.Exit(1)
+	}
+	switch *transport {
+	case transportAuto, transportWebSocket, transportWebTransport, transportSSE:
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown -transport %q, want auto, websocket, webtransport or sse\n", *transport)
+		os.Exit(1)
+	}
+	if *stdout && *noRecv {
+		fmt.Fprintln(os.Stderr, "Error: -stdout writes the frames -no-recv doesn't ask for")
+		os.Exit(1)
+	}
+	if *otelSample < 0 || *otelSample > 1 {
+		fmt.Fprintln(os.Stderr, "Error: -otel-sample must be between 0 and 1")
+		os.Exit(1)
+	}
+	stopOTel, err := setupOTel(*otelExporter, *otelSample)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	defer stopOTel()
+	streaming = *stdout
+
+	var inputW, inputH int
+	if *input != "" {
+		if *input != "-" {
+			fmt.Fprintf(os.Stderr, "Error: -input takes \"-\" for stdin, not %q\n", *input)
+			os.Exit(1)
+		}
+		if *inputFormat != "y4m" && inputFormatIndex(*inputFormat) < 0 {
+			fmt.Fprintf(os.Stderr, "Error: unknown -input-format %q\n", *inputFormat)
+			os.Exit(1)
+		}
+		if *inputSize != "" {
+			if _, err := fmt.Sscanf(*inputSize, "%dx%d", &inputW, &inputH); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: bad -input-size %q, want e.g. 640x480\n", *inputSize)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if capture.w, capture.h, err = parseCaptureSize(*captureSize); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	if capture.fps = *captureFPS; capture.fps < 0 {
+		fmt.Fprintln(os.Stderr, "Error: -capture-fps can't be negative")
+		os.Exit(1)
+	}
+	capture.mjpeg = *mjpeg
+	if *filters != "" {
+		if userFilters, err = parsePipeline(*filters); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+	}
+	if *markPath != "" {
+		if userMark, err = loadWatermark(*markPath, *markCorner, *markOpacity, *markSize); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+	}
+	intro, err := loadAnimation("intro", *introAnim)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	outro, err := loadAnimation("outro", *outroAnim)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	if *pluginCmd != "" {
+		if userPlugin, err = startPlugin(*pluginCmd); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		defer userPlugin.close()
+	}
+	if *scriptPath != "" {
+		if userScript, err = loadScript(*scriptPath); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+	}
+
 	// Check required integer flags
-	if *device == -1 {
+	if *device == -1 && !*noSend && *input == "" {
 		fmt.Fprintln(os.Stderr, "Error: -device flag is required")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	// Handle Ctrl+C gracefully
+	if rendererIndex(*mode) < 0 {
+		fmt.Fprintf(os.Stderr, "Error: unknown -mode %q\n", *mode)
+		os.Exit(1)
+	}
+
+	colorDepth, ok := parseDepth(*colors)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: unknown -colors %q\n", *colors)
+		os.Exit(1)
+	}
+	if *color {
+		colorDepth = depthTrue
+	}
+	if quantizerIndex(*quant) < 0 {
+		fmt.Fprintf(os.Stderr, "Error: unknown -quantizer %q\n", *quant)
+		os.Exit(1)
+	}
+
+	if ditherIndex(*dither) < 0 {
+		fmt.Fprintf(os.Stderr, "Error: unknown -dither %q\n", *dither)
+		os.Exit(1)
+	}
+
+	if *zoom < 1 || *zoom > 4 {
+		fmt.Fprintln(os.Stderr, "Error: -zoom must be between 1 and 4")
+		os.Exit(1)
+	}
+
+	if clockIndex(*clock) < 0 {
+		fmt.Fprintf(os.Stderr, "Error: unknown -clock %q\n", *clock)
+		os.Exit(1)
+	}
+
+	if splitIndex(*split) < 0 {
+		fmt.Fprintf(os.Stderr, "Error: unknown -split %q\n", *split)
+		os.Exit(1)
+	}
+
+	if colorFilterIndex(*pal) < 0 {
+		fmt.Fprintf(os.Stderr, "Error: unknown -palette %q\n", *pal)
+		os.Exit(1)
+	}
+	recolor := newRecolorer(colorFilterIndex(*pal))
+
+	var signer ssh.Signer
+	if *identityPath != "" {
+		var err error
+		if signer, err = loadIdentity(*identityPath); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: -identity:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *user != "" && signer == nil {
+		fmt.Fprintln(os.Stderr, "Error: -user needs -identity, the key to sign in with")
+		os.Exit(1)
+	}
+	if !slices.Contains(statuses, *status) {
+		fmt.Fprintf(os.Stderr, "Error: unknown -status %q\n", *status)
+		os.Exit(1)
+	}
+	if *callee != "" && *user == "" {
+		fmt.Fprintln(os.Stderr, "Error: -call needs -user: calling someone takes an account")
+		os.Exit(1)
+	}
+
+	set := &settings{opts: options{
+		Mode:      rendererIndex(*mode),
+		Depth:     colorDepth,
+		Quantizer: quantizerIndex(*quant),
+		Dither:    ditherIndex(*dither),
+		Charset:   defaultCharset,
+		FPS:       *fps,
+		Mirror:    true,
+		Split:     splitIndex(*split),
+		Caption:   cleanCaption(*caption),
+		Clock:     clockIndex(*clock),
+		MaxCols:   max(0, *maxCols),
+		MaxRows:   max(0, *maxRows),
+	}}
+
+	// remember this run's choices for next time, and the renderer as it
+	// was when we quit
+	if !*noSend {
+		saved.Device = device
+	}
+	saved.Mode = *mode
+	saved.visited(*room)
+	saved.save()
+	defer func() {
+		saved.Mode = renderers[set.get().Mode].name
+		saved.save()
+	}()
+
+	// a call still going when we quit goes in the history too
+	state := &callState{avail: *status, record: func(c callRecord) {
+		if err := recordCall(c); err != nil {
+			log.Println("history:", err)
+		}
+	}}
+	defer state.peerLeft()
+
+	// Put the terminal back however we go: Ctrl+C, kill, hangup or panic
+	defer guard()
+	defer restoreTerminal()
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
 		<-c
-		fmt.Print("\033[?25h")   // show cursor
-		fmt.Print("\033[0m")     // reset colors
-		fmt.Print("\033[?1049l") // exit alt screen
+		restoreTerminal()
+		state.peerLeft()
 		os.Exit(0)
 	}()
 
-	ws := connectWS(serverAddress)
-	defer ws.Close()
+	ep := endpoint{server: *server, query: url.Values{}, header: http.Header{}, compress: *compress, adapt: *adapt, transport: *transport}
+	for _, h := range headers {
+		k, v, ok := strings.Cut(h, ":")
+		if !ok || strings.TrimSpace(k) == "" {
+			fmt.Fprintf(os.Stderr, "Error: -header %q should look like \"Name: value\"\n", h)
+			os.Exit(1)
+		}
+		ep.header.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+	if ep.header.Get("Authorization") == "" {
+		ep.login = loginFor(*server)
+	}
 
-	// Open GoCV webcam
-	webcam, err := gocv.OpenVideoCapture(*device)
-	if err != nil || !webcam.IsOpened() {
-		panic("Unable to open webcam")
+	if *user != "" {
+		ep.user = &account{name: *user, signer: signer}
 	}
-	defer webcam.Close()
 
-	// Alt screen + hide cursor
-	fmt.Print("\033[?1049h") // alt screen
-	fmt.Print("\033[?25l")   // hide cursor
-	defer func() {
-		fmt.Print("\033[?25h")   // show cursor
-		fmt.Print("\033[?1049l") // exit alt screen
-	}()
+	if *room != "" {
+		ep.query.Set("room", *room)
+	}
+	with := "" // the account we're calling, or that called us
+	if *callee != "" {
+		with = accountFor(*callee)
+		ep.query.Set("call", with)
+	}
+	if *public {
+		ep.query.Set("public", "1")
+	}
+	if *match {
+		ep.query.Set("match", "1")
+	}
+	if *mix {
+		ep.query.Set("mix", "1")
+	}
+	ws, hdr, err := connectWS(ep, *connectTimeout)
+	if err != nil && (*noSend || *stdout || !offerMirror(err)) {
+		log.Fatal(err)
+	}
+	cc := &congestion{queue: 10}
+	if *adapt {
+		go cc.run()
+	}
+	conn := &link{ws: ws} // nil while offline; the reader keeps trying
+	if *adapt && !*compress {
+		conn.deflate = cc.deflate
+	}
+	defer conn.close()
+	// the server can shrink one frame for everyone, as long as it can
+	// read it
+	serverScales := hdr.Get("Faceterm-Downscale") == "1" && !*e2e
+	mixing := *mix && hdr.Get("Faceterm-Mix") == "1"
+	if *mix && ws != nil && !mixing {
+		log.Println("the server doesn't mix (-mix on the server); getting everyone's video separately")
+	}
 
-	// Initialize terminal size as this clients size, later it will update w + h from other client
+	// Open GoCV webcam, or stdin, unless we're only watching
+	var webcam source
+	switch {
+	case *noSend:
+	case *input == "-":
+		in, err := newStdinSource(os.Stdin, *inputFormat, inputW, inputH)
+		if err != nil {
+			log.Fatal(err)
+		}
+		webcam = in
+	default:
+		cam, err := openCamera(*device)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		steady := newSteadyCamera(cam, strconv.Itoa(*device)) // survives being unplugged, see camera.go
+		defer steady.Close()
+		webcam = steady
+	}
+	var cams *switcher
+	if webcam != nil && len(cameras) > 0 {
+		first := "camera"
+		switch {
+		case *input == "-":
+			first = "stdin"
+		case *device >= 0:
+			first += " " + strconv.Itoa(*device)
+		}
+		cams = newSwitcher(webcam, first, cameras)
+		defer cams.Close()
+		webcam = cams
+	}
+
+	scr := &screen{out: os.Stdout}
+	if streaming {
+		scr.out = io.Discard // stdout is for frames; toasts and the status go nowhere
+	} else {
+		// Alt screen + hide cursor
+		fmt.Print("\033[?1049h") // alt screen
+		fmt.Print("\033[?25l")   // hide cursor
+		pushTitle()
+		go keepTitle(state)
+	}
+
+	msgCh := make(chan Message, cc.queue) // buffered
+
+	// an answered call hangs up this connection, and the reader redials
+	// into the caller's room
+	answered := make(chan Message, 1)
+	ring := &ringing{scr: scr, msgCh: msgCh, notify: *notify, answer: func(inv Message) {
+		select {
+		case answered <- inv:
+		default:
+		}
+		conn.close()
+	}}
+	sess := newSession()
+	peers := newPeerSet(sess)
+
+	// skips the FPS wait, so whoever just turned up sees us right away
+	sendNow := make(chan struct{}, 1)
+	wake := func() {
+		select {
+		case sendNow <- struct{}{}:
+		default:
+		}
+	}
 
-	var remoteWidth, remoteHeight int
+	// Raw mode so single keys reach us without Enter
+	light := *invert
+	aspect := 0.0 // our cells' height over width, if the terminal says
+	quit := make(chan struct{})
+	var buttons func() []button
+	if *mouse {
+		buttons = func() []button { return statusButtons(set.get().Paused) }
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) && !streaming {
+		if rawState, err = term.MakeRaw(int(os.Stdin.Fd())); err == nil {
+			scr.raw = true
+
+			// -invert unless they said either way
+			invertGiven := false
+			flag.Visit(func(f *flag.Flag) { invertGiven = invertGiven || f.Name == "invert" })
+			reply := ask(backgroundQuery + cellQuery)
+			if !invertGiven {
+				light = lightBackground(reply)
+			}
+			aspect = cellAspect(reply)
+
+			if buttons != nil {
+				fmt.Print(mouseOn)
+			}
+
+			keys := make(chan string, 16)
+			go readKeys(os.Stdin, keys)
+			go handleKeys(keys, scr, set, state, peers, msgCh, *match, buttons, ring, cams, quit)
+		}
+	}
+	if rawState == nil {
+		buttons = nil // nothing would hear the clicks
+	}
+
+	go keepStatus(scr, state, func() []button {
+		if buttons == nil {
+			return nil
+		}
+		return buttons()
+	})
+
+	// Our terminal size; each peer gets a tile of it, and tells us theirs
 	width, height := 80, 40
-	remoteWidth, remoteHeight = width, height // initialize to local size
 	if term.IsTerminal(int(os.Stdout.Fd())) {
 		if w, h, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
 			width = w - 1
@@ -139,63 +929,516 @@ func main() {
 		}
 	}
 
-	sendTerminalSize(ws, width, height)
+	// What our terminal can display; the peer renders to fit it. Until
+	// a peer says otherwise, assume theirs is like ours.
+	localDepth := detectDepth()
+	if ui, err = loadTheme(*themeName, localDepth); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	canDraw := drawable()
+	var cramped atomic.Bool // the terminal's too small to draw video in
 
-	msgCh := make(chan Message, 10) // buffered
+	// where we draw ourselves (with -split) and the room
+	areas := func() (self, remote rect) {
+		if webcam == nil {
+			return rect{}, rect{0, 0, width, height} // nothing of ours to show
+		}
+		return panes(set.get().Split, width, height)
+	}
+	sizeMsg := func(to uint64) Message {
+		// with -zoom the peer sends a smaller frame that we enlarge
+		_, area := areas()
+		r := peers.tile(to, area)
+		if mixing {
+			r = area // the server tiles it for us
+		}
+		w, h := capSize(r.w / *zoom, r.h / *zoom, set.get())
+		m := Message{Type: MsgTypeSize, To: to, Width: w, Height: h, Name: *name, Colors: localDepth.String(), NoFrames: *noRecv, Light: light, Renderers: canDraw, Aspect: aspect}
+		if *pixelGrids {
+			rd := renderers[drawableMode(set.get().Mode, canDraw)]
+			m.CellW, m.CellH = rd.cellW, rd.cellH
+		}
+		return m
+	}
+	// rearrange redoes the tiles after someone comes or goes, and tells
+	// everyone their new size
+	rearrange := func() {
+		scr.clearFrames()
+		for _, p := range peers.list() {
+			msgCh <- sizeMsg(p.id)
+		}
+	}
+
+	go keepOverlay(scr, func() (string, bool) {
+		if cramped.Load() {
+			return "", false
+		}
+		return overlayText(state, peers, *match, !*noRecv), state.waiting()
+	}, func() rect {
+		_, area := areas()
+		return area
+	})
+
+	anim := &animator{scr: scr, area: func() rect {
+		_, area := areas()
+		return area
+	}}
+
+	floats := &floater{scr: scr}
+
+	var teeIn, teeOut *tee
+	if *teeInPath != "" {
+		teeIn = newTee(*teeInPath)
+	}
+	if *teeOutPath != "" {
+		teeOut = newTee(*teeOutPath)
+	}
+
+	var stats *statsLog
+	if *statsOut != "" {
+		if stats, err = openStats(*statsOut); err != nil {
+			fatalf("failed to start writing stats: %v", err)
+		}
+		defer stats.close()
+	}
+
+	var rec recorder
+	if *record != "" {
+		rec, err = newRecorder(*record, *recordFormat, width+1, height+1)
+		if err != nil {
+			fatalf("failed to start recording: %v", err)
+		}
+		defer rec.Close()
+	}
 
 	// Writer goroutine
 	go func() {
-		for m := range msgCh {
-			b, _ := json.Marshal(m)
-			if err := ws.WriteMessage(websocket.TextMessage, b); err != nil {
-				log.Println("write error:", err)
-				return
+		defer guard()
+		for msg := range msgCh {
+			frame := msg.Type == MsgTypeFrame
+			for _, m := range peers.wire(msg, *e2e) {
+				b, _ := json.Marshal(m)
+				start := time.Now()
+				sent := func() {}
+				if frame {
+					_, sent = stage(traced(m.Trace), "send", sendTime)
+				}
+				// while we're reconnecting this fails, and the message is lost
+				err := conn.write(b)
+				sent()
+				if err != nil {
+					log.Println("write error:", err)
+					stats.dropped()
+					continue
+				}
+				stats.sent(len(b), frame)
+				if frame {
+					state.frameSent()
+					cc.wrote(time.Since(start), len(msgCh))
+				}
 			}
 		}
 	}()
 
+	// greet introduces us to the room, on the first connection and on
+	// every reconnect
+	greet := func() {
+		state.setPlace(callRecord{Server: *server, Room: ep.query.Get("room"), Match: ep.query.Has("match"), User: with})
+		if *user != "" {
+			msgCh <- Message{Type: MsgTypeStatus, Status: state.myStatus()}
+		}
+		msgCh <- sizeMsg(0)
+
+		// Offer our key to whoever is already here
+		if *e2e {
+			msgCh <- sess.hello()
+		}
+
+		// Tell the matchmaker who we've blocked before
+		if *match {
+			for _, id := range loadBlocked() {
+				msgCh <- Message{Type: MsgTypeBlock, Peer: id}
+			}
+		}
+	}
+	if ws != nil {
+		state.setLost(false)
+		greet()
+	}
+
 	// goroutine: continuously read messages from WS
 	go func() {
+		defer guard()
+		if conn.get() == nil {
+			// started offline: mirror until the server turns up
+			state.setLost(true)
+			conn.redial(ep, state.setAttempt)
+			state.setLost(false)
+			scr.clearFrames()
+			scr.toast("connected")
+			greet()
+		}
+		stop := conn.watch()
 		for {
-			_, data, err := ws.ReadMessage()
+			_, data, err := conn.read()
 			if err != nil {
+				// the relay went away or stopped answering: start over,
+				// as if we'd just launched
 				log.Println("read error:", err)
-				return
+				close(stop)
+				state.setLost(true)
+				peers.clear()
+				scr.clearFrames()
+				state.peerLeft()
+				joined := ""
+				select {
+				case inv := <-answered:
+					ep.query.Set("room", inv.Room)
+					ep.query.Del("match")
+					ep.query.Del("call")
+					with, joined = inv.User, inv.User
+				default:
+				}
+				conn.redial(ep, state.setAttempt)
+				state.setLost(false)
+				if joined != "" {
+					scr.toast("in a call with " + cleanName(joined))
+				} else {
+					scr.toast("reconnected")
+				}
+				stop = conn.watch()
+				greet()
+				continue
 			}
+			stats.received(len(data))
 
 			var msg Message
 			if err := json.Unmarshal(data, &msg); err != nil {
 				log.Println("json unmarshal error:", err)
+				stats.dropped()
+				continue
+			}
+
+			// who it's from; an old server doesn't say, and then there's
+			// only the one peer, number 0
+			var p *peer
+			if forPeer(msg.Type) || msg.Type == MsgTypeHello || msg.Type == MsgTypeSealed {
+				var isNew bool
+				if p, isNew = peers.ensure(msg.From); isNew {
+					rearrange()
+				}
+			}
+
+			if msg.Type == MsgTypeHello && *e2e {
+				fresh, err := p.sess.establish(msg.Key)
+				if errors.Is(err, errRekey) {
+					log.Println("key exchange error:", err)
+					scr.toast("the peer's key changed! someone may be in the middle; kept the old one")
+					continue
+				}
+				if err != nil {
+					log.Println("key exchange error:", err)
+					continue
+				}
+				if fresh {
+					hello := sess.hello()
+					hello.To = p.id
+					msgCh <- hello         // they may not have ours yet
+					msgCh <- sizeMsg(p.id) // anything sent in the clear before now got dropped
+					if state.onHold() {
+						msgCh <- holdMsg(p.id, true)
+					}
+					wake()
+					if signer != nil {
+						if id, err := p.sess.identity(signer); err == nil {
+							id.To = p.id
+							msgCh <- id
+						}
+					}
+					state.setEncrypted(true)
+					scr.toast("call encrypted, press v to verify")
+				}
+				continue
+			}
+			if p != nil {
+				if msg, err = p.sess.open(msg, *e2e); err != nil {
+					log.Println("sealed message error:", err)
+					stats.dropped()
+					continue
+				}
+			}
+			if err := checkMessage(msg); err != nil {
+				log.Printf("dropping %s from %d: %v", msg.Type, msg.From, err)
+				stats.dropped()
 				continue
 			}
 
 			switch msg.Type {
 			case MsgTypeFrame:
-				// move cursor to top-left
-				print("\033[H")
-				print(msg.Frame)
+				if *noRecv || cramped.Load() || state.onHold() || p != nil && p.held {
+					continue
+				}
+				// a simulcast the server passed on whole: take the
+				// thumbnail if that's all our tile has room for
+				_, area := areas()
+				if t := peers.tile(p.id, area); msg.Thumb != "" && t.w / *zoom <= msg.ThumbW && t.h / *zoom <= msg.ThumbH {
+					msg.Frame = msg.Thumb
+				}
+				_, shown := stage(traced(msg.Trace), "show", showTime)
+				// never trust the peer's escape sequences
+				text := sanitizeFrame(msg.Frame)
+				if msg.Pixels != nil {
+					o := set.get()
+					o.Depth, o.Invert = min(o.Depth, localDepth), light
+					o.Mode = drawableMode(o.Mode, canDraw)
+					if text, err = renderPixels(msg, o); err != nil {
+						log.Println("pixel frame error:", err)
+						stats.dropped()
+						shown()
+						continue
+					}
+				}
+				frame := enlarge(recolor.frame(text), *zoom*max(1, msg.Scale))
+				if teeIn != nil {
+					teeIn.write(frame)
+				}
+				if streaming {
+					state.frameReceived()
+					stats.shown()
+					peers.sawFrame(p.id)
+					streamFrame(os.Stdout, frame)
+					shown()
+					continue
+				}
+				frame = place(frame, peers.tile(p.id, area))
+				state.frameReceived()
+				stats.shown()
+				peers.sawFrame(p.id)
+				scr.drawFrame(p.id, frame)
+				shown()
+				if rec != nil {
+					rec.write(frame)
+				}
+			case MsgTypeMix:
+				if *noRecv || cramped.Load() {
+					continue
+				}
+				frame := enlarge(recolor.frame(sanitizeFrame(msg.Frame)), *zoom)
+				_, area := areas()
+				state.frameReceived()
+				stats.shown()
+				for _, p := range peers.list() {
+					peers.sawFrame(p.id)
+				}
+				scr.drawFrame(mixTile, place(frame, area))
+			case MsgTypeHold:
+				p.held = msg.Held
+				if msg.Held {
+					scr.clearFrames()
+				}
+				wake() // our video to them stops or starts again
+			case MsgTypeReaction:
+				r, ok := reactionNamed(msg.Reaction)
+				if !ok || *noRecv || cramped.Load() {
+					continue
+				}
+				_, area := areas()
+				floats.float(r, peers.tile(p.id, area))
 			case MsgTypeSize:
 				// handle remote terminal size
-				remoteWidth = msg.Width
-				remoteHeight = msg.Height
-				msgCh <- Message{Type: MsgTypeSize, Width: width, Height: height} // if you get someone elses, send your own
+				first := p.width == 0
+				p.width, p.height = msg.Width, msg.Height
+				if d, ok := parseDepth(msg.Colors); ok && d != depthAuto {
+					p.depth = d
+				}
+				p.noFrames, p.light = msg.NoFrames, msg.Light
+				p.renderers, p.aspect = nil, msg.Aspect
+				if len(msg.Renderers) > 0 {
+					p.renderers = msg.Renderers
+				}
+				p.cellW, p.cellH = 0, 0
+				if msg.CellW > 0 && msg.CellH > 0 {
+					p.cellW, p.cellH = msg.CellW, msg.CellH
+				}
+				if p == peers.primary() {
+					state.peerJoined(msg.Name)
+				}
+				if first {
+					msgCh <- sizeMsg(p.id) // they may have missed ours; only once, or we'd ping-pong
+				}
+			case MsgTypeIdentity:
+				pub, err := p.sess.verifyIdentity(msg)
+				if err != nil {
+					log.Println("peer identity error:", err)
+					scr.toast("the peer's ssh key didn't check out!")
+					continue
+				}
+				fp, alias := ssh.FingerprintSHA256(pub), knownPeer(pub)
+				if p == peers.primary() {
+					state.setIdentity(fp, alias)
+				}
+				if alias != "" {
+					scr.toast("verified: " + alias)
+				} else {
+					scr.toast("new ssh key " + fp + ", press k to remember")
+				}
+			case MsgTypePing:
+				msgCh <- Message{Type: MsgTypePong, To: msg.From, Time: msg.Time}
+			case MsgTypePong:
+				rtt := time.Since(time.Unix(0, msg.Time))
+				state.setRTT(rtt)
+				stats.ack(rtt)
+				rttTime.Record(context.Background(), rtt.Seconds())
+				cc.ack(rtt)
+			case MsgTypeJoined:
+				if _, isNew := peers.ensure(msg.ID); isNew {
+					rearrange() // which also tells the newcomer our size
+					if len(peers.list()) == 1 {
+						anim.play(intro) // the call's begun, not just grown
+					}
+				}
+				state.setPeer(msg.Peer)
+				if state.onHold() && !*e2e { // encrypted, it waits for the keys
+					msgCh <- holdMsg(msg.ID, true)
+				}
+				if *e2e {
+					hello := sess.hello()
+					hello.To = msg.ID
+					msgCh <- hello
+				}
+				wake()
+				if *bell {
+					go ringBell()
+				}
+				if *notify {
+					desktopNotify("asciichat", "Your peer joined the call")
+				}
+			case MsgTypeScheduled:
+				state.setOpens(time.Unix(0, msg.Time))
+			case MsgTypeInvite:
+				ring.incoming(msg, state.myStatus() == statusBusy)
+			case MsgTypeCancelled:
+				ring.cancelled(msg.Room)
+			case MsgTypeDeclined:
+				state.setDialing("")
+				switch msg.Text {
+				case "no answer":
+					scr.toast(msg.User + " didn't answer")
+				case "busy":
+					scr.toast(msg.User + " is on another call")
+				default:
+					scr.toast(msg.User + " declined the call")
+				}
+			case MsgTypeCalling, MsgTypeUnreachable:
+				// the call's placed: come back to this room, not a new call
+				ep.query.Del("call")
+				ep.query.Set("room", msg.Room)
+				state.setPlace(callRecord{Server: *server, Room: msg.Room, User: with})
+				switch {
+				case msg.Status == statusDND:
+					scr.toast(msg.User + " doesn't want to be disturbed")
+				case msg.Type == MsgTypeUnreachable:
+					scr.toast(msg.User + " isn't online")
+				case msg.Status == statusBusy:
+					state.setDialing("calling " + msg.User + " (they're busy)...")
+				default:
+					state.setDialing("calling " + msg.User + "...")
+				}
+			case MsgTypeRefused:
+				fatalf("server refused: %s", msg.Text)
+			case MsgTypeWaiting:
+				peers.clear()
+				scr.clearFrames()
+				state.peerLeft()
+				scr.toast("waiting for someone to talk to...")
+			case MsgTypeLeft:
+				peers.remove(msg.ID)
+				rearrange()
+				if len(peers.list()) > 0 {
+					continue // the call goes on
+				}
+				state.peerLeft()
+				anim.play(outro)
+				if *notify {
+					desktopNotify("asciichat", "Your peer left the call")
+				}
 			}
 		}
 	}()
 
-	// Create Mat for webcam frames
+	// Create Mat for webcam frames, and the picture for when it's gone
 	img := gocv.NewMat()
 	defer img.Close()
+	noCamera := placeholder()
+	defer noCamera.Close()
+	wasLost := false
 
 	lastW, lastH := width, height // initialize
+	lastSplit := resolveSplit(set.get().Split, width, height)
+	lastFocus := uint64(0)
+	lastMode := set.get().Mode
+	lastPing := time.Now()
 	for {
-		if ok := webcam.Read(&img); !ok || img.Empty() {
-			continue
+		select {
+		case <-quit:
+			return
+		default:
 		}
 
-		// Prepare messages
-		msgs := []Message{
-			{Type: MsgTypeFrame, Frame: processFrame(img, remoteWidth, remoteHeight, *color)},
+		// Render a frame for each peer at the size they asked for
+		var msgs []Message
+		opts := cc.apply(set.get())
+		opts.ClockText = clockText(opts.Clock, state.callStart())
+		ctx, span := tracer.Start(context.Background(), "frame")
+		if webcam != nil {
+			_, captured := stage(ctx, "capture", captureTime)
+			needW, needH := neededPixels(peers.list(), width, height, opts)
+			wantPixels(webcam, needW, needH)
+			ok := webcam.Read(&img)
+			captured()
+			frame, lost := img, sourceLost(webcam)
+			if lost != wasLost {
+				wasLost = lost
+				if lost {
+					scr.toast("camera lost")
+				} else {
+					scr.toast("camera back")
+				}
+			}
+			if lost {
+				frame, opts.Caption = noCamera, lostCaption
+			} else if !ok || img.Empty() {
+				span.End()
+				continue
+			}
+			o := opts
+			o.Depth = min(o.Depth, localDepth)
+			o.Invert = light
+			o.Mode, o.Aspect = drawableMode(o.Mode, canDraw), aspect
+			if conn.get() == nil {
+				// offline: show us ourselves
+				if !cramped.Load() {
+					scr.drawFrame(selfTile, place(processFrame(frame, width, height, o), rect{0, 0, width, height}))
+				}
+			} else {
+				if !opts.Paused && !state.onHold() {
+					_, rendered := stage(ctx, "render", renderTime)
+					msgs = peerFrames(frame, peers.list(), opts, width, height, localDepth, serverScales, *simulcast)
+					rendered()
+					if tp := traceparent(ctx); tp != "" {
+						for i := range msgs {
+							msgs[i].Trace = tp
+						}
+					}
+				}
+				if teeOut != nil && len(msgs) > 0 {
+					teeOut.write(msgs[0].Frame)
+				}
+				if self, _ := areas(); self.w > 0 && !cramped.Load() {
+					scr.drawFrame(selfTile, place(processFrame(frame, self.w, self.h, o), self))
+				}
+			}
 		}
 
 		// Get current terminal size
@@ -204,63 +1447,47 @@ func main() {
 			height = h - 1
 		}
 
+		// Below a usable size, say so instead of drawing mush
+		if small := tooSmall(width, height); small != cramped.Load() {
+			cramped.Store(small)
+			scr.clearFrames()
+			if small {
+				scr.setLayer("small", func() string { return tooSmallNotice(width) })
+			} else {
+				scr.setLayer("small", nil)
+			}
+		}
+
 		// Only send terminal size if changed
-		if width != lastW || height != lastH {
-			msgs = append(msgs, Message{Type: MsgTypeSize, Width: width, Height: height})
-			lastW, lastH = width, height
+		arrangement, focus := resolveSplit(opts.Split, width, height), peers.focused()
+		if width != lastW || height != lastH || arrangement != lastSplit || focus != lastFocus || *pixelGrids && opts.Mode != lastMode {
+			if arrangement != lastSplit || focus != lastFocus {
+				scr.clearFrames() // the panes or tiles moved
+			}
+			for _, p := range peers.list() {
+				msgs = append(msgs, sizeMsg(p.id))
+			}
+			lastW, lastH, lastSplit, lastFocus, lastMode = width, height, arrangement, focus, opts.Mode
+		}
+
+		// Measure round trip every couple of seconds
+		if time.Since(lastPing) > 2*time.Second {
+			for _, p := range peers.list() {
+				msgs = append(msgs, Message{Type: MsgTypePing, To: p.id, Time: time.Now().UnixNano()})
+			}
+			lastPing = time.Now()
 		}
 
 		// Send all messages sequentially (single goroutine)
 		for _, msg := range msgs {
 			msgCh <- msg
 		}
+		span.End()
 
-		// Limit FPS (~30)
-		time.Sleep(33 * time.Millisecond)
-	}
-}
-
-func matToASCII(mat gocv.Mat) string {
-	rows, cols := mat.Rows(), mat.Cols()
-	out := make([]byte, 0, rows*cols/2)
-
-	for y := 0; y < rows; y += 2 { // skip every other row for terminal aspect
-		for x := 0; x < cols; x++ {
-			c := mat.GetVecbAt(y, x) // BGR
-			lum := 0.0722*float64(c[0]) + 0.7152*float64(c[1]) + 0.2126*float64(c[2])
-			idx := int(lum / 256 * float64(len(asciiChars)-1))
-			out = append(out, asciiChars[idx])
-		}
-		out = append(out, '\n')
-	}
-	return string(out)
-}
-
-func matToASCIIColor(mat gocv.Mat) string {
-	rows, cols := mat.Rows(), mat.Cols()
-
-	var b strings.Builder
-	b.Grow(rows * cols * 10) // avoid reallocs
-
-	for y := 0; y < rows; y += 2 {
-		for x := 0; x < cols; x++ {
-			c := mat.GetVecbAt(y, x) // BGR
-
-			bb := c[0]
-			gg := c[1]
-			rr := c[2]
-
-			// luminance → ascii
-			lum := 0.0722*float64(bb) + 0.7152*float64(gg) + 0.2126*float64(rr)
-			idx := int(lum / 256 * float64(len(asciiChars)-1))
-			ch := asciiChars[idx]
-
-			// 24-bit foreground color
-			fmt.Fprintf(&b, "\033[38;2;%d;%d;%dm%c", rr, gg, bb, ch)
+		// Limit FPS
+		select {
+		case <-time.After(time.Second / time.Duration(opts.FPS)):
+		case <-sendNow:
 		}
-		b.WriteByte('\n')
 	}
-
-	b.WriteString("\033[0m") // reset color
-	return b.String()
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+)
+
+// menuItem is one setting in the in-call menu
+type menuItem struct {
+	label  string
+	value  func(o options) string
+	change func(o *options, dir int)
+}
+
+var menuItems = []menuItem{
+	{
+		label:  "Mode",
+		value:  func(o options) string { return renderers[o.Mode].name },
+		change: func(o *options, dir int) { o.Mode = cycle(o.Mode, len(renderers), dir) },
+	},
+	{
+		label:  "Colors",
+		value:  func(o options) string { return o.Depth.String() },
+		change: func(o *options, dir int) { o.Depth = depth(cycle(int(o.Depth), len(depthNames), dir)) },
+	},
+	{
+		label:  "Quantizer",
+		value:  func(o options) string { return quantizers[o.Quantizer].name },
+		change: func(o *options, dir int) { o.Quantizer = cycle(o.Quantizer, len(quantizers), dir) },
+	},
+	{
+		label:  "Dither",
+		value:  func(o options) string { return ditherNames[o.Dither] },
+		change: func(o *options, dir int) { o.Dither = cycle(o.Dither, len(ditherNames), dir) },
+	},
+	{
+		label:  "Charset",
+		value:  func(o options) string { return charsets[o.Charset].name },
+		change: func(o *options, dir int) { o.Charset = cycle(o.Charset, len(charsets), dir) },
+	},
+	{
+		label: "FPS cap",
+		value: func(o options) string { return fmt.Sprint(o.FPS) },
+		change: func(o *options, dir int) {
+			i := 0
+			for j, f := range fpsChoices {
+				if f == o.FPS {
+					i = j
+				}
+			}
+			o.FPS = fpsChoices[cycle(i, len(fpsChoices), dir)]
+		},
+	},
+	{
+		label:  "Mirror",
+		value:  func(o options) string { return onOff(o.Mirror) },
+		change: func(o *options, dir int) { o.Mirror = !o.Mirror },
+	},
+	{
+		label:  "Clock",
+		value:  func(o options) string { return clockNames[o.Clock] },
+		change: func(o *options, dir int) { o.Clock = cycle(o.Clock, len(clockNames), dir) },
+	},
+	{
+		label:  "Split",
+		value:  func(o options) string { return splitNames[o.Split] },
+		change: func(o *options, dir int) { o.Split = cycle(o.Split, len(splitNames), dir) },
+	},
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// menu is the in-call settings overlay
+type menu struct {
+	scr      *screen
+	set      *settings
+	open     bool
+	selected int
+}
+
+func (m *menu) draw() string {
+	o := m.set.get()
+	lines := make([]string, 0, len(menuItems)+2)
+	for i, it := range menuItems {
+		cursor := "  "
+		if i == m.selected {
+			cursor = "> "
+		}
+		lines = append(lines, fmt.Sprintf("%s%-10s ◂ %s ▸", cursor, it.label, it.value(o)))
+	}
+	lines = append(lines, "", "↑↓ select  ←→ change  m/esc close")
+	return box("settings", lines)
+}
+
+// handle processes a key while the menu is open; false means the key
+// wasn't for us
+func (m *menu) handle(k string) bool {
+	if !m.open {
+		if k == "m" {
+			m.open = true
+			m.scr.setLayer("menu", m.draw)
+			return true
+		}
+		return false
+	}
+
+	dir := 0
+	switch k {
+	case "m", keyEsc:
+		m.open = false
+		m.scr.setLayer("menu", nil)
+		return true
+	case keyUp, "k":
+		m.selected = cycle(m.selected, len(menuItems), -1)
+	case keyDown, "j":
+		m.selected = cycle(m.selected, len(menuItems), 1)
+	case keyLeft, "h":
+		dir = -1
+	case keyRight, "l", keyEnter, " ":
+		dir = 1
+	default:
+		return true // swallow everything else while open
+	}
+
+	if dir != 0 {
+		it := menuItems[m.selected]
+		m.set.update(func(o *options) { it.change(o, dir) })
+	}
+	m.scr.setLayer("menu", m.draw)
+	return true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ---------- mouse ----------
+
+// With -mouse (the default) the terminal reports clicks, in SGR form:
+// ESC [ < button ; x ; y M, or m on release. A click on one of the
+// buttons at the right of the status line does what its key does, and
+// the wheel moves through the menu like the arrow keys.
+
+const (
+	mouseOn  = "\033[?1000h\033[?1006h"
+	mouseOff = "\033[?1000l\033[?1006l"
+)
+
+// button is a status line button and the key it presses
+type button struct {
+	label string
+	key   string
+}
+
+func statusButtons(paused bool) []button {
+	pause := button{"pause", "p"}
+	if paused {
+		pause = button{"resume", "p"}
+	}
+	return []button{pause, {"layout", "s"}, {"menu", "m"}, {"quit", "q"}}
+}
+
+// buttonBar is the buttons as drawn, right aligned, one space apart
+func buttonBar(buttons []button) string {
+	var b strings.Builder
+	for _, btn := range buttons {
+		b.WriteString(" [" + btn.label + "]")
+	}
+	b.WriteString(" ")
+	return b.String()
+}
+
+// buttonAt is the key for a click at column x (1 based) of a status
+// line width columns wide, or "" if it missed
+func buttonAt(buttons []button, x, width int) string {
+	col := width - len(buttonBar(buttons)) + 1 // where the bar starts
+	for _, btn := range buttons {
+		col++ // the space
+		w := len(btn.label) + 2
+		if x >= col && x < col+w {
+			return btn.key
+		}
+		col += w
+	}
+	return ""
+}
+
+// mouseKey turns an SGR mouse report into a key name: "click X Y" for a
+// left button press, up or down for the wheel, and "" for anything else
+func mouseKey(seq string) string {
+	var b, x, y int
+	var end rune
+	if _, err := fmt.Sscanf(seq, "\033[<%d;%d;%d%c", &b, &x, &y, &end); err != nil || end != 'M' {
+		return ""
+	}
+	switch b {
+	case 0:
+		return fmt.Sprintf("click %d %d", x, y)
+	case 64:
+		return keyUp
+	case 65:
+		return keyDown
+	}
+	return ""
+}
+
+// parseClick undoes mouseKey's click name
+func parseClick(k string) (x, y int, ok bool) {
+	_, err := fmt.Sscanf(k, "click %d %d", &x, &y)
+	return x, y, err == nil
+}
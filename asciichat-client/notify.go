@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// desktopNotify pops up a native notification; best effort, errors are
+// only logged since a missing notifier shouldn't break the call
+func desktopNotify(title, body string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux", "freebsd", "openbsd":
+		cmd = exec.Command("notify-send", "-a", "asciichat", title, body)
+	case "darwin":
+		script := fmt.Sprintf("display notification %q with title %q", body, title)
+		cmd = exec.Command("osascript", "-e", script)
+	case "windows":
+		quote := func(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" }
+		script := `Add-Type -AssemblyName System.Windows.Forms;` +
+			`$n = New-Object System.Windows.Forms.NotifyIcon;` +
+			`$n.Icon = [System.Drawing.SystemIcons]::Information; $n.Visible = $true;` +
+			`$n.ShowBalloonTip(5000, ` + quote(title) + `, ` + quote(body) + `, 'None'); Start-Sleep 6`
+		cmd = exec.Command("powershell", "-NoProfile", "-Command", script)
+	default:
+		return
+	}
+
+	if err := cmd.Start(); err != nil {
+		log.Println("notification error:", err)
+		return
+	}
+	go cmd.Wait()
+}
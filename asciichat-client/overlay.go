@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// ---------- connection overlay ----------
+
+// When there's no video, or it's stopped, a banner over the video area
+// says why, so a frozen or empty screen never has to be guessed at.
+
+const (
+	endedFor    = 5 * time.Second // how long "call ended" stays up
+	pausedAfter = 3 * time.Second // no frames for this long and the peer's paused
+)
+
+// connText describes the connection and the call, or "" when the video
+// speaks for itself
+func (s *callState) connText(match bool) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.lost && !s.online:
+		return fmt.Sprintf("connecting to the server (attempt %d)", s.attempt)
+	case s.lost:
+		return fmt.Sprintf("reconnecting (attempt %d)", s.attempt)
+	case s.hold:
+		return "call on hold, h to resume"
+	case !s.since.IsZero():
+		return ""
+	case time.Now().Before(s.opens):
+		return countdown(time.Until(s.opens))
+	case s.dialing != "":
+		return s.dialing
+	case !s.ended.IsZero() && time.Since(s.ended) < endedFor:
+		return "call ended"
+	case match:
+		return "looking for someone to talk to..."
+	}
+	return "waiting for someone to join"
+}
+
+// countdown says how long until a scheduled room opens, or when, if
+// it's not today
+func countdown(left time.Duration) string {
+	if left > 24*time.Hour {
+		return "the room opens " + time.Now().Add(left).Format("Mon Jan 2 15:04")
+	}
+	left = left.Round(time.Second)
+	h, m, sec := int(left.Hours()), int(left.Minutes())%60, int(left.Seconds())%60
+	if h > 0 {
+		return fmt.Sprintf("the room opens in %d:%02d:%02d", h, m, sec)
+	}
+	return fmt.Sprintf("the room opens in %d:%02d", m, sec)
+}
+
+// overlayText is what the banner says: the connection if there's
+// anything to say about it, else whether the peer's video has stopped
+func overlayText(state *callState, peers *peerSet, match, video bool) string {
+	if msg := state.connText(match); msg != "" || !video {
+		return msg
+	}
+	if peers.holding() {
+		who := state.name()
+		if who == "" {
+			who = "your peer"
+		}
+		return who + " put the call on hold"
+	}
+	quiet, ever := peers.quiet(pausedAfter)
+	if !quiet {
+		return ""
+	}
+	who := state.name()
+	if who == "" {
+		who = "your peer"
+	}
+	if ever {
+		return who + " paused their video"
+	}
+	return "waiting for video from " + who
+}
+
+// banner is msg on one row in the middle of area, in the theme's banner
+// style, with art above it if there's room
+func banner(area rect, msg string, art []string) string {
+	w := min(runewidth.StringWidth(msg)+4, area.w)
+	x := area.x + (area.w-w)/2
+	y := area.y + area.h/2
+	var b strings.Builder
+	b.WriteString("\0337")
+	if len(art) > 0 && len(art)+1 <= area.h/2 {
+		for i, line := range art {
+			aw := min(runewidth.StringWidth(line), area.w)
+			fmt.Fprintf(&b, "\033[%d;%dH%s%s", y-len(art)+i, area.x+(area.w-aw)/2+1, ui.box, fitWidth(line, aw))
+		}
+	}
+	fmt.Fprintf(&b, "\033[%d;%dH%s%s\033[0m\0338", y+1, x+1, ui.banner, fitWidth("  "+msg, w))
+	return b.String()
+}
+
+// keepOverlay puts up, changes or takes down the banner as the call
+// moves between states. text and area are asked afresh each time;
+// waiting is whether it's a wait for someone, which gets the theme's art.
+func keepOverlay(scr *screen, text func() (msg string, waiting bool), area func() rect) {
+	defer guard()
+	last := ""
+	for range time.Tick(500 * time.Millisecond) {
+		msg, waiting := text()
+		if msg == last {
+			continue
+		}
+		if last != "" {
+			scr.setLayer("overlay", nil) // repaints, wiping the old banner
+		}
+		last = msg
+		var art []string
+		if waiting {
+			art = ui.waiting
+		}
+		if msg != "" {
+			scr.setLayer("overlay", func() string { return banner(area(), msg, art) })
+		}
+	}
+}
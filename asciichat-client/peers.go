@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+	"gocv.io/x/gocv"
+)
+
+// ---------- peers ----------
+
+// peer is one other client in the room: what they want us to send them,
+// and our encrypted session with them. The server numbers clients, and
+// stamps that number on everything it relays as "from"; we address
+// messages back with "to".
+type peer struct {
+	id            uint64
+	width, height int      // cells they asked us to render at; 0 until their size arrives
+	depth         depth    // colors their terminal can show
+	noFrames      bool     // they run -no-recv
+	held          bool     // they've put the call on hold, see hold.go
+	light         bool     // their background is light, so the ramp runs backwards
+	cellW, cellH  int      // they render for themselves from this many pixels a cell, see pixels.go
+	renderers     []string // what their terminal can draw, nil for anything
+	aspect        float64  // their cells' height over width, 0 if they didn't say
+	sess          *session
+
+	lastFrame time.Time // when their video last arrived, zero if it never has
+}
+
+type peerSet struct {
+	mu    sync.Mutex
+	base  *session // our key; every peer's session shares it
+	peers map[uint64]*peer
+	focus uint64 // who gets the big tile, 0 for nobody; see f
+}
+
+func newPeerSet(base *session) *peerSet {
+	return &peerSet{base: base, peers: make(map[uint64]*peer)}
+}
+
+// ensure returns the peer with this id, adding them if they're new
+func (ps *peerSet) ensure(id uint64) (*peer, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if p, ok := ps.peers[id]; ok {
+		return p, false
+	}
+	p := &peer{id: id, depth: depthAuto, sess: ps.base.fork()}
+	ps.peers[id] = p
+	return p, true
+}
+
+func (ps *peerSet) get(id uint64) *peer {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.peers[id]
+}
+
+func (ps *peerSet) remove(id uint64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.peers, id)
+	if ps.focus == id {
+		ps.focus = 0
+	}
+}
+
+func (ps *peerSet) clear() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.peers = make(map[uint64]*peer)
+	ps.focus = 0
+}
+
+func (ps *peerSet) focused() uint64 {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.focus
+}
+
+// cycleFocus moves the focus to the next peer, then back to nobody
+func (ps *peerSet) cycleFocus() uint64 {
+	l := ps.list()
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	next := uint64(0)
+	if ps.focus == 0 {
+		if len(l) > 0 {
+			next = l[0].id
+		}
+	} else {
+		for i, p := range l {
+			if p.id == ps.focus && i+1 < len(l) {
+				next = l[i+1].id
+			}
+		}
+	}
+	ps.focus = next
+	return next
+}
+
+// tile is where peer id goes in area
+func (ps *peerSet) tile(id uint64, area rect) rect {
+	return tileFor(ps.list(), ps.focused(), id, area)
+}
+
+// list is every peer, oldest (lowest id) first
+func (ps *peerSet) list() []*peer {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	l := make([]*peer, 0, len(ps.peers))
+	for _, p := range ps.peers {
+		l = append(l, p)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].id < l[j].id })
+	return l
+}
+
+func (ps *peerSet) sawFrame(id uint64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if p := ps.peers[id]; p != nil {
+		p.lastFrame = time.Now()
+	}
+}
+
+// quiet reports whether there's anyone here and none of them have sent
+// video for d, and whether any of them ever did
+func (ps *peerSet) quiet(d time.Duration) (quiet, ever bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if len(ps.peers) == 0 {
+		return false, false
+	}
+	for _, p := range ps.peers {
+		if time.Since(p.lastFrame) < d {
+			return false, true
+		}
+		ever = ever || !p.lastFrame.IsZero()
+	}
+	return true, ever
+}
+
+// primary is who the single-peer UI talks about: the status line, the
+// fingerprint overlay and the identity keys
+func (ps *peerSet) primary() *peer {
+	if l := ps.list(); len(l) > 0 {
+		return l[0]
+	}
+	return nil
+}
+
+// session picks the session for an outgoing message: the addressee's
+func (ps *peerSet) session(to uint64) *session {
+	if p := ps.get(to); p != nil {
+		return p.sess
+	}
+	return nil
+}
+
+// peerFrames renders img for each peer at the size and color depth they
+// asked for, sharing renders between peers with the same terminal. With
+// once, the server shrinks frames for us (-downscale), so everyone gets
+// one frame big enough for anyone, in colors everyone can show. With
+// simulcast that one frame carries a thumbnail too, at the smallest
+// size anyone asked for, for the server or the receiver to pick. local
+// is what to assume about peers who haven't said.
+func peerFrames(img gocv.Mat, peers []*peer, opts options, width, height int, local depth, once, simulcast bool) []Message {
+	type look struct {
+		w, h   int
+		depth  depth
+		light  bool
+		mode   int
+		aspect float64
+	}
+	rendered := make(map[look]string)
+	render := func(w, h int, d depth, light bool, can []string, aspect float64) (string, int, int) {
+		if w == 0 {
+			w, h = width, height // until they tell us
+		}
+		if d == depthAuto {
+			d = local
+		}
+		w, h = capSize(w, h, opts)
+		o := opts
+		o.Depth = min(o.Depth, d)
+		o.Invert = light
+		o.Mode = drawableMode(o.Mode, can)
+		o.Aspect = aspect
+		key := look{w, h, o.Depth, light, o.Mode, aspect}
+		f, ok := rendered[key]
+		if !ok {
+			f = processFrame(img, w, h, o)
+			rendered[key] = f
+		}
+		return f, w, h
+	}
+
+	var watching []*peer
+	for _, p := range peers {
+		if !p.noFrames && !p.held {
+			watching = append(watching, p)
+		}
+	}
+
+	var msgs []Message
+	switch {
+	case len(peers) == 0:
+		// for viewers, or whoever turns up; encrypted, it goes nowhere
+		// (see wire)
+		f, _, _ := render(width, height, local, false, nil, 0)
+		msgs = append(msgs, Message{Type: MsgTypeFrame, Frame: f})
+	case len(watching) > 1 && (once || simulcast):
+		// one frame everyone can draw, stretched, since their cells
+		// may not all be the same shape
+		w, h, d := 0, 0, depthAuto
+		tw, th := width, height
+		can := rendererNames()
+		for _, p := range watching {
+			w, h, d = max(w, p.width), max(h, p.height), min(d, p.depth)
+			if p.width > 0 {
+				tw, th = min(tw, p.width), min(th, p.height)
+			}
+			if p.renderers != nil {
+				can = slices.DeleteFunc(can, func(r string) bool { return !slices.Contains(p.renderers, r) })
+			}
+		}
+		m := Message{Type: MsgTypeFrame}
+		m.Frame, w, h = render(w, h, d, false, can, 0)
+		if simulcast && 2*tw <= w {
+			m.Thumb, m.ThumbW, m.ThumbH = render(tw, th, d, false, can, 0)
+		}
+		msgs = append(msgs, m)
+	default:
+		for _, p := range watching {
+			if p.cellW > 0 && p.width > 0 {
+				o := opts
+				o.Depth = min(o.Depth, p.depth)
+				o.Aspect = p.aspect
+				w, h := capSize(p.width, p.height, o)
+				m := pixelFrame(img, w, h, p.cellW, p.cellH, o)
+				m.To = p.id
+				msgs = append(msgs, m)
+				continue
+			}
+			f, _, _ := render(p.width, p.height, p.depth, p.light, p.renderers, p.aspect)
+			msgs = append(msgs, Message{Type: MsgTypeFrame, To: p.id, Frame: f})
+		}
+	}
+	if opts.Scale > 1 {
+		for i := range msgs {
+			msgs[i].Scale = opts.Scale
+		}
+	}
+	return msgs
+}
+
+// ---------- tiles ----------
+
+// rect is a region of the terminal in cells, zero based
+type rect struct{ x, y, w, h int }
+
+// layout splits an area of the screen into n roughly square tiles,
+// filling rows first, with a one cell gutter between them
+func layout(n int, area rect) []rect {
+	if n <= 1 {
+		return []rect{area}
+	}
+	cols := int(math.Ceil(math.Sqrt(float64(n))))
+	rows := (n + cols - 1) / cols
+	tw := (area.w - (cols - 1)) / cols
+	th := (area.h - (rows - 1)) / rows
+
+	tiles := make([]rect, n)
+	for i := range tiles {
+		c, r := i%cols, i/cols
+		tiles[i] = rect{area.x + c*(tw+1), area.y + r*(th+1), max(1, tw), max(1, th)}
+	}
+	return tiles
+}
+
+// focusLayout gives the focused peer most of the area and the others
+// thumbnails in a row along the bottom, or returns nil when there'd be
+// no room for them
+func focusLayout(n, focused int, area rect) []rect {
+	th := max(3, area.h/4)
+	if n < 2 || area.h-th-1 < 3 {
+		return nil
+	}
+	thumbs := layout(n-1, rect{area.x, area.y + area.h - th, area.w, th})
+	if len(thumbs) > 1 {
+		// one row of them, however many there are
+		tw := (area.w - (n - 2)) / (n - 1)
+		for i := range thumbs {
+			thumbs[i] = rect{area.x + i*(tw+1), area.y + area.h - th, max(1, tw), th}
+		}
+	}
+
+	tiles := make([]rect, 0, n)
+	tiles = append(tiles, thumbs[:focused]...)
+	tiles = append(tiles, rect{area.x, area.y, area.w, area.h - th - 1})
+	return append(tiles, thumbs[focused:]...)
+}
+
+// tileFor is where peer id goes in area, given everyone in the room and
+// who's focused
+func tileFor(peers []*peer, focus, id uint64, area rect) rect {
+	tiles := layout(len(peers), area)
+	for i, p := range peers {
+		if p.id == focus && focus != 0 {
+			if t := focusLayout(len(peers), i, area); t != nil {
+				tiles = t
+			}
+		}
+	}
+	for i, p := range peers {
+		if p.id == id {
+			return tiles[i]
+		}
+	}
+	return tiles[0]
+}
+
+// place positions a frame's lines inside a tile, dropping any that
+// don't fit, so a peer can't draw over the tiles next to it, the status
+// line or a box
+func place(frame string, r rect) string {
+	var b strings.Builder
+	b.Grow(len(frame) + r.h*10)
+	for i, line := range strings.Split(strings.TrimSuffix(frame, "\n"), "\n") {
+		if i >= r.h {
+			break
+		}
+		fmt.Fprintf(&b, "\033[%d;%dH", r.y+i+1, r.x+1)
+		clipLine(&b, line, r.w)
+	}
+	b.WriteString("\033[0m")
+	return b.String()
+}
+
+// clipLine writes line's first w cells: its colors as they are, even
+// past the edge, since the next line carries on with them, but not its
+// cursor moves (the sanitizer lets a peer's through), which would take
+// it out of the tile, nor any other control character: a \r is a cursor
+// move too
+func clipLine(b *strings.Builder, line string, w int) {
+	cut := false
+	for i := 0; i < len(line); {
+		if line[i] == '\033' && i+1 < len(line) && line[i+1] == '[' {
+			j := i + 2
+			for j < len(line) && (line[j] < 0x40 || line[j] > 0x7e) {
+				j++
+			}
+			if j < len(line) && line[j] != 'H' && line[j] != 'f' {
+				b.WriteString(line[i : j+1])
+			}
+			i = j + 1
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(line[i:])
+		if r < 0x20 || r >= 0x7f && r <= 0x9f {
+			i += size
+			continue
+		}
+		if rw := runewidth.RuneWidth(r); !cut && rw <= w {
+			w -= rw
+			b.WriteString(line[i : i+size])
+		} else {
+			cut = true
+		}
+		i += size
+	}
+}
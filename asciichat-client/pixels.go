@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gocv.io/x/gocv"
+)
+
+// ---------- pixel grids ----------
+
+// With -pixels we ask peers for the picture itself rather than text: a
+// grid of pixels sized for our terminal and renderer, which we turn
+// into cells with our own renderer, charset and colors. RGB, or gray
+// for mono, takes about half the bytes of the escapes it replaces, and
+// a sender never has to guess what our terminal can draw. The size
+// message says how many pixels go in each of our cells; the frame
+// carries the pixels, plus the caption and clock as text.
+
+// the biggest grid we'll take, whatever the peer claims
+const maxPixels = 4096 * 4096
+
+// pixelFrame is a frame for a peer that renders for itself
+func pixelFrame(img gocv.Mat, w, h, cellW, cellH int, o options) Message {
+	p := applyFilters(scalePixels(img, w*cellW, h*cellH, o.Mirror, shape(w, h, o.Aspect)))
+	return Message{
+		Type: MsgTypeFrame, Pixels: packPixels(p, o.Depth == depthMono),
+		PixW: p.w, PixH: p.h,
+		Caption: o.Caption, Clock: o.ClockText,
+	}
+}
+
+// packPixels is BGR as RGB, or one byte of brightness for mono
+func packPixels(p pixels, gray bool) []byte {
+	n := p.w * p.h
+	if gray {
+		out := make([]byte, n)
+		for i := range out {
+			out[i] = uint8(p.at(i%p.w, i/p.w).lum())
+		}
+		return out
+	}
+	out := make([]byte, 3*n)
+	for i := 0; i < n; i++ {
+		out[3*i], out[3*i+1], out[3*i+2] = p.bgr[3*i+2], p.bgr[3*i+1], p.bgr[3*i]
+	}
+	return out
+}
+
+// unpackPixels checks a peer's grid and turns it back into pixels
+func unpackPixels(b []byte, w, h int) (pixels, error) {
+	if w <= 0 || h <= 0 || w*h > maxPixels {
+		return pixels{}, fmt.Errorf("pixel grid %dx%d", w, h)
+	}
+	n := w * h
+	p := pixels{w: w, h: h, bgr: make([]byte, 3*n)}
+	switch len(b) {
+	case n:
+		for i, v := range b {
+			p.bgr[3*i], p.bgr[3*i+1], p.bgr[3*i+2] = v, v, v
+		}
+	case 3 * n:
+		for i := 0; i < n; i++ {
+			p.bgr[3*i], p.bgr[3*i+1], p.bgr[3*i+2] = b[3*i+2], b[3*i+1], b[3*i]
+		}
+	default:
+		return pixels{}, fmt.Errorf("pixel grid %dx%d has %d bytes", w, h, len(b))
+	}
+	return p, nil
+}
+
+// renderPixels draws a peer's pixel grid our way. The grid was sized
+// for the renderer we had when we last asked, so a cell count is taken
+// from whatever fits if that's changed since.
+func renderPixels(msg Message, o options) (string, error) {
+	p, err := unpackPixels(msg.Pixels, msg.PixW, msg.PixH)
+	if err != nil {
+		return "", err
+	}
+	r := renderers[o.Mode]
+	w, h := p.w/r.cellW, p.h/r.cellH
+	if w == 0 || h == 0 {
+		return "", nil
+	}
+	printable := func(r rune) rune {
+		if !captionRune(r) {
+			return -1
+		}
+		return r
+	}
+	o.Caption, o.ClockText = strings.Map(printable, msg.Caption), strings.Map(printable, msg.Clock)
+	return drawGrid(p, w, h, o).ansi(o), nil
+}
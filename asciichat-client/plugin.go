@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- plugins ----------
+
+// -plugin pipes our video through another program, so a filter can be
+// written in anything and can't take the client down with it. The
+// program gets the scaled picture on stdin, after -filters and before
+// -script, and writes the same size picture back on stdout, frame after
+// frame:
+//
+//	FRAME <width> <height>\n  then width*height*3 bytes, RGB, row by row
+//
+// and it answers each with just the bytes. Anything it writes to stderr
+// ends up with our logs. One that exits, answers wrong, or takes longer
+// than pluginTimeout is stopped and the video goes on without it. In
+// Python, a negative:
+//
+//	import sys
+//	while line := sys.stdin.buffer.readline():
+//	    w, h = map(int, line.split()[1:])
+//	    px = sys.stdin.buffer.read(w * h * 3)
+//	    sys.stdout.buffer.write(bytes(255 - b for b in px))
+//	    sys.stdout.buffer.flush()
+
+const pluginTimeout = time.Second
+
+// plugin is a running -plugin
+type plugin struct {
+	name string
+	cmd  *exec.Cmd
+
+	mu     sync.Mutex
+	in     *os.File
+	out    *os.File
+	read   *bufio.Reader
+	sent   []byte
+	back   []byte
+	broken bool
+}
+
+// userPlugin is -plugin, nil if there isn't one
+var userPlugin *plugin
+
+// startPlugin runs cmdline: the program and any arguments, split on
+// spaces
+func startPlugin(cmdline string) (*plugin, error) {
+	args := strings.Fields(cmdline)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("-plugin needs a program")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return nil, err
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = inR, outW, os.Stderr
+	err = cmd.Start()
+	inR.Close() // the plugin's ends now
+	outW.Close()
+	if err != nil {
+		inW.Close()
+		outR.Close()
+		return nil, fmt.Errorf("starting -plugin: %w", err)
+	}
+	return &plugin{name: args[0], cmd: cmd, in: inW, out: outR, read: bufio.NewReader(outR)}, nil
+}
+
+// apply sends p through the plugin and takes back what it makes of it,
+// in place
+func (pl *plugin) apply(p pixels) pixels {
+	if pl == nil || p.w == 0 || p.h == 0 {
+		return p
+	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.broken {
+		return p
+	}
+
+	n := p.w * p.h * 3
+	if len(pl.sent) < n {
+		pl.sent, pl.back = make([]byte, n), make([]byte, n)
+	}
+	sent, back := pl.sent[:n], pl.back[:n]
+	for i := 0; i < n; i += 3 {
+		sent[i], sent[i+1], sent[i+2] = p.bgr[i+2], p.bgr[i+1], p.bgr[i]
+	}
+
+	// deadlines where the platform has them for pipes; where it doesn't,
+	// a plugin that hangs hangs us
+	deadline := time.Now().Add(pluginTimeout)
+	pl.in.SetWriteDeadline(deadline)
+	pl.out.SetReadDeadline(deadline)
+
+	// read while we write: a plugin that answers as it goes would fill
+	// its stdout and stall before taking the rest of the frame
+	answered := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(pl.read, back)
+		answered <- err
+	}()
+	if _, err := fmt.Fprintf(pl.in, "FRAME %d %d\n", p.w, p.h); err != nil {
+		pl.stop(err)
+		return p
+	}
+	if _, err := pl.in.Write(sent); err != nil {
+		pl.stop(err)
+		return p
+	}
+	if err := <-answered; err != nil {
+		pl.stop(err)
+		return p
+	}
+	for i := 0; i < n; i += 3 {
+		p.bgr[i], p.bgr[i+1], p.bgr[i+2] = back[i+2], back[i+1], back[i]
+	}
+	return p
+}
+
+// stop gives up on the plugin; the caller holds mu
+func (pl *plugin) stop(err error) {
+	pl.broken = true
+	if os.IsTimeout(err) {
+		err = fmt.Errorf("no answer in %s", pluginTimeout)
+	}
+	log.Printf("stopping -plugin %s: %v", pl.name, err)
+	pl.in.Close()
+	pl.out.Close()
+	pl.cmd.Process.Kill()
+	go pl.cmd.Wait()
+}
+
+// close ends the plugin with the call: its stdin closes, which is its
+// cue to exit
+func (pl *plugin) close() {
+	if pl == nil {
+		return
+	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.broken {
+		return
+	}
+	pl.broken = true
+	pl.in.Close()
+	done := make(chan struct{})
+	go func() {
+		pl.cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(pluginTimeout):
+		pl.cmd.Process.Kill()
+	}
+	pl.out.Close()
+}
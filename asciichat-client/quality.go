@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+)
+
+// ---------- quality presets ----------
+
+// A preset sets the knobs that trade picture for bandwidth and CPU all
+// at once, for anyone who'd rather not learn them one by one. Flags
+// given explicitly still win.
+
+type preset struct {
+	name       string
+	fps        int
+	cols, rows int // resolution cap, 0 for none
+	colors     string
+	compress   bool
+}
+
+var presets = []preset{
+	{"low", 10, 80, 24, "16", true},
+	{"medium", 15, 120, 40, "256", true},
+	{"high", 30, 0, 0, "auto", false},
+}
+
+func presetIndex(name string) int {
+	for i, p := range presets {
+		if p.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// applyPreset sets every flag the preset covers that wasn't given on
+// the command line
+func applyPreset(p preset) {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if given["color"] {
+		given["colors"] = true
+	}
+
+	for name, v := range map[string]string{
+		"fps":      strconv.Itoa(p.fps),
+		"max-cols": strconv.Itoa(p.cols),
+		"max-rows": strconv.Itoa(p.rows),
+		"colors":   p.colors,
+		"compress": strconv.FormatBool(p.compress),
+	} {
+		if !given[name] {
+			flag.Set(name, v)
+		}
+	}
+}
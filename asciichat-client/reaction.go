@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- reactions ----------
+
+// Number keys send a reaction to the room. When one arrives it floats up
+// over the sender's video for a moment, drawn as a layer, so it never
+// touches the frames themselves (or recordings of them).
+
+type reaction struct {
+	name  string
+	color string // SGR foreground
+	art   []string
+}
+
+// reactions, in key order: 1 is the first
+var reactions = []reaction{
+	{"heart", "1;31", []string{
+		" @@@ @@@ ",
+		"@@@@@@@@@",
+		" @@@@@@@ ",
+		"  @@@@@  ",
+		"    @    ",
+	}},
+	{"laugh", "1;33", []string{
+		" .-----. ",
+		"/  ^ ^  \\",
+		"| \\___/ |",
+		" '-----' ",
+	}},
+	{"wow", "1;33", []string{
+		" .-----. ",
+		"/  o o  \\",
+		"|   O   |",
+		" '-----' ",
+	}},
+	{"+1", "1;32", []string{
+		"   #    #  ",
+		" #####  ## ",
+		"   #    #  ",
+		"       ### ",
+	}},
+}
+
+const (
+	floatFor    = 1200 * time.Millisecond
+	floatStep   = 60 * time.Millisecond
+	maxFloating = 4 // more at once than this and the rest are dropped
+)
+
+// reactionNamed looks a reaction up by name; peers only get to pick
+// from our table, never send art of their own
+func reactionNamed(name string) (reaction, bool) {
+	for _, r := range reactions {
+		if r.name == name {
+			return r, true
+		}
+	}
+	return reaction{}, false
+}
+
+// reactionKey is the reaction bound to key k ("1" to "4")
+func reactionKey(k string) (reaction, bool) {
+	if len(k) != 1 || k[0] < '1' || int(k[0]-'1') >= len(reactions) {
+		return reaction{}, false
+	}
+	return reactions[k[0]-'1'], true
+}
+
+// floater animates reactions on a screen
+type floater struct {
+	scr *screen
+
+	mu     sync.Mutex
+	next   int // for layer names
+	flying int
+}
+
+// float sends r up through tile, from the bottom to about a third of the
+// way from the top. Every frame repaints the tile, so the trail it
+// leaves is cleaned up as the video goes by.
+func (f *floater) float(r reaction, tile rect) {
+	f.mu.Lock()
+	if f.flying >= maxFloating {
+		f.mu.Unlock()
+		return
+	}
+	f.flying++
+	f.next++
+	name := fmt.Sprintf("reaction%d", f.next)
+	// spread simultaneous ones out a little
+	offset := (f.next%3 - 1) * tile.w / 4
+	f.mu.Unlock()
+
+	start := time.Now()
+	from := tile.y + tile.h - len(r.art)
+	to := tile.y + tile.h/3
+	x := tile.x + (tile.w-len(r.art[0]))/2 + offset
+	f.scr.setLayer(name, func() string {
+		t := min(1, float64(time.Since(start))/float64(floatFor))
+		return r.draw(x, from+int(float64(to-from)*t), tile)
+	})
+
+	go func() {
+		defer guard()
+		t := time.NewTicker(floatStep)
+		defer t.Stop()
+		for range t.C {
+			if time.Since(start) >= floatFor {
+				break
+			}
+			f.scr.redrawLayers()
+		}
+		f.scr.setLayer(name, nil)
+		f.mu.Lock()
+		f.flying--
+		f.mu.Unlock()
+	}()
+}
+
+// draw paints the art with its top left at x, y (zero based), leaving
+// the video showing through the spaces and clipping it to tile
+func (r reaction) draw(x, y int, tile rect) string {
+	var b strings.Builder
+	b.WriteString("\0337\033[0;" + r.color + "m")
+	for i, line := range r.art {
+		row := y + i
+		if row < tile.y || row >= tile.y+tile.h {
+			continue
+		}
+		for j, ch := range []rune(line) {
+			col := x + j
+			if ch == ' ' || col < tile.x || col >= tile.x+tile.w {
+				continue
+			}
+			fmt.Fprintf(&b, "\033[%d;%dH%c", row+1, col+1, ch)
+		}
+	}
+	b.WriteString("\033[0m\0338")
+	return b.String()
+}
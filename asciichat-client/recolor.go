@@ -0,0 +1,185 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ---------- colorblind palettes ----------
+
+// A recolorer daltonizes the peer's frames on the way to our screen:
+// it works out what a color looks like with a given deficiency, and
+// pushes the part that's lost into channels that are still visible.
+// It's all linear, so the whole thing folds into one 3x3 matrix.
+
+// deficiency simulation matrices, in LMS space
+var colorFilters = []struct {
+	name string
+	sim  [3][3]float64
+}{
+	{"none", [3][3]float64{}},
+	{"deuteranopia", [3][3]float64{{1, 0, 0}, {0.494207, 0, 1.24827}, {0, 0, 1}}},
+	{"protanopia", [3][3]float64{{0, 2.02344, -2.52581}, {0, 1, 0}, {0, 0, 1}}},
+	{"tritanopia", [3][3]float64{{1, 0, 0}, {0, 1, 0}, {-0.395913, 0.801109, 0}}},
+}
+
+func colorFilterIndex(name string) int {
+	for i, f := range colorFilters {
+		if f.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+var (
+	rgbToLMS = [3][3]float64{
+		{17.8824, 43.5161, 4.11935},
+		{3.45565, 27.1554, 3.86714},
+		{0.0299566, 0.184309, 1.46709},
+	}
+	lmsToRGB = [3][3]float64{
+		{0.0809444479, -0.130504409, 0.116721066},
+		{-0.0102485335, 0.0540193266, -0.113614708},
+		{-0.000365296938, -0.00412161469, 0.693511405},
+	}
+	// where the lost information goes
+	errorShift = [3][3]float64{{0, 0, 0}, {0.7, 1, 0}, {0.7, 0, 1}}
+)
+
+func mul3(a, b [3][3]float64) [3][3]float64 {
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return m
+}
+
+type recolorer struct {
+	m      [3][3]float64
+	idx16  [16]int  // system color -> system color
+	idx256 [256]int // 256-color index -> 256-color index
+}
+
+// newRecolorer builds the remap for colorFilters[i]; nil for "none"
+func newRecolorer(i int) *recolorer {
+	if i <= 0 {
+		return nil
+	}
+
+	// corrected = c + shift * (c - simulated(c))
+	sim := mul3(lmsToRGB, mul3(colorFilters[i].sim, rgbToLMS))
+	var m [3][3]float64
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			id := 0.0
+			if r == c {
+				id = 1
+			}
+			m[r][c] = id - sim[r][c]
+		}
+	}
+	m = mul3(errorShift, m)
+	for d := 0; d < 3; d++ {
+		m[d][d]++
+	}
+
+	rc := &recolorer{m: m}
+	enc16 := newColorEncoder(options{Depth: depth16, Quantizer: quantizerIndex("perceptual")})
+	enc256 := newColorEncoder(options{Depth: depth256, Quantizer: quantizerIndex("perceptual")})
+	for n := 0; n < 256; n++ {
+		x := xterm256(n)
+		c := rc.apply(rgb{x.R, x.G, x.B})
+		if n < 16 {
+			rc.idx16[n] = enc16.index(c)
+			rc.idx256[n] = rc.idx16[n]
+		} else {
+			rc.idx256[n] = enc256.index(c)
+		}
+	}
+	return rc
+}
+
+func (rc *recolorer) apply(c rgb) rgb {
+	in := [3]float64{float64(c.r), float64(c.g), float64(c.b)}
+	var out [3]uint8
+	for i := 0; i < 3; i++ {
+		v := rc.m[i][0]*in[0] + rc.m[i][1]*in[1] + rc.m[i][2]*in[2]
+		out[i] = uint8(min(255, max(0, v+0.5)))
+	}
+	return rgb{out[0], out[1], out[2]}
+}
+
+// frame rewrites every SGR color in a (sanitized) frame
+func (rc *recolorer) frame(frame string) string {
+	if rc == nil {
+		return frame
+	}
+
+	var b strings.Builder
+	b.Grow(len(frame))
+	for {
+		i := strings.Index(frame, "\033[")
+		if i < 0 {
+			b.WriteString(frame)
+			return b.String()
+		}
+		j := i + 2
+		for j < len(frame) && (frame[j] >= '0' && frame[j] <= '9' || frame[j] == ';') {
+			j++
+		}
+		b.WriteString(frame[:i])
+		if j < len(frame) && frame[j] == 'm' {
+			b.WriteString("\033[" + rc.sgr(frame[i+2:j]) + "m")
+		} else {
+			b.WriteString(frame[i:min(j+1, len(frame))])
+		}
+		frame = frame[min(j+1, len(frame)):]
+	}
+}
+
+// sgr remaps the colors in one SGR parameter list
+func (rc *recolorer) sgr(params string) string {
+	p := strings.Split(params, ";")
+	for i := 0; i < len(p); i++ {
+		n, err := strconv.Atoi(p[i])
+		if err != nil {
+			continue
+		}
+		switch {
+		case n >= 30 && n <= 37, n >= 40 && n <= 47:
+			base := n - n%10
+			to := rc.idx16[n%10]
+			if to >= 8 {
+				base += 60 // bright: 90-97 / 100-107
+			}
+			p[i] = strconv.Itoa(base + to%8)
+		case n >= 90 && n <= 97, n >= 100 && n <= 107:
+			base := n - n%10 - 60
+			to := rc.idx16[n%10+8]
+			if to >= 8 {
+				base += 60
+			}
+			p[i] = strconv.Itoa(base + to%8)
+		case (n == 38 || n == 48) && i+2 < len(p) && p[i+1] == "5":
+			if k, err := strconv.Atoi(p[i+2]); err == nil && k >= 0 && k < 256 {
+				p[i+2] = strconv.Itoa(rc.idx256[k])
+			}
+			i += 2
+		case (n == 38 || n == 48) && i+4 < len(p) && p[i+1] == "2":
+			var c [3]uint8
+			for k := 0; k < 3; k++ {
+				v, _ := strconv.Atoi(p[i+2+k])
+				c[k] = uint8(min(255, max(0, v)))
+			}
+			out := rc.apply(rgb{c[0], c[1], c[2]})
+			p[i+2], p[i+3], p[i+4] = strconv.Itoa(int(out.r)), strconv.Itoa(int(out.g)), strconv.Itoa(int(out.b))
+			i += 4
+		}
+	}
+	return strings.Join(p, ";")
+}
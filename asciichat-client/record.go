@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recorder captures everything we draw to the screen
+type recorder interface {
+	write(data string)
+	Close() error
+}
+
+// newRecorder picks the format from -record-format, or the file extension
+func newRecorder(path, format string, width, height int) (recorder, error) {
+	if format == "auto" {
+		format = "cast"
+		if strings.HasSuffix(path, ".ttyrec") || strings.HasSuffix(path, ".tty") {
+			format = "ttyrec"
+		}
+	}
+
+	switch format {
+	case "cast":
+		return newCastRecorder(path, width, height)
+	case "ttyrec":
+		return newTtyrecRecorder(path)
+	default:
+		return nil, fmt.Errorf("unknown recording format %q (want cast or ttyrec)", format)
+	}
+}
+
+// ---------- asciinema ----------
+
+// castRecorder writes an asciinema v2 cast file
+type castRecorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	start time.Time
+}
+
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+func newCastRecorder(path string, width, height int) (*castRecorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &castRecorder{f: f, start: time.Now()}
+	hdr, _ := json.Marshal(castHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: r.start.Unix(),
+		Env:       map[string]string{"TERM": os.Getenv("TERM")},
+	})
+	if _, err := fmt.Fprintf(f, "%s\n", hdr); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// write appends an output event
+func (r *castRecorder) write(data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ev, _ := json.Marshal([]any{time.Since(r.start).Seconds(), "o", data})
+	fmt.Fprintf(r.f, "%s\n", ev)
+}
+
+func (r *castRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// ---------- ttyrec ----------
+
+// ttyrecRecorder writes the ttyrec format understood by ttyplay/ttygif:
+// each chunk is a little-endian sec, usec, len header followed by data
+type ttyrecRecorder struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func newTtyrecRecorder(path string) (*ttyrecRecorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ttyrecRecorder{f: f}, nil
+}
+
+func (r *ttyrecRecorder) write(data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var hdr [12]byte
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(data)))
+	r.f.Write(hdr[:])
+	r.f.WriteString(data)
+}
+
+func (r *ttyrecRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
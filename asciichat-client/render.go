@@ -0,0 +1,263 @@
+package main
+
+import (
+	"image"
+	"slices"
+
+	"gocv.io/x/gocv"
+)
+
+// renderer turns pixels into a grid; each cell covers cellW x cellH pixels
+type renderer struct {
+	name         string
+	cellW, cellH int
+	render       func(p pixels, g *grid, o options)
+}
+
+var renderers = []renderer{
+	{"ascii", 1, 2, renderASCII},
+	{"quadrant", 2, 2, renderQuadrant},
+	{"sextant", 2, 3, renderSextant},
+	{"bg", 1, 2, renderBackground},
+	{"halfblock", 1, 2, renderHalfBlock},
+}
+
+func rendererIndex(name string) int {
+	for i, r := range renderers {
+		if r.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// fallbacks is what to draw instead when a terminal lacks a renderer's
+// glyphs, ending at ascii, which every terminal can show
+var fallbacks = map[string]string{"sextant": "quadrant", "quadrant": "halfblock", "halfblock": "bg", "bg": "ascii"}
+
+// drawableMode is mode, or the nearest renderer to it that a terminal
+// that can draw these (nil for anything) can show
+func drawableMode(mode int, can []string) int {
+	for name := renderers[mode].name; ; name = fallbacks[name] {
+		if can == nil || name == "ascii" || slices.Contains(can, name) {
+			return rendererIndex(name)
+		}
+	}
+}
+
+func processFrame(img gocv.Mat, width, height int, o options) string {
+	g := drawGrid(applyFilters(scaleFrame(img, width, height, o)), width, height, o)
+	userScript.filterCells(g)
+	userMark.stampCells(g)
+	return g.ansi(o)
+}
+
+// scaleFrame mirrors and resizes the camera picture to the grid times
+// the pixels each cell covers
+func scaleFrame(img gocv.Mat, width, height int, o options) pixels {
+	r := renderers[o.Mode]
+	return scalePixels(img, width*r.cellW, height*r.cellH, o.Mirror, shape(width, height, o.Aspect))
+}
+
+// shape is how wide a width x height grid of cells looks for its
+// height, given the cells' aspect; 0 if that's unknown
+func shape(width, height int, aspect float64) float64 {
+	if aspect <= 0 || height <= 0 {
+		return 0
+	}
+	return float64(width) / (float64(height) * aspect)
+}
+
+// scalePixels mirrors and resizes the camera picture to w x h pixels,
+// first trimming it to the shape it'll be seen at, if known, rather
+// than stretching it
+func scalePixels(img gocv.Mat, w, h int, mirror bool, shape float64) pixels {
+	src := img
+	if shape > 0 {
+		cols, rows := img.Cols(), img.Rows()
+		r := image.Rect(0, 0, cols, rows)
+		if float64(cols) > shape*float64(rows) {
+			cw := int(shape * float64(rows)) // too wide: trim the sides
+			r = image.Rect((cols-cw)/2, 0, (cols-cw)/2+cw, rows)
+		} else {
+			ch := int(float64(cols) / shape) // too tall: trim top and bottom
+			r = image.Rect(0, (rows-ch)/2, cols, (rows-ch)/2+ch)
+		}
+		if r.Dx() > 0 && r.Dy() > 0 {
+			cropped := img.Region(r)
+			defer cropped.Close()
+			src = cropped
+		}
+	}
+
+	// Flip horizontally (mirror)
+	if mirror {
+		flipped := gocv.NewMat()
+		gocv.Flip(src, &flipped, 1)
+		defer flipped.Close()
+		src = flipped
+	}
+
+	resized := gocv.NewMat()
+	gocv.Resize(src, &resized, image.Point{X: w, Y: h}, 0, 0, gocv.InterpolationArea)
+	defer resized.Close()
+
+	return pixels{w: resized.Cols(), h: resized.Rows(), bgr: resized.ToBytes()}
+}
+
+// drawGrid turns scaled pixels into cells, with the caption and clock
+// on top
+func drawGrid(p pixels, width, height int, o options) *grid {
+	g := newGrid(width, height)
+	renderers[o.Mode].render(p, g, o)
+	if o.Caption != "" {
+		g.stampCaption(o.Caption)
+	}
+	if o.ClockText != "" {
+		g.stampClock(o.ClockText)
+	}
+	return g
+}
+
+// renderASCII picks a ramp character by brightness
+func renderASCII(p pixels, g *grid, o options) {
+	ramp := rampFor(o.Charset)
+	for y := 0; y < g.h; y++ {
+		for x := 0; x < g.w; x++ {
+			c := p.at(x, y*2) // skip every other row for terminal aspect
+			idx := int(c.lum() / 256 * float64(len(ramp)-1))
+			if o.Dither == ditherOrdered {
+				// pick between the two nearest ramp characters
+				idx = min(len(ramp)-1, int(c.lum()/255*float64(len(ramp)-1)+bayer(x, y)))
+			}
+
+			if o.Invert {
+				idx = len(ramp) - 1 - idx // dense is dark on a light background
+			}
+
+			cl := g.at(x, y)
+			cl.ch = ramp[idx]
+			if o.color() {
+				cl.fg, cl.hasFg = c, true
+			}
+		}
+	}
+}
+
+// renderBackground paints each cell's background in its color under a
+// space: nothing but color, nearly a photo in a truecolor terminal
+func renderBackground(p pixels, g *grid, o options) {
+	if !o.color() {
+		renderASCII(p, g, o) // no colors, no picture
+		return
+	}
+	for y := 0; y < g.h; y++ {
+		for x := 0; x < g.w; x++ {
+			a, b := p.at(x, y*2), p.at(x, y*2+1)
+			cl := g.at(x, y)
+			cl.ch = ' '
+			cl.bg, cl.hasBg = rgb{uint8((int(a.r) + int(b.r)) / 2), uint8((int(a.g) + int(b.g)) / 2), uint8((int(a.b) + int(b.b)) / 2)}, true
+		}
+	}
+}
+
+// renderHalfBlock splits each cell into two square pixels: the top one
+// is the background, the bottom one a ▄ in the foreground
+func renderHalfBlock(p pixels, g *grid, o options) {
+	if !o.color() {
+		renderASCII(p, g, o)
+		return
+	}
+	for y := 0; y < g.h; y++ {
+		for x := 0; x < g.w; x++ {
+			cl := g.at(x, y)
+			cl.ch = '▄'
+			cl.bg, cl.hasBg = p.at(x, y*2), true
+			cl.fg, cl.hasFg = p.at(x, y*2+1), true
+		}
+	}
+}
+
+// 2x2 blocks, bit 0 top-left, 1 top-right, 2 bottom-left, 3 bottom-right
+var quadrants = []rune(" ▘▝▀▖▌▞▛▗▚▐▜▄▙▟█")
+
+// sextant returns the 2x3 block for a pattern, bit 0 top-left through bit
+// 5 bottom-right. Unicode 13 skips the patterns that already exist as
+// half and full blocks.
+func sextant(n int) rune {
+	switch {
+	case n == 0:
+		return ' '
+	case n == 21:
+		return '▌'
+	case n == 42:
+		return '▐'
+	case n == 63:
+		return '█'
+	case n > 42:
+		return rune(0x1FB00 + n - 3)
+	case n > 21:
+		return rune(0x1FB00 + n - 2)
+	default:
+		return rune(0x1FB00 + n - 1)
+	}
+}
+
+func renderQuadrant(p pixels, g *grid, o options) {
+	renderBlocks(p, g, o, 2, 2, func(n int) rune { return quadrants[n] })
+}
+
+func renderSextant(p pixels, g *grid, o options) {
+	renderBlocks(p, g, o, 2, 3, sextant)
+}
+
+// renderBlocks splits each cell's pixels into a bright and a dark group,
+// and draws the bright ones in the foreground color over the dark ones
+func renderBlocks(p pixels, g *grid, o options, cw, ch int, glyph func(int) rune) {
+	px := make([]rgb, cw*ch)
+	for y := 0; y < g.h; y++ {
+		for x := 0; x < g.w; x++ {
+			var mean float64
+			for i := range px {
+				px[i] = p.at(x*cw+i%cw, y*ch+i/cw)
+				mean += px[i].lum()
+			}
+			mean /= float64(len(px))
+
+			n := 0
+			var fg, bg [3]int
+			var nfg, nbg int
+			for i, c := range px {
+				// mono has no background to paint with, so use a fixed
+				// threshold, or a Bayer one per sub-pixel
+				threshold := mean
+				if !o.color() {
+					threshold = 128
+					if o.Dither == ditherOrdered {
+						threshold = 255 * bayer(x*cw+i%cw, y*ch+i/cw)
+					}
+				}
+
+				// in mono the glyph is drawn in the terminal's foreground,
+				// which is dark on a light background
+				if (c.lum() >= threshold) != (o.Invert && !o.color()) {
+					n |= 1 << i
+					fg[0], fg[1], fg[2], nfg = fg[0]+int(c.r), fg[1]+int(c.g), fg[2]+int(c.b), nfg+1
+				} else {
+					bg[0], bg[1], bg[2], nbg = bg[0]+int(c.r), bg[1]+int(c.g), bg[2]+int(c.b), nbg+1
+				}
+			}
+
+			cl := g.at(x, y)
+			cl.ch = glyph(n)
+			if o.color() {
+				if nfg > 0 {
+					cl.fg, cl.hasFg = rgb{uint8(fg[0] / nfg), uint8(fg[1] / nfg), uint8(fg[2] / nfg)}, true
+				}
+				if nbg > 0 {
+					cl.bg, cl.hasBg = rgb{uint8(bg[0] / nbg), uint8(bg[1] / nbg), uint8(bg[2] / nbg)}, true
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ---------- ringing ----------
+
+// An invite (see contacts.go) doesn't take us anywhere by itself: it
+// rings, with the bell every couple of seconds (not while we're busy)
+// and a prompt over the call, until we answer with y, which redials
+// into the caller's room, or decline with n. Left alone it gives up
+// after ringFor, and the caller hears we didn't answer; if the caller
+// hangs up first, the server says so and the ringing stops. A second
+// call while one's ringing is turned away as busy.
+
+// ringFor is how long a call rings; the server gives up at the same time
+const ringFor = 30 * time.Second
+
+const ringEvery = 2 * time.Second
+
+// ringing is the incoming call, if there is one
+type ringing struct {
+	scr    *screen
+	msgCh  chan<- Message
+	answer func(invite Message) // takes us to the caller's room
+	notify bool                 // a desktop notification too
+
+	mu     sync.Mutex
+	invite *Message // nil when nothing's ringing
+	done   chan struct{}
+}
+
+// incoming starts ringing for an invite; quietly, without the bell, if
+// we're busy
+func (r *ringing) incoming(m Message, quiet bool) {
+	r.mu.Lock()
+	if r.invite != nil {
+		r.mu.Unlock()
+		r.msgCh <- Message{Type: MsgTypeDecline, Room: m.Room, Text: "busy"}
+		return
+	}
+	r.invite, r.done = &m, make(chan struct{})
+	done := r.done
+	r.mu.Unlock()
+
+	r.scr.setLayer("ringing", func() string {
+		return box("incoming call", []string{cleanName(m.User) + " is calling", "", "y: answer  n: decline"})
+	})
+	if r.notify {
+		desktopNotify("asciichat", m.User+" is calling")
+	}
+	go r.ring(m.Room, done, quiet)
+}
+
+func (r *ringing) ring(room string, done <-chan struct{}, quiet bool) {
+	defer guard()
+	tick := time.NewTicker(ringEvery)
+	defer tick.Stop()
+	giveUp := time.After(ringFor)
+	for {
+		if !quiet {
+			ringBell()
+		}
+		select {
+		case <-done:
+			return
+		case <-giveUp:
+			if inv := r.finish(room); inv != nil {
+				r.msgCh <- Message{Type: MsgTypeDecline, Room: room, Text: "no answer"}
+				r.scr.toast("missed a call from " + cleanName(inv.User))
+			}
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// finish stops the ringing for room's invite and returns it, nil if
+// that's not what's ringing
+func (r *ringing) finish(room string) *Message {
+	r.mu.Lock()
+	inv := r.invite
+	if inv == nil || inv.Room != room && room != "" {
+		r.mu.Unlock()
+		return nil
+	}
+	r.invite = nil
+	close(r.done)
+	r.mu.Unlock()
+	r.scr.setLayer("ringing", nil)
+	return inv
+}
+
+// cancelled is the caller hanging up before we answered
+func (r *ringing) cancelled(room string) {
+	if inv := r.finish(room); inv != nil {
+		r.scr.toast("missed a call from " + cleanName(inv.User))
+	}
+}
+
+// handle answers or declines while a call's ringing; every other key
+// waits, apart from quitting
+func (r *ringing) handle(k string) bool {
+	r.mu.Lock()
+	ringing := r.invite != nil
+	r.mu.Unlock()
+	if !ringing || k == "q" || k == keyCtrlC {
+		return false
+	}
+	switch k {
+	case "y", keyEnter:
+		if inv := r.finish(""); inv != nil {
+			r.scr.toast("answering " + cleanName(inv.User) + "...")
+			r.answer(*inv)
+		}
+	case "n", keyEsc:
+		if inv := r.finish(""); inv != nil {
+			r.msgCh <- Message{Type: MsgTypeDecline, Room: inv.Room, Text: "declined"}
+			r.scr.toast("declined")
+		}
+	}
+	return true
+}
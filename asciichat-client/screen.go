@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-runewidth"
+	"golang.org/x/term"
+)
+
+// layer is something drawn on top of the video, like the status line or
+// a menu. draw returns the escapes that paint it.
+type layer struct {
+	name string
+	draw func() string
+}
+
+// screen owns the terminal: it serializes drawing so goroutines can't
+// interleave their escape sequences, and repaints layers over each frame
+type screen struct {
+	mu     sync.Mutex
+	out    io.Writer
+	raw    bool              // stdin is in raw mode, so \n needs a \r
+	tiles  map[uint64]string // each peer's latest frame, already positioned
+	layers []layer
+
+	toastID int // so an older toast's timer doesn't hide a newer one
+}
+
+func (s *screen) write(str string) {
+	if s.raw {
+		str = strings.ReplaceAll(str, "\n", "\r\n")
+	}
+	io.WriteString(s.out, str)
+}
+
+// drawFrame paints a new video frame from peer id, placed in its tile,
+// and the layers on top of it
+func (s *screen) drawFrame(id uint64, frame string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tiles == nil {
+		s.tiles = make(map[uint64]string)
+	}
+	s.tiles[id] = frame
+	s.write(frame + s.layerString())
+}
+
+// clearFrames wipes the video, e.g. when the tiles move around because
+// someone came or went
+func (s *screen) clearFrames() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tiles = nil
+	s.repaint()
+}
+
+// setLayer adds or replaces a layer; a nil draw removes it
+func (s *screen) setLayer(name string, draw func() string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, l := range s.layers {
+		if l.name == name {
+			if draw == nil {
+				s.layers = append(s.layers[:i], s.layers[i+1:]...)
+				s.repaint()
+				return
+			}
+			s.layers[i].draw = draw
+			s.write(draw())
+			return
+		}
+	}
+	if draw != nil {
+		s.layers = append(s.layers, layer{name, draw})
+		s.write(draw())
+	}
+}
+
+func (s *screen) hasLayer(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, l := range s.layers {
+		if l.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// redrawLayers paints the layers again without touching the video
+func (s *screen) redrawLayers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.write(s.layerString())
+}
+
+// repaint clears and draws everything; must hold s.mu
+func (s *screen) repaint() {
+	var b strings.Builder
+	b.WriteString("\033[2J\033[H")
+	for _, f := range s.tiles {
+		b.WriteString(f) // tiles don't overlap, so order doesn't matter
+	}
+	s.write(b.String() + s.layerString())
+}
+
+func (s *screen) layerString() string {
+	var b strings.Builder
+	for _, l := range s.layers {
+		b.WriteString(l.draw())
+	}
+	return b.String()
+}
+
+// toast shows a short message on the row above the status line for a
+// moment
+func (s *screen) toast(msg string) {
+	s.mu.Lock()
+	s.toastID++
+	id := s.toastID
+	s.mu.Unlock()
+
+	s.setLayer("toast", func() string {
+		_, h, err := term.GetSize(int(os.Stdout.Fd()))
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf("\0337\033[%d;1H%s %s \033[0m\0338", max(1, h-1), ui.toast, msg)
+	})
+
+	time.AfterFunc(1500*time.Millisecond, func() {
+		s.mu.Lock()
+		current := s.toastID == id
+		s.mu.Unlock()
+		if current {
+			s.setLayer("toast", nil)
+		}
+	})
+}
+
+// the smallest area, in cells, that video is worth drawing in; that's
+// the terminal less a column and the status row
+const minWidth, minHeight = 20, 8
+
+func tooSmall(width, height int) bool {
+	return width < minWidth || height < minHeight
+}
+
+// tooSmallNotice takes the place of video in a cramped terminal
+func tooSmallNotice(width int) string {
+	msg := fmt.Sprintf(" terminal too small (need ≥ %dx%d)", minWidth+1, minHeight+1)
+	return "\0337\033[1;1H\033[0m" + fitWidth(msg, max(1, width)) + "\0338"
+}
+
+// fitWidth truncates or pads s to exactly w terminal columns, counting
+// wide characters (CJK, emoji) as two so layouts don't drift
+func fitWidth(s string, w int) string {
+	return runewidth.FillRight(runewidth.Truncate(s, w, ""), w)
+}
+
+// box draws lines framed and centered on the terminal
+func box(title string, lines []string) string {
+	tw, th, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		tw, th = 80, 24
+	}
+
+	inner := runewidth.StringWidth(title) + 2
+	for _, l := range lines {
+		inner = max(inner, runewidth.StringWidth(l))
+	}
+	inner = min(inner+2, tw-2)
+
+	pad := func(s string) string { return fitWidth(s, inner) }
+
+	top := max(1, (th-len(lines)-2)/2+1)
+	left := max(1, (tw-inner-2)/2+1)
+
+	var b strings.Builder
+	tl, tr, bl, br, hz, vt := ui.border[0], ui.border[1], ui.border[2], ui.border[3], ui.border[4], ui.border[5]
+	b.WriteString("\0337" + ui.box)
+	t := hz + " " + title + " "
+	fmt.Fprintf(&b, "\033[%d;%dH%s%s%s", top, left, tl, pad(t+strings.Repeat(hz, max(0, inner-runewidth.StringWidth(t)))), tr)
+	for i, l := range lines {
+		fmt.Fprintf(&b, "\033[%d;%dH%s%s%s", top+1+i, left, vt, pad(" "+l), vt)
+	}
+	fmt.Fprintf(&b, "\033[%d;%dH%s%s%s", top+1+len(lines), left, bl, strings.Repeat(hz, inner), br)
+	b.WriteString("\033[0m\0338")
+	return b.String()
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"go.starlark.net/starlark"
+)
+
+// ---------- scripts ----------
+
+// -script runs a Starlark (a small Python) file over our video before
+// it's sent or shown, for filters and overlays the client doesn't have.
+// The file can define either or both of:
+//
+//	def pixels(frame):  # the scaled camera picture, before it's drawn
+//	    for y in range(frame.height):
+//	        for x in range(frame.width):
+//	            r, g, b = frame.get(x, y)
+//	            frame.set(x, y, (b, g, r))
+//
+//	def cells(frame):  # the drawn cells, after the caption and clock
+//	    frame.text(0, 0, "LIVE", fg = (255, 0, 0))
+//
+// Both frames have width, height and t (seconds since the script
+// started) and get(x, y); pixels has set(x, y, color) and fill(x, y, w,
+// h, color), with colors as (r, g, b); cells has set(x, y, char = None,
+// fg = None, bg = None) and text(x, y, s, fg = None, bg = None), and get
+// gives (char, fg, bg) with None for the terminal's own colors. Anything
+// drawn off the edge is dropped. Peers who render for themselves (see
+// pixels.go) get the pixels hook but not the cells one. A script that
+// fails, or runs longer than maxScriptSteps, is turned off, and the
+// reason logged; print goes to the log too.
+
+const maxScriptSteps = 20_000_000 // per hook, per frame
+
+// script is a loaded -script
+type script struct {
+	path          string
+	pixels, cells starlark.Callable // nil if the file doesn't define it
+	start         time.Time
+	broken        atomic.Bool
+}
+
+// userScript is -script, nil if there isn't one
+var userScript *script
+
+func loadScript(path string) (*script, error) {
+	thread := &starlark.Thread{Name: "load", Print: scriptPrint}
+	thread.SetMaxExecutionSteps(maxScriptSteps)
+	globals, err := starlark.ExecFile(thread, path, nil, nil)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	s := &script{path: path, start: time.Now()}
+	for name, fn := range map[string]*starlark.Callable{"pixels": &s.pixels, "cells": &s.cells} {
+		if v, ok := globals[name]; ok {
+			if *fn, ok = v.(starlark.Callable); !ok {
+				return nil, fmt.Errorf("%s: %s is a %s, not a function", path, name, v.Type())
+			}
+		}
+	}
+	if s.pixels == nil && s.cells == nil {
+		return nil, fmt.Errorf("%s defines neither pixels(frame) nor cells(frame)", path)
+	}
+	return s, nil
+}
+
+func scriptPrint(_ *starlark.Thread, msg string) { log.Println("script:", msg) }
+
+// scriptError includes the Starlark backtrace, which says where
+func scriptError(err error) error {
+	var e *starlark.EvalError
+	if errors.As(err, &e) {
+		return errors.New(e.Backtrace())
+	}
+	return err
+}
+
+// run calls one of the hooks with frame, turning the script off if it
+// fails
+func (s *script) run(fn starlark.Callable, frame starlark.Value) {
+	if s.broken.Load() {
+		return
+	}
+	thread := &starlark.Thread{Name: fn.Name(), Print: scriptPrint}
+	thread.SetMaxExecutionSteps(maxScriptSteps)
+	if _, err := starlark.Call(thread, fn, starlark.Tuple{frame}, nil); err != nil {
+		if !s.broken.Swap(true) {
+			log.Printf("turning off -script %s: %v", s.path, scriptError(err))
+		}
+	}
+}
+
+func (s *script) elapsed() starlark.Float {
+	return starlark.Float(time.Since(s.start).Seconds())
+}
+
+// filterPixels runs the pixels hook over p, in place
+func (s *script) filterPixels(p pixels) pixels {
+	if s != nil && s.pixels != nil {
+		s.run(s.pixels, &scriptPixels{p: p, t: s.elapsed()})
+	}
+	return p
+}
+
+// filterCells runs the cells hook over g
+func (s *script) filterCells(g *grid) {
+	if s != nil && s.cells != nil {
+		s.run(s.cells, &scriptCells{g: g, t: s.elapsed()})
+	}
+}
+
+// toRGB reads an (r, g, b) color
+func toRGB(v starlark.Value) (rgb, error) {
+	seq, ok := v.(starlark.Indexable)
+	if !ok || seq.Len() != 3 {
+		return rgb{}, fmt.Errorf("want a color (r, g, b), not %s", v)
+	}
+	var c [3]uint8
+	for i := range c {
+		n, err := starlark.AsInt32(seq.Index(i))
+		if err != nil || n < 0 || n > 255 {
+			return rgb{}, fmt.Errorf("want a color (r, g, b) of 0-255, not %s", v)
+		}
+		c[i] = uint8(n)
+	}
+	return rgb{c[0], c[1], c[2]}, nil
+}
+
+func fromRGB(c rgb) starlark.Tuple {
+	return starlark.Tuple{starlark.MakeInt(int(c.r)), starlark.MakeInt(int(c.g)), starlark.MakeInt(int(c.b))}
+}
+
+// optionalRGB is a color, or None to leave it
+func optionalRGB(v starlark.Value) (rgb, bool, error) {
+	if v == nil || v == starlark.None {
+		return rgb{}, false, nil
+	}
+	c, err := toRGB(v)
+	return c, err == nil, err
+}
+
+// frameAttrs is what both frames have; method makes the rest
+func frameAttrs(name string, w, h int, t starlark.Float, method func(string) *starlark.Builtin) (starlark.Value, error) {
+	switch name {
+	case "width":
+		return starlark.MakeInt(w), nil
+	case "height":
+		return starlark.MakeInt(h), nil
+	case "t":
+		return t, nil
+	}
+	if m := method(name); m != nil {
+		return m, nil
+	}
+	return nil, nil // no such attribute
+}
+
+// scriptPixels is the pixels hook's frame
+type scriptPixels struct {
+	p pixels
+	t starlark.Float
+}
+
+func (f *scriptPixels) String() string        { return fmt.Sprintf("<pixels %dx%d>", f.p.w, f.p.h) }
+func (f *scriptPixels) Type() string          { return "pixels" }
+func (f *scriptPixels) Freeze()               {}
+func (f *scriptPixels) Truth() starlark.Bool  { return true }
+func (f *scriptPixels) Hash() (uint32, error) { return 0, errors.New("unhashable: pixels") }
+func (f *scriptPixels) AttrNames() []string {
+	return []string{"fill", "get", "height", "set", "t", "width"}
+}
+
+func (f *scriptPixels) Attr(name string) (starlark.Value, error) {
+	return frameAttrs(name, f.p.w, f.p.h, f.t, f.method)
+}
+
+func (f *scriptPixels) put(x, y int, c rgb) {
+	if x >= 0 && y >= 0 && x < f.p.w && y < f.p.h {
+		i := (y*f.p.w + x) * 3
+		f.p.bgr[i], f.p.bgr[i+1], f.p.bgr[i+2] = c.b, c.g, c.r
+	}
+}
+
+func (f *scriptPixels) method(name string) *starlark.Builtin {
+	var fn func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error)
+	switch name {
+	case "get":
+		fn = func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var x, y int
+			if err := starlark.UnpackPositionalArgs(name, args, kwargs, 2, &x, &y); err != nil {
+				return nil, err
+			}
+			if x < 0 || y < 0 || x >= f.p.w || y >= f.p.h {
+				return nil, fmt.Errorf("get: (%d, %d) is outside %dx%d", x, y, f.p.w, f.p.h)
+			}
+			return fromRGB(f.p.at(x, y)), nil
+		}
+	case "set":
+		fn = func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var x, y int
+			var color starlark.Value
+			if err := starlark.UnpackPositionalArgs(name, args, kwargs, 3, &x, &y, &color); err != nil {
+				return nil, err
+			}
+			c, err := toRGB(color)
+			if err != nil {
+				return nil, err
+			}
+			f.put(x, y, c)
+			return starlark.None, nil
+		}
+	case "fill":
+		fn = func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var x, y, w, h int
+			var color starlark.Value
+			if err := starlark.UnpackPositionalArgs(name, args, kwargs, 5, &x, &y, &w, &h, &color); err != nil {
+				return nil, err
+			}
+			c, err := toRGB(color)
+			if err != nil {
+				return nil, err
+			}
+			for py := max(y, 0); py < min(y+h, f.p.h); py++ {
+				for px := max(x, 0); px < min(x+w, f.p.w); px++ {
+					f.put(px, py, c)
+				}
+			}
+			return starlark.None, nil
+		}
+	default:
+		return nil
+	}
+	return starlark.NewBuiltin(name, func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return fn(args, kwargs)
+	}).BindReceiver(f)
+}
+
+// scriptCells is the cells hook's frame
+type scriptCells struct {
+	g *grid
+	t starlark.Float
+}
+
+func (f *scriptCells) String() string        { return fmt.Sprintf("<cells %dx%d>", f.g.w, f.g.h) }
+func (f *scriptCells) Type() string          { return "cells" }
+func (f *scriptCells) Freeze()               {}
+func (f *scriptCells) Truth() starlark.Bool  { return true }
+func (f *scriptCells) Hash() (uint32, error) { return 0, errors.New("unhashable: cells") }
+func (f *scriptCells) AttrNames() []string {
+	return []string{"get", "height", "set", "t", "text", "width"}
+}
+
+func (f *scriptCells) Attr(name string) (starlark.Value, error) {
+	return frameAttrs(name, f.g.w, f.g.h, f.t, f.method)
+}
+
+// put sets one cell; off the grid it does nothing
+func (f *scriptCells) put(x, y int, ch rune, fg, bg starlark.Value) error {
+	fgc, hasFg, err := optionalRGB(fg)
+	if err != nil {
+		return err
+	}
+	bgc, hasBg, err := optionalRGB(bg)
+	if err != nil {
+		return err
+	}
+	if x < 0 || y < 0 || x >= f.g.w || y >= f.g.h {
+		return nil
+	}
+	cl := f.g.at(x, y)
+	if ch != 0 {
+		cl.ch = ch
+	}
+	if hasFg {
+		cl.fg, cl.hasFg = fgc, true
+	}
+	if hasBg {
+		cl.bg, cl.hasBg = bgc, true
+	}
+	return nil
+}
+
+// cellRune checks a character from the script: one, and safe to send,
+// the same as a caption's
+func cellRune(s string) (rune, error) {
+	r, size := utf8.DecodeRuneInString(s)
+	if size != len(s) || !captionRune(r) {
+		return 0, fmt.Errorf("want one printable, one-cell character, not %q", s)
+	}
+	return r, nil
+}
+
+func (f *scriptCells) method(name string) *starlark.Builtin {
+	var fn func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error)
+	switch name {
+	case "get":
+		fn = func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var x, y int
+			if err := starlark.UnpackPositionalArgs(name, args, kwargs, 2, &x, &y); err != nil {
+				return nil, err
+			}
+			if x < 0 || y < 0 || x >= f.g.w || y >= f.g.h {
+				return nil, fmt.Errorf("get: (%d, %d) is outside %dx%d", x, y, f.g.w, f.g.h)
+			}
+			cl := f.g.at(x, y)
+			var fg, bg starlark.Value = starlark.None, starlark.None
+			if cl.hasFg {
+				fg = fromRGB(cl.fg)
+			}
+			if cl.hasBg {
+				bg = fromRGB(cl.bg)
+			}
+			return starlark.Tuple{starlark.String(string(cl.ch)), fg, bg}, nil
+		}
+	case "set":
+		fn = func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var x, y int
+			var char string
+			var fg, bg starlark.Value
+			if err := starlark.UnpackArgs(name, args, kwargs, "x", &x, "y", &y, "char?", &char, "fg?", &fg, "bg?", &bg); err != nil {
+				return nil, err
+			}
+			var ch rune
+			if char != "" {
+				var err error
+				if ch, err = cellRune(char); err != nil {
+					return nil, err
+				}
+			}
+			return starlark.None, f.put(x, y, ch, fg, bg)
+		}
+	case "text":
+		fn = func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var x, y int
+			var s string
+			var fg, bg starlark.Value
+			if err := starlark.UnpackArgs(name, args, kwargs, "x", &x, "y", &y, "s", &s, "fg?", &fg, "bg?", &bg); err != nil {
+				return nil, err
+			}
+			for _, r := range s {
+				ch, err := cellRune(string(r))
+				if err != nil {
+					return nil, err
+				}
+				if err := f.put(x, y, ch, fg, bg); err != nil {
+					return nil, err
+				}
+				x++
+			}
+			return starlark.None, nil
+		}
+	default:
+		return nil
+	}
+	return starlark.NewBuiltin(name, func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return fn(args, kwargs)
+	}).BindReceiver(f)
+}
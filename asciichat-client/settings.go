@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// charset is a brightness ramp, from dark to bright
+type charset struct {
+	name string
+	ramp []rune
+}
+
+// ordered from sparsest to densest
+var charsets = []charset{
+	{"blocks", []rune(" ░▒▓█")},
+	{"simple", []rune(" .:oO@")},
+	{"standard", []rune(" .:-=+*#%@")},
+	{"detailed", []rune(" .'`^\",:;Il!i><~+_-?][}{1)(|\\/tfjrxnuvczXYUJCLQ0OZmwqpdbkhao*#MW&8%B@$")},
+}
+
+const defaultCharset = 2 // standard
+
+// rampFor returns the charset's ramp, falling back to standard if any of
+// its glyphs would take two columns (the block shades are "ambiguous"
+// width and go wide in CJK locales), which would shear the video grid
+func rampFor(i int) []rune {
+	for _, r := range charsets[i].ramp {
+		if runewidth.RuneWidth(r) != 1 {
+			return charsets[defaultCharset].ramp
+		}
+	}
+	return charsets[i].ramp
+}
+
+var fpsChoices = []int{5, 10, 15, 24, 30, 60}
+
+// options controls how we capture and render; they can change mid-call
+type options struct {
+	Mode      int // index into renderers
+	Depth     depth
+	Quantizer int // index into quantizers, for 256 and 16 colors
+	Dither    int // ditherNone or ditherOrdered
+	Charset   int // index into charsets
+	FPS       int
+	Mirror    bool
+	Split     int  // index into splitNames
+	Paused    bool // stop sending our video, see p
+
+	Invert  bool   // reverse the brightness ramp, for a light background
+	Caption string // burned into the bottom row, see caption.go
+
+	Clock     int    // index into clockNames
+	ClockText string // what the clock says this frame, filled in by the capture loop
+
+	// resolution cap in cells, 0 for none
+	MaxCols int
+	MaxRows int
+	Scale   int     // render at 1/Scale of that, set by congestion control
+	Aspect  float64 // the receiver's cells' height over width, to crop to; 0 to stretch
+}
+
+func (o options) color() bool { return o.Depth != depthMono }
+
+// capSize applies the resolution cap to a frame size
+func capSize(w, h int, o options) (int, int) {
+	if o.MaxCols > 0 {
+		w = min(w, o.MaxCols)
+	}
+	if o.MaxRows > 0 {
+		h = min(h, o.MaxRows)
+	}
+	if o.Scale > 1 {
+		w, h = max(1, w/o.Scale), max(1, h/o.Scale)
+	}
+	return w, h
+}
+
+// settings guards the live options shared by the menu and the capture loop
+type settings struct {
+	mu   sync.Mutex
+	opts options
+}
+
+func (s *settings) get() options {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.opts
+}
+
+func (s *settings) update(f func(o *options)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.opts)
+}
+
+// cycle steps i through n choices, wrapping around
+func cycle(i, n, dir int) int {
+	return ((i+dir)%n + n) % n
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gocv.io/x/gocv"
+	"golang.org/x/term"
+)
+
+// ---------- first run setup ----------
+
+// The first time there's no config and no -device, we ask which camera
+// (showing each one live), which colors and which server, and save the
+// answers to config.json. "asciichat-client setup" asks again.
+
+const maxCameras = 10 // device numbers we try
+
+// runSetup asks its questions and saves the answers, returning them
+func runSetup(server string) (map[string]any, error) {
+	cfg := make(map[string]any)
+	fmt.Println("asciichat setup: a few questions, then you're in.")
+	fmt.Println()
+
+	if dev, ok := pickCamera(); ok {
+		cfg["device"] = dev
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	detected := detectDepth()
+	fmt.Printf("Colors to send: auto (your terminal can show %s), truecolor, 256, 16 or mono [auto]: ", detected)
+	for {
+		answer := readAnswer(in)
+		if answer == "" {
+			answer = "auto"
+		}
+		if _, ok := parseDepth(answer); ok {
+			cfg["colors"] = answer
+			break
+		}
+		fmt.Printf("%q isn't one of those; try again [auto]: ", answer)
+	}
+
+	fmt.Printf("Server [%s]: ", server)
+	if answer := readAnswer(in); answer != "" {
+		cfg["server"] = answer
+	}
+
+	path, err := saveConfig(cfg)
+	if err != nil {
+		return cfg, err
+	}
+	fmt.Printf("\nSaved to %s; edit it, or run \"asciichat-client setup\" to start over.\n\n", path)
+	return cfg, nil
+}
+
+func readAnswer(in *bufio.Reader) string {
+	s, _ := in.ReadString('\n')
+	return strings.TrimSpace(s)
+}
+
+// pickCamera previews each camera that opens until one is picked
+func pickCamera() (int, bool) {
+	var devices []int
+	for _, c := range openableCameras(-1) {
+		devices = append(devices, c.n)
+	}
+	if len(devices) == 0 {
+		fmt.Println("No camera found; you can still watch with -no-send.")
+		fmt.Println()
+		return 0, false
+	}
+
+	old, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return devices[0], true
+	}
+	defer term.Restore(int(os.Stdin.Fd()), old)
+	fmt.Print("\033[?1049h\033[?25l")
+	defer fmt.Print("\033[?25h\033[?1049l")
+
+	// one key at a time, and only while we're still asking, so nothing
+	// is left reading stdin once we're done
+	keys, more := make(chan byte), make(chan bool)
+	go func() {
+		defer guard()
+		b := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(b); err != nil {
+				close(keys)
+				return
+			}
+			keys <- b[0]
+			if !<-more {
+				return
+			}
+		}
+	}()
+
+	for i := 0; ; {
+		switch k, done := previewCamera(devices[i], len(devices) > 1, keys); {
+		case done:
+			return 0, false
+		case k == '\r' || k == '\n':
+			more <- false
+			return devices[i], true
+		case k == 'q' || k == 3 || k == 033:
+			more <- false
+			return 0, false
+		case k == 'n' || k == ' ':
+			i = (i + 1) % len(devices)
+			more <- true
+		default:
+			more <- true
+		}
+	}
+}
+
+// previewCamera shows camera n until a key comes in, returning it; done
+// means stdin closed
+func previewCamera(n int, others bool, keys <-chan byte) (byte, bool) {
+	w, h, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		w, h = 80, 24
+	}
+	w, h = min(w-1, 100), max(1, min(h-3, 40))
+	hint := "enter: use this camera  q: skip"
+	if others {
+		hint = "enter: use this camera  n: next camera  q: skip"
+	}
+	fmt.Printf("\033[2J\033[HCamera %d\r\n%s", n, hint)
+
+	cam, err := gocv.OpenVideoCapture(n)
+	if err != nil || !cam.IsOpened() {
+		fmt.Printf("\r\n\r\ncan't open camera %d any more", n)
+		k, ok := <-keys
+		return k, !ok
+	}
+	defer cam.Close()
+
+	img := gocv.NewMat()
+	defer img.Close()
+	o := options{Depth: detectDepth(), Charset: defaultCharset, Mirror: true, Quantizer: quantizerIndex("perceptual")}
+	tick := time.NewTicker(time.Second / 15)
+	defer tick.Stop()
+	for {
+		select {
+		case k, ok := <-keys:
+			return k, !ok
+		case <-tick.C:
+			if cam.Read(&img) && !img.Empty() {
+				frame := processFrame(img, w, h, o)
+				fmt.Print(place(frame, rect{0, 3, w, h}))
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+// ---------- split view ----------
+
+// With a split, our own camera gets half the screen and whoever we're
+// talking to gets the other half, both rendered to fit their pane.
+
+var splitNames = []string{"off", "side", "stacked", "auto"}
+
+const (
+	splitOff     = iota
+	splitSide    // us on the right
+	splitStacked // us underneath
+	splitAuto    // whichever suits the terminal's shape
+)
+
+func splitIndex(name string) int {
+	for i, n := range splitNames {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// resolveSplit picks side or stacked for splitAuto: whichever leaves
+// the panes closest to a 4:3 camera picture. Cells are about twice as
+// tall as they are wide, so side by side panes are w/4h and stacked ones
+// w/h; they're equally good at w = 8h/3.
+func resolveSplit(split, width, height int) int {
+	if split != splitAuto {
+		return split
+	}
+	if 3*width > 8*height {
+		return splitSide
+	}
+	return splitStacked
+}
+
+// panes divides a width x height screen between us and the room, with a
+// one cell gutter. Without a split, self is empty.
+func panes(split, width, height int) (self, remote rect) {
+	switch resolveSplit(split, width, height) {
+	case splitSide:
+		remote = rect{0, 0, max(1, (width-1)/2), height}
+		self = rect{remote.w + 1, 0, max(1, width-remote.w-1), height}
+	case splitStacked:
+		remote = rect{0, 0, width, max(1, (height-1)/2)}
+		self = rect{0, remote.h + 1, width, max(1, height-remote.h-1)}
+	default:
+		remote = rect{0, 0, width, height}
+	}
+	return self, remote
+}
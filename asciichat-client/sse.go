@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ---------- server-sent events ----------
+
+// The last transport auto tries, for networks that block websockets and
+// UDP both: messages come down a stream of server-sent events from
+// /sse, and go up as a POST each to the same URL with the session the
+// stream started with. It's a request a message, so slower, but it's
+// just HTTP.
+
+// dialSSE makes one attempt over an event stream
+func dialSSE(ep endpoint) (wire, http.Header, error) {
+	u, err := altURL(ep.server, "/sse", false)
+	if err != nil {
+		return nil, nil, err
+	}
+	u.RawQuery = ep.query.Encode()
+	log.Printf("connecting to %s for events", u.String())
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range ep.header {
+		req.Header[k] = v
+	}
+	req.Header.Set(protocolHeader, subprotocol)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect for events: %w", err)
+	}
+	fail := func(err error) (wire, http.Header, error) {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusUpgradeRequired:
+		return fail(fmt.Errorf("%w: the server speaks a different protocol version than this client (%s); time to update", errIncompatible, subprotocol))
+	case resp.StatusCode == http.StatusUnauthorized:
+		return fail(loginNeeded())
+	case resp.StatusCode != http.StatusOK:
+		return fail(fmt.Errorf("failed to connect for events: %s", resp.Status))
+	case resp.Header.Get(protocolHeader) != subprotocol:
+		return fail(fmt.Errorf("%w: server didn't agree to %s, it's probably too old for this client", errIncompatible, subprotocol))
+	}
+
+	c := &sseConn{body: resp.Body, r: bufio.NewReaderSize(resp.Body, 64<<10)}
+	c.stall = time.AfterFunc(writeWait, func() { resp.Body.Close() })
+	name, session, err := c.next()
+	c.stall.Stop() // until the first read sets a deadline
+	if err != nil || name != "session" {
+		return fail(fmt.Errorf("failed to start an event stream: no session (%v)", err))
+	}
+	q := u.Query()
+	q.Set("session", string(session))
+	u.RawQuery = q.Encode()
+	c.post = u.String()
+	c.header = ep.header
+	return c, resp.Header, nil
+}
+
+// sseConn is an event stream down and posts up
+type sseConn struct {
+	body   io.ReadCloser
+	r      *bufio.Reader
+	post   string // where our messages go
+	header http.Header
+
+	// the read deadline, as a timer that hangs up; every event or
+	// keepalive pushes it back, like a pong
+	mu    sync.Mutex
+	stall *time.Timer
+	wait  time.Duration
+
+	deadline time.Time // for posts
+}
+
+// next reads one event, skipping keepalives
+func (c *sseConn) next() (string, []byte, error) {
+	var name string
+	var data [][]byte
+	size := 0
+	for {
+		line, err := c.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// a long line: read the rest of it
+			rest, err2 := c.r.ReadBytes('\n')
+			line, err = append(bytes.Clone(line), rest...), err2
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		c.alive()
+		line = bytes.TrimRight(line, "\r\n")
+		switch {
+		case len(line) == 0:
+			if data != nil {
+				return name, bytes.Join(data, []byte("\n")), nil
+			}
+			name = ""
+		case line[0] == ':': // keepalive
+		default:
+			field, value, _ := bytes.Cut(line, []byte(":"))
+			value = bytes.TrimPrefix(value, []byte(" "))
+			switch string(field) {
+			case "event":
+				name = string(value)
+			case "data":
+				if size += len(value) + 1; size > maxMessage {
+					return "", nil, errors.New("event over the size limit")
+				}
+				data = append(data, bytes.Clone(value))
+			}
+		}
+	}
+}
+
+// alive pushes the read deadline back
+func (c *sseConn) alive() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.wait > 0 {
+		c.stall.Reset(c.wait)
+	}
+}
+
+func (c *sseConn) ReadMessage() (int, []byte, error) {
+	for {
+		name, data, err := c.next()
+		if err != nil {
+			return 0, nil, err
+		}
+		if name == "" {
+			return websocket.TextMessage, data, nil
+		}
+	}
+}
+
+func (c *sseConn) WriteMessage(_ int, data []byte) error {
+	ctx := context.Background()
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.post, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("posting a message: %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *sseConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wait = time.Until(t)
+	c.stall.Reset(c.wait)
+	return nil
+}
+
+func (c *sseConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *sseConn) Close() error {
+	c.stall.Stop()
+	return c.body.Close()
+}
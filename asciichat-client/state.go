@@ -0,0 +1,238 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// callState is what we know about the other end, shared between the
+// read loop and anything that displays it
+type callState struct {
+	mu       sync.Mutex
+	peerName string
+	peerID   string    // anonymous id from the matchmaker
+	since    time.Time // zero while waiting for a peer
+
+	encrypted bool   // keys agreed with the peer
+	keyPrint  string // fingerprint of the peer's ssh key, once verified
+	alias     string // what we saved that key as in known_peers
+
+	lost    bool      // the relay stopped answering and we're redialing
+	online  bool      // we've reached the relay at least once
+	attempt int       // which redial we're on while lost
+	ended   time.Time // when the last call ended, for the overlay
+	opens   time.Time // when a scheduled room lets us in, zero if it's not one
+
+	rtt    time.Duration // last ping round trip through the relay
+	frames int           // frames received since the last tick
+	fps    int
+
+	avail   string // how available we've said we are, see contacts.go
+	dialing string // who we're calling while they haven't answered, see ring.go
+	hold    bool   // we've put the call on hold, see hold.go
+
+	// for the call history, see history.go: where we are, and what
+	// this call has done so far
+	place   callRecord
+	record  func(callRecord) // nil to keep no history
+	in, out int
+	rttSum  time.Duration
+	pongs   int
+}
+
+func (s *callState) frameReceived() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frames++
+	s.in++
+}
+
+func (s *callState) frameSent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.out++
+}
+
+func (s *callState) setRTT(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rtt = d
+	s.rttSum += d
+	s.pongs++
+}
+
+// tick turns the frame count into fps; call once a second
+func (s *callState) tick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fps, s.frames = s.frames, 0
+}
+
+func (s *callState) peerJoined(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.peerName = cleanName(name)
+	s.dialing = ""
+	if s.since.IsZero() {
+		s.since = time.Now()
+	}
+}
+
+func (s *callState) setPeer(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peerID = id
+}
+
+func (s *callState) setEncrypted(e bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.encrypted = e
+}
+
+func (s *callState) setLost(lost bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lost = lost
+	if !lost {
+		s.online, s.attempt = true, 0
+	}
+}
+
+// setOpens notes that the room is booked and we're waiting outside
+func (s *callState) setOpens(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opens = t
+}
+
+func (s *callState) setAttempt(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempt = n
+}
+
+func (s *callState) setIdentity(fingerprint, alias string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keyPrint, s.alias = fingerprint, alias
+}
+
+// cycleStatus moves on to the next status and returns it
+func (s *callState) cycleStatus() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.Index(statuses, s.avail)
+	s.avail = statuses[(i+1)%len(statuses)]
+	return s.avail
+}
+
+func (s *callState) myStatus() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.avail
+}
+
+func (s *callState) setDialing(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dialing = text
+}
+
+// setPlace is where calls happen from now on: the server, the room and
+// whether it's matchmaking, and the account we called or that called us
+func (s *callState) setPlace(place callRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.place = place
+}
+
+// waiting reports whether we're online with nobody to talk to yet
+func (s *callState) waiting() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.lost && !s.hold && s.since.IsZero()
+}
+
+// callStart is when the call began, zero while waiting
+func (s *callState) callStart() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.since
+}
+
+// name is what the peer calls themselves
+func (s *callState) name() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peerName
+}
+
+func (s *callState) peer() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peerID
+}
+
+func (s *callState) peerLeft() {
+	if c, ok := s.hangUp(); ok && s.record != nil {
+		s.record(c)
+	}
+}
+
+// hangUp forgets the peer, and returns the call that's ended, if one had
+// begun
+func (s *callState) hangUp() (callRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.place, !s.since.IsZero()
+	if ok {
+		s.ended = time.Now()
+		c.Start, c.End = s.since, s.ended
+		c.Peer, c.Key, c.Alias = s.peerName, s.keyPrint, s.alias
+		c.FramesIn, c.FramesOut = s.in, s.out
+		if s.pongs > 0 {
+			c.RTT = float64((s.rttSum / time.Duration(s.pongs)).Microseconds()) / 1000
+		}
+	}
+	s.in, s.out, s.rttSum, s.pongs = 0, 0, 0, 0
+	s.peerName, s.peerID, s.encrypted = "", "", false
+	s.keyPrint, s.alias = "", ""
+	s.since = time.Time{}
+	s.rtt, s.fps, s.frames = 0, 0, 0
+	return c, ok
+}
+
+// title describes the call for the terminal title
+func (s *callState) title() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lost {
+		return "asciichat — reconnecting"
+	}
+	if s.since.IsZero() {
+		return "asciichat — waiting"
+	}
+
+	elapsed := formatElapsed(time.Since(s.since))
+	if s.peerName == "" {
+		return "asciichat — in call " + elapsed
+	}
+	return "asciichat — call with " + s.peerName + " " + elapsed
+}
+
+// cleanName drops control characters so a peer's name can't smuggle
+// escape sequences into our title
+func cleanName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0) {
+			return -1
+		}
+		return r
+	}, name)
+}
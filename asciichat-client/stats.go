@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- stats ----------
+
+// With -stats-out we write a row of numbers for every second of the
+// session, for chasing a call that's always choppy: frames and bytes
+// each way, the round trip, and messages dropped, whether we couldn't
+// send them or they arrived unusable. It's CSV, or JSON lines if the
+// file ends in .json or .jsonl, and each row is flushed as it's written,
+// so a client that's killed mid-call still leaves everything up to then.
+
+// statsLog counts what one second of the call did. A nil one counts
+// nothing, so callers needn't check for -stats-out.
+type statsLog struct {
+	mu                  sync.Mutex
+	framesIn, framesOut int
+	bytesIn, bytesOut   int
+	drops               int
+	rtt                 time.Duration // the worst round trip this second, 0 for none
+
+	f    *os.File
+	csv  *csv.Writer // nil when writing JSON
+	json *json.Encoder
+}
+
+// statsRow is one second, as a JSON line
+type statsRow struct {
+	Time     string   `json:"time"`
+	FPSIn    int      `json:"fps_in"`
+	FPSOut   int      `json:"fps_out"`
+	BytesIn  int      `json:"bytes_in"`
+	BytesOut int      `json:"bytes_out"`
+	RTT      *float64 `json:"rtt_ms"` // null when no pong came back
+	Drops    int      `json:"drops"`
+}
+
+var statsColumns = []string{"time", "fps_in", "fps_out", "bytes_in", "bytes_out", "rtt_ms", "drops"}
+
+// openStats starts writing stats to path, a row a second until close
+func openStats(path string) (*statsLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &statsLog{f: f}
+	if strings.HasSuffix(path, ".json") || strings.HasSuffix(path, ".jsonl") {
+		l.json = json.NewEncoder(f)
+	} else {
+		l.csv = csv.NewWriter(f)
+		l.csv.Write(statsColumns)
+		l.csv.Flush()
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *statsLog) run() {
+	defer guard()
+	for now := range time.Tick(time.Second) {
+		if err := l.flush(now); err != nil {
+			log.Println("stats:", err)
+			return
+		}
+	}
+}
+
+// flush writes the second that's just gone and starts the next
+func (l *statsLog) flush(now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil // closed
+	}
+
+	row := statsRow{
+		Time: now.Format(time.RFC3339), FPSIn: l.framesIn, FPSOut: l.framesOut,
+		BytesIn: l.bytesIn, BytesOut: l.bytesOut, Drops: l.drops,
+	}
+	if l.rtt > 0 {
+		ms := float64(l.rtt.Microseconds()) / 1000
+		row.RTT = &ms
+	}
+	l.framesIn, l.framesOut, l.bytesIn, l.bytesOut, l.drops, l.rtt = 0, 0, 0, 0, 0, 0
+
+	if l.json != nil {
+		return l.json.Encode(row)
+	}
+	rtt := ""
+	if row.RTT != nil {
+		rtt = strconv.FormatFloat(*row.RTT, 'f', 1, 64)
+	}
+	l.csv.Write([]string{row.Time, strconv.Itoa(row.FPSIn), strconv.Itoa(row.FPSOut),
+		strconv.Itoa(row.BytesIn), strconv.Itoa(row.BytesOut), rtt, strconv.Itoa(row.Drops)})
+	l.csv.Flush()
+	return l.csv.Error()
+}
+
+// sent counts a message written to the relay
+func (l *statsLog) sent(n int, frame bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bytesOut += n
+	if frame {
+		l.framesOut++
+	}
+}
+
+// received counts a message read from the relay
+func (l *statsLog) received(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bytesIn += n
+}
+
+// shown counts a peer's frame making it to the screen
+func (l *statsLog) shown() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.framesIn++
+}
+
+func (l *statsLog) dropped() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.drops++
+}
+
+func (l *statsLog) ack(rtt time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rtt = max(l.rtt, rtt)
+}
+
+// close writes the last, partial second and the file
+func (l *statsLog) close() error {
+	if l == nil {
+		return nil
+	}
+	err := l.flush(time.Now())
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-runewidth"
+	"golang.org/x/term"
+)
+
+// quality grades the call from rtt and fps
+func quality(rtt time.Duration, fps int) (string, string) {
+	switch {
+	case rtt < 150*time.Millisecond && fps >= 20:
+		return "●●●", "good"
+	case rtt < 400*time.Millisecond && fps >= 10:
+		return "●●○", "fair"
+	default:
+		return "●○○", "poor"
+	}
+}
+
+// status renders the bottom row, padded to width
+func (s *callState) status(width int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var text string
+	if s.lost {
+		text = " offline, trying to reach the server..."
+	} else if s.since.IsZero() {
+		text = " waiting for peer..."
+	} else {
+		name := s.peerName
+		if name == "" {
+			name = "peer"
+		}
+		name = runewidth.Truncate(name, 20, "…")
+		switch {
+		case s.alias != "":
+			name = runewidth.Truncate(s.alias, 20, "…") + " ✓" // a key we know
+		case s.keyPrint != "":
+			name += " (new key)"
+		}
+		rtt := "--"
+		if s.rtt > 0 {
+			rtt = fmt.Sprintf("%dms", s.rtt.Milliseconds())
+		}
+		dots, label := quality(s.rtt, s.fps)
+		text = " " + strings.Join([]string{name, "rtt " + rtt, fmt.Sprintf("%d fps", s.fps), dots + " " + label}, ui.sep)
+		if s.encrypted {
+			text += ui.sep + "e2e"
+		}
+	}
+	if fx := userFilters.status(); fx != "" {
+		text += ui.sep + fx
+	}
+
+	return fitWidth(text, width)
+}
+
+// statusLine is the escape sequence that draws the status on the last
+// row, with the mouse buttons at the right if there are any
+func statusLine(state *callState, buttons []button) string {
+	w, h, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return ""
+	}
+	text := state.status(w)
+	if len(buttons) > 0 {
+		bar := buttonBar(buttons)
+		text = state.status(max(0, w-len(bar))) + bar
+	}
+	// save cursor, jump to the last row, reverse video, restore
+	return fmt.Sprintf("\0337\033[%d;1H%s%s\033[0m\0338", h, ui.status, fitWidth(text, w))
+}
+
+// keepStatus updates fps and redraws the status once a second
+func keepStatus(scr *screen, state *callState, buttons func() []button) {
+	defer guard()
+	scr.setLayer("status", func() string { return statusLine(state, buttons()) })
+	for range time.Tick(time.Second) {
+		state.tick()
+		scr.redrawLayers()
+	}
+}
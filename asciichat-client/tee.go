@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// ---------- tee ----------
+
+// -tee-in and -tee-out copy the video we receive or send, as ANSI text,
+// to a file or named pipe while the call runs, for OBS text sources,
+// overlays and the like. A regular file always holds just the latest
+// frame, replaced whole so readers never see half of one; a named pipe
+// gets every frame in turn, as -stdout writes them. A reader that
+// falls behind misses frames rather than holding up the call.
+
+type tee struct {
+	path   string
+	frames chan string
+}
+
+func newTee(path string) *tee {
+	t := &tee{path: path, frames: make(chan string, 4)}
+	go t.run()
+	return t
+}
+
+// write queues a frame, dropping it if the reader's behind
+func (t *tee) write(frame string) {
+	select {
+	case t.frames <- frame:
+	default:
+	}
+}
+
+func (t *tee) run() {
+	defer guard()
+	if info, err := os.Stat(t.path); err == nil && info.Mode()&os.ModeNamedPipe != 0 {
+		t.stream()
+	} else {
+		t.replace()
+	}
+}
+
+// stream writes frames to a named pipe, waiting for a reader to open it
+// and again whenever one goes away
+func (t *tee) stream() {
+	for {
+		f, err := os.OpenFile(t.path, os.O_WRONLY, 0) // blocks until there's a reader
+		if err != nil {
+			log.Printf("tee %s: %v", t.path, err)
+			return
+		}
+		for frame := range t.frames {
+			var b strings.Builder
+			streamFrame(&b, frame)
+			if _, err = f.WriteString(b.String()); err != nil {
+				break // the reader left
+			}
+		}
+		f.Close()
+	}
+}
+
+// replace keeps the file holding the latest frame
+func (t *tee) replace() {
+	tmp := t.path + ".tmp"
+	for frame := range t.frames {
+		if err := os.WriteFile(tmp, []byte(frame+"\033[0m\n"), 0o644); err != nil {
+			log.Printf("tee %s: %v", t.path, err)
+			continue
+		}
+		if err := os.Rename(tmp, t.path); err != nil {
+			log.Printf("tee %s: %v", t.path, err)
+		}
+	}
+}
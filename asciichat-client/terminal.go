@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// ---------- terminal restore ----------
+
+// rawState is set once stdin is in raw mode
+var (
+	rawState    *term.State
+	restoreOnce sync.Once
+)
+
+// streaming is -stdout: stdout carries frames, so we never touch the
+// terminal
+var streaming bool
+
+// restoreTerminal undoes everything we did to the user's terminal. It's
+// safe to call from anywhere, any number of times: signal handler, panic,
+// fatal error or a normal return from main.
+func restoreTerminal() {
+	restoreOnce.Do(func() {
+		if rawState != nil {
+			term.Restore(int(os.Stdin.Fd()), rawState)
+		}
+		if streaming {
+			return
+		}
+		popTitle()
+		fmt.Print(mouseOff)
+		fmt.Print("\033[?25h")   // show cursor
+		fmt.Print("\033[0m")     // reset colors
+		fmt.Print("\033[?1049l") // exit alt screen
+	})
+}
+
+// guard puts the terminal back before letting a panic continue, so the
+// stack trace lands on the normal screen. Defer it first thing in main
+// and in every goroutine.
+func guard() {
+	if r := recover(); r != nil {
+		restoreTerminal()
+		panic(r)
+	}
+}
+
+// fatalf is log.Fatalf for after we've taken over the screen
+func fatalf(format string, v ...any) {
+	restoreTerminal()
+	log.Fatalf(format, v...)
+}
+
+// streamFrame writes a frame for -stdout: its lines, colors reset at the
+// end, and a blank line before the next one
+func streamFrame(w io.Writer, frame string) {
+	io.WriteString(w, strings.TrimSuffix(frame, "\n")+"\033[0m\n\n")
+}
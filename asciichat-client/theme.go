@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ---------- themes ----------
+
+// -theme styles everything we draw around the video, never the video
+// itself: the status line, toasts, the banner that stands in for video
+// that isn't there, the boxes (help, settings, an incoming call), and art
+// over the banner while we wait for someone. It's one of the themes
+// below, or a JSON file, named by path or found by name in the themes
+// directory next to config.json:
+//
+//	{
+//	  "status": {"fg": "#ffffff", "bg": "#005f87"},
+//	  "toast": {"fg": "#000000", "bg": "#5fd7ff"},
+//	  "banner": {"fg": "#ffffff", "bg": "#005f87", "bold": true},
+//	  "box": {"fg": "#5fafd7"},
+//	  "borders": "rounded",
+//	  "separator": " · ",
+//	  "waiting": ["(ascii art,", " a line each)"]
+//	}
+//
+// A style is fg and bg colors, bold and reverse; anything a file leaves
+// out is the default theme's. Colors come out at whatever our terminal
+// can show, and in mono a style with colors is reverse video instead.
+
+// style is how one piece of chrome is drawn
+type style struct {
+	FG      string `json:"fg,omitempty"` // #rrggbb, or empty for the terminal's own
+	BG      string `json:"bg,omitempty"`
+	Bold    bool   `json:"bold,omitempty"`
+	Reverse bool   `json:"reverse,omitempty"`
+}
+
+// theme is a theme file
+type theme struct {
+	Status    *style   `json:"status,omitempty"`
+	Toast     *style   `json:"toast,omitempty"`
+	Banner    *style   `json:"banner,omitempty"`
+	Box       *style   `json:"box,omitempty"`
+	Borders   string   `json:"borders,omitempty"` // a name from borderSets
+	Separator string   `json:"separator,omitempty"`
+	Waiting   []string `json:"waiting,omitempty"`
+}
+
+var reversed = &style{Reverse: true}
+
+var waitingFace = []string{
+	` .-------. `,
+	`|  o   o  |`,
+	`|    ^    |`,
+	`|  '---'  |`,
+	` '-------' `,
+}
+
+var themes = []struct {
+	name string
+	t    theme
+}{
+	{"default", theme{Status: reversed, Toast: reversed, Banner: reversed, Box: &style{}, Borders: "single", Separator: " │ "}},
+	{"ascii", theme{Borders: "ascii", Separator: " | "}}, // for fonts without box drawing
+	{"ocean", theme{
+		Status: &style{FG: "#ffffff", BG: "#005f87"}, Toast: &style{FG: "#000000", BG: "#5fd7ff"},
+		Banner: &style{FG: "#ffffff", BG: "#005f87", Bold: true}, Box: &style{FG: "#5fafd7"},
+		Borders: "rounded", Separator: " · ", Waiting: waitingFace,
+	}},
+	{"amber", theme{
+		Status: &style{FG: "#000000", BG: "#ffb000"}, Toast: &style{FG: "#000000", BG: "#ffb000"},
+		Banner: &style{FG: "#ffb000", Bold: true, Reverse: true}, Box: &style{FG: "#ffb000"},
+		Borders: "double", Separator: " | ", Waiting: waitingFace,
+	}},
+}
+
+func themeIndex(name string) int {
+	for i, t := range themes {
+		if t.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// borderSets are the corners, top left, top right, bottom left, bottom
+// right, then the horizontal and vertical lines
+var borderSets = map[string][6]string{
+	"single":  {"┌", "┐", "└", "┘", "─", "│"},
+	"rounded": {"╭", "╮", "╰", "╯", "─", "│"},
+	"double":  {"╔", "╗", "╚", "╝", "═", "║"},
+	"heavy":   {"┏", "┓", "┗", "┛", "━", "┃"},
+	"ascii":   {"+", "+", "+", "+", "-", "|"},
+}
+
+// chrome is a theme ready to draw with: styles as escape sequences, each
+// starting from a reset
+type chrome struct {
+	status, toast, banner, box string
+	border                     [6]string
+	sep                        string
+	waiting                    []string
+}
+
+// ui is the theme everything's drawn with
+var ui = mustChrome(themes[0].t, depthMono)
+
+// loadTheme finds -theme and readies it for a terminal showing d
+func loadTheme(name string, d depth) (chrome, error) {
+	if i := themeIndex(name); i >= 0 {
+		return compileTheme(themes[i].t, d)
+	}
+	path := name
+	if !strings.ContainsRune(name, filepath.Separator) && !strings.HasSuffix(name, ".json") {
+		dir, err := configDir()
+		if err != nil {
+			return chrome{}, err
+		}
+		path = filepath.Join(dir, "themes", name+".json")
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) && path != name {
+		var names []string
+		for _, t := range themes {
+			names = append(names, t.name)
+		}
+		return chrome{}, fmt.Errorf("no theme %q: there's %s, or put %s.json in %s", name, strings.Join(names, ", "), name, filepath.Dir(path))
+	}
+	if err != nil {
+		return chrome{}, err
+	}
+	var t theme
+	if err := json.Unmarshal(b, &t); err != nil {
+		return chrome{}, fmt.Errorf("%s: %v", path, err)
+	}
+	c, err := compileTheme(t, d)
+	if err != nil {
+		return chrome{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+func mustChrome(t theme, d depth) chrome {
+	c, err := compileTheme(t, d)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// compileTheme turns t, filled in from the default, into escapes for d
+func compileTheme(t theme, d depth) (chrome, error) {
+	def := themes[0].t
+	var c chrome
+	for _, s := range []struct {
+		out      *string
+		in, dflt *style
+	}{{&c.status, t.Status, def.Status}, {&c.toast, t.Toast, def.Toast}, {&c.banner, t.Banner, def.Banner}, {&c.box, t.Box, def.Box}} {
+		in := s.in
+		if in == nil {
+			in = s.dflt
+		}
+		sgr, err := in.sgr(d)
+		if err != nil {
+			return chrome{}, err
+		}
+		*s.out = sgr
+	}
+
+	borders := t.Borders
+	if borders == "" {
+		borders = def.Borders
+	}
+	set, ok := borderSets[borders]
+	if !ok {
+		return chrome{}, fmt.Errorf("no borders %q: there's single, rounded, double, heavy and ascii", borders)
+	}
+	c.border = set
+	c.sep = t.Separator
+	if c.sep == "" {
+		c.sep = def.Separator
+	}
+	for _, l := range t.Waiting {
+		c.waiting = append(c.waiting, cleanName(l)) // no escapes from a file
+	}
+	return c, nil
+}
+
+// sgr is the escape for s at depth d
+func (s *style) sgr(d depth) (string, error) {
+	code := "\033[0"
+	if s.Bold {
+		code += ";1"
+	}
+	reverse := s.Reverse
+	var colors string
+	enc := newColorEncoder(options{Depth: d, Quantizer: quantizerIndex("perceptual")})
+	for _, c := range []struct {
+		hex string
+		bg  bool
+	}{{s.FG, false}, {s.BG, true}} {
+		if c.hex == "" {
+			continue
+		}
+		col, err := parseHex(c.hex)
+		if err != nil {
+			return "", err
+		}
+		if d == depthMono {
+			reverse = true // it was meant to stand out
+			continue
+		}
+		colors += enc.sgr(col, c.bg, 0, 0)
+	}
+	if reverse {
+		code += ";7"
+	}
+	return code + "m" + colors, nil
+}
+
+// parseHex reads a #rrggbb color
+func parseHex(s string) (rgb, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 16, 32)
+	if !strings.HasPrefix(s, "#") || len(s) != 7 || err != nil {
+		return rgb{}, fmt.Errorf("color %q should be #rrggbb", s)
+	}
+	return rgb{uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ---------- terminal title ----------
+
+func pushTitle()        { fmt.Print("\033[22;0t") } // save title on the xterm stack
+func popTitle()         { fmt.Print("\033[23;0t") } // restore it
+func setTitle(t string) { fmt.Print("\033]0;" + t + "\a") }
+
+// keepTitle refreshes the title once a second
+func keepTitle(state *callState) {
+	defer guard()
+	last := ""
+	for range time.Tick(time.Second) {
+		if t := state.title(); t != last {
+			setTitle(t)
+			last = t
+		}
+	}
+}
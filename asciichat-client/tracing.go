@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ---------- tracing ----------
+
+// With -otel we report OpenTelemetry spans and metrics for where a
+// frame's time goes: a "frame" span for each one we send, -otel-sample
+// of them, with capture, render and send under it, and a "show" span
+// for each traced frame that reaches us, from arriving to being on
+// screen. Connection attempts get a span each too. A traced frame
+// carries its traceparent in "trace", in the clear even in an
+// encrypted call, and the relay (with -otel) joins the trace and swaps
+// in its own, so a slow frame can be put down to the camera, our
+// renderer, the network, the relay or the other end. "otlp" exports
+// over OTLP/HTTP, configured by the usual OTEL_EXPORTER_OTLP_*
+// variables; "stderr" prints everything, where it won't scribble over
+// the call (2>trace.log).
+
+var (
+	tracer = otel.Tracer("asciichat-client")
+	meter  = otel.Meter("asciichat-client")
+
+	// global instruments forward to the real provider once there is one
+	captureTime, _ = meter.Float64Histogram("faceterm.capture.duration", metric.WithUnit("s"), metric.WithDescription("Time to read a frame from the camera"))
+	renderTime, _  = meter.Float64Histogram("faceterm.render.duration", metric.WithUnit("s"), metric.WithDescription("Time to render a frame for everyone in the call"))
+	sendTime, _    = meter.Float64Histogram("faceterm.send.duration", metric.WithUnit("s"), metric.WithDescription("Time to write a frame to the relay"))
+	showTime, _    = meter.Float64Histogram("faceterm.show.duration", metric.WithUnit("s"), metric.WithDescription("Time from a peer's frame arriving to it being on screen"))
+	rttTime, _     = meter.Float64Histogram("faceterm.rtt", metric.WithUnit("s"), metric.WithDescription("Round trip to a peer and back"))
+)
+
+// setupOTel starts exporting, tracing sample of the frames we send,
+// and returns what flushes and stops it
+func setupOTel(exporter string, sample float64) (func(), error) {
+	if exporter == "" {
+		return func() {}, nil
+	}
+	ctx := context.Background()
+	var spans sdktrace.SpanExporter
+	var metrics sdkmetric.Exporter
+	var err, err2 error
+	switch exporter {
+	case "otlp":
+		spans, err = otlptracehttp.New(ctx)
+		metrics, err2 = otlpmetrichttp.New(ctx)
+	case "stderr":
+		spans, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+		metrics, err2 = stdoutmetric.New(stdoutmetric.WithWriter(os.Stderr))
+	default:
+		return nil, fmt.Errorf("unknown -otel exporter %q, want otlp or stderr", exporter)
+	}
+	if err = errors.Join(err, err2); err != nil {
+		return nil, err
+	}
+
+	res, _ := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", "asciichat-client")))
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spans),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(rootSampler{sdktrace.TraceIDRatioBased(sample)})),
+	)
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metrics)), sdkmetric.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetMeterProvider(mp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		tp.Shutdown(ctx)
+		mp.Shutdown(ctx)
+	}, nil
+}
+
+// rootSampler decides on spans that start a trace: frames by the ratio,
+// since there are dozens a second, and connection attempts always. The
+// rest only count as part of a traced frame, so a peer's untraced
+// frame isn't traced here either.
+type rootSampler struct{ frames sdktrace.Sampler }
+
+func (s rootSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	switch p.Name {
+	case "frame":
+		return s.frames.ShouldSample(p)
+	case "connect":
+		return sdktrace.AlwaysSample().ShouldSample(p)
+	}
+	return sdktrace.NeverSample().ShouldSample(p)
+}
+
+func (s rootSampler) Description() string { return "frames: " + s.frames.Description() }
+
+// stage starts the span for one stage of a frame; calling done ends it
+// and records how long it took
+func stage(ctx context.Context, name string, h metric.Float64Histogram) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, name)
+	return ctx, func() {
+		span.End()
+		h.Record(ctx, time.Since(start).Seconds())
+	}
+}
+
+// traceparent is what a frame carries for ctx, if it's being traced
+func traceparent(ctx context.Context) string {
+	if !trace.SpanContextFromContext(ctx).IsSampled() {
+		return ""
+	}
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// traced is the context a frame's traceparent puts us in
+func traced(tp string) context.Context {
+	if tp == "" {
+		return context.Background()
+	}
+	return otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier{"traceparent": tp})
+}
+
+// connectSpan starts the span for one connection attempt; end it with
+// the result
+func connectSpan(transport string) func(error) {
+	_, span := tracer.Start(context.Background(), "connect", trace.WithAttributes(attribute.String("transport", transport)))
+	return func(err error) {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
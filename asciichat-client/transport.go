@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/webtransport-go"
+)
+
+// ---------- transports ----------
+
+// The relay takes calls over websockets, over server-sent events and
+// posts (see sse.go), and, if it runs -webtransport, over WebTransport
+// (HTTP/3, on UDP), for networks where websockets get mangled or
+// blocked. With -transport auto we try the websocket first and fall
+// back to the others in turn when it won't connect, starting with
+// whichever worked last time; either way the rest of the client just
+// sees a wire. The others live on the same host and port as the
+// websocket, at /wt and /sse instead of /ws.
+
+const (
+	transportAuto         = "auto"
+	transportWebSocket    = "websocket"
+	transportWebTransport = "webtransport"
+	transportSSE          = "sse"
+)
+
+var dialers = map[string]func(endpoint) (wire, http.Header, error){
+	transportWebSocket:    dialWS,
+	transportWebTransport: dialWT,
+	transportSSE:          dialSSE,
+}
+
+// worked is the transport auto last got through on, to try first next
+// time rather than wait out the ones the network blocks
+var worked = transportWebSocket
+
+// wire is a connection messages come and go over
+type wire interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// dial makes one attempt over the transport ep asks for, or each in
+// turn for auto
+func dial(ep endpoint) (wire, http.Header, error) {
+	if ep.login != nil {
+		tok, err := ep.login.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		ep.header = ep.header.Clone()
+		ep.header.Set("Authorization", tok.Type()+" "+tok.AccessToken)
+	}
+	if ep.user != nil {
+		ep.query = maps.Clone(ep.query)
+		if err := ep.user.signIn(ep.query); err != nil {
+			return nil, nil, err
+		}
+	}
+	try := func(t string) (wire, http.Header, error) {
+		done := connectSpan(t)
+		c, hdr, err := dialers[t](ep)
+		done(err)
+		return c, hdr, err
+	}
+	if _, ok := dialers[ep.transport]; ok {
+		return try(ep.transport)
+	}
+	order := []string{worked}
+	for _, t := range []string{transportWebSocket, transportWebTransport, transportSSE} {
+		if t != worked {
+			order = append(order, t)
+		}
+	}
+
+	var first error
+	var others []string
+	for _, t := range order {
+		c, hdr, err := try(t)
+		if err == nil {
+			worked = t
+			return c, hdr, nil
+		}
+		if hopeless(err) {
+			return nil, nil, err
+		}
+		if first == nil {
+			first = err
+		} else {
+			others = append(others, fmt.Sprintf("over %s: %v", t, err))
+		}
+	}
+	return nil, nil, fmt.Errorf("%w (and %s)", first, strings.Join(others, "; "))
+}
+
+// protocolHeader takes the place of the websocket subprotocol
+const protocolHeader = "Faceterm-Protocol"
+
+var wtDialer = webtransport.Dialer{
+	QUICConfig: &quic.Config{
+		EnableDatagrams: true,
+		KeepAlivePeriod: pingEvery, // in place of websocket pings
+		MaxIdleTimeout:  stallAfter,
+	},
+}
+
+// altURL is where another transport lives next to a websocket URL: the
+// same host and port, at path instead of /ws, over plain HTTP(S) or,
+// with tls, always HTTPS
+func altURL(server, path string, tls bool) (*url.URL, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("bad -server URL: %w", err)
+	}
+	if u.Scheme == "wss" || tls {
+		u.Scheme = "https"
+	} else {
+		u.Scheme = "http"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/ws") + path
+	return u, nil
+}
+
+// dialWT makes one attempt over WebTransport
+func dialWT(ep endpoint) (wire, http.Header, error) {
+	u, err := altURL(ep.server, "/wt", true) // HTTP/3 is always encrypted
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "443") // the dialer wants one
+	}
+	u.RawQuery = ep.query.Encode()
+	log.Printf("connecting to %s over webtransport", u.String())
+
+	hdr := ep.header.Clone()
+	if hdr == nil {
+		hdr = http.Header{}
+	}
+	hdr.Set(protocolHeader, subprotocol)
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	resp, sess, err := wtDialer.Dial(ctx, u.String(), hdr)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUpgradeRequired {
+			return nil, nil, fmt.Errorf("%w: the server speaks a different protocol version than this client (%s); time to update", errIncompatible, subprotocol)
+		}
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return nil, nil, loginNeeded()
+		}
+		return nil, nil, fmt.Errorf("failed to connect over webtransport: %w", err)
+	}
+	if resp.Header.Get(protocolHeader) != subprotocol {
+		sess.CloseWithError(0, "")
+		return nil, nil, fmt.Errorf("%w: server didn't agree to %s, it's probably too old for this client", errIncompatible, subprotocol)
+	}
+
+	// the server waits for us to open the stream, and only sees it once
+	// something's written
+	str, err := sess.OpenStreamSync(ctx)
+	if err == nil {
+		_, err = str.Write(nil)
+	}
+	if err != nil {
+		sess.CloseWithError(0, "")
+		return nil, nil, fmt.Errorf("failed to open a webtransport stream: %w", err)
+	}
+	return &streamConn{sess: sess, str: str, r: bufio.NewReader(str)}, resp.Header, nil
+}
+
+// streamConn is a WebTransport stream of messages, each prefixed by its
+// length as a uvarint
+type streamConn struct {
+	sess *webtransport.Session
+	str  *webtransport.Stream
+	r    *bufio.Reader
+}
+
+func (c *streamConn) ReadMessage() (int, []byte, error) {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > maxMessage {
+		return 0, nil, fmt.Errorf("message of %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return 0, nil, err
+	}
+	return websocket.TextMessage, b, nil
+}
+
+func (c *streamConn) WriteMessage(_ int, data []byte) error {
+	b := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(data)), uint64(len(data)))
+	_, err := c.str.Write(append(b, data...))
+	return err
+}
+
+// SetReadDeadline does nothing: a quiet room goes quiet here too, and
+// with no pings to answer, it's QUIC's keepalives and idle timeout that
+// notice a dead relay
+func (c *streamConn) SetReadDeadline(time.Time) error { return nil }
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.str.SetWriteDeadline(t) }
+
+func (c *streamConn) Close() error { return c.sess.CloseWithError(0, "") }
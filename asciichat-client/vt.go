@@ -0,0 +1,190 @@
+package main
+
+import (
+	"image/color"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// vt is a tiny terminal emulator that understands just enough ANSI to
+// replay the frames our own renderers produce: cursor home/positioning,
+// clears, and SGR colors.
+
+var (
+	vtDefaultFg = color.RGBA{0xcc, 0xcc, 0xcc, 0xff}
+	vtDefaultBg = color.RGBA{0x00, 0x00, 0x00, 0xff}
+)
+
+type vtCell struct {
+	ch rune
+	fg color.RGBA
+	bg color.RGBA
+}
+
+type vt struct {
+	width, height int
+	cells         []vtCell
+	x, y          int
+	fg, bg        color.RGBA
+}
+
+func newVT(width, height int) *vt {
+	v := &vt{width: width, height: height, fg: vtDefaultFg, bg: vtDefaultBg}
+	v.cells = make([]vtCell, width*height)
+	v.clear()
+	return v
+}
+
+func (v *vt) clear() {
+	for i := range v.cells {
+		v.cells[i] = vtCell{ch: ' ', fg: vtDefaultFg, bg: vtDefaultBg}
+	}
+}
+
+func (v *vt) at(x, y int) vtCell {
+	return v.cells[y*v.width+x]
+}
+
+// feed processes a chunk of terminal output
+func (v *vt) feed(data string) {
+	for i := 0; i < len(data); {
+		if data[i] == '\033' && i+1 < len(data) && data[i+1] == '[' {
+			// CSI: parameters up to the final byte in 0x40..0x7e
+			j := i + 2
+			for j < len(data) && (data[j] < 0x40 || data[j] > 0x7e) {
+				j++
+			}
+			if j >= len(data) {
+				return
+			}
+			v.csi(data[i+2:j], data[j])
+			i = j + 1
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(data[i:])
+		i += size
+
+		switch r {
+		case '\n':
+			// frames are written through a cooked tty, so \n is CRLF
+			v.x = 0
+			v.y++
+		case '\r':
+			v.x = 0
+		default:
+			if r < 0x20 {
+				continue
+			}
+			w := runewidth.RuneWidth(r)
+			if w == 0 {
+				continue // combining marks ride on the previous cell
+			}
+			if v.x >= 0 && v.y >= 0 && v.x < v.width && v.y < v.height {
+				v.cells[v.y*v.width+v.x] = vtCell{ch: r, fg: v.fg, bg: v.bg}
+				// the right half of a wide glyph is blank
+				if w == 2 && v.x+1 < v.width {
+					v.cells[v.y*v.width+v.x+1] = vtCell{ch: ' ', fg: v.fg, bg: v.bg}
+				}
+			}
+			v.x += w
+		}
+	}
+}
+
+func (v *vt) csi(params string, final byte) {
+	switch final {
+	case 'H', 'f':
+		row, col := 1, 1
+		parts := strings.Split(params, ";")
+		if n, err := strconv.Atoi(parts[0]); err == nil {
+			row = n
+		}
+		if len(parts) > 1 {
+			if n, err := strconv.Atoi(parts[1]); err == nil {
+				col = n
+			}
+		}
+		v.x, v.y = max(col, 1)-1, max(row, 1)-1 // 0 means 1, and so does worse
+	case 'J':
+		if params == "2" {
+			v.clear()
+		}
+	case 'm':
+		v.sgr(params)
+	}
+}
+
+func (v *vt) sgr(params string) {
+	if params == "" {
+		params = "0"
+	}
+	var p []int
+	for _, s := range strings.Split(params, ";") {
+		n, _ := strconv.Atoi(s)
+		p = append(p, n)
+	}
+
+	for i := 0; i < len(p); i++ {
+		switch n := p[i]; {
+		case n == 0:
+			v.fg, v.bg = vtDefaultFg, vtDefaultBg
+		case n == 39:
+			v.fg = vtDefaultFg
+		case n == 49:
+			v.bg = vtDefaultBg
+		case n >= 30 && n <= 37:
+			v.fg = xterm256(n - 30)
+		case n >= 90 && n <= 97:
+			v.fg = xterm256(n - 90 + 8)
+		case n >= 40 && n <= 47:
+			v.bg = xterm256(n - 40)
+		case n >= 100 && n <= 107:
+			v.bg = xterm256(n - 100 + 8)
+		case (n == 38 || n == 48) && i+1 < len(p):
+			var c color.RGBA
+			switch {
+			case p[i+1] == 2 && i+4 < len(p):
+				c = color.RGBA{uint8(p[i+2]), uint8(p[i+3]), uint8(p[i+4]), 0xff}
+				i += 4
+			case p[i+1] == 5 && i+2 < len(p):
+				c = xterm256(p[i+2])
+				i += 2
+			default:
+				continue
+			}
+			if n == 38 {
+				v.fg = c
+			} else {
+				v.bg = c
+			}
+		}
+	}
+}
+
+// xterm256 returns the RGB value of an xterm 256-color palette index
+func xterm256(n int) color.RGBA {
+	system := [16][3]uint8{
+		{0, 0, 0}, {205, 0, 0}, {0, 205, 0}, {205, 205, 0},
+		{0, 0, 238}, {205, 0, 205}, {0, 205, 205}, {229, 229, 229},
+		{127, 127, 127}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0},
+		{92, 92, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+	}
+	switch {
+	case n < 0 || n > 255:
+		return vtDefaultFg
+	case n < 16:
+		c := system[n]
+		return color.RGBA{c[0], c[1], c[2], 0xff}
+	case n < 232:
+		levels := [6]uint8{0, 95, 135, 175, 215, 255}
+		n -= 16
+		return color.RGBA{levels[n/36], levels[n/6%6], levels[n%6], 0xff}
+	default:
+		g := uint8(8 + (n-232)*10)
+		return color.RGBA{g, g, g, 0xff}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// ---------- watermark ----------
+
+// -watermark puts a logo in a corner of our video, on top of everything
+// else: an image (PNG, JPEG or GIF), scaled to -watermark-size of the
+// picture's width and blended in by its own transparency times
+// -watermark-opacity, or a text file of ASCII art, drawn over the cells
+// as it is, spaces letting the video through. Peers who render for
+// themselves (see pixels.go) get the image but not the art, which only
+// exists as cells.
+
+var watermarkCorners = []string{"bottom-right", "bottom-left", "top-right", "top-left"}
+
+// watermark is a loaded -watermark
+type watermark struct {
+	img     image.Image // nil for art
+	art     [][]rune
+	corner  string
+	opacity float64
+	size    float64 // of the picture's width
+}
+
+// userMark is -watermark, nil if there isn't one
+var userMark *watermark
+
+func loadWatermark(path, corner string, opacity, size float64) (*watermark, error) {
+	if !slices.Contains(watermarkCorners, corner) {
+		return nil, fmt.Errorf("-watermark-corner %q: want %s", corner, strings.Join(watermarkCorners, ", "))
+	}
+	if opacity < 0 || opacity > 1 {
+		return nil, fmt.Errorf("-watermark-opacity %g: want 0 to 1", opacity)
+	}
+	if size <= 0 || size > 1 {
+		return nil, fmt.Errorf("-watermark-size %g: want a fraction of the width, more than 0 and at most 1", size)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &watermark{corner: corner, opacity: opacity, size: size}
+	if img, _, err := image.Decode(bytes.NewReader(b)); err == nil {
+		m.img = img
+		return m, nil
+	}
+	if !utf8.Valid(b) {
+		return nil, fmt.Errorf("%s is neither an image we can read (PNG, JPEG, GIF) nor text", path)
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		var row []rune
+		for _, r := range strings.TrimRight(line, "\r") {
+			if !captionRune(r) {
+				r = ' ' // tabs and the like; they'd throw the art out of line
+			}
+			row = append(row, r)
+		}
+		m.art = append(m.art, row)
+	}
+	return m, nil
+}
+
+// origin is where a w x h mark goes in an areaW x areaH picture, a step
+// in from the edges
+func (m *watermark) origin(w, h, areaW, areaH int) (int, int) {
+	x, y := 1, 1
+	if strings.HasSuffix(m.corner, "right") {
+		x = areaW - w - 1
+	}
+	if strings.HasPrefix(m.corner, "bottom") {
+		y = areaH - h - 1
+	}
+	return x, y
+}
+
+// stampPixels blends the image into p
+func (m *watermark) stampPixels(p pixels) pixels {
+	if m == nil || m.img == nil || p.w == 0 || p.h == 0 {
+		return p
+	}
+	b := m.img.Bounds()
+	w := max(1, int(float64(p.w)*m.size))
+	h := max(1, w*b.Dy()/max(1, b.Dx()))
+	if w > p.w-2 || h > p.h-2 {
+		return p // no room
+	}
+	ox, oy := m.origin(w, h, p.w, p.h)
+	for y := range h {
+		for x := range w {
+			r, g, bl, a := m.img.At(b.Min.X+x*b.Dx()/w, b.Min.Y+y*b.Dy()/h).RGBA()
+			alpha := float64(a) / 0xffff * m.opacity
+			if alpha == 0 {
+				continue
+			}
+			i := ((oy+y)*p.w + ox + x) * 3
+			// RGBA is premultiplied, 16 bits a channel
+			for ch, v := range [3]uint32{bl, g, r} {
+				under := float64(p.bgr[i+ch])
+				p.bgr[i+ch] = clampByte(float64(v)/257*m.opacity + under*(1-alpha))
+			}
+		}
+	}
+	return p
+}
+
+// stampCells draws the art over g
+func (m *watermark) stampCells(g *grid) {
+	if m == nil || m.art == nil {
+		return
+	}
+	h, w := len(m.art), 0
+	for _, row := range m.art {
+		w = max(w, len(row))
+	}
+	if w > g.w-2 || h > g.h-2 {
+		return // no room
+	}
+	ox, oy := m.origin(w, h, g.w, g.h)
+	white := rgb{255, 255, 255}
+	for y, row := range m.art {
+		for x, r := range row {
+			if r == ' ' {
+				continue
+			}
+			cl := g.at(ox+x, oy+y)
+			under := cl.fg
+			if !cl.hasFg {
+				under = rgb{128, 128, 128}
+			}
+			cl.ch = r
+			cl.fg, cl.hasFg = blend(under, white, m.opacity), true
+		}
+	}
+}
+
+// blend is a moved toward b by t
+func blend(a, b rgb, t float64) rgb {
+	mix := func(x, y uint8) uint8 { return clampByte(float64(x) + (float64(y)-float64(x))*t) }
+	return rgb{mix(a.r, b.r), mix(a.g, b.g), mix(a.b, b.b)}
+}
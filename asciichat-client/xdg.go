@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+)
+
+// ---------- config and state directories ----------
+
+// Settings people choose (config.json, known peers, blocks) live in the
+// config directory; things we remember on our own (last camera, recent
+// rooms) in the state directory, which is fine to lose. Both follow XDG
+// where it applies, and each platform's usual place where it doesn't.
+
+// configDir is $XDG_CONFIG_HOME/faceterm, ~/.config/faceterm, or
+// Application Support / %AppData% on macOS and Windows
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "faceterm"), nil
+}
+
+// stateDir is $XDG_STATE_HOME/faceterm or ~/.local/state/faceterm;
+// macOS and Windows have no separate place for state, so there it's
+// Application Support and %LocalAppData%
+func stateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "faceterm"), nil
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return configDir()
+	case "windows":
+		if dir := os.Getenv("LocalAppData"); dir != "" {
+			return filepath.Join(dir, "faceterm"), nil
+		}
+		return configDir()
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state", "faceterm"), nil
+}
+
+// ---------- saved state ----------
+
+const maxRecentRooms = 10
+
+// savedState is what we remember between runs, filled in as defaults
+// for flags nothing else has set
+type savedState struct {
+	Device *int     `json:"device,omitempty"`
+	Mode   string   `json:"mode,omitempty"`
+	Rooms  []string `json:"rooms,omitempty"` // most recent first
+}
+
+func statePath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "state.json"), nil
+}
+
+// loadState never fails: no state is an empty one
+func loadState() savedState {
+	var st savedState
+	path, err := statePath()
+	if err != nil {
+		return st
+	}
+	if b, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(b, &st)
+	}
+	return st
+}
+
+func (st savedState) save() error {
+	path, err := statePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	b, _ := json.MarshalIndent(st, "", "  ")
+	return os.WriteFile(path, append(b, '\n'), 0o600)
+}
+
+// visited moves room to the front of the recent rooms
+func (st *savedState) visited(room string) {
+	if room == "" {
+		return
+	}
+	st.Rooms = slices.DeleteFunc(st.Rooms, func(r string) bool { return r == room })
+	st.Rooms = append([]string{room}, st.Rooms...)
+	if len(st.Rooms) > maxRecentRooms {
+		st.Rooms = st.Rooms[:maxRecentRooms]
+	}
+}
+
+// defaults is the state as flag values, for applyConfig
+func (st savedState) defaults() map[string]any {
+	d := make(map[string]any)
+	if st.Device != nil {
+		d["device"] = *st.Device
+	}
+	if st.Mode != "" {
+		d["mode"] = st.Mode
+	}
+	return d
+}
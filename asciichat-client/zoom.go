@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ---------- low-vision zoom ----------
+
+// With -zoom n we ask the peer for a frame 1/n the size of our terminal
+// and blow every cell up into an n x n block, so each "pixel" is big
+// enough to make out on a small font.
+
+// enlarge repeats every character of a (sanitized) frame n times across
+// and every line n times down. Repeated lines start from the colors the
+// original line started with.
+func enlarge(frame string, n int) string {
+	if n <= 1 {
+		return frame
+	}
+
+	var b strings.Builder
+	b.Grow(len(frame) * n * n)
+
+	// the SGR in effect: the last foreground, the last background, and
+	// which attributes (bold, underline...) are on, kept as flags so a
+	// frame full of them can't make each line's start any longer
+	var fg, bg string
+	var attrs [10]bool
+	for _, line := range strings.SplitAfter(frame, "\n") {
+		if line == "" {
+			continue
+		}
+		start := attrSGR(attrs) + fg + bg
+
+		var row strings.Builder
+		for i := 0; i < len(line); {
+			if line[i] == '\033' {
+				j := strings.IndexAny(line[i+1:], "mHf")
+				if j < 0 {
+					break
+				}
+				seq := line[i : i+j+2]
+				row.WriteString(seq)
+				if seq[len(seq)-1] == 'm' {
+					p := seq[2 : len(seq)-1]
+					first, _, _ := strings.Cut(p, ";")
+					switch {
+					case first == "" || first == "0":
+						fg, bg, attrs = "", "", [10]bool{}
+					case first == "38" || first == "39" || len(first) == 2 && (first[0] == '3' || first[0] == '9'):
+						fg = seq
+					case first == "48" || first == "49" || len(first) == 2 && first[0] == '4' || len(first) == 3 && first[:2] == "10":
+						bg = seq
+					default:
+						setAttrs(&attrs, p)
+					}
+				}
+				i += j + 2
+				continue
+			}
+			r, size := utf8.DecodeRuneInString(line[i:])
+			i += size
+			if r == '\n' || r == '\r' {
+				row.WriteRune(r)
+				continue
+			}
+			for k := 0; k < n; k++ {
+				row.WriteRune(r)
+			}
+		}
+
+		reps := n
+		if !strings.HasSuffix(line, "\n") {
+			reps = 1 // trailing resets, or a frame missing its last newline
+		}
+		for k := 0; k < reps; k++ {
+			if k > 0 {
+				b.WriteString("\033[0m" + start)
+			}
+			b.WriteString(row.String())
+		}
+	}
+	return b.String()
+}
+
+// setAttrs turns attributes on (1 to 9) or off (22 to 29, 22 being
+// both bold and faint) as SGR params p say, up to any extended color,
+// whose numbers aren't attributes
+func setAttrs(attrs *[10]bool, p string) {
+	for _, f := range strings.Split(p, ";") {
+		n, err := strconv.Atoi(f)
+		switch {
+		case n == 38 || n == 48 || n == 58:
+			return
+		case err != nil:
+		case n >= 1 && n <= 9:
+			attrs[n] = true
+		case n == 22:
+			attrs[1], attrs[2] = false, false
+		case n >= 21 && n <= 29:
+			attrs[n-20] = false
+		}
+	}
+}
+
+// attrSGR is the SGR that turns attrs on, "" if none are
+func attrSGR(attrs [10]bool) string {
+	var on []string
+	for n, ok := range attrs {
+		if ok {
+			on = append(on, strconv.Itoa(n))
+		}
+	}
+	if on == nil {
+		return ""
+	}
+	return "\033[" + strings.Join(on, ";") + "m"
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ---------- accounts ----------
+
+// With -accounts, people can take a name and be called by it. A client
+// connects with ?user=alice plus its ssh public key, the time, and a
+// signature over "faceterm-login\nalice\n<time>" made with that key.
+// The first key to sign in as a name owns it from then on; the names
+// and their keys are kept in the -accounts file. Someone signed in can
+// be called: a client connecting with ?call=alice gets a fresh private
+// room, and alice's client, wherever it's connected, gets an invite to
+// it ({"type":"invite","user":"bob","room":...}). The caller is told the
+// room too, "calling" or, if alice isn't around, "unreachable", so it
+// comes back to the same room if it has to reconnect.
+//
+// Someone signed in can say how available they are with a status
+// message: available, the default, busy, or dnd. Callers are told the
+// callee's status along with "calling" or "unreachable"; someone on dnd
+// isn't sent the invite at all. GET /api/presence?user=alice&user=bob
+// says how each is doing, offline for anyone not connected, so a client
+// can show its contacts before calling any of them.
+//
+// An invite rings until the callee answers by joining the room, or
+// declines ({"type":"decline","room":...,"text":"declined"}), or ringFor
+// goes by; either of the last two, the caller gets "declined" with the
+// reason. If the caller hangs up first, the callee gets "cancelled".
+
+var errNoAccounts = errors.New("this server has no accounts")
+
+// ringFor is how long an invite rings before it counts as unanswered
+const ringFor = 30 * time.Second
+
+// loginSkew is how far a login's time can be from ours
+const loginSkew = 2 * time.Minute
+
+const (
+	statusAvailable = "available"
+	statusBusy      = "busy"
+	statusDND       = "dnd"
+	statusOffline   = "offline"
+)
+
+func validStatus(s string) bool {
+	return s == statusAvailable || s == statusBusy || s == statusDND
+}
+
+var userName = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,31}$`)
+
+type accounts struct {
+	path string
+
+	mu     sync.Mutex
+	keys   map[string]string  // name -> authorized key line
+	online map[string]*Client // the latest connection signed in as each name
+	status map[*Client]string // of those that have said, see setStatus
+}
+
+func loadAccounts(path string) (*accounts, error) {
+	a := &accounts{path: path, keys: make(map[string]string), online: make(map[string]*Client), status: make(map[*Client]string)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &a.keys); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return a, nil
+}
+
+// signIn checks a login in a connection's query, registering the name
+// if it's new, and returns the name; "" with no error if there's no
+// login. A nil accounts turns logins away.
+func (a *accounts) signIn(q url.Values) (string, error) {
+	name := q.Get("user")
+	switch {
+	case name == "":
+		return "", nil
+	case a == nil:
+		return "", errNoAccounts
+	}
+	if !userName.MatchString(name) {
+		return "", errors.New("user names are lowercase letters, digits and _.-, up to 32")
+	}
+	keyBytes, err1 := base64.StdEncoding.DecodeString(q.Get("key"))
+	sigBytes, err2 := base64.StdEncoding.DecodeString(q.Get("sig"))
+	t, err3 := strconv.ParseInt(q.Get("t"), 10, 64)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return "", errors.New("malformed login")
+	}
+	if d := time.Since(time.Unix(t, 0)); d > loginSkew || d < -loginSkew {
+		return "", errors.New("login too old; check your clock")
+	}
+	pub, err := ssh.ParsePublicKey(keyBytes)
+	if err != nil {
+		return "", errors.New("malformed login key")
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(sigBytes, &sig); err != nil {
+		return "", errors.New("malformed login signature")
+	}
+	if err := pub.Verify(loginPayload(name, t), &sig); err != nil {
+		return "", errors.New("login signature doesn't check out")
+	}
+
+	line := string(ssh.MarshalAuthorizedKey(pub))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch owner, taken := a.keys[name]; {
+	case taken && owner != line:
+		return "", fmt.Errorf("%s belongs to another key", name)
+	case !taken:
+		a.keys[name] = line
+		if err := a.save(); err != nil {
+			delete(a.keys, name)
+			return "", err
+		}
+		log.Printf("account %s registered", name)
+	}
+	return name, nil
+}
+
+// loginPayload is what a login signs
+func loginPayload(name string, t int64) []byte {
+	return []byte("faceterm-login\n" + name + "\n" + strconv.FormatInt(t, 10))
+}
+
+// save writes the accounts file. Must hold a.mu.
+func (a *accounts) save() error {
+	b, _ := json.MarshalIndent(a.keys, "", "  ")
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// arrived marks c as the one to invite when someone calls its name
+func (a *accounts) arrived(c *Client) {
+	if a == nil || c.user == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.online[c.user] = c
+}
+
+func (a *accounts) left(c *Client) {
+	if a == nil || c.user == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.online[c.user] == c {
+		delete(a.online, c.user)
+	}
+	delete(a.status, c)
+}
+
+// find is the connection signed in as name, nil if there's none, and
+// its status
+func (a *accounts) find(name string) (*Client, string) {
+	if a == nil {
+		return nil, statusOffline
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.presence(name)
+}
+
+// presence is like find. Must hold a.mu.
+func (a *accounts) presence(name string) (*Client, string) {
+	c := a.online[name]
+	if c == nil {
+		return nil, statusOffline
+	}
+	if st, ok := a.status[c]; ok {
+		return c, st
+	}
+	return c, statusAvailable
+}
+
+// setStatus is a signed-in client saying how available it is
+func (a *accounts) setStatus(c *Client, status string) {
+	if a == nil || c.user == "" || !validStatus(status) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.status[c] = status
+}
+
+// apiPresence is GET /api/presence: the status of each ?user
+func (s *Server) apiPresence(w http.ResponseWriter, req *http.Request) {
+	names := req.URL.Query()["user"]
+	if len(names) > 100 {
+		http.Error(w, "too many users", http.StatusBadRequest)
+		return
+	}
+	a := s.accounts
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make(map[string]string, len(names))
+	for _, n := range names {
+		_, out[n] = a.presence(n)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// callMsg is an invite, calling or unreachable; status is the callee's
+func callMsg(kind, user, room, status string) []byte {
+	m := map[string]string{"type": kind, "user": user, "room": room}
+	if status != "" {
+		m["status"] = status
+	}
+	b, _ := json.Marshal(m)
+	return b
+}
+
+// refusedMsg tells a client why it was turned away, before we hang up
+func refusedMsg(reason string) []byte {
+	b, _ := json.Marshal(map[string]string{"type": "refused", "text": reason})
+	return b
+}
+
+// call puts a signed-in caller in a fresh private room and invites
+// callee to it, or tells the caller they can't be reached
+func (s *Server) call(c *Client, callee string) bool {
+	s.mu.Lock()
+	r := s.room(s.newCode()) // made now, so the code stays ours
+	code := r.code
+	s.mu.Unlock()
+	if !s.add(c, code, false) {
+		return false
+	}
+
+	// found and sent to under s.mu: a client leaves the accounts before
+	// it's removed, which closes its send under s.mu, so one we find
+	// here stays open until we let go
+	s.mu.Lock()
+	o, status := s.accounts.find(callee)
+	if o == c {
+		o, status = nil, statusOffline
+	}
+	reply, ringing := callMsg("unreachable", callee, code, status), false
+	if o != nil && status != statusDND {
+		select {
+		case o.send <- callMsg("invite", c.user, code, ""):
+			r.invited, ringing = callee, true
+			reply = callMsg("calling", callee, code, status)
+		default:
+		}
+	}
+	s.mu.Unlock()
+	if ringing {
+		log.Printf("%s invited %s to room %s", c.user, callee, code)
+		time.AfterFunc(ringFor, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if r.invited == callee {
+				log.Printf("%s didn't answer the call in room %s", callee, code)
+				s.stopRinging(r, "no answer")
+			}
+		})
+	}
+	select {
+	case c.send <- reply:
+	default:
+	}
+	return true
+}
+
+// declineReasons are what a callee can give for not answering
+var declineReasons = map[string]bool{"declined": true, "busy": true, "no answer": true}
+
+// decline is the callee turning down an invite to the room code
+func (s *Server) decline(c *Client, code, reason string) {
+	if !declineReasons[reason] {
+		reason = "declined"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r := s.rooms[code]; r != nil && c.user != "" && r.invited == c.user {
+		log.Printf("%s declined the call in room %s: %s", c.user, code, reason)
+		s.stopRinging(r, reason)
+	}
+}
+
+// stopRinging ends r's invite: with a reason, the caller's told it went
+// unanswered; without one, the caller gave up and the callee's told.
+// Must hold s.mu, which is also what keeps the callee we find from
+// having its send closed under us (see call).
+func (s *Server) stopRinging(r *Room, reason string) {
+	callee := r.invited
+	r.invited = ""
+	if reason != "" {
+		b, _ := json.Marshal(map[string]string{"type": "declined", "user": callee, "text": reason})
+		r.notify(nil, b)
+		return
+	}
+	if o, _ := s.accounts.find(callee); o != nil {
+		select {
+		case o.send <- callMsg("cancelled", "", r.code, ""):
+		default:
+		}
+	}
+}
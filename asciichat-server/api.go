@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ---------- rest api ----------
+
+type roomInfo struct {
+	Code    string    `json:"code"`
+	URL     string    `json:"url"`
+	Watch   string    `json:"watch"`
+	Clients int       `json:"clients"`
+	Viewers int       `json:"viewers"`
+	Dropped uint64    `json:"dropped"`
+	Created time.Time `json:"created"`
+
+	// scheduled rooms, see schedule.go
+	Opens   *time.Time `json:"opens,omitempty"`
+	Closes  *time.Time `json:"closes,omitempty"`
+	Waiting int        `json:"waiting,omitempty"`
+}
+
+// roomRequest is the optional body of a create: whether GET /api/rooms
+// lists it (not by default), when it opens and how long it stays open,
+// e.g. "30m"
+type roomRequest struct {
+	Public   bool      `json:"public"`
+	Opens    time.Time `json:"opens"`
+	Duration string    `json:"duration"`
+}
+
+func (s *Server) registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET "+s.basePath+"/api/rooms", s.apiListRooms)
+	mux.HandleFunc("POST "+s.basePath+"/api/rooms", s.operator(s.apiCreateRoom))
+	mux.HandleFunc("GET "+s.basePath+"/api/rooms/{code}", s.apiRoomStatus)
+	mux.HandleFunc("DELETE "+s.basePath+"/api/rooms/{code}", s.operator(s.apiCloseRoom))
+}
+
+// operator guards what only whoever runs the server may do: it takes
+// -api-token as "Authorization: Bearer", and without one set it's off
+func (s *Server) operator(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		want := s.login().apiToken
+		if want == "" {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "the server has no -api-token, so this is turned off"})
+			return
+		}
+		token, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "needs the server's -api-token"})
+			return
+		}
+		h(w, req)
+	}
+}
+
+// info describes a room, with join links relative to the request. Must hold s.mu.
+func (s *Server) info(r *Room, req *http.Request) roomInfo {
+	scheme, wsScheme := "http", "ws"
+	if s.secure(req) {
+		scheme, wsScheme = "https", "wss"
+	}
+	q := url.Values{"room": {r.code}}.Encode()
+
+	info := roomInfo{
+		Code:    r.code,
+		URL:     (&url.URL{Scheme: wsScheme, Host: req.Host, Path: s.basePath + "/ws", RawQuery: q}).String(),
+		Watch:   (&url.URL{Scheme: scheme, Host: req.Host, Path: s.basePath + "/watch", RawQuery: q}).String(),
+		Clients: len(r.clients),
+		Viewers: len(r.viewers),
+		Dropped: r.stats.dropped,
+		Created: r.created,
+		Waiting: len(r.outside),
+	}
+	if r.early() {
+		info.Opens = &r.opens
+	}
+	if !r.closes.IsZero() {
+		info.Closes = &r.closes
+	}
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) apiCreateRoom(w http.ResponseWriter, req *http.Request) {
+	var body roomRequest
+	var duration time.Duration
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4096)).Decode(&body); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad request body: " + err.Error()})
+		return
+	}
+	if body.Duration != "" {
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil || d <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad duration, want e.g. \"30m\""})
+			return
+		}
+		duration = d
+	}
+	r := s.scheduleRoom(body.Opens, duration, body.Public)
+
+	s.mu.Lock()
+	info := s.info(r, req)
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusCreated, info)
+}
+
+// apiListRooms lists the public rooms, the busiest first, for a lobby.
+// Private and matchmaking rooms never show up; their codes are how you
+// get in.
+func (s *Server) apiListRooms(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	list := []roomInfo{}
+	for _, r := range s.rooms {
+		if r.public && !r.matched {
+			list = append(list, s.info(r, req))
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Clients != list[j].Clients {
+			return list[i].Clients > list[j].Clients
+		}
+		return list[i].Code < list[j].Code
+	})
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) apiRoomStatus(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.rooms[req.PathValue("code")]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such room"})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.info(r, req))
+}
+
+func (s *Server) apiCloseRoom(w http.ResponseWriter, req *http.Request) {
+	if !s.closeRoom(req.PathValue("code"), "room closed") {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such room"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- login ----------
+
+// A hosted relay can have people log in with your OAuth provider. With
+// -oauth-client-id, -oauth-device-url and -oauth-token-url we tell
+// clients at GET /api/auth how to run the device flow against it
+// ("asciichat-client login"), and they send the token they get back as
+// "Authorization: Bearer" on every connection. With -oauth-userinfo too
+// we check that token ourselves, by asking that URL (the provider's
+// OIDC userinfo endpoint, or anything that answers 200 to a good token)
+// and remembering the answer for a minute; without it, checking it is
+// left to whatever's in front. Browsers can't send the header on a
+// websocket, so with -oauth-userinfo the /watch page can't get in; ssh
+// viewers give the token as their password.
+
+// authSettings are the login side of things, swapped whole on SIGHUP
+type authSettings struct {
+	config   *authConfig   // how to log in, nil if we don't say
+	tokens   *tokenChecker // nil to let anyone in
+	apiToken string        // for the API's writes, see api.go; empty turns them off
+}
+
+// authConfig is what GET /api/auth says
+type authConfig struct {
+	ClientID  string   `json:"client_id"`
+	DeviceURL string   `json:"device_url"`
+	TokenURL  string   `json:"token_url"`
+	Scopes    []string `json:"scopes,omitempty"`
+}
+
+func (s *Server) handleAuth(w http.ResponseWriter, r *http.Request) {
+	c := s.login().config
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+const tokenCheckFor = time.Minute
+
+// tokenChecker asks the userinfo URL about tokens, and remembers
+type tokenChecker struct {
+	url    string
+	client http.Client
+
+	mu   sync.Mutex
+	seen map[string]checkedToken
+}
+
+type checkedToken struct {
+	ok    bool
+	until time.Time
+}
+
+func newTokenChecker(url string) *tokenChecker {
+	return &tokenChecker{url: url, client: http.Client{Timeout: 5 * time.Second}, seen: make(map[string]checkedToken)}
+}
+
+// check reports whether an Authorization header carries a good token. A
+// nil checker lets everyone in.
+func (t *tokenChecker) check(header string) bool {
+	if t == nil {
+		return true
+	}
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+
+	t.mu.Lock()
+	c, ok := t.seen[token]
+	t.mu.Unlock()
+	if ok && time.Now().Before(c.until) {
+		return c.ok
+	}
+
+	req, err := http.NewRequest(http.MethodGet, t.url, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return false // not remembered: the provider may be back in a moment
+	}
+	resp.Body.Close()
+	good := resp.StatusCode == http.StatusOK
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for k, v := range t.seen {
+		if now.After(v.until) {
+			delete(t.seen, k)
+		}
+	}
+	t.seen[token] = checkedToken{good, now.Add(tokenCheckFor)}
+	return good
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// ---------- chat filtering ----------
+
+// chatFilter is the operator's chain of hooks run over chat text before
+// it's relayed. Each hook gets the text so far and returns what's left.
+// Only chat we can read gets here: an encrypted call's goes by sealed.
+type chatFilter []func(string) string
+
+var urlPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// newChatFilter builds the hooks from the -chat-* flags: a file of
+// words to mask, URL stripping and a length cap (0 = no cap)
+func newChatFilter(wordsPath string, stripURLs bool, maxLen int) (chatFilter, error) {
+	var f chatFilter
+
+	if wordsPath != "" {
+		words, err := readWords(wordsPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(words) > 0 {
+			for i, w := range words {
+				words[i] = regexp.QuoteMeta(w)
+			}
+			re := regexp.MustCompile(`(?i)\b(?:` + strings.Join(words, "|") + `)\b`)
+			f = append(f, func(s string) string {
+				return re.ReplaceAllStringFunc(s, func(w string) string {
+					return strings.Repeat("*", utf8.RuneCountInString(w))
+				})
+			})
+		}
+	}
+
+	if stripURLs {
+		f = append(f, func(s string) string { return urlPattern.ReplaceAllString(s, "[link removed]") })
+	}
+
+	if maxLen > 0 {
+		f = append(f, func(s string) string {
+			if utf8.RuneCountInString(s) <= maxLen {
+				return s
+			}
+			return string([]rune(s)[:maxLen])
+		})
+	}
+	return f, nil
+}
+
+// readWords reads one word or phrase per line; # starts a comment
+func readWords(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var words []string
+	sc := bufio.NewScanner(file)
+	for sc.Scan() {
+		w := strings.TrimSpace(sc.Text())
+		if w != "" && !strings.HasPrefix(w, "#") {
+			words = append(words, w)
+		}
+	}
+	return words, sc.Err()
+}
+
+// apply runs a chat message through the hooks. It returns nil if
+// nothing's left worth relaying.
+func (f chatFilter) apply(msg []byte) []byte {
+	if len(f) == 0 {
+		return msg
+	}
+
+	var m map[string]json.RawMessage
+	var text string
+	if json.Unmarshal(msg, &m) != nil || json.Unmarshal(m["text"], &text) != nil {
+		return nil
+	}
+	for _, hook := range f {
+		text = hook(text)
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+
+	m["text"], _ = json.Marshal(text)
+	out, _ := json.Marshal(m)
+	return out
+}
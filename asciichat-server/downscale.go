@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// ---------- downscaling ----------
+
+// With -downscale, a sender can render one frame at the biggest size
+// anyone in the room asked for and send it to everyone; the server
+// shrinks it for receivers with smaller terminals. It only works when
+// the server can read the frames, so encrypted calls still render per
+// receiver. We say we can do it in a response header on the upgrade.
+
+const downscaleHeader = "Faceterm-Downscale"
+
+// the biggest size a client can ask for, as in the client's limits.go;
+// we allocate by it when mixing
+const maxWidth, maxHeight = 1000, 500
+
+func (s *Server) upgradeHeader() http.Header {
+	h := http.Header{}
+	if s.downscale {
+		h.Set(downscaleHeader, "1")
+	}
+	if s.mix {
+		h.Set(mixHeader, "1")
+	}
+	return h
+}
+
+// wantSize remembers the size c asked ctl.To to render at; unaddressed
+// size messages go to everyone. One too big to be honest is ignored.
+// Must hold s.mu.
+func (c *Client) wantSize(ctl control) {
+	if ctl.Width < 0 || ctl.Width > maxWidth || ctl.Height < 0 || ctl.Height > maxHeight {
+		return
+	}
+	if c.wants == nil {
+		c.wants = make(map[uint64][2]int)
+	}
+	c.wants[ctl.To] = [2]int{ctl.Width, ctl.Height}
+}
+
+// wanted is the size c asked sender for, if it said. Must hold s.mu.
+func (c *Client) wanted(sender *Client) (int, int, bool) {
+	w, ok := c.wants[sender.id]
+	if !ok {
+		w, ok = c.wants[0]
+	}
+	return w[0], w[1], ok && w[0] > 0 && w[1] > 0
+}
+
+// fitFrame shrinks an unaddressed frame for receiver c, caching by size
+// so a room full of small terminals costs one shrink each. Must hold
+// s.mu.
+func (s *Server) fitFrame(sender, c *Client, msg []byte, cache map[[2]int][]byte) []byte {
+	w, h, ok := c.wanted(sender)
+	if !ok {
+		return msg
+	}
+	key := [2]int{w, h}
+	if out, ok := cache[key]; ok {
+		return out
+	}
+
+	var m map[string]any
+	if json.Unmarshal(msg, &m) != nil {
+		return msg
+	}
+	frame, _ := m["frame"].(string)
+	small, changed := shrink(frame, w, h)
+	out := msg
+	if changed {
+		m["frame"] = small
+		out, _ = json.Marshal(m)
+	}
+	cache[key] = out
+	return out
+}
+
+// cell is one character of a frame and the colors it's drawn in
+type cell struct {
+	fg, bg string
+	ch     rune
+}
+
+// shrink samples a frame down to at most w x h cells, keeping each
+// picked cell's colors. Frames that already fit come back untouched.
+func shrink(frame string, w, h int) (string, bool) {
+	rows := parseCells(frame)
+	srcH, srcW := len(rows), 0
+	for _, r := range rows {
+		srcW = max(srcW, len(r))
+	}
+	if srcW <= w && srcH <= h {
+		return frame, false
+	}
+	w, h = min(w, srcW), min(h, srcH)
+
+	var b strings.Builder
+	b.Grow(len(frame) * w * h / max(1, srcW*srcH))
+	writeCells(&b, sample(rows, w, h))
+	return b.String(), true
+}
+
+// parseCells splits a frame into rows of cells
+func parseCells(frame string) [][]cell {
+	var rows [][]cell
+	var fg, bg string
+	for _, line := range strings.Split(strings.TrimSuffix(frame, "\n"), "\n") {
+		var row []cell
+		for i := 0; i < len(line); {
+			if line[i] == '\033' && i+1 < len(line) && line[i+1] == '[' {
+				j := strings.IndexByte(line[i:], 'm')
+				if j < 0 {
+					break
+				}
+				seq := line[i : i+j+1]
+				switch p := seq[2 : len(seq)-1]; {
+				case p == "" || p == "0":
+					fg, bg = "", ""
+				case strings.HasPrefix(p, "48") || strings.HasPrefix(p, "4") && len(p) == 2 || strings.HasPrefix(p, "10") && len(p) == 3:
+					bg = seq
+				default:
+					fg = seq
+				}
+				i += j + 1
+				continue
+			}
+			r, size := utf8.DecodeRuneInString(line[i:])
+			i += size
+			row = append(row, cell{fg, bg, r})
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// sample picks w x h cells out of rows, nearest neighbour, so it
+// stretches as well as shrinks
+func sample(rows [][]cell, w, h int) [][]cell {
+	out := make([][]cell, 0, h)
+	for y := 0; y < h && len(rows) > 0; y++ {
+		row := rows[y*len(rows)/h]
+		picked := make([]cell, 0, w)
+		for x := 0; x < w && len(row) > 0; x++ {
+			picked = append(picked, row[x*len(row)/w])
+		}
+		out = append(out, picked)
+	}
+	return out
+}
+
+// writeCells turns rows of cells back into a frame, switching colors
+// only where they change
+func writeCells(b *strings.Builder, rows [][]cell) {
+	for _, row := range rows {
+		var fg, bg string
+		for _, c := range row {
+			if c.fg != fg && c.fg == "" || c.bg != bg && c.bg == "" {
+				b.WriteString("\033[0m")
+				fg, bg = "", ""
+			}
+			if c.fg != fg {
+				b.WriteString(c.fg)
+				fg = c.fg
+			}
+			if c.bg != bg {
+				b.WriteString(c.bg)
+				bg = c.bg
+			}
+			b.WriteRune(c.ch)
+		}
+		if fg != "" || bg != "" {
+			b.WriteString("\033[0m")
+		}
+		b.WriteByte('\n')
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// ---------- idle rooms ----------
+
+// expireRooms closes rooms nobody has used in a while, so abandoned
+// calls and forgotten API rooms don't hold slots forever. -room-idle
+// applies to rooms with people in them but no traffic; -room-empty to
+// rooms with nobody in them at all. Zero disables either.
+func (s *Server) expireRooms() {
+	for range time.Tick(30 * time.Second) {
+		var expired []string
+		s.mu.Lock()
+		idle, empty := s.roomIdle, s.roomEmpty
+		for code, r := range s.rooms {
+			if r.early() {
+				continue // booked, see schedule.go
+			}
+			quiet := time.Since(r.active)
+			occupied := len(r.clients) > 0 || len(r.viewers) > 0
+			if occupied && idle > 0 && quiet > idle || !occupied && empty > 0 && quiet > empty {
+				expired = append(expired, code)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, code := range expired {
+			log.Printf("room %s expired", code)
+			s.closeRoom(code, "room expired after being idle")
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "time"
+
+// ---------- focus ----------
+
+// In a big room a client can focus on one person ({"type":"focus",
+// "id":N}, 0 for nobody). It asks everyone else for small frames, and we
+// pass theirs on only a few times a second, so the bandwidth goes to the
+// one that's being watched. This works on encrypted calls too: it only
+// needs to know who frames are from.
+
+const thumbEvery = time.Second / 5
+
+func (s *Server) setFocus(c *Client, id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.focus = id
+	c.thumbed = make(map[uint64]time.Time)
+}
+
+// wantsFrame reports whether c should get this frame from sender: always
+// from whoever it's focused on, or with no focus, otherwise if the last
+// one from them was long enough ago. Must hold s.mu.
+func (c *Client) wantsFrame(sender *Client) bool {
+	if c.focus == 0 || c.focus == sender.id {
+		return true
+	}
+	if time.Since(c.thumbed[sender.id]) < thumbEvery {
+		return false
+	}
+	c.thumbed[sender.id] = time.Now()
+	return true
+}
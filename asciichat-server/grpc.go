@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ---------- grpc ----------
+
+// With -grpc the relay is also a gRPC service, faceterm.v1.Relay in
+// relay.proto, so a client in another language can generate typed
+// messages rather than hand-roll JSON over a websocket. There's no
+// generated code here: the relay passes JSON around, so the codec
+// turns each Message into the JSON a websocket client would have sent
+// and back, by the field table below, and from the room on down a
+// gRPC client is just another wire. Keep the table, relay.proto and
+// the client's Message in step.
+
+type pbKind int
+
+const (
+	pbString pbKind = iota
+	pbInt
+	pbUint
+	pbBool
+	pbBytes
+	pbDouble
+	pbStrings
+)
+
+type pbField struct {
+	num  protowire.Number
+	name string // in the JSON
+	kind pbKind
+}
+
+var relayFields = []pbField{
+	{1, "type", pbString}, {2, "from", pbUint}, {3, "to", pbUint}, {4, "id", pbUint},
+	{5, "width", pbInt}, {6, "height", pbInt}, {7, "frame", pbString}, {8, "name", pbString},
+	{9, "time", pbInt}, {10, "colors", pbString}, {11, "peer", pbString},
+	{12, "key", pbBytes}, {13, "data", pbBytes}, {14, "sig", pbBytes},
+	{15, "noframes", pbBool}, {16, "light", pbBool}, {17, "reaction", pbString},
+	{18, "thumb", pbString}, {19, "thumbw", pbInt}, {20, "thumbh", pbInt}, {21, "scale", pbInt},
+	{22, "cellw", pbInt}, {23, "cellh", pbInt}, {24, "pixels", pbBytes}, {25, "pixw", pbInt}, {26, "pixh", pbInt},
+	{27, "caption", pbString}, {28, "clock", pbString}, {29, "renderers", pbStrings}, {30, "aspect", pbDouble},
+	{31, "text", pbString}, {32, "trace", pbString},
+	{33, "user", pbString}, {34, "room", pbString}, {35, "status", pbString},
+}
+
+// extraField carries whatever JSON the table has no field for
+const extraField protowire.Number = 100
+
+// toProto encodes a JSON message as a Message. A field that isn't in
+// the table, or doesn't have the type the table says, goes in extra;
+// the odd message that isn't JSON at all, like "room full", is text.
+func toProto(msg []byte) ([]byte, error) {
+	var b []byte
+	var m map[string]json.RawMessage
+	if json.Unmarshal(msg, &m) != nil {
+		return protowire.AppendBytes(protowire.AppendTag(b, 31, protowire.BytesType), msg), nil
+	}
+	for _, f := range relayFields {
+		raw, ok := m[f.name]
+		if !ok {
+			continue
+		}
+		var err error
+		switch f.kind {
+		case pbString:
+			var v string
+			if err = json.Unmarshal(raw, &v); err == nil && v != "" {
+				b = protowire.AppendString(protowire.AppendTag(b, f.num, protowire.BytesType), v)
+			}
+		case pbInt:
+			var v int64
+			if err = json.Unmarshal(raw, &v); err == nil && v != 0 {
+				b = protowire.AppendVarint(protowire.AppendTag(b, f.num, protowire.VarintType), uint64(v))
+			}
+		case pbUint:
+			var v uint64
+			if err = json.Unmarshal(raw, &v); err == nil && v != 0 {
+				b = protowire.AppendVarint(protowire.AppendTag(b, f.num, protowire.VarintType), v)
+			}
+		case pbBool:
+			var v bool
+			if err = json.Unmarshal(raw, &v); err == nil && v {
+				b = protowire.AppendVarint(protowire.AppendTag(b, f.num, protowire.VarintType), 1)
+			}
+		case pbBytes:
+			var v []byte
+			if err = json.Unmarshal(raw, &v); err == nil && len(v) > 0 {
+				b = protowire.AppendBytes(protowire.AppendTag(b, f.num, protowire.BytesType), v)
+			}
+		case pbDouble:
+			var v float64
+			if err = json.Unmarshal(raw, &v); err == nil && v != 0 {
+				b = protowire.AppendFixed64(protowire.AppendTag(b, f.num, protowire.Fixed64Type), math.Float64bits(v))
+			}
+		case pbStrings:
+			var v []string
+			if err = json.Unmarshal(raw, &v); err == nil {
+				for _, s := range v {
+					b = protowire.AppendString(protowire.AppendTag(b, f.num, protowire.BytesType), s)
+				}
+			}
+		}
+		if err == nil {
+			delete(m, f.name)
+		}
+	}
+	if len(m) > 0 {
+		extra, _ := json.Marshal(m)
+		b = protowire.AppendBytes(protowire.AppendTag(b, extraField, protowire.BytesType), extra)
+	}
+	return b, nil
+}
+
+// fromProto decodes a Message as JSON, skipping fields it doesn't know
+func fromProto(b []byte) ([]byte, error) {
+	byNum := make(map[protowire.Number]pbField, len(relayFields))
+	for _, f := range relayFields {
+		byNum[f.num] = f
+	}
+
+	m := make(map[string]any)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		f, known := byNum[num]
+		switch {
+		case num == extraField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			var extra map[string]json.RawMessage
+			if json.Unmarshal(v, &extra) != nil {
+				return nil, fmt.Errorf("extra isn't a JSON object")
+			}
+			for k, v := range extra {
+				if _, ok := m[k]; !ok {
+					m[k] = v
+				}
+			}
+			b = b[n:]
+		case known && typ == kindWireType(f.kind):
+			n = decodeField(b, f, m)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+		default:
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return json.Marshal(m)
+}
+
+func kindWireType(k pbKind) protowire.Type {
+	switch k {
+	case pbInt, pbUint, pbBool:
+		return protowire.VarintType
+	case pbDouble:
+		return protowire.Fixed64Type
+	}
+	return protowire.BytesType
+}
+
+// decodeField puts one field's value in m, returning how many bytes it
+// took, or a negative protowire error
+func decodeField(b []byte, f pbField, m map[string]any) int {
+	switch f.kind {
+	case pbInt, pbUint, pbBool:
+		v, n := protowire.ConsumeVarint(b)
+		switch f.kind {
+		case pbInt:
+			m[f.name] = int64(v)
+		case pbUint:
+			m[f.name] = v
+		default:
+			m[f.name] = v != 0
+		}
+		return n
+	case pbDouble:
+		v, n := protowire.ConsumeFixed64(b)
+		m[f.name] = math.Float64frombits(v)
+		return n
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n
+	}
+	switch f.kind {
+	case pbBytes:
+		m[f.name] = v
+	case pbStrings:
+		list, _ := m[f.name].([]string)
+		m[f.name] = append(list, string(v))
+	default:
+		m[f.name] = string(v)
+	}
+	return n
+}
+
+// relayCodec is the wire format for the service: each message is JSON
+// on our side of it and a Message on the client's
+type relayCodec struct{}
+
+func (relayCodec) Name() string { return "proto" }
+
+func (relayCodec) Marshal(v any) ([]byte, error) {
+	return toProto(*v.(*[]byte))
+}
+
+func (relayCodec) Unmarshal(data []byte, v any) error {
+	msg, err := fromProto(data)
+	*v.(*[]byte) = msg
+	return err
+}
+
+// relayService is faceterm.v1.Relay, written out by hand since there's
+// no generated code
+var relayService = grpc.ServiceDesc{
+	ServiceName: "faceterm.v1.Relay",
+	HandlerType: (*any)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Connect",
+		ServerStreams: true,
+		ClientStreams: true,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			return srv.(*Server).handleGRPC(stream)
+		},
+	}},
+	Metadata: "relay.proto",
+}
+
+// serveGRPC answers gRPC clients on ln until it fails, over TLS if
+// there's a certificate
+func (s *Server) serveGRPC(ln net.Listener, certFile, keyFile string) error {
+	opts := []grpc.ServerOption{
+		grpc.ForceServerCodec(relayCodec{}),
+		grpc.MaxRecvMsgSize(maxStreamMessage),
+		grpc.MaxSendMsgSize(maxStreamMessage),
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: 10 * time.Second, Timeout: 20 * time.Second}),
+	}
+	if certFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	gs := grpc.NewServer(opts...)
+	gs.RegisterService(&relayService, s)
+	log.Println("gRPC on", ln.Addr())
+	return gs.Serve(ln)
+}
+
+func (s *Server) handleGRPC(stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	md, _ := metadata.FromIncomingContext(ctx)
+	span := connecting(ctx, "grpc")
+	defer span.End()
+
+	// the same checks as a websocket gets, with the peer's address and
+	// any X-Forwarded-For standing in for the request
+	r := &http.Request{Header: http.Header{"X-Forwarded-For": md.Get("x-forwarded-for")}}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	ip := s.clientIP(r)
+	switch err := s.letIn(ip); err {
+	case nil:
+	case errTooMany:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	defer s.limits.release(ip)
+
+	if a := md.Get("authorization"); len(a) > 1 || !s.login().tokens.check(strings.Join(a, "")) {
+		return status.Error(codes.Unauthenticated, "log in first")
+	}
+
+	if p := md.Get("faceterm-protocol"); len(p) != 1 || p[0] != subprotocol {
+		log.Printf("rejecting %s: offered %v over grpc, we speak %s", ip, p, subprotocol)
+		return status.Error(codes.FailedPrecondition, "unsupported protocol version, this server speaks "+subprotocol)
+	}
+
+	hdr := metadata.Pairs("faceterm-protocol", subprotocol)
+	for k, v := range s.upgradeHeader() {
+		hdr.Append(k, v...)
+	}
+	if err := stream.SendHeader(hdr); err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	for _, k := range []string{"room", "match", "view", "mix", "public", "user", "key", "t", "sig", "call", "status"} {
+		if v := md.Get(k); len(v) > 0 {
+			q.Set(k, v[0])
+		}
+	}
+	c := &streamWire{stream: stream, done: make(chan struct{})}
+	span.End()
+	go s.serve(c, q, ip)
+
+	// the stream lasts as long as this does; returning ends it, which
+	// is how Close hangs up
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		c.Close()
+	}
+
+	// wait out a send in progress; none can start once done is closed
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reason != "" {
+		return status.Error(codes.Unavailable, c.reason)
+	}
+	return nil
+}
+
+// streamWire is a gRPC stream as a wire
+type streamWire struct {
+	stream grpc.ServerStream
+	mu     sync.Mutex // one sender at a time
+
+	once   sync.Once
+	done   chan struct{}
+	reason string // why we hung up, if we said
+}
+
+func (c *streamWire) ReadMessage() (int, []byte, error) {
+	var msg []byte
+	if err := c.stream.RecvMsg(&msg); err != nil {
+		return 0, nil, err
+	}
+	return websocket.TextMessage, msg, nil
+}
+
+func (c *streamWire) WriteMessage(_ int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return net.ErrClosed
+	default:
+	}
+	return c.stream.SendMsg(&data)
+}
+
+// WriteControl only does closes; gRPC has keepalives of its own
+func (c *streamWire) WriteControl(messageType int, data []byte, _ time.Time) error {
+	if messageType == websocket.CloseMessage && len(data) > 2 {
+		c.mu.Lock()
+		c.reason = string(data[2:])
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+func (c *streamWire) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
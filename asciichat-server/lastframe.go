@@ -0,0 +1,31 @@
+package main
+
+// ---------- last frame cache ----------
+
+// Each client's most recent frame is kept so anyone who turns up later,
+// peer or viewer, has something to look at straight away. Encrypted
+// calls can't be cached (we can't tell frames apart, and a new peer
+// couldn't open them anyway); there the sender sends a fresh frame as
+// soon as it hears the peer joined.
+
+// keepFrame remembers c's latest frame
+func (s *Server) keepFrame(c *Client, msg []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.outside != nil {
+		return // not in yet, and not stamped with an id, see schedule.go
+	}
+	c.lastFrame = msg
+}
+
+// sendLastFrame gives a newcomer the latest frame from someone already
+// in the room. Must hold s.mu.
+func sendLastFrame(from *Client, to chan []byte) {
+	if from == nil || from.lastFrame == nil {
+		return
+	}
+	select {
+	case to <- from.lastFrame:
+	default:
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ---------- per-ip limits ----------
+
+// ipLimiter caps how many connections one address can hold open at once
+// and how fast it can open new ones. Zero disables either limit.
+type ipLimiter struct {
+	maxConns    int
+	maxAttempts int // per minute
+
+	mu       sync.Mutex
+	conns    map[string]int
+	attempts map[string]*bucket
+}
+
+// bucket is a token bucket refilled at maxAttempts per minute
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newIPLimiter(maxConns, maxAttempts int) *ipLimiter {
+	l := &ipLimiter{
+		maxConns:    maxConns,
+		maxAttempts: maxAttempts,
+		conns:       make(map[string]int),
+		attempts:    make(map[string]*bucket),
+	}
+	go l.sweep()
+	return l
+}
+
+// set changes the limits; connections already in stay in
+func (l *ipLimiter) set(maxConns, maxAttempts int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxConns, l.maxAttempts = maxConns, maxAttempts
+}
+
+// acquire admits a new connection from ip; call release when it ends
+func (l *ipLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxAttempts > 0 {
+		now := time.Now()
+		b := l.attempts[ip]
+		if b == nil {
+			b = &bucket{tokens: float64(l.maxAttempts), last: now}
+			l.attempts[ip] = b
+		}
+		b.tokens = min(float64(l.maxAttempts), b.tokens+now.Sub(b.last).Minutes()*float64(l.maxAttempts))
+		b.last = now
+		if b.tokens < 1 {
+			return false
+		}
+		b.tokens--
+	}
+
+	if l.maxConns > 0 && l.conns[ip] >= l.maxConns {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *ipLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// sweep forgets buckets that have been full for a while, so the map
+// doesn't grow with every address that ever connected
+func (l *ipLimiter) sweep() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		for ip, b := range l.attempts {
+			if time.Since(b.last) > 2*time.Minute {
+				delete(l.attempts, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
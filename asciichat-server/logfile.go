@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ---------- log rotation ----------
+
+// With -log-file the log goes to a file that's rotated once it gets too
+// big or too old: server.log becomes server.log.1, .1 becomes .2 and so
+// on, and the oldest past -log-keep is deleted. It's what logrotate
+// does, for relays that run for months without anyone setting it up.
+
+type logFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64         // bytes, 0 for no limit
+	maxAge  time.Duration // since the file was started, 0 for no limit
+	keep    int           // rotated files to keep
+
+	f       *os.File
+	size    int64
+	started time.Time
+}
+
+func openLogFile(path string, maxSize int64, maxAge time.Duration, keep int) (*logFile, error) {
+	l := &logFile{path: path, maxSize: maxSize, maxAge: maxAge, keep: max(keep, 1)}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open appends to the current file, restarting the age clock
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size, l.started = f, info.Size(), time.Now()
+	return nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	full := l.maxSize > 0 && l.size+int64(len(p)) > l.maxSize && l.size > 0
+	old := l.maxAge > 0 && time.Since(l.started) > l.maxAge
+	if full || old {
+		if err := l.rotate(); err != nil {
+			// keep logging to whatever we have rather than lose lines
+			fmt.Fprintln(os.Stderr, "log rotation failed:", err)
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the numbered files up one and starts a fresh log. Must
+// hold l.mu.
+func (l *logFile) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	os.Remove(l.numbered(l.keep))
+	for i := l.keep - 1; i >= 1; i-- {
+		os.Rename(l.numbered(i), l.numbered(i+1)) // gaps are fine
+	}
+	if err := os.Rename(l.path, l.numbered(1)); err != nil && !os.IsNotExist(err) {
+		l.open()
+		return err
+	}
+	return l.open()
+}
+
+func (l *logFile) numbered(i int) string {
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
@@ -1,106 +1,451 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const maxClients = 2
+// maxClients is how many people fit in a room, see -room-size, set by
+// configure before anyone gets in. SIGHUP can change it, and it's read
+// without s.mu, so it's atomic.
+var maxClients atomic.Int64
+
+const defaultRoomSize = 2
 
 // ---------- client ----------
 
 type Client struct {
-	conn *websocket.Conn
-	send chan []byte
+	id    uint64
+	ip    string
+	room  *Room
+	conn  wire // see webtransport.go
+	send  chan []byte
+	stats relayStats
+
+	// matchmaking: id of the last partner, so we don't rematch straight
+	// away, our anonymous peer id and the peer ids we never want to see
+	last    uint64
+	peer    string
+	blocked map[string]bool
+
+	lastFrame []byte // for late joiners, see lastframe.go
+
+	outside *Room // waiting for this room to open, see schedule.go
+
+	user string // the account it signed in as, see accounts.go
+
+	// the size each other client asked us to render at, keyed by their
+	// id (0 for everyone), for -downscale
+	wants map[uint64][2]int
+
+	mix bool // gets one composite instead of everyone's frames, see mix.go
+
+	// who this client is watching, and when each of the others last got
+	// a thumbnail frame through to it, see focus.go
+	focus   uint64
+	thumbed map[uint64]time.Time
+}
+
+// Viewer is a watch-only participant; it doesn't take a room slot
+type Viewer struct {
+	ip    string
+	room  *Room
+	send  chan []byte
+	stats relayStats
 }
 
 // ---------- server ----------
 
 type Server struct {
-	clients map[*Client]bool
-	mu      sync.Mutex
+	rooms     map[string]*Room
+	pool      []*Client // waiting for a random partner
+	nextID    uint64
+	hooks     *webhooks
+	limits    *ipLimiter
+	mod       *moderation
+	basePath  string // URL prefix when mounted under a reverse proxy, e.g. /faceterm
+	downscale bool   // shrink unaddressed frames for smaller receivers, see downscale.go
+	mix       bool   // composite the room for clients that ask, see mix.go
+	sse       sseSessions
+	accounts  *accounts // nil without -accounts
+	mu        sync.Mutex
+
+	roomIdle, roomEmpty time.Duration // see expire.go; guarded by mu
+	stats               relayStats    // everything relayed, for /metrics; guarded by mu
+
+	// what SIGHUP can swap, see reload.go
+	conf    sync.RWMutex
+	chat    chatFilter
+	proxies trustedProxies
+	origins []string     // see origin.go
+	auth    authSettings // see auth.go
 }
 
-func NewServer() *Server {
+func NewServer(hooks *webhooks, limits *ipLimiter, mod *moderation) *Server {
 	return &Server{
-		clients: make(map[*Client]bool),
+		rooms:  make(map[string]*Room),
+		hooks:  hooks,
+		limits: limits,
+		mod:    mod,
+	}
+}
+
+// notify sends a message to everyone in the room except skip. Must hold s.mu.
+func (r *Room) notify(skip *Client, msg []byte) {
+	for c := range r.clients {
+		if c != skip {
+			select {
+			case c.send <- msg:
+			default:
+			}
+		}
 	}
 }
 
-// add client (limit 2)
-func (s *Server) add(c *Client) bool {
+// add client to a room (limit maxClients), or outside it if it hasn't
+// opened yet. A room the client makes by joining is listed if it asks.
+func (s *Server) add(c *Client, code string, public bool) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if len(s.clients) >= maxClients {
+	_, exists := s.rooms[code]
+	r := s.room(code)
+	if !exists && public {
+		r.public = true
+	}
+	if r.early() {
+		if len(r.outside) >= int(maxClients.Load()) {
+			return false
+		}
+		s.waitOutside(c, r)
+		return true
+	}
+	if len(r.clients) >= int(maxClients.Load()) {
 		return false
 	}
-
-	s.clients[c] = true
-	log.Println("client connected, total:", len(s.clients))
+	s.enter(c, r)
 	return true
 }
 
+// enter puts a client in a room and introduces it. Must hold s.mu.
+func (s *Server) enter(c *Client, r *Room) {
+	s.nextID++
+	c.id = s.nextID
+	c.room = r
+	r.clients[c] = true
+	r.active = time.Now()
+	if c.user != "" && c.user == r.invited {
+		r.invited = "" // answered
+	}
+	log.Printf("client %s connected to room %s, total: %d", c.ip, r.code, len(r.clients))
+	r.notify(c, joinedMsg(c.id, ""))
+	for o := range r.clients {
+		if o != c {
+			// so the newcomer knows who to address
+			select {
+			case c.send <- joinedMsg(o.id, ""):
+			default:
+			}
+			sendLastFrame(o, c.send)
+		}
+	}
+	s.hooks.emit("peer_joined", r)
+}
+
 // remove client
 func (s *Server) remove(c *Client) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	delete(s.clients, c)
+	r := c.room
+	if r == nil {
+		if c.outside != nil {
+			s.leaveOutside(c)
+			close(c.send)
+			log.Printf("client %s gave up waiting for a room", c.ip)
+		} else if s.leavePool(c) {
+			close(c.send)
+			log.Printf("client %s left matchmaking, waiting: %d", c.ip, len(s.pool))
+		}
+		return
+	}
+	if !r.clients[c] {
+		return
+	}
+	delete(r.clients, c)
 	close(c.send)
+	r.active = time.Now()
+	r.mixDirty = true // their tile goes
+	for o := range r.clients {
+		if o.focus == c.id {
+			o.focus = 0
+		}
+	}
 
-	log.Println("client disconnected, total:", len(s.clients))
+	log.Printf("client %s disconnected from room %s, total: %d", c.ip, r.code, len(r.clients))
+	if len(r.clients) == 0 && r.invited != "" {
+		s.stopRinging(r, "") // the caller hung up
+	}
+	if r.matched {
+		// whoever's left goes looking for someone new
+		r.notify(nil, leftMsg(c.id))
+		s.unmatch(r)
+		s.match()
+		return
+	}
+	r.notify(nil, leftMsg(c.id))
+	if s.rooms[r.code] == r { // not already closed
+		s.hooks.emit("peer_left", r)
+	}
+	s.cleanup(r)
 }
 
-// relay message to everyone except sender
-func (s *Server) broadcast(sender *Client, msg []byte) {
+// add viewer to a room
+func (s *Server) addViewer(v *Viewer, code string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for c := range s.clients {
-		if c != sender {
-			select {
-			case c.send <- msg:
-			default:
-				// drop if slow
+	r := s.room(code)
+	v.room = r
+	r.viewers[v] = true
+	log.Printf("viewer %s connected to room %s, total: %d", v.ip, r.code, len(r.viewers))
+	sendLastFrame(r.featured(), v.send)
+}
+
+// remove viewer
+func (s *Server) removeViewer(v *Viewer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := v.room
+	if !r.viewers[v] {
+		return
+	}
+	delete(r.viewers, v)
+	close(v.send)
+
+	log.Printf("viewer %s disconnected from room %s, total: %d", v.ip, r.code, len(r.viewers))
+	s.cleanup(r)
+}
+
+// relay message to everyone in the sender's room except the sender, or
+// only to client ctl.To when that's set
+func (s *Server) broadcast(sender *Client, ctl control, msg []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// drop if slow, but keep count
+	r := sender.room
+	if r == nil {
+		return // still waiting for a match
+	}
+	r.active = time.Now()
+	to := ctl.To
+	fit := s.downscale && to == 0 && ctl.Type == "frame"
+	cache := map[bool]map[[2]int][]byte{false: {}, true: {}} // by rendition, then size
+	simul := ctl.Type == "frame" && ctl.ThumbW > 0
+	renditions := make(map[bool][]byte)
+	for c := range r.clients {
+		if c != sender && (to == 0 || c.id == to) {
+			if c.mix && ctl.Type == "frame" {
+				r.mixDirty = true // it'll be in their next composite
+				continue
+			}
+			if ctl.Type == "frame" && !c.wantsFrame(sender) {
+				continue
+			}
+			out, small := msg, false
+			if simul {
+				w, h, ok := c.wanted(sender)
+				small = ok && w <= ctl.ThumbW && h <= ctl.ThumbH
+				out = rendition(msg, small, renditions)
+			}
+			if fit {
+				out = s.fitFrame(sender, c, out, cache[small]) // shrinks the rendition picked
 			}
+			s.deliver(c.send, &c.stats, r, out)
+		}
+	}
+
+	// viewers watch the featured client as seen by whoever's been here
+	// next longest
+	if sender == r.featured() && (to == 0 || to == r.audience(sender)) {
+		if simul {
+			msg = rendition(msg, false, renditions)
+		}
+		for v := range r.viewers {
+			s.deliver(v.send, &v.stats, r, msg)
 		}
 	}
 }
 
 // ---------- websocket ----------
 
+// subprotocol is the wire protocol version we speak. Clients that don't
+// ask for any subprotocol are older builds and still get in.
+const subprotocol = "faceterm.v1"
+
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	Subprotocols: []string{subprotocol}, // CheckOrigin is set in main, see origin.go
+
+	// only for clients that ask (-compress); frames are very repetitive
+	EnableCompression: true,
+}
+
+// compatible reports whether the client offered our protocol, or no
+// protocol at all
+func compatible(r *http.Request) bool {
+	offered := websocket.Subprotocols(r)
+	if len(offered) == 0 {
+		return true
+	}
+	for _, p := range offered {
+		if p == subprotocol {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	span := connecting(r.Context(), "websocket")
+	defer span.End()
+	ip, ok := s.admit(w, r)
+	if !ok {
+		return
+	}
+	defer s.limits.release(ip)
+
+	if !compatible(r) {
+		log.Printf("rejecting %s: offered %v, we speak %s", ip, websocket.Subprotocols(r), subprotocol)
+		http.Error(w, "unsupported protocol version, this server speaks "+subprotocol, http.StatusUpgradeRequired)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, s.upgradeHeader())
+	if err != nil {
+		return
+	}
+	span.End()
+	s.serve(conn, r.URL.Query(), ip)
+}
+
+// admit checks an address against the limits and bans, and takes one
+// of its connections; release it when done
+func (s *Server) admit(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ip := s.clientIP(r)
+	switch err := s.letIn(ip); err {
+	case nil:
+		if !s.login().tokens.check(r.Header.Get("Authorization")) {
+			s.limits.release(ip)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "log in first", http.StatusUnauthorized)
+			return ip, false
+		}
+		return ip, true
+	case errTooMany:
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	default:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	}
+	return ip, false
+}
+
+var (
+	errTooMany = errors.New("too many connections")
+	errBanned  = errors.New("banned")
+)
+
+// letIn is admit for any transport
+func (s *Server) letIn(ip string) error {
+	if !s.limits.acquire(ip) {
+		log.Printf("too many connections from %s", ip)
+		return errTooMany
+	}
+	if s.mod.banned(ip) {
+		s.limits.release(ip)
+		return errBanned
+	}
+	return nil
+}
+
+// serve puts a new connection, however it came in, into its room, the
+// matchmaking pool or the audience, and runs it until it closes
+func (s *Server) serve(conn wire, q url.Values, ip string) {
+	code := q.Get("room")
+
+	if q.Has("view") {
+		s.handleViewerWS(conn, code, ip)
+		return
+	}
+
+	user, err := s.accounts.signIn(q)
+	if err == nil && q.Has("call") && user == "" {
+		err = errors.New("calling someone takes an account: sign in with -user")
+		if s.accounts == nil {
+			err = errNoAccounts
+		}
+	}
 	if err != nil {
+		log.Printf("refusing %s: %v", ip, err)
+		conn.WriteMessage(websocket.TextMessage, refusedMsg(err.Error()))
+		conn.Close()
 		return
 	}
 
 	client := &Client{
-		conn: conn,
-		send: make(chan []byte, 16),
+		ip:      ip,
+		conn:    conn,
+		send:    make(chan []byte, 16),
+		peer:    s.mod.peerID(ip),
+		blocked: make(map[string]bool),
+		mix:     s.mix && q.Has("mix"),
+		user:    user,
 	}
 
-	if !s.add(client) {
-		conn.WriteMessage(websocket.TextMessage, []byte("room full (2 clients max)"))
+	in := true
+	switch {
+	case q.Has("match"):
+		s.joinPool(client)
+	case q.Has("call"):
+		in = s.call(client, q.Get("call"))
+	default:
+		in = s.add(client, code, q.Has("public"))
+	}
+	if !in {
+		conn.WriteMessage(websocket.TextMessage, []byte(roomFull()))
 		conn.Close()
 		return
 	}
+	s.accounts.arrived(client)
+	if st := q.Get("status"); st != "" {
+		s.accounts.setStatus(client, st)
+	}
 
 	go s.writer(client)
 	s.reader(client)
 }
 
+func roomFull() string {
+	return fmt.Sprintf("room full (%d clients max)", maxClients.Load())
+}
+
 // read loop
 func (s *Server) reader(c *Client) {
 	defer func() {
+		s.accounts.left(c)
 		s.remove(c)
 		c.conn.Close()
 	}()
@@ -111,8 +456,55 @@ func (s *Server) reader(c *Client) {
 			return
 		}
 
-		// just relay raw bytes
-		s.broadcast(c, msg)
+		ctl := parseControl(msg)
+		switch ctl.Type {
+		case "next":
+			s.next(c)
+			continue
+		case "block":
+			s.block(c, ctl.Peer)
+			continue
+		case "report":
+			s.report(c, ctl.Peer)
+			continue
+		case "focus":
+			s.setFocus(c, ctl.ID)
+			continue
+		case "status":
+			s.accounts.setStatus(c, ctl.Status)
+			continue
+		case "decline":
+			s.decline(c, ctl.Room, ctl.Text)
+			continue
+		case "joined", "left", "waiting", "mix", "scheduled", "invite", "calling", "unreachable", "refused", "declined", "cancelled":
+			continue // ours to send: from a client it's someone posing as us
+		case "size":
+			s.mu.Lock()
+			c.wantSize(ctl)
+			s.mu.Unlock()
+		case "chat":
+			if msg = s.chatRules().apply(msg); msg == nil {
+				continue
+			}
+		}
+
+		// just relay raw bytes, plus who they're from
+		msg = stamp(msg, c.id)
+		var span trace.Span
+		if ctl.Trace != "" {
+			msg, span = traceRelay(msg, ctl)
+		}
+		start := time.Now()
+		if ctl.Type == "frame" {
+			s.keepFrame(c, msg)
+		}
+		s.broadcast(c, ctl, msg)
+		if ctl.Type == "frame" || ctl.Type == "sealed" {
+			relayed(start, len(msg))
+		}
+		if span != nil {
+			span.End()
+		}
 	}
 }
 
@@ -128,11 +520,211 @@ func (s *Server) writer(c *Client) {
 
 // ---------- main ----------
 
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
 func main() {
-	s := NewServer()
+	metricsAddr := flag.String("metrics-addr", "", "Listen address for Prometheus /metrics (e.g. 127.0.0.1:9100), kept off the public port; empty disables")
+	sshAddr := flag.String("ssh", "", "Listen address for ssh viewers (e.g. :2222); empty disables")
+	sshKey := flag.String("ssh-key", "ssh_host_ed25519_key", "SSH host key, generated if missing")
+	var hookURLs stringList
+	flag.Var(&hookURLs, "webhook", "URL to POST room events to (repeatable)")
+	maxConns := flag.Int("max-conns-per-ip", 8, "Simultaneous connections allowed from one IP (0 = unlimited)")
+	maxAttempts := flag.Int("max-attempts-per-ip", 30, "New connections per minute allowed from one IP (0 = unlimited)")
+	proxies := flag.String("trusted-proxies", "", "Comma-separated IPs/CIDRs of reverse proxies whose X-Forwarded-For to believe")
+	basePath := flag.String("base-path", "", "URL prefix to serve under, e.g. /faceterm")
+	peerSecret := flag.String("peer-secret", "", "Key for anonymous peer ids; set it to keep clients' block lists working across restarts")
+	banAfter := flag.Int("ban-after", 3, "Ban an address after this many different people report it (0 = never)")
+	banFor := flag.Duration("ban-for", 24*time.Hour, "How long a ban lasts")
+	chatWords := flag.String("chat-words", "", "File of words to mask in chat, one per line (unencrypted calls only, see -chat-max)")
+	chatURLs := flag.Bool("chat-strip-urls", false, "Remove links from chat messages (unencrypted calls only, see -chat-max)")
+	chatMax := flag.Int("chat-max", 500, "Longest chat message in characters, longer ones are cut (0 = no limit). Like all the -chat- filters, this only reaches calls with -e2e=false: encrypted chat, the client's default, goes by sealed")
+	roomIdle := flag.Duration("room-idle", 15*time.Minute, "Close rooms whose clients haven't sent anything for this long (0 = never)")
+	roomEmpty := flag.Duration("room-empty", 24*time.Hour, "Close rooms (including API rooms) that have sat empty this long (0 = never)")
+	mix := flag.Bool("mix", false, "Composite everyone's unencrypted video into one frame for clients that ask (-mix on the client)")
+	downscale := flag.Bool("downscale", false, "Shrink unencrypted frames for receivers with smaller terminals, so senders can render once")
+	roomSize := flag.Int("room-size", defaultRoomSize, "Most clients allowed in one room (viewers don't count)")
+	origins := flag.String("origins", "", "Comma-separated origins browsers may connect from, e.g. https://example.com (empty = any)")
+	configPath := flag.String("config", "", "File of flag settings, one \"name = value\" a line; SIGHUP reloads limits, proxies, origins, bans, chat, room and login settings from it")
+	wtAddr := flag.String("webtransport", "", "UDP listen address for WebTransport (HTTP/3) clients, e.g. :443; empty disables. Needs -tls-cert and -tls-key")
+	grpcAddr := flag.String("grpc", "", "Listen address for gRPC clients (e.g. :8081), see relay.proto; empty disables. TLS with -tls-cert, plaintext without")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate for -webtransport and -grpc")
+	tlsKey := flag.String("tls-key", "", "TLS private key for -webtransport and -grpc")
+	logPath := flag.String("log-file", "", "Log to this file instead of stderr, rotating it by -log-max-size and -log-max-age")
+	logSize := flag.Int("log-max-size", 100, "Rotate the log file once it reaches this many megabytes (0 = no limit)")
+	logAge := flag.Duration("log-max-age", 0, "Rotate the log file once it's been written to this long, e.g. 24h (0 = no limit)")
+	logKeep := flag.Int("log-keep", 5, "Rotated log files to keep")
+	oauthClient := flag.String("oauth-client-id", "", "OAuth client id for logging in with the device flow (asciichat-client login); with -oauth-device-url and -oauth-token-url")
+	oauthDevice := flag.String("oauth-device-url", "", "Your OAuth provider's device authorization endpoint")
+	oauthToken := flag.String("oauth-token-url", "", "Your OAuth provider's token endpoint")
+	oauthScopes := flag.String("oauth-scopes", "", "Comma-separated OAuth scopes to ask for when logging in")
+	oauthUserinfo := flag.String("oauth-userinfo", "", "Only let in connections whose bearer token this URL accepts (e.g. the provider's OIDC userinfo endpoint; ssh viewers give the token as their password); empty leaves checking to a proxy in front")
+	apiToken := flag.String("api-token", "", "Bearer token for creating and closing rooms through /api/rooms (POST and DELETE); empty turns those off")
+	accountsPath := flag.String("accounts", "", "File of user names and their ssh keys, so clients can sign in (-user) and call each other by name; empty disables")
+	otelExporter := flag.String("otel", "", "Export OpenTelemetry traces and metrics: otlp (set OTEL_EXPORTER_OTLP_ENDPOINT) or stdout; empty disables")
+	flag.Parse()
 
-	http.HandleFunc("/ws", s.handleWS)
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if *configPath != "" {
+		if err := applyConfigFile(*configPath, given, nil); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *logPath != "" {
+		lf, err := openLogFile(*logPath, int64(*logSize)<<20, *logAge, *logKeep)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(lf)
+	}
+
+	if err := setupOTel(*otelExporter); err != nil {
+		log.Fatal(err)
+	}
 
-	log.Println("ASCII relay server on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	s := NewServer(newWebhooks(hookURLs), newIPLimiter(*maxConns, *maxAttempts), newModeration(*peerSecret, *banAfter, *banFor))
+	s.downscale = *downscale
+	s.mix = *mix
+	s.basePath = "/" + strings.Trim(*basePath, "/")
+	if s.basePath == "/" {
+		s.basePath = ""
+	}
+	upgrader.CheckOrigin = s.originAllowed
+	if *accountsPath != "" {
+		a, err := loadAccounts(*accountsPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.accounts = a
+	}
+
+	// configure applies the settings a reload can change, all of them
+	// or none if any don't check out
+	configure := func() error {
+		p, err := parseTrustedProxies(*proxies)
+		if err != nil {
+			return err
+		}
+		chat, err := newChatFilter(*chatWords, *chatURLs, *chatMax)
+		if err != nil {
+			return err
+		}
+		if *chatWords != "" || *chatURLs {
+			log.Println("chat filters only see unencrypted calls; clients encrypt by default (-e2e), and that chat goes by untouched")
+		}
+		if *roomSize < 1 {
+			return fmt.Errorf("-room-size must be at least 1")
+		}
+		auth := authSettings{apiToken: *apiToken}
+		if *oauthClient != "" {
+			if *oauthDevice == "" || *oauthToken == "" {
+				return fmt.Errorf("-oauth-client-id needs -oauth-device-url and -oauth-token-url")
+			}
+			auth.config = &authConfig{ClientID: *oauthClient, DeviceURL: *oauthDevice, TokenURL: *oauthToken}
+			if *oauthScopes != "" {
+				auth.config.Scopes = strings.Split(*oauthScopes, ",")
+			}
+		}
+		if *oauthUserinfo != "" {
+			auth.tokens = s.login().tokens // what it's already checked
+			if auth.tokens == nil || auth.tokens.url != *oauthUserinfo {
+				auth.tokens = newTokenChecker(*oauthUserinfo)
+			}
+		}
+		s.limits.set(*maxConns, *maxAttempts)
+		s.mod.set(*banAfter, *banFor)
+		s.configure(p, parseOrigins(*origins), chat, auth, *roomSize, *roomIdle, *roomEmpty)
+		return nil
+	}
+	if err := configure(); err != nil {
+		log.Fatal(err)
+	}
+	go reloadOnHUP(func() error {
+		sdNotify("RELOADING=1")
+		defer sdNotify("READY=1")
+		if *configPath != "" {
+			if err := applyConfigFile(*configPath, given, reloadable); err != nil {
+				return err
+			}
+		}
+		return configure()
+	})
+
+	go s.watchDrops()
+	if s.mix {
+		go s.mixLoop()
+	}
+	go s.expireRooms()
+
+	web, sshLn, err := activated()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sshLn == nil && *sshAddr != "" {
+		if sshLn, err = net.Listen("tcp", *sshAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if sshLn != nil {
+		go func() {
+			log.Fatal(s.serveSSH(sshLn, *sshKey))
+		}()
+	}
+	if *wtAddr != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatal("-webtransport needs -tls-cert and -tls-key")
+		}
+		go func() {
+			log.Fatal(s.serveWebTransport(*wtAddr, *tlsCert, *tlsKey))
+		}()
+	}
+	if *metricsAddr != "" {
+		ln, err := net.Listen("tcp", *metricsAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Fatal(s.serveMetrics(ln))
+		}()
+	}
+	if *grpcAddr != "" {
+		ln, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Fatal(s.serveGRPC(ln, *tlsCert, *tlsKey))
+		}()
+	}
+	if len(web) == 0 {
+		ln, err := net.Listen("tcp", ":8080")
+		if err != nil {
+			log.Fatal(err)
+		}
+		web = append(web, ln)
+	}
+
+	http.HandleFunc(s.basePath+"/ws", s.handleWS)
+	http.HandleFunc(s.basePath+"/sse", s.handleSSE)
+	http.HandleFunc(s.basePath+"/watch", serveViewerPage)
+	http.HandleFunc("GET "+s.basePath+"/api/auth", s.handleAuth)
+	if s.accounts != nil {
+		http.HandleFunc("GET "+s.basePath+"/api/presence", s.apiPresence)
+	}
+	s.registerAPI(http.DefaultServeMux)
+
+	for _, ln := range web[1:] {
+		go func() {
+			log.Fatal(http.Serve(ln, nil))
+		}()
+	}
+	log.Println("ASCII relay server on", web[0].Addr())
+	sdNotify("READY=1")
+	go s.watchdog()
+	log.Fatal(http.Serve(web[0], nil))
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// ---------- matchmaking ----------
+
+// Clients that connect with /ws?match=1 wait in a pool until the server
+// pairs them with a stranger in a fresh room. Sending {"type":"next"}
+// ends the call and puts both back in the pool.
+
+var msgWaiting = []byte(`{"type":"waiting"}`)
+
+// control is the part of a message the server looks at: its type, who
+// in the room it's addressed to (0 for everyone), and for the ones meant
+// for the server rather than the peer, their target
+type control struct {
+	Type string `json:"type"`
+	To   uint64 `json:"to,omitempty"`
+	Peer string `json:"peer,omitempty"`
+
+	// in size messages, for -downscale
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	// in focus messages: who the sender's watching, see focus.go
+	ID uint64 `json:"id,omitempty"`
+
+	// in simulcast frames, the thumbnail's size, see simulcast.go
+	ThumbW int `json:"thumbw,omitempty"`
+	ThumbH int `json:"thumbh,omitempty"`
+
+	Trace string `json:"trace,omitempty"` // W3C traceparent, see tracing.go
+
+	// in status messages and declines, see accounts.go
+	Status string `json:"status,omitempty"`
+	Room   string `json:"room,omitempty"`
+	Text   string `json:"text,omitempty"`
+}
+
+// parseControl peeks at a message. Every message gets looked at, big
+// or small, so nothing can dodge the chat filter by padding itself out;
+// decoding a few fields is cheap next to the websocket I/O.
+func parseControl(msg []byte) control {
+	var ctl control
+	json.Unmarshal(msg, &ctl)
+	return ctl
+}
+
+// joinPool adds a new client to the matchmaking pool
+func (s *Server) joinPool(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	c.id = s.nextID
+	s.wait(c)
+	log.Printf("client %s joined matchmaking, waiting: %d", c.ip, len(s.pool))
+	s.match()
+}
+
+// wait parks a client in the pool. Must hold s.mu.
+func (s *Server) wait(c *Client) {
+	c.room = nil
+	s.pool = append(s.pool, c)
+	select {
+	case c.send <- msgWaiting:
+	default:
+	}
+}
+
+// leavePool takes a client out of the pool. Must hold s.mu.
+func (s *Server) leavePool(c *Client) bool {
+	for i, p := range s.pool {
+		if p == c {
+			s.pool = append(s.pool[:i], s.pool[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// match pairs up whoever in the pool can be paired, skipping the
+// partner each of them just left. Must hold s.mu.
+func (s *Server) match() {
+	for i := 0; i < len(s.pool); i++ {
+		for j := i + 1; j < len(s.pool); j++ {
+			a, b := s.pool[i], s.pool[j]
+			if a.last == b.id || b.last == a.id || a.blocked[b.peer] || b.blocked[a.peer] {
+				continue
+			}
+
+			s.leavePool(a)
+			s.leavePool(b)
+			r := s.room(s.newCode())
+			r.matched = true
+			for _, c := range []*Client{a, b} {
+				c.room = r
+				r.clients[c] = true
+			}
+			for _, p := range [][2]*Client{{a, b}, {b, a}} {
+				select {
+				case p[0].send <- joinedMsg(p[1].id, p[1].peer):
+				default:
+				}
+				sendLastFrame(p[1], p[0].send)
+			}
+			log.Printf("matched clients %d and %d in room %s", a.id, b.id, r.code)
+			s.hooks.emit("peer_joined", r)
+
+			// the pool shrank; start over
+			i = -1
+			break
+		}
+	}
+}
+
+// next ends a matched call and sends everyone in it back to the pool
+func (s *Server) next(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c.room == nil || !c.room.matched {
+		return
+	}
+	s.unmatch(c.room)
+	s.match()
+}
+
+// unmatch empties a matched room into the pool. Must hold s.mu.
+func (s *Server) unmatch(r *Room) {
+	var ids []uint64
+	for c := range r.clients {
+		ids = append(ids, c.id)
+	}
+	for c := range r.clients {
+		delete(r.clients, c)
+		for _, id := range ids {
+			if id != c.id {
+				c.last = id
+				select {
+				case c.send <- leftMsg(id):
+				default:
+				}
+			}
+		}
+		s.wait(c)
+	}
+	s.hooks.emit("peer_left", r)
+	s.cleanup(r)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ---------- relay metrics ----------
+
+// relayStats counts messages relayed to one receiver and how many were
+// dropped because it wasn't keeping up. Guarded by s.mu.
+type relayStats struct {
+	sent    uint64
+	dropped uint64
+
+	// as of the last spike check
+	lastSent    uint64
+	lastDropped uint64
+}
+
+// since returns what happened since the last call
+func (st *relayStats) since() (sent, dropped uint64) {
+	sent, dropped = st.sent-st.lastSent, st.dropped-st.lastDropped
+	st.lastSent, st.lastDropped = st.sent, st.dropped
+	return sent, dropped
+}
+
+// deliver queues msg for a receiver without blocking, counting a drop if
+// its buffer is full. Must hold s.mu.
+func (s *Server) deliver(ch chan []byte, st *relayStats, r *Room, msg []byte) {
+	st.sent++
+	r.stats.sent++
+	s.stats.sent++
+	select {
+	case ch <- msg:
+	default:
+		st.dropped++
+		r.stats.dropped++
+		s.stats.dropped++
+	}
+}
+
+const spikeInterval = 10 * time.Second
+
+// watchDrops logs receivers that lost a good chunk of their messages in
+// the last interval, the usual cause of "their video is choppy"
+func (s *Server) watchDrops() {
+	for range time.Tick(spikeInterval) {
+		s.mu.Lock()
+		for _, r := range s.rooms {
+			for c := range r.clients {
+				if sent, dropped := c.stats.since(); isSpike(sent, dropped) {
+					log.Printf("client %d (%s) in room %s dropped %d of %d messages in %s", c.id, c.ip, r.code, dropped, sent, spikeInterval)
+				}
+			}
+			for v := range r.viewers {
+				if sent, dropped := v.stats.since(); isSpike(sent, dropped) {
+					log.Printf("viewer %s in room %s dropped %d of %d messages in %s", v.ip, r.code, dropped, sent, spikeInterval)
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// isSpike is at least 10 drops making up at least a tenth of the traffic
+func isSpike(sent, dropped uint64) bool {
+	return dropped >= 10 && dropped*10 >= sent
+}
+
+// serveMetrics serves /metrics on a listener of its own, so it can be
+// kept somewhere only the operator's scraper reaches
+func (s *Server) serveMetrics(ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	log.Println("metrics on", ln.Addr())
+	return http.Serve(ln, mux)
+}
+
+// handleMetrics serves the counters in the Prometheus text format. It's
+// the whole server's, never a room's: a room's code is how you get in,
+// so it can't be a label.
+func (s *Server) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clients, viewers := 0, 0
+	for _, r := range s.rooms {
+		clients += len(r.clients)
+		viewers += len(r.viewers)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct {
+		name, kind, help string
+		v                uint64
+	}{
+		{"asciichat_messages_total", "counter", "Messages relayed to receivers.", s.stats.sent},
+		{"asciichat_dropped_total", "counter", "Messages dropped because a receiver was too slow.", s.stats.dropped},
+		{"asciichat_rooms", "gauge", "Rooms open.", uint64(len(s.rooms))},
+		{"asciichat_clients", "gauge", "Clients in rooms.", uint64(clients)},
+		{"asciichat_viewers", "gauge", "Viewers watching rooms.", uint64(viewers)},
+		{"asciichat_waiting", "gauge", "Clients waiting for a random partner.", uint64(len(s.pool))},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.v)
+	}
+}
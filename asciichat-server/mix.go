@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ---------- mixing ----------
+
+// With -mix, clients that connect with ?mix=1 don't get everyone's
+// frames: a few times a second the server tiles the latest frame from
+// each of the others into one frame the size the client asked for, so a
+// weak client in a big room receives and draws a single stream. Like
+// -downscale it needs frames the server can read, so not encrypted
+// calls. We say we can do it in a response header on the upgrade.
+
+const (
+	mixHeader = "Faceterm-Mix"
+	mixEvery  = time.Second / 15
+)
+
+// mixLoop sends fresh composites to every mixing client whose room has
+// had new frames since the last round
+func (s *Server) mixLoop() {
+	for range time.Tick(mixEvery) {
+		s.mu.Lock()
+		for _, r := range s.rooms {
+			if !r.mixDirty {
+				continue
+			}
+			r.mixDirty = false
+			for c := range r.clients {
+				if c.mix {
+					s.deliver(c.send, &c.stats, r, r.mixFor(c))
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// mixFor composites the room, less c, at the size c asked for. Must
+// hold s.mu.
+func (r *Room) mixFor(c *Client) []byte {
+	w, h := 80, 24
+	if size, ok := c.wants[0]; ok && size[0] > 0 && size[1] > 0 {
+		w, h = size[0], size[1]
+	}
+
+	var others []*Client
+	for o := range r.clients {
+		if o != c && o.lastFrame != nil {
+			others = append(others, o)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].id < others[j].id })
+
+	canvas := make([][]cell, h)
+	for y := range canvas {
+		canvas[y] = make([]cell, w)
+		for x := range canvas[y] {
+			canvas[y][x].ch = ' '
+		}
+	}
+	for i, t := range mixLayout(len(others), w, h) {
+		var m struct {
+			Frame string `json:"frame"`
+		}
+		json.Unmarshal(others[i].lastFrame, &m)
+		for y, row := range sample(parseCells(m.Frame), t.w, t.h) {
+			if t.y+y < h && t.x+t.w <= w { // a room too big for the screen
+				copy(canvas[t.y+y][t.x:], row)
+			}
+		}
+	}
+
+	var b strings.Builder
+	writeCells(&b, canvas)
+	out, _ := json.Marshal(map[string]string{"type": "mix", "frame": b.String()})
+	return out
+}
+
+type tile struct{ x, y, w, h int }
+
+// mixLayout splits w x h into n roughly square tiles, filling rows
+// first, with a one cell gutter; the same layout the client uses
+func mixLayout(n, w, h int) []tile {
+	if n <= 1 {
+		return []tile{{0, 0, w, h}}[:n]
+	}
+	cols := int(math.Ceil(math.Sqrt(float64(n))))
+	rows := (n + cols - 1) / cols
+	tw := max(1, (w-(cols-1))/cols)
+	th := max(1, (h-(rows-1))/rows)
+
+	tiles := make([]tile, n)
+	for i := range tiles {
+		c, r := i%cols, i/cols
+		tiles[i] = tile{c * (tw + 1), r * (th + 1), tw, th}
+	}
+	return tiles
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+// ---------- block and report ----------
+
+// In matchmaking, strangers know each other only by a peer id: a keyed
+// hash of their IP. Clients keep their own block lists of peer ids and
+// hand them to us so they're never matched again; reports are counted
+// and enough distinct reporters get the address banned for a while.
+
+type moderation struct {
+	secret   []byte
+	banAfter int // distinct reporters; 0 never bans
+	banFor   time.Duration
+
+	mu      sync.Mutex
+	reports map[string]map[string]bool // reported peer id -> reporter peer ids
+	bans    map[string]time.Time       // ip -> until
+}
+
+// newModeration uses secret to derive peer ids; without one they change
+// whenever the server restarts, and so do clients' block lists
+func newModeration(secret string, banAfter int, banFor time.Duration) *moderation {
+	m := &moderation{
+		secret:   []byte(secret),
+		banAfter: banAfter,
+		banFor:   banFor,
+		reports:  make(map[string]map[string]bool),
+		bans:     make(map[string]time.Time),
+	}
+	if secret == "" {
+		m.secret = make([]byte, 32)
+		rand.Read(m.secret)
+	}
+	return m
+}
+
+// set changes the ban policy; bans already handed out keep their time
+func (m *moderation) set(banAfter int, banFor time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.banAfter, m.banFor = banAfter, banFor
+}
+
+// peerID is the stable, anonymous name for an address
+func (m *moderation) peerID(ip string) string {
+	h := hmac.New(sha256.New, m.secret)
+	h.Write([]byte(ip))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+func (m *moderation) banned(ip string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	until, ok := m.bans[ip]
+	if ok && time.Now().After(until) {
+		delete(m.bans, ip)
+		return false
+	}
+	return ok
+}
+
+// report records one reporter's complaint and says whether that was
+// the one that got the address banned. Reporting twice counts once.
+func (m *moderation) report(reporter, reported, ip string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	by := m.reports[reported]
+	if by == nil {
+		by = make(map[string]bool)
+		m.reports[reported] = by
+	}
+	by[reporter] = true
+	log.Printf("peer %s (%s) reported by %s, reports: %d", reported, ip, reporter, len(by))
+
+	if m.banAfter > 0 && len(by) >= m.banAfter {
+		m.bans[ip] = time.Now().Add(m.banFor)
+		delete(m.reports, reported)
+		log.Printf("banned %s for %s", ip, m.banFor)
+		return true
+	}
+	return false
+}
+
+// partner is the other client in c's room with the given peer id. Must hold s.mu.
+func (c *Client) partner(peer string) *Client {
+	if c.room == nil {
+		return nil
+	}
+	for o := range c.room.clients {
+		if o != c && o.peer == peer {
+			return o
+		}
+	}
+	return nil
+}
+
+// block stops c from ever being matched with peer, ending the call if
+// that's who they're talking to
+func (s *Server) block(c *Client, peer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(c.blocked) >= 1000 {
+		return // be reasonable
+	}
+	c.blocked[peer] = true
+	if c.partner(peer) != nil && c.room.matched {
+		s.unmatch(c.room)
+		s.match()
+	}
+}
+
+// report files a complaint about c's current partner, and blocks them
+func (s *Server) report(c *Client, peer string) {
+	s.mu.Lock()
+	o := c.partner(peer)
+	s.mu.Unlock()
+	if o == nil {
+		return // you can only report who you're talking to
+	}
+
+	if s.mod.report(c.peer, peer, o.ip) {
+		o.conn.Close()
+	}
+	s.block(c, peer)
+}
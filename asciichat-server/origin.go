@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ---------- allowed origins ----------
+
+// Browsers say which page opened a websocket. With -origins only pages
+// from those get in, so another site can't put our users' calls on
+// its own page; native clients send no Origin and always do.
+
+// parseOrigins reads a comma-separated list, e.g.
+// "https://example.com, https://www.example.com"
+func parseOrigins(list string) []string {
+	var origins []string
+	for _, o := range strings.Split(list, ",") {
+		if o = strings.TrimRight(strings.TrimSpace(o), "/"); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return origins
+}
+
+func (s *Server) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	s.conf.RLock()
+	defer s.conf.RUnlock()
+	if origin == "" || len(s.origins) == 0 {
+		return true
+	}
+	for _, o := range s.origins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ---------- reverse proxies ----------
+
+// trustedProxies are the addresses allowed to tell us who the real
+// client is through X-Forwarded-For / X-Forwarded-Proto
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies reads a comma-separated list of IPs and CIDRs
+func parseTrustedProxies(list string) (trustedProxies, error) {
+	var t trustedProxies
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad trusted proxy %q", s)
+		}
+		t = append(t, n)
+	}
+	return t, nil
+}
+
+func (t trustedProxies) trusts(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address a request really came from. Forwarded headers
+// only count when the hop that added them is a trusted proxy; walking
+// X-Forwarded-For from the right, the first untrusted hop is the client.
+func (s *Server) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !s.trusted().trusts(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !s.trusted().trusts(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// secure reports whether the client reached us over TLS, directly or
+// through a trusted proxy that terminated it
+func (s *Server) secure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return s.trusted().trusts(host) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
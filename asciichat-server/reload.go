@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ---------- configuration file and reloading ----------
+
+// With -config, flags can also come from a file, one "name = value" a
+// line, # for comments; the command line still wins. On SIGHUP we read
+// it again, along with -chat-words, and apply what can change under a
+// running server: connection limits, trusted proxies, allowed origins,
+// bans, chat filtering, room size and expiry, and logging in (the
+// -oauth flags and -api-token). Calls in progress
+// carry on; the new settings apply to whatever happens next. Anything
+// else in the file needs a restart, and we say so.
+
+// reloadable are the flags SIGHUP applies
+var reloadable = map[string]bool{
+	"max-conns-per-ip": true, "max-attempts-per-ip": true, "trusted-proxies": true, "origins": true,
+	"ban-after": true, "ban-for": true, "chat-words": true, "chat-strip-urls": true, "chat-max": true,
+	"room-size": true, "room-idle": true, "room-empty": true,
+	"oauth-client-id": true, "oauth-device-url": true, "oauth-token-url": true, "oauth-scopes": true,
+	"oauth-userinfo": true, "api-token": true,
+}
+
+// setting is one line of a config file
+type setting struct{ name, value string }
+
+func readConfigFile(path string) ([]setting, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var settings []setting
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		k = strings.TrimLeft(strings.TrimSpace(k), "-")
+		if !ok || flag.Lookup(k) == nil {
+			return nil, fmt.Errorf("%s:%d: want \"name = value\" for one of the flags", path, n)
+		}
+		settings = append(settings, setting{k, strings.TrimSpace(v)})
+	}
+	return settings, sc.Err()
+}
+
+// applyConfigFile sets the flags in the file that weren't given on the
+// command line. With only, it sets just those, putting them back to
+// their defaults first so a line taken out of the file counts too.
+func applyConfigFile(path string, given, only map[string]bool) error {
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for name := range only {
+		if !given[name] {
+			flag.Set(name, flag.Lookup(name).DefValue)
+		}
+	}
+
+	fixed := make(map[string][]string) // what only leaves out, for the warning
+	for _, st := range settings {
+		switch {
+		case given[st.name]:
+		case only != nil && !only[st.name]:
+			fixed[st.name] = append(fixed[st.name], st.value)
+		default:
+			if err := flag.Set(st.name, st.value); err != nil {
+				return fmt.Errorf("%s: %s: %v", path, st.name, err)
+			}
+		}
+	}
+	for name, values := range fixed {
+		if flag.Lookup(name).Value.String() != strings.Join(values, ",") {
+			log.Printf("%s changed in %s; restart to apply it", name, path)
+		}
+	}
+	return nil
+}
+
+// reloadOnHUP calls reload on every SIGHUP, keeping the old settings if
+// it fails
+func reloadOnHUP(reload func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reload(); err != nil {
+			log.Printf("reload failed, keeping the old settings: %v", err)
+			continue
+		}
+		log.Println("reloaded settings")
+	}
+}
+
+// configure swaps in the settings a reload can change
+func (s *Server) configure(proxies trustedProxies, origins []string, chat chatFilter, auth authSettings, roomSize int, roomIdle, roomEmpty time.Duration) {
+	s.conf.Lock()
+	s.proxies, s.origins, s.chat, s.auth = proxies, origins, chat, auth
+	s.conf.Unlock()
+
+	maxClients.Store(int64(roomSize))
+	s.mu.Lock()
+	s.roomIdle, s.roomEmpty = roomIdle, roomEmpty
+	s.mu.Unlock()
+}
+
+// trusted, chatRules and login are the current settings, for anything that
+// doesn't hold s.conf
+func (s *Server) trusted() trustedProxies {
+	s.conf.RLock()
+	defer s.conf.RUnlock()
+	return s.proxies
+}
+
+func (s *Server) chatRules() chatFilter {
+	s.conf.RLock()
+	defer s.conf.RUnlock()
+	return s.chat
+}
+
+func (s *Server) login() authSettings {
+	s.conf.RLock()
+	defer s.conf.RUnlock()
+	return s.auth
+}
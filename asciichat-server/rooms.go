@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/rand"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// clients that don't ask for a room all end up here
+const defaultRoom = "lobby"
+
+// no 0/o/1/l so codes can be read out loud
+const codeAlphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+
+// ---------- rooms ----------
+
+type Room struct {
+	code    string
+	clients map[*Client]bool
+	viewers map[*Viewer]bool
+	created time.Time
+	active  time.Time  // last message, join or leave
+	stats   relayStats // everyone who's been in the room
+
+	// created through the API; stays around when empty until closed
+	persistent bool
+
+	// made by the matchmaker for two strangers
+	matched bool
+
+	// listed by GET /api/rooms; decided when the room is made and never
+	// after, so a private room can't be outed by whoever joins it next
+	public bool
+
+	mixDirty bool // frames arrived since the last composite, see mix.go
+
+	// booked ahead: when it lets people in and when it shuts, zero for
+	// now and never, and who's queued up until then; see schedule.go
+	opens, closes time.Time
+	outside       []*Client
+
+	// the account a call to this room is ringing, until they answer,
+	// decline or give up; see accounts.go
+	invited string
+}
+
+func newRoom(code string) *Room {
+	return &Room{
+		code:    code,
+		clients: make(map[*Client]bool),
+		viewers: make(map[*Viewer]bool),
+		created: time.Now(),
+		active:  time.Now(),
+	}
+}
+
+// featured is the client viewers watch: whoever has been here longest
+func (r *Room) featured() *Client {
+	var f *Client
+	for c := range r.clients {
+		if f == nil || c.id < f.id {
+			f = c
+		}
+	}
+	return f
+}
+
+// room finds a room by code, creating it on the fly. Must hold s.mu.
+func (s *Server) room(code string) *Room {
+	if code == "" {
+		code = defaultRoom
+	}
+	r, ok := s.rooms[code]
+	if !ok {
+		r = newRoom(code)
+		r.public = code == defaultRoom
+		s.rooms[code] = r
+		log.Println("room created:", code)
+		s.hooks.emit("room_created", r)
+	}
+	return r
+}
+
+// cleanup drops ad-hoc rooms once everyone has left. Must hold s.mu.
+func (s *Server) cleanup(r *Room) {
+	if r.persistent || len(r.clients) > 0 || len(r.viewers) > 0 {
+		return
+	}
+	if s.rooms[r.code] == r {
+		delete(s.rooms, r.code)
+		log.Println("room closed:", r.code)
+		s.hooks.emit("room_closed", r)
+	}
+}
+
+// createRoom makes a persistent room with a fresh random code
+func (s *Server) createRoom(public bool) *Room {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.room(s.newCode())
+	r.persistent, r.public = true, public
+	return r
+}
+
+// newCode picks a random room code nobody is using. Must hold s.mu.
+func (s *Server) newCode() string {
+	for {
+		b := make([]byte, 6)
+		rand.Read(b)
+		for i := range b {
+			b[i] = codeAlphabet[int(b[i])%len(codeAlphabet)]
+		}
+		if _, taken := s.rooms[string(b)]; !taken {
+			return string(b)
+		}
+	}
+}
+
+// closeRoom disconnects everyone in a room and forgets it
+func (s *Server) closeRoom(code, reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.rooms[code]
+	if !ok {
+		return false
+	}
+
+	// clients clean themselves up once their reader sees the close
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason)
+	for c := range r.clients {
+		c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		c.conn.Close()
+	}
+	for _, c := range r.outside {
+		c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		c.conn.Close()
+	}
+	for v := range r.viewers {
+		delete(r.viewers, v)
+		close(v.send)
+	}
+
+	delete(s.rooms, code)
+	log.Printf("room closed: %s (%s)", code, reason)
+	s.hooks.emit("room_closed", r)
+	return true
+}
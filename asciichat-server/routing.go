@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// ---------- addressing ----------
+
+// Rooms can hold more than two clients (-room-size), and each one wants
+// frames rendered at its own size, so clients address their size, frame
+// and ping messages to one another with "to". The server stamps "from"
+// on everything it relays, and joined/left say whose id came or went.
+
+// joinedMsg tells a client someone arrived, and in a matched room, who
+// it was matched with
+func joinedMsg(id uint64, peer string) []byte {
+	m := map[string]any{"type": "joined", "id": id}
+	if peer != "" {
+		m["peer"] = peer
+	}
+	b, _ := json.Marshal(m)
+	return b
+}
+
+func leftMsg(id uint64) []byte {
+	return []byte(`{"type":"left","id":` + strconv.FormatUint(id, 10) + `}`)
+}
+
+// stamp adds the sender's id to a relayed message. It goes last, so it
+// wins over any "from" the client made up.
+func stamp(msg []byte, id uint64) []byte {
+	return stampRaw(msg, "from", strconv.AppendUint(nil, id, 10))
+}
+
+// stampString sets a string field the same way
+func stampString(msg []byte, field, value string) []byte {
+	return stampRaw(msg, field, strconv.AppendQuote(nil, value))
+}
+
+func stampRaw(msg []byte, field string, value []byte) []byte {
+	msg = bytes.TrimRight(msg, " \t\r\n")
+	end := bytes.LastIndexByte(msg, '}')
+	if end < 1 {
+		return msg // not an object; nothing reads it anyway
+	}
+	out := make([]byte, 0, len(msg)+len(field)+len(value)+4)
+	out = append(out, msg[:end]...)
+	if len(bytes.TrimSpace(msg[1:end])) > 0 { // not {}
+		out = append(out, ',')
+	}
+	out = append(out, '"')
+	out = append(out, field...)
+	out = append(out, '"', ':')
+	out = append(out, value...)
+	return append(out, '}')
+}
+
+// audience is whose view of the featured client viewers get: the next
+// longest in the room. Must hold s.mu.
+func (r *Room) audience(featured *Client) uint64 {
+	var a *Client
+	for c := range r.clients {
+		if c != featured && (a == nil || c.id < a.id) {
+			a = c
+		}
+	}
+	if a == nil {
+		return 0
+	}
+	return a.id
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// ---------- frame sanitizer ----------
+
+// Frames are whatever a client sent, and viewers' terminals don't get
+// to check them the way a client does, so what we pass on to a viewer
+// goes through the same rules as the client's own sanitizer.
+
+// sanitizeFrame strips everything from a client's frame except
+// printable text, newlines and the escape sequences the renderers emit:
+// SGR colors and cursor positioning. Anything else (OSC title/clipboard
+// writes, DCS, terminal queries, mode switches, stray C0/C1 controls)
+// could mess with a viewer's terminal, so it's dropped.
+func sanitizeFrame(frame string) string {
+	var b strings.Builder
+	b.Grow(len(frame))
+
+	for i := 0; i < len(frame); {
+		c := frame[i]
+
+		if c == '\033' {
+			i += copyCSI(&b, frame[i:])
+			continue
+		}
+		if c < 0x20 || c == 0x7f {
+			if c == '\n' || c == '\r' {
+				b.WriteByte(c)
+			}
+			i++
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(frame[i:])
+		i += size
+		if r == utf8.RuneError && size == 1 {
+			continue // invalid UTF-8
+		}
+		if r >= 0x80 && r <= 0x9f {
+			continue // C1 controls
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// copyCSI copies the escape sequence at the start of s if it's one we
+// allow, and returns how many bytes to skip either way
+func copyCSI(b *strings.Builder, s string) int {
+	if len(s) < 2 {
+		return 1
+	}
+	switch s[1] {
+	case '[':
+	case ']', 'P', '_', '^':
+		// OSC/DCS/APC/PM strings: skip through BEL or ST
+		for j := 2; j < len(s); j++ {
+			if s[j] == '\a' {
+				return j + 1
+			}
+			if s[j] == '\033' && j+1 < len(s) && s[j+1] == '\\' {
+				return j + 2
+			}
+		}
+		return len(s)
+	default:
+		// two-byte escape: drop the ESC and let the rest print as text,
+		// which defuses it
+		return 1
+	}
+
+	j := 2
+	for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == ';') {
+		j++
+	}
+	if j >= len(s) {
+		return len(s) // unterminated
+	}
+
+	switch s[j] {
+	case 'm', 'H', 'f':
+		if j-2 <= 64 {
+			b.WriteString(s[:j+1])
+		}
+		return j + 1
+	}
+
+	// some other CSI (private modes, queries...): skip through its
+	// final byte
+	for j < len(s) && (s[j] < 0x40 || s[j] > 0x7e) {
+		j++
+	}
+	return min(j+1, len(s))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ---------- scheduled rooms ----------
+
+// A room made through the API can be booked ahead, for a demo or a
+// standup: POST /api/rooms, with the -api-token, and {"opens":
+// "2025-03-01T09:00:00Z", "duration": "30m"}, either one optional. Whoever turns up early waits
+// outside, told when it opens ({"type":"scheduled","time":<unix nanos>})
+// so their client can count down, and at that time they're let in, as
+// many as fit. Once the duration is up the room closes, mid-call or not.
+
+// scheduledMsg tells an early client when the room opens
+func scheduledMsg(opens time.Time) []byte {
+	return []byte(`{"type":"scheduled","time":` + strconv.FormatInt(opens.UnixNano(), 10) + `}`)
+}
+
+// scheduleRoom makes a persistent room that opens at opens and, with a
+// duration, closes that long after
+func (s *Server) scheduleRoom(opens time.Time, duration time.Duration, public bool) *Room {
+	r := s.createRoom(public)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if opens.After(time.Now()) {
+		r.opens = opens
+		time.AfterFunc(time.Until(opens), func() { s.openRoom(r) })
+	} else {
+		opens = time.Now()
+	}
+	if duration > 0 {
+		r.closes = opens.Add(duration)
+		time.AfterFunc(time.Until(r.closes), func() {
+			if s.closeRoom(r.code, "the scheduled time is over") {
+				log.Printf("room %s ended on schedule", r.code)
+			}
+		})
+	}
+	return r
+}
+
+// early reports whether a room hasn't opened yet. Must hold s.mu.
+func (r *Room) early() bool {
+	return !r.opens.IsZero() && time.Now().Before(r.opens)
+}
+
+// waitOutside parks a client until the room opens. Must hold s.mu.
+func (s *Server) waitOutside(c *Client, r *Room) {
+	c.outside = r
+	r.outside = append(r.outside, c)
+	select {
+	case c.send <- scheduledMsg(r.opens):
+	default:
+	}
+	log.Printf("client %s waiting for room %s to open, waiting: %d", c.ip, r.code, len(r.outside))
+}
+
+// leaveOutside takes an early client out of the queue. Must hold s.mu.
+func (s *Server) leaveOutside(c *Client) {
+	r := c.outside
+	for i, o := range r.outside {
+		if o == c {
+			r.outside = append(r.outside[:i], r.outside[i+1:]...)
+			break
+		}
+	}
+	c.outside = nil
+}
+
+// openRoom lets in everyone who came early, the first ones first
+func (s *Server) openRoom(r *Room) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rooms[r.code] != r {
+		return // closed before it opened
+	}
+	log.Printf("room %s open, %d waiting", r.code, len(r.outside))
+	waiting := r.outside
+	r.outside = nil
+	r.active = time.Now()
+	for _, c := range waiting {
+		if len(r.clients) >= int(maxClients.Load()) { // -room-size went down meanwhile
+			msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, roomFull())
+			c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			c.conn.Close() // its reader cleans up, still outside
+			continue
+		}
+		c.outside = nil
+		s.enter(c, r)
+	}
+}
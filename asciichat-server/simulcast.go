@@ -0,0 +1,32 @@
+package main
+
+import "encoding/json"
+
+// ---------- simulcast ----------
+
+// A sender with -simulcast puts two renditions in each frame it sends
+// to everyone: "frame" at the biggest size anyone asked for, and
+// "thumb" at the smallest, with its size in thumbw and thumbh. Each
+// receiver gets just the one that fits what it asked for, rather than
+// both, and the server never has to re-render anything.
+
+// rendition is msg with only the thumbnail (small) or only the full
+// frame left in it, cached since every receiver gets one of the two
+func rendition(msg []byte, small bool, cache map[bool][]byte) []byte {
+	if out, ok := cache[small]; ok {
+		return out
+	}
+	var m map[string]any
+	if json.Unmarshal(msg, &m) != nil {
+		return msg
+	}
+	if small {
+		m["frame"] = m["thumb"]
+	}
+	delete(m, "thumb")
+	delete(m, "thumbw")
+	delete(m, "thumbh")
+	out, _ := json.Marshal(m)
+	cache[small] = out
+	return out
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ---------- server-sent events ----------
+
+// Last resort for networks that let nothing through but plain HTTP:
+// GET <base path>/sse opens a stream of server-sent events, one message
+// each, and every message the client sends is a POST back to the same
+// place with the session the stream started with. Slower than a
+// websocket, a request a message, but it gets through proxies that
+// don't understand upgrades at all. Always on, like /ws.
+
+// sseSessions are the open streams, by session
+type sseSessions struct {
+	mu sync.Mutex
+	m  map[string]*sseConn
+}
+
+func (ss *sseSessions) add(c *sseConn) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.m == nil {
+		ss.m = make(map[string]*sseConn)
+	}
+	ss.m[id] = c
+	return id
+}
+
+func (ss *sseSessions) get(id string) *sseConn {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.m[id]
+}
+
+func (ss *sseSessions) remove(id string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.m, id)
+}
+
+// sseKeepalive is how often an idle stream gets a comment, so proxies
+// don't time it out and the client knows we're still there
+const sseKeepalive = 10 * time.Second
+
+func (s *Server) handleSSE(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		s.handleSSEPost(w, r)
+		return
+	}
+
+	span := connecting(r.Context(), "sse")
+	defer span.End()
+	ip, ok := s.admit(w, r)
+	if !ok {
+		return
+	}
+	defer s.limits.release(ip)
+
+	if p := r.Header.Get(protocolHeader); p != subprotocol {
+		log.Printf("rejecting %s: offered %q over sse, we speak %s", ip, p, subprotocol)
+		http.Error(w, "unsupported protocol version, this server speaks "+subprotocol, http.StatusUpgradeRequired)
+		return
+	}
+	if !s.originAllowed(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	c := &sseConn{w: w, flusher: flusher, ip: ip, in: make(chan []byte, 16), done: make(chan struct{})}
+	id := s.sse.add(c)
+	defer s.sse.remove(id)
+
+	for k, v := range s.upgradeHeader() {
+		w.Header()[k] = v
+	}
+	w.Header().Set(protocolHeader, subprotocol)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx would hold events back otherwise
+	c.event("session", []byte(id))
+
+	span.End()
+	go s.serve(c, r.URL.Query(), ip)
+
+	t := time.NewTicker(sseKeepalive)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			c.mu.Lock() // wait out a write in progress
+			c.closed = true
+			c.mu.Unlock()
+			return
+		case <-r.Context().Done():
+			c.Close()
+		case <-t.C:
+			c.comment()
+		}
+	}
+}
+
+// handleSSEPost takes one message for a stream
+func (s *Server) handleSSEPost(w http.ResponseWriter, r *http.Request) {
+	c := s.sse.get(r.URL.Query().Get("session"))
+	if c == nil || c.ip != s.clientIP(r) {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+	msg, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxStreamMessage))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	select {
+	case c.in <- msg:
+		w.WriteHeader(http.StatusNoContent)
+	case <-c.done:
+		http.Error(w, "session closed", http.StatusGone)
+	}
+}
+
+// sseConn is an event stream and the posts that go with it, as a wire
+type sseConn struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	ip      string
+	in      chan []byte // posted messages
+
+	mu     sync.Mutex // one write at a time
+	closed bool       // the handler's returned; no more writes
+
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *sseConn) ReadMessage() (int, []byte, error) {
+	select {
+	case msg := <-c.in:
+		return websocket.TextMessage, msg, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *sseConn) WriteMessage(_ int, data []byte) error {
+	return c.event("", data)
+}
+
+// event writes one event, a data line for each line of the message
+func (c *sseConn) event(name string, data []byte) error {
+	var b bytes.Buffer
+	if name != "" {
+		b.WriteString("event: " + name + "\n")
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, maxStreamMessage)
+	for sc.Scan() {
+		b.WriteString("data: ")
+		b.Write(sc.Bytes())
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	return c.write(b.Bytes())
+}
+
+func (c *sseConn) comment() error { return c.write([]byte(":\n\n")) }
+
+func (c *sseConn) write(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if _, err := c.w.Write(b); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// WriteControl only does closes, and those are just Close; the stream
+// has its own keepalives
+func (c *sseConn) WriteControl(int, []byte, time.Time) error { return nil }
+
+func (c *sseConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ---------- ssh viewers ----------
+
+// serveSSH lets people watch with a plain `ssh -p 2222 watch@host`;
+// any other user name is taken as the room code. With -oauth-userinfo
+// the password is the token, like the bearer token anywhere else.
+func (s *Server) serveSSH(ln net.Listener, keyPath string) error {
+	signer, err := loadHostKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	// asked each time, as a reload can turn -oauth-userinfo on or off
+	config := &ssh.ServerConfig{
+		NoClientAuth: true,
+		NoClientAuthCallback: func(ssh.ConnMetadata) (*ssh.Permissions, error) {
+			if s.login().tokens != nil {
+				return nil, errors.New("log in first")
+			}
+			return nil, nil
+		},
+		PasswordCallback: func(_ ssh.ConnMetadata, token []byte) (*ssh.Permissions, error) {
+			if !s.login().tokens.check("Bearer " + string(token)) {
+				return nil, errors.New("log in first")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	log.Println("ssh viewers on", ln.Addr())
+
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		ip, _, _ := net.SplitHostPort(nc.RemoteAddr().String())
+		if err := s.letIn(ip); err != nil {
+			nc.Close()
+			continue
+		}
+		go func() {
+			defer s.limits.release(ip)
+			s.handleSSH(nc, config)
+		}()
+	}
+}
+
+// loadHostKey reads the host key, creating an ed25519 one on first run
+func loadHostKey(path string) (ssh.Signer, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(priv, "asciichat-server")
+		if err != nil {
+			return nil, err
+		}
+		b = pem.EncodeToMemory(block)
+		if err := os.WriteFile(path, b, 0o600); err != nil {
+			return nil, err
+		}
+		log.Println("generated ssh host key", path)
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(b)
+}
+
+func (s *Server) handleSSH(nc net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, requests, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+
+		// we only stream, so say yes to pty/shell and no to everything else
+		go func() {
+			for req := range requests {
+				switch req.Type {
+				case "pty-req", "shell", "window-change":
+					req.Reply(true, nil)
+				default:
+					req.Reply(false, nil)
+				}
+			}
+		}()
+
+		code := conn.User()
+		if code == "watch" {
+			code = ""
+		}
+		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		go s.streamToSSH(ch, code, ip)
+	}
+}
+
+// streamToSSH writes the featured client's frames until the viewer quits
+func (s *Server) streamToSSH(ch ssh.Channel, code, ip string) {
+	defer ch.Close()
+
+	v := &Viewer{ip: ip, send: make(chan []byte, 16)}
+	s.addViewer(v, code)
+
+	// q or Ctrl+C quits
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 32)
+		for {
+			n, err := ch.Read(buf)
+			if err != nil || strings.ContainsAny(string(buf[:n]), "q\x03") {
+				return
+			}
+		}
+	}()
+
+	ch.Write([]byte("\033[?1049h\033[?25l\033[2J\033[Hwaiting for video... (q to quit)"))
+	defer ch.Write([]byte("\033[0m\033[?25h\033[?1049l"))
+	defer s.removeViewer(v)
+
+	for {
+		select {
+		case <-done:
+			return
+		case msg, ok := <-v.send:
+			if !ok {
+				return
+			}
+			var m struct {
+				Type  string `json:"type"`
+				Frame string `json:"frame"`
+			}
+			if json.Unmarshal(msg, &m) != nil || m.Type != "frame" {
+				continue
+			}
+
+			// no line discipline on our side of the pty
+			frame := strings.ReplaceAll(sanitizeFrame(m.Frame), "\n", "\r\n")
+			if _, err := ch.Write([]byte("\033[H" + frame)); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ---------- systemd ----------
+
+// Under systemd the server can be socket activated, so it binds nothing
+// itself and a restart doesn't refuse anyone trying to connect, and it
+// tells systemd when it's ready, when it's reloading and that it's
+// still alive (Type=notify, WatchdogSec=). Outside systemd none of this
+// does anything.
+//
+// Sockets are told apart by FileDescriptorName: one called "ssh" takes
+// ssh viewers, any others serve HTTP and websockets. So alongside
+// asciichat.service, with Type=notify and ExecReload=kill -HUP $MAINPID:
+//
+//	# asciichat.socket
+//	[Socket]
+//	ListenStream=8080
+//	Service=asciichat.service
+//
+//	# asciichat-ssh.socket
+//	[Socket]
+//	ListenStream=2222
+//	FileDescriptorName=ssh
+//	Service=asciichat.service
+
+// the first file descriptor systemd passes, after stdin, out and err
+const listenFdsStart = 3
+
+// activated returns the sockets systemd passed us, if it did: the ones
+// to serve HTTP on, and the one for ssh viewers
+func activated() (web []net.Listener, ssh net.Listener, err error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil, nil
+	}
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// not for anything we start
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := range n {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("systemd socket %d", fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("socket %d from systemd: %w", fd, err)
+		}
+		if i < len(names) && names[i] == "ssh" {
+			ssh = ln
+		} else {
+			web = append(web, ln)
+		}
+	}
+	return web, ssh, nil
+}
+
+// sdNotify tells systemd how we're doing, e.g. READY=1
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		log.Printf("sd_notify: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("sd_notify: %v", err)
+	}
+}
+
+// watchdog pings systemd twice per WatchdogSec, as long as the server
+// isn't wedged: a deadlock on s.mu stops the pings and gets us
+// restarted
+func (s *Server) watchdog() {
+	usec, _ := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+		s.mu.Lock()
+		s.mu.Unlock()
+		sdNotify("WATCHDOG=1")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ---------- tracing ----------
+
+// With -otel the server reports OpenTelemetry spans and metrics: a span
+// for letting each connection in, and one for relaying each traced
+// frame. A client that traces a frame (-otel on the client) sends its
+// traceparent along in "trace"; the relay's span joins that trace, and
+// we pass our own on in its place, so one trace follows a frame from
+// the camera through us to every screen it lands on. "otlp" exports
+// over OTLP/HTTP, configured by the usual OTEL_EXPORTER_OTLP_* variables,
+// and "stdout" prints everything, for trying it out.
+
+var (
+	tracer = otel.Tracer("asciichat-server")
+	meter  = otel.Meter("asciichat-server")
+
+	// global instruments forward to the real provider once there is one
+	relayTime, _   = meter.Float64Histogram("faceterm.relay.duration", metric.WithUnit("s"), metric.WithDescription("Time to pass a frame, sealed or not, on to everyone it's for"))
+	relayBytes, _  = meter.Int64Counter("faceterm.relay.bytes", metric.WithUnit("By"), metric.WithDescription("Bytes of frames and sealed messages relayed, counted once however many get them"))
+	connections, _ = meter.Int64Counter("faceterm.connections", metric.WithDescription("Connections attempted, by transport"))
+)
+
+// setupOTel starts exporting. The server runs until it's killed, so
+// there's no shutdown; the batches go out every few seconds anyway.
+func setupOTel(exporter string) error {
+	if exporter == "" {
+		return nil
+	}
+	ctx := context.Background()
+	var spans sdktrace.SpanExporter
+	var metrics sdkmetric.Exporter
+	var err, err2 error
+	switch exporter {
+	case "otlp":
+		spans, err = otlptracehttp.New(ctx)
+		metrics, err2 = otlpmetrichttp.New(ctx)
+	case "stdout":
+		spans, err = stdouttrace.New()
+		metrics, err2 = stdoutmetric.New()
+	default:
+		return fmt.Errorf("unknown -otel exporter %q, want otlp or stdout", exporter)
+	}
+	if err = errors.Join(err, err2); err != nil {
+		return err
+	}
+
+	res, _ := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", "asciichat-server")))
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(spans), sdktrace.WithResource(res))
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metrics)), sdkmetric.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetMeterProvider(mp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return nil
+}
+
+// connecting starts the span for letting a connection in over
+// transport. It ends once the connection's been handed to serve, not
+// when the call does.
+func connecting(ctx context.Context, transport string) trace.Span {
+	_, span := tracer.Start(ctx, "connect", trace.WithAttributes(attribute.String("transport", transport)))
+	connections.Add(ctx, 1, metric.WithAttributes(attribute.String("transport", transport)))
+	return span
+}
+
+// traceRelay starts the relay span for a message that carries a trace,
+// and returns the message with ours in its place
+func traceRelay(msg []byte, ctl control) ([]byte, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier{"traceparent": ctl.Trace})
+	ctx, span := tracer.Start(ctx, "relay", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("type", ctl.Type), attribute.Int("bytes", len(msg)),
+	))
+	if sc := span.SpanContext(); sc.IsValid() {
+		carrier := propagation.MapCarrier{}
+		otel.GetTextMapPropagator().Inject(ctx, carrier)
+		if tp := carrier.Get("traceparent"); tp != "" {
+			msg = stampString(msg, "trace", tp)
+		}
+	}
+	return msg, span
+}
+
+// relayed records the metrics for a frame passed on
+func relayed(start time.Time, n int) {
+	relayTime.Record(context.Background(), time.Since(start).Seconds())
+	relayBytes.Add(context.Background(), int64(n))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// ---------- web viewers ----------
+
+//go:embed viewer.html
+var viewerPage []byte
+
+// serveViewerPage serves the xterm.js watch page
+func serveViewerPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(viewerPage)
+}
+
+// handleViewerWS streams frames to a browser joined with /ws?view=1
+func (s *Server) handleViewerWS(conn wire, code, ip string) {
+	v := &Viewer{ip: ip, send: make(chan []byte, 16)}
+	s.addViewer(v, code)
+
+	// viewers don't send anything; reading just notices the close
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	defer func() {
+		s.removeViewer(v)
+		conn.Close()
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case msg, ok := <-v.send:
+			if !ok {
+				return
+			}
+			frame, ok := viewerFrame(msg)
+			if !ok {
+				continue
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// viewerFrame is what the page gets of msg: just the frame, sanitized,
+// since xterm.js would act on anything else in it. Anything that isn't
+// a frame the page has no use for.
+func viewerFrame(msg []byte) ([]byte, bool) {
+	var m struct {
+		Type  string `json:"type"`
+		Frame string `json:"frame"`
+	}
+	if json.Unmarshal(msg, &m) != nil || m.Type != "frame" {
+		return nil, false
+	}
+	m.Frame = sanitizeFrame(m.Frame)
+	b, err := json.Marshal(m)
+	return b, err == nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ---------- webhooks ----------
+
+type webhookEvent struct {
+	Event   string    `json:"event"` // room_created, peer_joined, peer_left, room_closed
+	Room    string    `json:"room"`
+	Clients int       `json:"clients"`
+	Time    time.Time `json:"time"`
+}
+
+// webhooks POSTs room events to operator-configured URLs. Delivery
+// happens on its own goroutine so a slow endpoint never stalls a call.
+type webhooks struct {
+	urls   []string
+	events chan webhookEvent
+	client *http.Client
+}
+
+func newWebhooks(urls []string) *webhooks {
+	w := &webhooks{
+		urls:   urls,
+		events: make(chan webhookEvent, 256),
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+	if len(urls) > 0 {
+		go w.run()
+	}
+	return w
+}
+
+// emit queues an event; callers may hold s.mu
+func (w *webhooks) emit(event string, r *Room) {
+	if w == nil || len(w.urls) == 0 {
+		return
+	}
+
+	ev := webhookEvent{Event: event, Room: r.code, Clients: len(r.clients), Time: time.Now()}
+	select {
+	case w.events <- ev:
+	default:
+		log.Println("webhook queue full, dropping", event, r.code)
+	}
+}
+
+func (w *webhooks) run() {
+	for ev := range w.events {
+		body, _ := json.Marshal(ev)
+		for _, u := range w.urls {
+			resp, err := w.client.Post(u, "application/json", bytes.NewReader(body))
+			if err != nil {
+				log.Println("webhook error:", err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Printf("webhook %s: %s", u, resp.Status)
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// ---------- webtransport ----------
+
+// Some networks mangle or block websockets but let HTTP/3 through, so
+// with -webtransport the server also takes calls over WebTransport, on
+// UDP, at <base path>/wt. A session carries one bidirectional stream,
+// which the client opens, of messages each prefixed by its length as a
+// uvarint; past that a client can't tell which one it's on. Everything
+// from the room on down sees a wire either way.
+//
+// HTTP/3 needs TLS of its own, hence -tls-cert and -tls-key, even
+// behind a proxy that ends TLS for the websockets. Clients look for it
+// on the same host and port as -server, so listen on the UDP side of
+// whatever port that is, usually 443.
+
+// wire is a connection messages come and go over: a *websocket.Conn,
+// or a WebTransport stream made to look like one
+type wire interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	Close() error
+}
+
+// protocolHeader stands in for the websocket subprotocol, which
+// WebTransport and event streams have no equivalent of
+const protocolHeader = "Faceterm-Protocol"
+
+// maxStreamMessage is the longest message we'll read off a stream;
+// clients drop anything bigger than this themselves
+const maxStreamMessage = 8 << 20
+
+// serveWebTransport answers WebTransport sessions on addr until it fails
+func (s *Server) serveWebTransport(addr, certFile, keyFile string) error {
+	mux := http.NewServeMux()
+	wts := &webtransport.Server{
+		H3: http3.Server{Addr: addr, Handler: mux, QUICConfig: &quic.Config{
+			KeepAlivePeriod: 10 * time.Second, // what the websockets get in pings
+			MaxIdleTimeout:  30 * time.Second,
+		}},
+		CheckOrigin: s.originAllowed,
+	}
+	mux.HandleFunc(s.basePath+"/wt", func(w http.ResponseWriter, r *http.Request) {
+		s.handleWT(wts, w, r)
+	})
+	log.Println("WebTransport on", addr, "(udp)")
+	return wts.ListenAndServeTLS(certFile, keyFile)
+}
+
+func (s *Server) handleWT(wts *webtransport.Server, w http.ResponseWriter, r *http.Request) {
+	span := connecting(r.Context(), "webtransport")
+	defer span.End()
+	ip, ok := s.admit(w, r)
+	if !ok {
+		return
+	}
+	defer s.limits.release(ip)
+
+	if p := r.Header.Get(protocolHeader); p != subprotocol {
+		log.Printf("rejecting %s: offered %q over webtransport, we speak %s", ip, p, subprotocol)
+		http.Error(w, "unsupported protocol version, this server speaks "+subprotocol, http.StatusUpgradeRequired)
+		return
+	}
+
+	for k, v := range s.upgradeHeader() {
+		w.Header()[k] = v
+	}
+	w.Header().Set(protocolHeader, subprotocol)
+	sess, err := wts.Upgrade(w, r)
+	if err != nil {
+		log.Printf("webtransport upgrade from %s: %v", ip, err)
+		return
+	}
+
+	// the client opens the stream straight away; anyone who doesn't
+	// isn't a client of ours
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	str, err := sess.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		sess.CloseWithError(0, "no stream")
+		return
+	}
+	span.End()
+	s.serve(&streamConn{sess: sess, str: str, r: bufio.NewReader(str)}, r.URL.Query(), ip)
+}
+
+// streamConn is a WebTransport session's stream as a wire
+type streamConn struct {
+	sess *webtransport.Session
+	str  *webtransport.Stream
+	r    *bufio.Reader
+	mu   sync.Mutex // one writer at a time, like a websocket
+}
+
+func (c *streamConn) ReadMessage() (int, []byte, error) {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > maxStreamMessage {
+		c.Close()
+		return 0, nil, fmt.Errorf("message of %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return 0, nil, err
+	}
+	return websocket.TextMessage, b, nil
+}
+
+func (c *streamConn) WriteMessage(_ int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(data)), uint64(len(data)))
+	_, err := c.str.Write(append(b, data...))
+	return err
+}
+
+// WriteControl only does closes; QUIC does its own keepalives, so there
+// are no pings
+func (c *streamConn) WriteControl(messageType int, data []byte, _ time.Time) error {
+	if messageType != websocket.CloseMessage {
+		return nil
+	}
+	code, reason := websocket.CloseNormalClosure, ""
+	if len(data) >= 2 {
+		code, reason = int(binary.BigEndian.Uint16(data)), string(data[2:])
+	}
+	return c.sess.CloseWithError(webtransport.SessionErrorCode(code), reason)
+}
+
+func (c *streamConn) Close() error {
+	return c.sess.CloseWithError(0, "")
+}